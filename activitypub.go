@@ -0,0 +1,672 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ActivityPub federation: every author is a Person actor that fediverse
+// users can find with WebFinger and follow. New articles are sent to the
+// followers' inboxes as Create activities, signed with the author's key.
+
+const (
+	activityContentType    = "application/activity+json"
+	activityStreamsContext = "https://www.w3.org/ns/activitystreams"
+	securityContext        = "https://w3id.org/security/v1"
+	publicAudience         = "https://www.w3.org/ns/activitystreams#Public"
+
+	// Number of activities listed in an outbox.
+	outboxLimit      = 20
+	activityInterval = 15 * time.Second
+	// Finished deliveries are kept this long for debugging, then deleted.
+	activityRetention = 30 * 24 * time.Hour
+)
+
+// ActorKey is the RSA key pair an author signs federated requests with. It is
+// created the first time the author's actor is needed.
+type ActorKey struct {
+	UserID        uint   `gorm:"primaryKey;autoIncrement:false"`
+	PublicKeyPEM  string `gorm:"type:text"`
+	PrivateKeyPEM string `gorm:"type:text"`
+	CreatedAt     time.Time
+}
+
+// Follower is an actor on another server following an author.
+type Follower struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	UserID      uint      `json:"user_id" gorm:"uniqueIndex:idx_follower_actor"`
+	ActorURI    string    `json:"actor" gorm:"uniqueIndex:idx_follower_actor;size:512"`
+	Inbox       string    `json:"inbox"`
+	SharedInbox string    `json:"shared_inbox"`
+	FollowID    string    `json:"follow_id"` // the Follow activity, which an Undo names
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// ActivityDelivery is one activity sent, or still to be sent, to one remote
+// inbox. It is retried like a WebhookDelivery.
+type ActivityDelivery struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	UserID        uint       `json:"user_id" gorm:"index"` // the author signing it
+	Inbox         string     `json:"inbox"`
+	Activity      string     `json:"activity" gorm:"type:text"`
+	Status        string     `json:"status" gorm:"index"`
+	Attempts      int        `json:"attempts" gorm:"not null;default:0"`
+	NextAttemptAt *time.Time `json:"next_attempt_at" gorm:"index"`
+	LastAttemptAt *time.Time `json:"last_attempt_at"`
+	ResponseCode  int        `json:"response_code"`
+	Error         string     `json:"error"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// activityWake nudges the dispatcher when activities are queued.
+var activityWake = make(chan struct{}, 1)
+
+func actorURI(userID uint) string {
+	return fmt.Sprintf("%s/ap/authors/%d", siteURL, userID)
+}
+
+// actorUsername is the name in the author's fediverse handle,
+// @author12@example.com. Users have no unique names of their own.
+func actorUsername(userID uint) string {
+	return fmt.Sprintf("author%d", userID)
+}
+
+func articleObjectURI(articleID uint) string {
+	return fmt.Sprintf("%s/ap/articles/%d", siteURL, articleID)
+}
+
+// siteHost is the domain of handles, taken from SITE_URL.
+func siteHost() string {
+	u, err := url.Parse(siteURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// actorSigner returns the signing key of an author, creating the key pair
+// the first time.
+func actorSigner(userID uint) (httpSigner, string, error) {
+	var key ActorKey
+	err := db.First(&key, "user_id = ?", userID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		private, public, genErr := generateKeyPair()
+		if genErr != nil {
+			return httpSigner{}, "", genErr
+		}
+		// Another request may have created the key in the meantime; its key wins
+		key = ActorKey{UserID: userID, PublicKeyPEM: public, PrivateKeyPEM: private}
+		if err = db.Clauses(clause.OnConflict{DoNothing: true}).Create(&key).Error; err == nil {
+			err = db.First(&key, "user_id = ?", userID).Error
+		}
+	}
+	if err != nil {
+		return httpSigner{}, "", err
+	}
+	private, err := parsePrivateKeyPEM(key.PrivateKeyPEM)
+	if err != nil {
+		return httpSigner{}, "", err
+	}
+	return httpSigner{keyID: actorURI(userID) + "#main-key", key: private}, key.PublicKeyPEM, nil
+}
+
+// loadActor loads the author of an actor route. Only authors with a
+// published article are actors; anyone else is not found.
+func loadActor(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error": "Invalid author ID"}`, http.StatusBadRequest)
+		return nil, false
+	}
+	user, ok := findActor(uint(id))
+	if !ok {
+		http.Error(w, `{"error": "Actor not found"}`, http.StatusNotFound)
+		return nil, false
+	}
+	return user, true
+}
+
+func findActor(userID uint) (*User, bool) {
+	var user User
+	if err := db.First(&user, userID).Error; err != nil || user.Banned {
+		return nil, false
+	}
+	var published int64
+	db.Model(&Article{}).Where("user_id = ? AND status = ?", userID, ArticlePublished).Count(&published)
+	return &user, published > 0
+}
+
+func writeActivityJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", activityContentType)
+	json.NewEncoder(w).Encode(v)
+}
+
+// webfingerHandler resolves acct:author12@example.com, or the actor URI
+// itself, to the author's actor.
+func webfingerHandler(w http.ResponseWriter, r *http.Request) {
+	resource := r.URL.Query().Get("resource")
+	var userID uint64
+	if strings.HasPrefix(resource, siteURL+"/ap/authors/") {
+		userID, _ = strconv.ParseUint(strings.TrimPrefix(resource, siteURL+"/ap/authors/"), 10, 64)
+	} else {
+		name, host, _ := strings.Cut(strings.TrimPrefix(resource, "acct:"), "@")
+		if strings.EqualFold(host, siteHost()) && strings.HasPrefix(name, "author") {
+			userID, _ = strconv.ParseUint(strings.TrimPrefix(name, "author"), 10, 64)
+		}
+	}
+	if userID == 0 {
+		http.Error(w, `{"error": "Unknown resource"}`, http.StatusNotFound)
+		return
+	}
+	if _, ok := findActor(uint(userID)); !ok {
+		http.Error(w, `{"error": "Unknown resource"}`, http.StatusNotFound)
+		return
+	}
+
+	actor := actorURI(uint(userID))
+	w.Header().Set("Content-Type", "application/jrd+json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"subject": "acct:" + actorUsername(uint(userID)) + "@" + siteHost(),
+		"aliases": []string{actor},
+		"links": []map[string]string{
+			{"rel": "self", "type": activityContentType, "href": actor},
+		},
+	})
+}
+
+// actorHandler serves an author as a Person, with the public key their
+// activities are signed with.
+func actorHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := loadActor(w, r)
+	if !ok {
+		return
+	}
+	signer, publicKey, err := actorSigner(user.ID)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"user_id": user.ID,
+			"error":   err.Error(),
+		}).Error("Failed to load actor key")
+		http.Error(w, `{"error": "Error loading actor"}`, http.StatusInternalServerError)
+		return
+	}
+
+	actor := actorURI(user.ID)
+	doc := map[string]interface{}{
+		"@context":                  []string{activityStreamsContext, securityContext},
+		"id":                        actor,
+		"type":                      "Person",
+		"preferredUsername":         actorUsername(user.ID),
+		"name":                      user.Name,
+		"inbox":                     actor + "/inbox",
+		"outbox":                    actor + "/outbox",
+		"followers":                 actor + "/followers",
+		"published":                 user.CreatedAt.UTC().Format(time.RFC3339),
+		"manuallyApprovesFollowers": false,
+		"publicKey": map[string]string{
+			"id":           signer.keyID,
+			"owner":        actor,
+			"publicKeyPem": publicKey,
+		},
+	}
+	if user.ProfilePicture != "" {
+		icon := user.ProfilePicture
+		if !strings.HasPrefix(icon, "http://") && !strings.HasPrefix(icon, "https://") {
+			icon = siteURL + "/" + strings.TrimPrefix(icon, "/")
+		}
+		doc["icon"] = map[string]string{"type": "Image", "url": icon}
+	}
+	writeActivityJSON(w, doc)
+}
+
+// articleObject is a published article as an ActivityStreams Article.
+func articleObject(article Article) map[string]interface{} {
+	actor := actorURI(article.UserID)
+	object := map[string]interface{}{
+		"id":           articleObjectURI(article.ID),
+		"type":         "Article",
+		"attributedTo": actor,
+		"name":         article.Title,
+		"content":      article.ContentHTML,
+		"contentMap":   map[string]string{articleLanguage(article): article.ContentHTML},
+		"mediaType":    "text/html",
+		"url":          articleURL(article),
+		"to":           []string{publicAudience},
+		"cc":           []string{actor + "/followers"},
+	}
+	if article.PublishedAt != nil {
+		object["published"] = article.PublishedAt.UTC().Format(time.RFC3339)
+	}
+	tags := make([]map[string]string, 0, len(article.Tags))
+	for _, tag := range article.Tags {
+		tags = append(tags, map[string]string{
+			"type": "Hashtag",
+			"name": "#" + tag.Name,
+			"href": siteURL + pageLinks{}.Listing("tag", tag.Slug, 1),
+		})
+	}
+	if len(tags) > 0 {
+		object["tag"] = tags
+	}
+	return object
+}
+
+// createActivity wraps a published article in the Create that announces it.
+func createActivity(article Article) map[string]interface{} {
+	object := articleObject(article)
+	activity := map[string]interface{}{
+		"@context": activityStreamsContext,
+		"id":       articleObjectURI(article.ID) + "/activity",
+		"type":     "Create",
+		"actor":    object["attributedTo"],
+		"to":       object["to"],
+		"cc":       object["cc"],
+		"object":   object,
+	}
+	if published, ok := object["published"]; ok {
+		activity["published"] = published
+	}
+	return activity
+}
+
+// articleObjectHandler serves a published article as an ActivityStreams
+// object, so the IDs in activities can be looked up.
+func articleObjectHandler(w http.ResponseWriter, r *http.Request) {
+	article, ok := loadArticle(w, r)
+	if !ok {
+		return
+	}
+	if article.Status != ArticlePublished {
+		http.Error(w, `{"error": "Article not found"}`, http.StatusNotFound)
+		return
+	}
+	object := articleObject(*article)
+	object["@context"] = activityStreamsContext
+	writeActivityJSON(w, object)
+}
+
+// outboxHandler lists the author's latest articles as Create activities.
+func outboxHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := loadActor(w, r)
+	if !ok {
+		return
+	}
+	query := db.Model(&Article{}).Where("user_id = ? AND status = ?", user.ID, ArticlePublished)
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		http.Error(w, `{"error": "Error fetching articles"}`, http.StatusInternalServerError)
+		return
+	}
+	var articles []Article
+	if err := query.Preload("Tags").Order("published_at DESC").Limit(outboxLimit).Find(&articles).Error; err != nil {
+		http.Error(w, `{"error": "Error fetching articles"}`, http.StatusInternalServerError)
+		return
+	}
+
+	items := make([]interface{}, len(articles))
+	for i, article := range articles {
+		activity := createActivity(article)
+		delete(activity, "@context")
+		items[i] = activity
+	}
+	writeActivityJSON(w, map[string]interface{}{
+		"@context":     activityStreamsContext,
+		"id":           actorURI(user.ID) + "/outbox",
+		"type":         "OrderedCollection",
+		"totalItems":   total,
+		"orderedItems": items,
+	})
+}
+
+// followersHandler tells how many follow the author. Who they are is not
+// published.
+func followersHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := loadActor(w, r)
+	if !ok {
+		return
+	}
+	var total int64
+	if err := db.Model(&Follower{}).Where("user_id = ?", user.ID).Count(&total).Error; err != nil {
+		http.Error(w, `{"error": "Error fetching followers"}`, http.StatusInternalServerError)
+		return
+	}
+	writeActivityJSON(w, map[string]interface{}{
+		"@context":   activityStreamsContext,
+		"id":         actorURI(user.ID) + "/followers",
+		"type":       "OrderedCollection",
+		"totalItems": total,
+	})
+}
+
+// objectRef reads the object of an activity, which is either its ID or the
+// object itself.
+func objectRef(raw json.RawMessage) (id, kind string) {
+	if err := json.Unmarshal(raw, &id); err == nil {
+		return id, ""
+	}
+	var object struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+	}
+	json.Unmarshal(raw, &object)
+	return object.ID, object.Type
+}
+
+// inboxHandler receives activities for an author. Follow and Undo of a
+// Follow are acted on; anything else is accepted and ignored. Every
+// activity has to be signed by the actor it claims to come from.
+func inboxHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := loadActor(w, r)
+	if !ok {
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRemoteDocumentBytes))
+	if err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	var activity struct {
+		ID     string          `json:"id"`
+		Type   string          `json:"type"`
+		Actor  string          `json:"actor"`
+		Object json.RawMessage `json:"object"`
+	}
+	if err := json.Unmarshal(body, &activity); err != nil || activity.Actor == "" {
+		http.Error(w, `{"error": "Invalid activity"}`, http.StatusBadRequest)
+		return
+	}
+
+	signer, _, err := actorSigner(user.ID)
+	if err != nil {
+		http.Error(w, `{"error": "Error loading actor"}`, http.StatusInternalServerError)
+		return
+	}
+	remote, err := verifyRequestSignature(r, body, &signer, time.Now())
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"user_id": user.ID,
+			"actor":   activity.Actor,
+			"error":   err.Error(),
+		}).Warn("Rejected inbox activity")
+		http.Error(w, `{"error": "Invalid signature"}`, http.StatusUnauthorized)
+		return
+	}
+	if remote.ID != activity.Actor {
+		http.Error(w, `{"error": "Activity was not signed by its actor"}`, http.StatusUnauthorized)
+		return
+	}
+
+	switch activity.Type {
+	case "Follow":
+		if target, _ := objectRef(activity.Object); target != actorURI(user.ID) {
+			http.Error(w, `{"error": "Follow is not addressed to this actor"}`, http.StatusBadRequest)
+			return
+		}
+		if err := acceptFollow(user.ID, remote, activity.ID, body); err != nil {
+			logger.WithFields(logrus.Fields{
+				"user_id": user.ID,
+				"actor":   remote.ID,
+				"error":   err.Error(),
+			}).Error("Failed to accept follow")
+			http.Error(w, `{"error": "Error accepting follow"}`, http.StatusInternalServerError)
+			return
+		}
+	case "Undo":
+		followID, kind := objectRef(activity.Object)
+		// Only the follower's own Follow can be undone, matched by actor
+		query := db.Where("user_id = ? AND actor_uri = ?", user.ID, remote.ID)
+		if kind != "Follow" {
+			query = query.Where("follow_id = ?", followID)
+		}
+		if err := query.Delete(&Follower{}).Error; err != nil {
+			http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// acceptFollow records a follower and answers the Follow with an Accept.
+func acceptFollow(userID uint, remote *remoteActor, followID string, follow []byte) error {
+	follower := Follower{
+		UserID:      userID,
+		ActorURI:    remote.ID,
+		Inbox:       remote.Inbox,
+		SharedInbox: remote.SharedInbox,
+		FollowID:    followID,
+	}
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "actor_uri"}},
+		DoUpdates: clause.AssignmentColumns([]string{"inbox", "shared_inbox", "follow_id"}),
+	}).Create(&follower).Error
+	if err != nil {
+		return err
+	}
+
+	actor := actorURI(userID)
+	accept := map[string]interface{}{
+		"@context": activityStreamsContext,
+		"id":       actor + "#accepts/" + newInvitationCode(),
+		"type":     "Accept",
+		"actor":    actor,
+		"object":   json.RawMessage(follow),
+	}
+	_, err = queueActivity(userID, accept, []string{remote.Inbox})
+	return err
+}
+
+// federateArticle sends a newly published article to the author's
+// followers, once per server when they share an inbox.
+func federateArticle(article *Article) {
+	var followers []Follower
+	if err := db.Where("user_id = ?", article.UserID).Find(&followers).Error; err != nil || len(followers) == 0 {
+		return
+	}
+	var loaded Article
+	if err := db.Preload("Tags").First(&loaded, article.ID).Error; err != nil {
+		return
+	}
+
+	seen := make(map[string]bool)
+	var inboxes []string
+	for _, follower := range followers {
+		inbox := follower.Inbox
+		if follower.SharedInbox != "" {
+			inbox = follower.SharedInbox
+		}
+		if !seen[inbox] {
+			seen[inbox] = true
+			inboxes = append(inboxes, inbox)
+		}
+	}
+	if _, err := queueActivity(article.UserID, createActivity(loaded), inboxes); err != nil {
+		logger.WithFields(logrus.Fields{
+			"article_id": article.ID,
+			"error":      err.Error(),
+		}).Error("Failed to queue article for followers")
+	}
+}
+
+// queueActivity stores one delivery of activity per inbox and wakes the
+// dispatcher.
+func queueActivity(userID uint, activity map[string]interface{}, inboxes []string) ([]ActivityDelivery, error) {
+	payload, err := json.Marshal(activity)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	deliveries := make([]ActivityDelivery, len(inboxes))
+	for i, inbox := range inboxes {
+		deliveries[i] = ActivityDelivery{
+			UserID:        userID,
+			Inbox:         inbox,
+			Activity:      string(payload),
+			Status:        DeliveryPending,
+			NextAttemptAt: &now,
+		}
+	}
+	if len(deliveries) == 0 {
+		return nil, nil
+	}
+	if err := db.Create(&deliveries).Error; err != nil {
+		return nil, err
+	}
+	select {
+	case activityWake <- struct{}{}:
+	default:
+	}
+	return deliveries, nil
+}
+
+// deliverDueActivities attempts every pending delivery whose time has come,
+// claiming and sending them like deliverDueWebhooks does, so one slow inbox
+// does not hold up the others.
+func deliverDueActivities(now time.Time) {
+	var due []ActivityDelivery
+	if err := db.Where("status = ? AND next_attempt_at <= ?", DeliveryPending, now).
+		Order("next_attempt_at, id").Limit(100).Find(&due).Error; err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Failed to fetch due activity deliveries")
+		return
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, webhookConcurrency)
+	for i := range due {
+		delivery := &due[i]
+		slots <- struct{}{}
+		lease := time.Now().Add(webhookLease)
+		res := db.Model(&ActivityDelivery{}).
+			Where("id = ? AND status = ? AND next_attempt_at = ?", delivery.ID, DeliveryPending, *delivery.NextAttemptAt).
+			Update("next_attempt_at", lease)
+		if res.Error != nil || res.RowsAffected == 0 {
+			<-slots
+			continue
+		}
+		delivery.NextAttemptAt = &lease
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			attemptActivityDelivery(delivery)
+		}()
+	}
+	wg.Wait()
+}
+
+// attemptActivityDelivery posts a claimed delivery and records the outcome.
+// Client errors other than 429 will not go away and are not retried.
+func attemptActivityDelivery(delivery *ActivityDelivery) {
+	signer, _, err := actorSigner(delivery.UserID)
+	var code int
+	if err == nil {
+		code, err = postActivity(delivery.Inbox, []byte(delivery.Activity), signer)
+	}
+	finished := time.Now()
+
+	updates := map[string]interface{}{
+		"attempts":        delivery.Attempts + 1,
+		"last_attempt_at": finished,
+		"response_code":   code,
+		"error":           "",
+	}
+	permanent := code >= 400 && code < 500 && code != http.StatusTooManyRequests
+	switch {
+	case err == nil && code >= 200 && code < 300:
+		updates["status"] = DeliverySucceeded
+		updates["next_attempt_at"] = nil
+	case permanent || delivery.Attempts+1 >= webhookMaxAttempts:
+		updates["status"] = DeliveryFailed
+		updates["next_attempt_at"] = nil
+	default:
+		updates["next_attempt_at"] = finished.Add(webhookBackoff(delivery.Attempts + 1))
+	}
+	if err != nil {
+		updates["error"] = err.Error()
+	} else if code < 200 || code >= 300 {
+		updates["error"] = fmt.Sprintf("inbox answered %d", code)
+	}
+
+	if err := db.Model(delivery).Updates(updates).Error; err != nil {
+		logger.WithFields(logrus.Fields{
+			"delivery_id": delivery.ID,
+			"error":       err.Error(),
+		}).Error("Failed to record activity delivery")
+		return
+	}
+	if updates["status"] == DeliveryFailed {
+		logger.WithFields(logrus.Fields{
+			"delivery_id": delivery.ID,
+			"inbox":       delivery.Inbox,
+		}).Warn("Activity delivery failed for good")
+	}
+}
+
+// postActivity posts a signed activity to a remote inbox.
+func postActivity(inbox string, payload []byte, signer httpSigner) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, inbox, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", activityContentType)
+	req.Header.Set("User-Agent", siteName+"-ActivityPub")
+	if err := signRequest(req, payload, signer, time.Now()); err != nil {
+		return 0, err
+	}
+
+	resp, err := federationClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, webhookResponseLimit))
+	return resp.StatusCode, nil
+}
+
+// runActivityDispatcher delivers queued activities in the background.
+func runActivityDispatcher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			pruneActivityDeliveries(now)
+		case <-activityWake:
+		}
+		deliverDueActivities(time.Now())
+	}
+}
+
+// pruneActivityDeliveries deletes deliveries that finished longer than
+// activityRetention ago; every follower and article federated adds rows,
+// and nothing reads them once they are done.
+func pruneActivityDeliveries(now time.Time) {
+	err := db.Where("status IN ? AND updated_at < ?", []string{DeliverySucceeded, DeliveryFailed}, now.Add(-activityRetention)).
+		Delete(&ActivityDelivery{}).Error
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Failed to prune activity deliveries")
+	}
+}
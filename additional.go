@@ -150,6 +150,10 @@ func paymentCallbackHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The payment service may repeat a callback; only the first completion
+	// is announced
+	wasCompleted := transaction.Status == "Completed"
+
 	// Update transaction status to "Completed" after successful payment
 	if callback.Status == "paid" {
 		transaction.Status = "Completed"
@@ -167,6 +171,9 @@ func paymentCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	fmt.Println("✅ Transaction updated to:", transaction.Status)
+	if transaction.Status == "Completed" && !wasCompleted {
+		emitWebhookEvent(EventTransactionCompleted, transactionEventData(transaction))
+	}
 
 	// If payment is successful, generate and send receipt
 	if callback.Status == "paid" {
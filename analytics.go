@@ -0,0 +1,624 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ArticleDailyStat holds the analytics of one article on one UTC day. Only
+// counts are stored; which visitor read what never reaches the database.
+type ArticleDailyStat struct {
+	ArticleID uint   `json:"article_id" gorm:"primaryKey;autoIncrement:false"`
+	Day       string `json:"day" gorm:"primaryKey;size:10"` // 2006-01-02
+	Views     int64  `json:"views"`
+	// Readers who scrolled through at least a quarter, half, three quarters
+	// and all of the article
+	Depth25  int64 `json:"depth_25"`
+	Depth50  int64 `json:"depth_50"`
+	Depth75  int64 `json:"depth_75"`
+	Depth100 int64 `json:"depth_100"`
+}
+
+// ArticleReferrerStat counts the views of an article on one day that came
+// from another site, by the domain of the referring page.
+type ArticleReferrerStat struct {
+	ArticleID uint   `gorm:"primaryKey;autoIncrement:false"`
+	Day       string `gorm:"primaryKey;size:10"`
+	Domain    string `gorm:"primaryKey;size:255"`
+	Views     int64
+}
+
+const (
+	beaconView  = "view"
+	beaconDepth = "depth"
+
+	maxBeaconBytes = 2 << 10
+	dayLayout      = "2006-01-02"
+
+	analyticsDefaultDays = 30
+	analyticsMaxDays     = 365
+	topReferrerLimit     = 10
+)
+
+// analyticsVisit is what the collector remembers about a visitor reading an
+// article, for as long as the dedup window lasts.
+type analyticsVisit struct {
+	at    time.Time
+	depth int // quarters of the article read so far, 0-4
+}
+
+type dailyStatKey struct {
+	articleID uint
+	day       string
+}
+
+type referrerStatKey struct {
+	articleID uint
+	day       string
+	domain    string
+}
+
+// analyticsCollector counts beacons in memory and hands the counts to
+// flushAnalytics, the way viewCounter does for view_count.
+type analyticsCollector struct {
+	mu        sync.Mutex
+	window    time.Duration
+	visits    map[string]*analyticsVisit // "articleID:visitor"
+	days      map[dailyStatKey]*ArticleDailyStat
+	referrers map[referrerStatKey]int64
+}
+
+var beaconStats = newAnalyticsCollector(viewDedupWindow)
+
+func newAnalyticsCollector(window time.Duration) *analyticsCollector {
+	return &analyticsCollector{
+		window:    window,
+		visits:    make(map[string]*analyticsVisit),
+		days:      make(map[dailyStatKey]*ArticleDailyStat),
+		referrers: make(map[referrerStatKey]int64),
+	}
+}
+
+// visit returns the visit of visitor to articleID, starting and counting a
+// new one when there is none in the window. The caller holds the lock.
+func (ac *analyticsCollector) visit(articleID uint, visitor string, now time.Time) (*analyticsVisit, bool) {
+	key := strconv.FormatUint(uint64(articleID), 10) + ":" + visitor
+	if v, ok := ac.visits[key]; ok && now.Sub(v.at) < ac.window {
+		return v, false
+	}
+	v := &analyticsVisit{at: now}
+	ac.visits[key] = v
+	ac.stat(articleID, now).Views++
+	return v, true
+}
+
+// stat is the buffered row of articleID for the day of now. The caller holds
+// the lock.
+func (ac *analyticsCollector) stat(articleID uint, now time.Time) *ArticleDailyStat {
+	key := dailyStatKey{articleID, now.UTC().Format(dayLayout)}
+	stat, ok := ac.days[key]
+	if !ok {
+		stat = &ArticleDailyStat{ArticleID: articleID, Day: key.day}
+		ac.days[key] = stat
+	}
+	return stat
+}
+
+// view counts a view of articleID and where it came from, unless visitor was
+// counted within the window. It reports whether the view was counted.
+func (ac *analyticsCollector) view(articleID uint, visitor, domain string, now time.Time) bool {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if _, counted := ac.visit(articleID, visitor, now); !counted {
+		return false
+	}
+	if domain != "" {
+		ac.referrers[referrerStatKey{articleID, now.UTC().Format(dayLayout), domain}]++
+	}
+	return true
+}
+
+// depth records that visitor has read percent of articleID. Each reader adds
+// to a depth bucket once, however often the page reports progress; a depth
+// without a view (the view beacon got lost) counts as the view too.
+func (ac *analyticsCollector) depth(articleID uint, visitor string, percent int, now time.Time) {
+	quarters := percent / 25
+	if quarters > 4 {
+		quarters = 4
+	}
+	if quarters <= 0 {
+		return
+	}
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	v, _ := ac.visit(articleID, visitor, now)
+	stat := ac.stat(articleID, now)
+	for q := v.depth + 1; q <= quarters; q++ {
+		switch q {
+		case 1:
+			stat.Depth25++
+		case 2:
+			stat.Depth50++
+		case 3:
+			stat.Depth75++
+		case 4:
+			stat.Depth100++
+		}
+	}
+	if quarters > v.depth {
+		v.depth = quarters
+	}
+}
+
+// pending returns copies of the counts of articles not flushed yet.
+func (ac *analyticsCollector) pending(articles map[uint]bool, since string) ([]ArticleDailyStat, []ArticleReferrerStat) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	var stats []ArticleDailyStat
+	for key, stat := range ac.days {
+		if articles[key.articleID] && key.day >= since {
+			stats = append(stats, *stat)
+		}
+	}
+	var referrers []ArticleReferrerStat
+	for key, views := range ac.referrers {
+		if articles[key.articleID] && key.day >= since {
+			referrers = append(referrers, ArticleReferrerStat{ArticleID: key.articleID, Day: key.day, Domain: key.domain, Views: views})
+		}
+	}
+	return stats, referrers
+}
+
+// drain hands over the buffered counts and forgets visits outside the window.
+func (ac *analyticsCollector) drain(now time.Time) (map[dailyStatKey]*ArticleDailyStat, map[referrerStatKey]int64) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	for key, v := range ac.visits {
+		if now.Sub(v.at) >= ac.window {
+			delete(ac.visits, key)
+		}
+	}
+	days, referrers := ac.days, ac.referrers
+	ac.days = make(map[dailyStatKey]*ArticleDailyStat)
+	ac.referrers = make(map[referrerStatKey]int64)
+	return days, referrers
+}
+
+// restoreDay puts back a daily row that could not be written, so the next
+// flush retries it.
+func (ac *analyticsCollector) restoreDay(stat *ArticleDailyStat) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	key := dailyStatKey{stat.ArticleID, stat.Day}
+	buffered, ok := ac.days[key]
+	if !ok {
+		buffered = &ArticleDailyStat{ArticleID: stat.ArticleID, Day: stat.Day}
+		ac.days[key] = buffered
+	}
+	buffered.Views += stat.Views
+	buffered.Depth25 += stat.Depth25
+	buffered.Depth50 += stat.Depth50
+	buffered.Depth75 += stat.Depth75
+	buffered.Depth100 += stat.Depth100
+}
+
+// restoreReferrer puts back referrer views that could not be written.
+func (ac *analyticsCollector) restoreReferrer(key referrerStatKey, views int64) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.referrers[key] += views
+}
+
+// forget drops the buffered counts of a deleted article.
+func (ac *analyticsCollector) forget(articleID uint) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	for key := range ac.days {
+		if key.articleID == articleID {
+			delete(ac.days, key)
+		}
+	}
+	for key := range ac.referrers {
+		if key.articleID == articleID {
+			delete(ac.referrers, key)
+		}
+	}
+}
+
+// flushAnalytics adds the buffered counts to the daily rows. Counts that fail
+// to write stay buffered for the next flush.
+func flushAnalytics(now time.Time) {
+	days, referrers := beaconStats.drain(now)
+	for _, stat := range days {
+		err := db.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "article_id"}, {Name: "day"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"views":    gorm.Expr("article_daily_stats.views + excluded.views"),
+				"depth25":  gorm.Expr("article_daily_stats.depth25 + excluded.depth25"),
+				"depth50":  gorm.Expr("article_daily_stats.depth50 + excluded.depth50"),
+				"depth75":  gorm.Expr("article_daily_stats.depth75 + excluded.depth75"),
+				"depth100": gorm.Expr("article_daily_stats.depth100 + excluded.depth100"),
+			}),
+		}).Create(stat).Error
+		if err != nil {
+			beaconStats.restoreDay(stat)
+			logger.WithFields(logrus.Fields{
+				"article_id": stat.ArticleID,
+				"day":        stat.Day,
+				"error":      err.Error(),
+			}).Error("Failed to flush article analytics")
+		}
+	}
+	for key, views := range referrers {
+		stat := ArticleReferrerStat{ArticleID: key.articleID, Day: key.day, Domain: key.domain, Views: views}
+		err := db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "article_id"}, {Name: "day"}, {Name: "domain"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{"views": gorm.Expr("article_referrer_stats.views + excluded.views")}),
+		}).Create(&stat).Error
+		if err != nil {
+			beaconStats.restoreReferrer(key, views)
+			logger.WithFields(logrus.Fields{
+				"article_id": key.articleID,
+				"domain":     key.domain,
+				"error":      err.Error(),
+			}).Error("Failed to flush article referrers")
+		}
+	}
+}
+
+// runAnalyticsFlusher periodically writes buffered analytics to the database.
+func runAnalyticsFlusher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		flushAnalytics(now)
+	}
+}
+
+// referrerDomain reduces a referring page to its domain, so no path or query
+// of another site is stored. Links from the blog itself are not referrers.
+func referrerDomain(raw string, r *http.Request) string {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return ""
+	}
+	domain := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+
+	own := map[string]bool{}
+	if site, err := url.Parse(siteURL); err == nil {
+		own[strings.TrimPrefix(strings.ToLower(site.Hostname()), "www.")] = true
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	own[strings.TrimPrefix(strings.ToLower(host), "www.")] = true
+	if own[domain] || len(domain) > 255 {
+		return ""
+	}
+	return domain
+}
+
+// articleBeaconHandler records a view or the read depth of a published
+// article, sent by the article page with navigator.sendBeacon. Visitors who
+// ask not to be tracked (Do Not Track or Global Privacy Control) are not
+// counted.
+func articleBeaconHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error": "Invalid article ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	// sendBeacon posts text/plain, so the content type is not checked
+	r.Body = http.MaxBytesReader(w, r.Body, maxBeaconBytes)
+	var input struct {
+		Event    string `json:"event"`
+		Depth    int    `json:"depth"`
+		Referrer string `json:"referrer"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if input.Event != beaconView && input.Event != beaconDepth {
+		http.Error(w, `{"error": "Unknown event"}`, http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var article Article
+	if err := db.Select("id", "status").First(&article, uint(id)).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, `{"error": "Article not found"}`, http.StatusNotFound)
+		} else {
+			http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		}
+		return
+	}
+	if article.Status != ArticlePublished {
+		http.Error(w, `{"error": "Article not found"}`, http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	if input.Event == beaconView {
+		beaconStats.view(article.ID, visitorKey(r), referrerDomain(input.Referrer, r), now)
+	} else {
+		beaconStats.depth(article.ID, visitorKey(r), input.Depth, now)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readDepth is how many readers got through each quarter of an article.
+type readDepth struct {
+	Quarter       int64 `json:"25"`
+	Half          int64 `json:"50"`
+	ThreeQuarters int64 `json:"75"`
+	Full          int64 `json:"100"`
+}
+
+type analyticsDay struct {
+	Day   string `json:"day"`
+	Views int64  `json:"views"`
+	Reads int64  `json:"reads"`
+}
+
+type referrerCount struct {
+	Domain string `json:"domain"`
+	Views  int64  `json:"views"`
+}
+
+// articleAnalytics is the dashboard of one article over a range of days.
+// Reads are readers who reached the end; ReadThroughRate is reads per view.
+type articleAnalytics struct {
+	ArticleID       uint            `json:"article_id"`
+	Title           string          `json:"title"`
+	Slug            string          `json:"slug"`
+	Status          string          `json:"status"`
+	Views           int64           `json:"views"`
+	Reads           int64           `json:"reads"`
+	ReadThroughRate float64         `json:"read_through_rate"`
+	Depth           readDepth       `json:"depth"`
+	TopReferrer     string          `json:"top_referrer,omitempty"`
+	Referrers       []referrerCount `json:"referrers,omitempty"`
+	Daily           []analyticsDay  `json:"daily,omitempty"`
+}
+
+// analyticsRange reads ?days (default 30) and returns the first day of the
+// range and today.
+func analyticsRange(w http.ResponseWriter, r *http.Request, now time.Time) (string, string, bool) {
+	days := analyticsDefaultDays
+	if raw := r.URL.Query().Get("days"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > analyticsMaxDays {
+			http.Error(w, `{"error": "days must be between 1 and 365"}`, http.StatusBadRequest)
+			return "", "", false
+		}
+		days = n
+	}
+	today := now.UTC()
+	return today.AddDate(0, 0, -(days - 1)).Format(dayLayout), today.Format(dayLayout), true
+}
+
+// collectAnalytics sums the stats of articles from day since to until,
+// counts not flushed yet included, into one summary per article. With daily
+// the summaries also list every day of the range.
+func collectAnalytics(articles []Article, since, until string, daily bool) ([]articleAnalytics, error) {
+	ids := make([]uint, len(articles))
+	wanted := make(map[uint]bool, len(articles))
+	for i, article := range articles {
+		ids[i] = article.ID
+		wanted[article.ID] = true
+	}
+
+	var stats []ArticleDailyStat
+	var referrers []ArticleReferrerStat
+	if len(ids) > 0 {
+		if err := db.Where("article_id IN ? AND day >= ?", ids, since).Find(&stats).Error; err != nil {
+			return nil, err
+		}
+		if err := db.Where("article_id IN ? AND day >= ?", ids, since).Find(&referrers).Error; err != nil {
+			return nil, err
+		}
+	}
+	pendingStats, pendingReferrers := beaconStats.pending(wanted, since)
+	stats = append(stats, pendingStats...)
+	referrers = append(referrers, pendingReferrers...)
+
+	days := make(map[uint]map[string]*ArticleDailyStat)
+	for _, stat := range stats {
+		if days[stat.ArticleID] == nil {
+			days[stat.ArticleID] = make(map[string]*ArticleDailyStat)
+		}
+		day, ok := days[stat.ArticleID][stat.Day]
+		if !ok {
+			day = &ArticleDailyStat{ArticleID: stat.ArticleID, Day: stat.Day}
+			days[stat.ArticleID][stat.Day] = day
+		}
+		day.Views += stat.Views
+		day.Depth25 += stat.Depth25
+		day.Depth50 += stat.Depth50
+		day.Depth75 += stat.Depth75
+		day.Depth100 += stat.Depth100
+	}
+	domains := make(map[uint]map[string]int64)
+	for _, ref := range referrers {
+		if domains[ref.ArticleID] == nil {
+			domains[ref.ArticleID] = make(map[string]int64)
+		}
+		domains[ref.ArticleID][ref.Domain] += ref.Views
+	}
+
+	summaries := make([]articleAnalytics, len(articles))
+	for i, article := range articles {
+		summary := articleAnalytics{
+			ArticleID: article.ID,
+			Title:     article.Title,
+			Slug:      article.Slug,
+			Status:    article.Status,
+		}
+		for _, day := range days[article.ID] {
+			summary.Views += day.Views
+			summary.Depth.Quarter += day.Depth25
+			summary.Depth.Half += day.Depth50
+			summary.Depth.ThreeQuarters += day.Depth75
+			summary.Depth.Full += day.Depth100
+		}
+		summary.Reads = summary.Depth.Full
+		summary.ReadThroughRate = readThroughRate(summary.Reads, summary.Views)
+
+		for domain, views := range domains[article.ID] {
+			summary.Referrers = append(summary.Referrers, referrerCount{Domain: domain, Views: views})
+		}
+		sort.Slice(summary.Referrers, func(a, b int) bool {
+			if summary.Referrers[a].Views != summary.Referrers[b].Views {
+				return summary.Referrers[a].Views > summary.Referrers[b].Views
+			}
+			return summary.Referrers[a].Domain < summary.Referrers[b].Domain
+		})
+		if len(summary.Referrers) > topReferrerLimit {
+			summary.Referrers = summary.Referrers[:topReferrerLimit]
+		}
+		if len(summary.Referrers) > 0 {
+			summary.TopReferrer = summary.Referrers[0].Domain
+		}
+
+		if daily {
+			start, _ := time.Parse(dayLayout, since)
+			for d := start; d.Format(dayLayout) <= until; d = d.AddDate(0, 0, 1) {
+				entry := analyticsDay{Day: d.Format(dayLayout)}
+				if stat, ok := days[article.ID][entry.Day]; ok {
+					entry.Views = stat.Views
+					entry.Reads = stat.Depth100
+				}
+				summary.Daily = append(summary.Daily, entry)
+			}
+		}
+		summaries[i] = summary
+	}
+	return summaries, nil
+}
+
+// readThroughRate is the share of views that were read to the end, rounded
+// to three decimals.
+func readThroughRate(reads, views int64) float64 {
+	if views == 0 {
+		return 0
+	}
+	rate := float64(reads) / float64(views)
+	if rate > 1 {
+		rate = 1
+	}
+	return math.Round(rate*1000) / 1000
+}
+
+// getArticleAnalyticsHandler shows the author views per day, top referrers
+// and read depth of one article.
+func getArticleAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+	article, ok := loadArticle(w, r)
+	if !ok {
+		return
+	}
+	if !canEditArticle(r, article) {
+		http.Error(w, `{"error": "Forbidden: only the author can see analytics"}`, http.StatusForbidden)
+		return
+	}
+	since, until, ok := analyticsRange(w, r, time.Now())
+	if !ok {
+		return
+	}
+
+	summaries, err := collectAnalytics([]Article{*article}, since, until, true)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"article_id": article.ID,
+			"error":      err.Error(),
+		}).Error("Failed to fetch article analytics")
+		http.Error(w, `{"error": "Error fetching analytics"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":      since,
+		"to":        until,
+		"analytics": summaries[0],
+	})
+}
+
+// getAuthorAnalyticsHandler lists the analytics of all of the caller's
+// articles, most viewed first. Admins may look at another author with
+// ?author_id.
+func getAuthorAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+	authorID, _ := r.Context().Value("user_id").(uint)
+	role, _ := r.Context().Value("role").(string)
+	if raw := r.URL.Query().Get("author_id"); raw != "" {
+		id, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			http.Error(w, `{"error": "Invalid author ID"}`, http.StatusBadRequest)
+			return
+		}
+		if uint(id) != authorID && role != "admin" {
+			http.Error(w, `{"error": "Forbidden: only admins can see other authors' analytics"}`, http.StatusForbidden)
+			return
+		}
+		authorID = uint(id)
+	}
+	since, until, ok := analyticsRange(w, r, time.Now())
+	if !ok {
+		return
+	}
+
+	var articles []Article
+	if err := db.Select("id", "title", "slug", "status").Where("user_id = ?", authorID).
+		Order("id").Find(&articles).Error; err != nil {
+		http.Error(w, `{"error": "Error fetching articles"}`, http.StatusInternalServerError)
+		return
+	}
+	summaries, err := collectAnalytics(articles, since, until, false)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"author_id": authorID,
+			"error":     err.Error(),
+		}).Error("Failed to fetch author analytics")
+		http.Error(w, `{"error": "Error fetching analytics"}`, http.StatusInternalServerError)
+		return
+	}
+	sort.SliceStable(summaries, func(a, b int) bool { return summaries[a].Views > summaries[b].Views })
+
+	var views, reads int64
+	for _, summary := range summaries {
+		views += summary.Views
+		reads += summary.Reads
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":              since,
+		"to":                until,
+		"views":             views,
+		"reads":             reads,
+		"read_through_rate": readThroughRate(reads, views),
+		"articles":          summaries,
+	})
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+)
+
+// frontMatter is the YAML header of an exported or imported Markdown file.
+type frontMatter struct {
+	Title    string     `yaml:"title"`
+	Slug     string     `yaml:"slug,omitempty"`
+	Date     *time.Time `yaml:"date,omitempty"`
+	Updated  *time.Time `yaml:"updated,omitempty"`
+	Status   string     `yaml:"status,omitempty"`
+	Tags     []string   `yaml:"tags,omitempty"`
+	Category string     `yaml:"category,omitempty"`
+	Author   string     `yaml:"author,omitempty"`
+}
+
+// Outcomes reported per file by an import.
+const (
+	ImportCreated = "created"
+	ImportUpdated = "updated"
+	ImportSkipped = "skipped"
+	ImportFailed  = "failed"
+)
+
+// importResult reports what happened to one file of an import.
+type importResult struct {
+	File      string   `json:"file"`
+	Status    string   `json:"status"`
+	ArticleID uint     `json:"article_id,omitempty"`
+	Slug      string   `json:"slug,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Warnings  []string `json:"warnings,omitempty"`
+}
+
+// importReport sums up an import.
+type importReport struct {
+	Created int            `json:"created"`
+	Updated int            `json:"updated"`
+	Skipped int            `json:"skipped"`
+	Failed  int            `json:"failed"`
+	Results []importResult `json:"results"`
+}
+
+func (r *importReport) add(result importResult) {
+	switch result.Status {
+	case ImportCreated:
+		r.Created++
+	case ImportUpdated:
+		r.Updated++
+	case ImportSkipped:
+		r.Skipped++
+	case ImportFailed:
+		r.Failed++
+	}
+	r.Results = append(r.Results, result)
+}
+
+const (
+	maxImportArchiveBytes = 20 << 20
+	maxImportFileBytes    = 2 << 20
+	maxImportFiles        = 500
+)
+
+const frontMatterDelimiter = "---"
+
+// parseFrontMatter splits a Markdown file into its YAML front matter and
+// body. Files without front matter are returned whole as the body.
+func parseFrontMatter(data []byte) (frontMatter, string, error) {
+	var meta frontMatter
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+
+	if !strings.HasPrefix(text, frontMatterDelimiter+"\n") {
+		return meta, text, nil
+	}
+	rest := text[len(frontMatterDelimiter)+1:]
+	end := strings.Index(rest, "\n"+frontMatterDelimiter+"\n")
+	header, body := "", ""
+	switch {
+	case end >= 0:
+		header, body = rest[:end], rest[end+len(frontMatterDelimiter)+2:]
+	case strings.HasSuffix(rest, "\n"+frontMatterDelimiter):
+		header = strings.TrimSuffix(rest, "\n"+frontMatterDelimiter)
+	case strings.HasPrefix(rest, frontMatterDelimiter+"\n"):
+		// Empty front matter
+		body = rest[len(frontMatterDelimiter)+1:]
+	default:
+		return meta, "", errors.New("front matter is not closed with ---")
+	}
+
+	if err := yaml.Unmarshal([]byte(header), &meta); err != nil {
+		return meta, "", fmt.Errorf("invalid front matter: %w", err)
+	}
+	return meta, strings.TrimLeft(body, "\n"), nil
+}
+
+// formatFrontMatter writes article as a Markdown file with front matter.
+func formatFrontMatter(article Article) ([]byte, error) {
+	meta := frontMatter{
+		Title:  article.Title,
+		Slug:   article.Slug,
+		Status: article.Status,
+		Author: article.User.Name,
+	}
+	published := feedPublished(article)
+	meta.Date = &published
+	if !article.UpdatedAt.IsZero() {
+		updated := article.UpdatedAt
+		meta.Updated = &updated
+	}
+	if article.Category != nil {
+		meta.Category = article.Category.Name
+	}
+	for _, tag := range article.Tags {
+		meta.Tags = append(meta.Tags, tag.Name)
+	}
+
+	header, err := yaml.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	out.WriteString(frontMatterDelimiter + "\n")
+	out.Write(header)
+	out.WriteString(frontMatterDelimiter + "\n\n")
+	out.WriteString(article.Content)
+	if !strings.HasSuffix(article.Content, "\n") {
+		out.WriteString("\n")
+	}
+	return out.Bytes(), nil
+}
+
+// markdownTitle finds the first level-one heading of a Markdown body.
+func markdownTitle(body string) string {
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, "# ") {
+			return strings.TrimSpace(line[2:])
+		}
+	}
+	return ""
+}
+
+// importedStatus maps the status asked for in front matter onto what the
+// importing user may set, following the review workflow.
+func importedStatus(requested string, date *time.Time, isAdmin bool, now time.Time) (string, string) {
+	switch requested {
+	case "", ArticleDraft:
+		return ArticleDraft, ""
+	case ArticleInReview:
+		return ArticleInReview, ""
+	case ArticlePublished, ArticleScheduled:
+		if !isAdmin {
+			return ArticleInReview, "only an admin can publish; the article was submitted for review"
+		}
+		if date != nil && date.After(now) {
+			return ArticleScheduled, ""
+		}
+		return ArticlePublished, ""
+	case ArticleArchived:
+		return ArticleArchived, ""
+	}
+	return ArticleDraft, "unknown status " + strconv.Quote(requested) + "; imported as draft"
+}
+
+// importMarkdownFile creates or, with overwrite, updates one article of user
+// from a Markdown file.
+func importMarkdownFile(name string, data []byte, user User, isAdmin, overwrite bool) importResult {
+	result := importResult{File: name}
+	fail := func(err error) importResult {
+		result.Status = ImportFailed
+		result.Error = err.Error()
+		return result
+	}
+
+	meta, body, err := parseFrontMatter(data)
+	if err != nil {
+		return fail(err)
+	}
+	title := strings.TrimSpace(meta.Title)
+	if title == "" {
+		title = markdownTitle(body)
+	}
+	if title == "" {
+		title = strings.TrimSuffix(path.Base(name), path.Ext(name))
+	}
+	if len(meta.Tags) > maxTagsPerArticle {
+		return fail(fmt.Errorf("more than %d tags", maxTagsPerArticle))
+	}
+
+	existing, found, err := findImportedArticle(name, meta, title, user, isAdmin)
+	if err != nil {
+		return fail(err)
+	}
+	if found && !overwrite {
+		result.Status = ImportSkipped
+		result.ArticleID = existing.ID
+		result.Slug = existing.Slug
+		result.Error = "an article with this slug already exists"
+		return result
+	}
+
+	// Imported text is moderated like text written in the editor
+	var moderation moderationResult
+	if !isAdmin {
+		moderation = moderate(moderationSubject{Kind: ReportArticle, ID: existing.ID, UserID: user.ID, Title: title, Text: body})
+		if moderation.Verdict == moderationReject {
+			return fail(errors.New("rejected by moderation: " + moderation.reasons()))
+		}
+	}
+
+	tags, err := resolveTags(meta.Tags)
+	if err != nil {
+		return fail(err)
+	}
+	var categoryID *uint
+	if meta.Category != "" {
+		var category Category
+		if err := db.Where("slug = ?", taxonomySlug(meta.Category)).First(&category).Error; err == nil {
+			categoryID = &category.ID
+		} else {
+			result.Warnings = append(result.Warnings, "unknown category "+strconv.Quote(meta.Category)+" ignored")
+		}
+	}
+
+	if found {
+		loadedAt := existing.UpdatedAt
+		wasPublished := existing.Status == ArticlePublished
+		existing.Title = title
+		existing.Content = body
+		existing.Tags = tags
+		if meta.Category != "" {
+			existing.CategoryID = categoryID
+		}
+		if warning := applyImportedStatus(&existing, meta, isAdmin, time.Now()); warning != "" {
+			result.Warnings = append(result.Warnings, warning)
+		}
+		holdImportForReview(&existing, moderation, &result)
+		if err := saveArticle(&existing, loadedAt, user.ID, "Imported from "+path.Base(name)); err != nil {
+			return fail(err)
+		}
+		if err := rememberImportedFile(db, name, user, existing.ID); err != nil {
+			return fail(err)
+		}
+		if moderation.Verdict == moderationReview {
+			flagForReview(ReportArticle, existing.ID, moderation)
+		}
+		if existing.Status == ArticlePublished && !wasPublished && announceImport(meta) {
+			articlePublished(&existing)
+		}
+		result.Status = ImportUpdated
+		result.ArticleID = existing.ID
+		result.Slug = existing.Slug
+		return result
+	}
+
+	article := Article{
+		Title:      title,
+		Content:    body,
+		UserID:     user.ID,
+		Name:       user.Name,
+		Tags:       tags,
+		CategoryID: categoryID,
+	}
+	if warning := applyImportedStatus(&article, meta, isAdmin, time.Now()); warning != "" {
+		result.Warnings = append(result.Warnings, warning)
+	}
+	holdImportForReview(&article, moderation, &result)
+	if err := renderArticleContent(&article); err != nil {
+		return fail(err)
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// The slug of an exported article is kept when it is still free
+		if fits, _ := slugFitsTitle(meta.Slug, title, nil); meta.Slug != "" && fits {
+			free, err := uniqueSlug(tx, meta.Slug, 0)
+			if err != nil {
+				return err
+			}
+			if free == meta.Slug {
+				article.Slug = meta.Slug
+			} else {
+				result.Warnings = append(result.Warnings, "slug "+strconv.Quote(meta.Slug)+" is taken; a new one was chosen")
+			}
+		}
+		if err := insertArticleTx(tx, &article, user.ID, "Imported from "+path.Base(name)); err != nil {
+			return err
+		}
+		return rememberImportedFile(tx, name, user, article.ID)
+	})
+	if err != nil {
+		return fail(err)
+	}
+	if moderation.Verdict == moderationReview {
+		flagForReview(ReportArticle, article.ID, moderation)
+	}
+	if article.Status == ArticlePublished && announceImport(meta) {
+		articlePublished(&article)
+	}
+
+	result.Status = ImportCreated
+	result.ArticleID = article.ID
+	result.Slug = article.Slug
+	return result
+}
+
+// holdImportForReview takes a live or scheduled article back to review when
+// moderation flagged the imported text, and says so in the report.
+func holdImportForReview(article *Article, moderation moderationResult, result *importResult) {
+	status := article.Status
+	holdFlaggedEdit(article, moderation)
+	if article.Status != status {
+		result.Warnings = append(result.Warnings, "held for review by moderation: "+moderation.reasons())
+	}
+}
+
+// findImportedArticle finds the article of user a Markdown file was
+// imported as before: the one with the slug in its front matter, the one
+// imported from the same path, or the one whose slug comes from the title.
+// Admins match articles of any author.
+func findImportedArticle(name string, meta frontMatter, title string, user User, isAdmin bool) (Article, bool, error) {
+	lookup := func(query string, args ...interface{}) (Article, bool, error) {
+		var article Article
+		q := db.Preload("Tags").Where(query, args...)
+		if !isAdmin {
+			q = q.Where("user_id = ?", user.ID)
+		}
+		err := q.First(&article).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return article, false, nil
+		}
+		return article, err == nil, err
+	}
+
+	if meta.Slug != "" {
+		// The slug may have moved since the export; old slugs still point here
+		article, found, err := lookup("slug = ? OR id IN (SELECT article_id FROM article_slugs WHERE slug = ?)", meta.Slug, meta.Slug)
+		if found || err != nil {
+			return article, found, err
+		}
+	}
+	var item ImportedItem
+	err := db.Where("source = ? AND kind = ? AND external_id = ?", markdownImportSource(user), ImportedPost, name).First(&item).Error
+	if err == nil {
+		article, found, err := lookup("id = ?", item.LocalID)
+		if found || err != nil {
+			return article, found, err
+		}
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return Article{}, false, err
+	}
+	return lookup("slug = ?", slugify(title))
+}
+
+// markdownImportSource names the Markdown imports of a user in the
+// imported items table, so a file is recognized by its path.
+func markdownImportSource(user User) string {
+	return fmt.Sprintf("markdown:%d", user.ID)
+}
+
+// announceImport reports whether publishing an imported file is news for
+// webhooks and followers. A file dated in its front matter is older writing
+// brought over from elsewhere and, like a WordPress import, is published
+// quietly.
+func announceImport(meta frontMatter) bool {
+	return meta.Date == nil
+}
+
+func rememberImportedFile(tx *gorm.DB, name string, user User, articleID uint) error {
+	item := ImportedItem{Source: markdownImportSource(user), Kind: ImportedPost, ExternalID: name}
+	return tx.Where(item).Assign(ImportedItem{LocalID: articleID}).FirstOrCreate(&item).Error
+}
+
+// applyImportedStatus sets the status and dates the front matter asks for,
+// as far as the importing user may: an existing article only moves along
+// the workflow. It returns a warning when the request was not followed.
+func applyImportedStatus(article *Article, meta frontMatter, isAdmin bool, now time.Time) string {
+	status, warning := article.Status, ""
+	if article.ID == 0 || (meta.Status != "" && meta.Status != article.Status) {
+		status, warning = importedStatus(meta.Status, meta.Date, isAdmin, now)
+	}
+	if article.ID != 0 && status != article.Status && !isAdmin {
+		if allowed, _ := canTransition(article.Status, status); !allowed {
+			return "status cannot change from " + article.Status + " to " + status + "; it was kept"
+		}
+	}
+
+	article.Status = status
+	switch status {
+	case ArticlePublished:
+		if meta.Date != nil {
+			article.PublishedAt = meta.Date
+		} else if article.PublishedAt == nil {
+			article.PublishedAt = &now
+		}
+		article.ScheduledAt = nil
+	case ArticleScheduled:
+		if meta.Date != nil {
+			article.ScheduledAt = meta.Date
+		}
+	default:
+		article.ScheduledAt = nil
+	}
+	return warning
+}
+
+// importMarkdownArchive imports every Markdown file in a ZIP archive for
+// user. Other files are reported as skipped.
+func importMarkdownArchive(archive *zip.Reader, user User, isAdmin, overwrite bool) importReport {
+	report := importReport{Results: []importResult{}}
+	files := 0
+	for _, file := range archive.File {
+		name := file.Name
+		base := path.Base(name)
+		if file.FileInfo().IsDir() || strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(base, ".") {
+			continue
+		}
+		ext := strings.ToLower(path.Ext(name))
+		if ext != ".md" && ext != ".markdown" {
+			report.add(importResult{File: name, Status: ImportSkipped, Error: "not a Markdown file"})
+			continue
+		}
+		if files++; files > maxImportFiles {
+			report.add(importResult{File: name, Status: ImportSkipped, Error: fmt.Sprintf("more than %d files in the archive", maxImportFiles)})
+			continue
+		}
+		if file.UncompressedSize64 > maxImportFileBytes {
+			report.add(importResult{File: name, Status: ImportFailed, Error: "file is too large"})
+			continue
+		}
+
+		data, err := readZipFile(file)
+		if err != nil {
+			report.add(importResult{File: name, Status: ImportFailed, Error: err.Error()})
+			continue
+		}
+		report.add(importMarkdownFile(name, data, user, isAdmin, overwrite))
+	}
+	return report
+}
+
+func readZipFile(file *zip.File) ([]byte, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	// The header size can lie, so the read is capped as well
+	data, err := io.ReadAll(io.LimitReader(rc, maxImportFileBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxImportFileBytes {
+		return nil, errors.New("file is too large")
+	}
+	return data, nil
+}
+
+// writeMarkdownArchive writes articles into a ZIP archive, one Markdown file
+// with front matter per article.
+func writeMarkdownArchive(w io.Writer, articles []Article) error {
+	archive := zip.NewWriter(w)
+	for _, article := range articles {
+		data, err := formatFrontMatter(article)
+		if err != nil {
+			return err
+		}
+		name := article.Slug
+		if name == "" {
+			name = strconv.FormatUint(uint64(article.ID), 10)
+		}
+		header := &zip.FileHeader{Name: name + ".md", Method: zip.Deflate, Modified: article.UpdatedAt}
+		file, err := archive.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(data); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// exportableArticles loads the articles of userID, or of every user when
+// userID is 0.
+func exportableArticles(userID uint) ([]Article, error) {
+	query := db.Preload("User").Preload("Category").Preload("Tags").Order("id")
+	if userID != 0 {
+		query = query.Where("user_id = ?", userID)
+	}
+	var articles []Article
+	return articles, query.Find(&articles).Error
+}
+
+// importArticlesHandler imports a ZIP of Markdown files uploaded as "file"
+// into the caller's articles. With ?overwrite=true files matching an existing
+// slug update that article instead of being skipped.
+func importArticlesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(uint)
+	role, _ := r.Context().Value("role").(string)
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		http.Error(w, `{"error": "User not found"}`, http.StatusBadRequest)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportArchiveBytes+1<<20)
+	if err := r.ParseMultipartForm(maxImportArchiveBytes); err != nil {
+		http.Error(w, `{"error": "Upload is too large or not multipart"}`, http.StatusRequestEntityTooLarge)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, `{"error": "file is required"}`, http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	archive, err := zip.NewReader(file, header.Size)
+	if err != nil {
+		http.Error(w, `{"error": "File is not a ZIP archive"}`, http.StatusBadRequest)
+		return
+	}
+
+	report := importMarkdownArchive(archive, user, role == "admin", r.URL.Query().Get("overwrite") == "true")
+
+	logger.WithFields(logrus.Fields{
+		"user_id": user.ID,
+		"created": report.Created,
+		"updated": report.Updated,
+		"skipped": report.Skipped,
+		"failed":  report.Failed,
+	}).Info("Markdown import finished")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// exportArticlesHandler downloads the caller's articles as a ZIP of Markdown
+// files. Admins can export another user with ?user_id= or the whole site
+// with ?all=true.
+func exportArticlesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(uint)
+	role, _ := r.Context().Value("role").(string)
+
+	if role == "admin" {
+		if r.URL.Query().Get("all") == "true" {
+			userID = 0
+		} else if other := r.URL.Query().Get("user_id"); other != "" {
+			id, err := strconv.ParseUint(other, 10, 64)
+			if err != nil {
+				http.Error(w, `{"error": "Invalid user ID"}`, http.StatusBadRequest)
+				return
+			}
+			userID = uint(id)
+		}
+	}
+
+	articles, err := exportableArticles(userID)
+	if err != nil {
+		http.Error(w, `{"error": "Error fetching articles"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var out bytes.Buffer
+	if err := writeMarkdownArchive(&out, articles); err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Failed to build export")
+		http.Error(w, `{"error": "Error building export"}`, http.StatusInternalServerError)
+		return
+	}
+
+	name := "articles"
+	if userID != 0 {
+		name = fmt.Sprintf("articles-user-%d", userID)
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.zip"`, name, time.Now().Format("20060102")))
+	w.Write(out.Bytes())
+}
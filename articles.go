@@ -0,0 +1,564 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// errArticleConflict is returned by saveArticle when the row was changed by
+// someone else after the caller loaded it.
+var errArticleConflict = errors.New("article was modified concurrently")
+
+// articleInput is the writable part of an Article accepted by the create, PUT
+// and PATCH handlers. Pointer fields let PATCH tell a missing field from an
+// empty one.
+type articleInput struct {
+	Title      *string    `json:"title"`
+	Content    *string    `json:"content"`
+	Status     *string    `json:"status"`      // create only: draft (default) or in_review
+	Tags       *[]string  `json:"tags"`        // tag names, created on first use
+	CategoryID *uint      `json:"category_id"` // 0 removes the category
+	Language   *string    `json:"language"`    // language of title and content
+	UpdatedAt  *time.Time `json:"updated_at"`  // optional precondition, same as If-Match
+}
+
+// articleEditableColumns are the columns written by saveArticle.
+var articleEditableColumns = []string{"title", "slug", "content", "content_html", "toc", "fingerprint", "language", "category_id", "status", "published_at", "scheduled_at", "updated_at"}
+
+// getArticles lists published articles, newest first, optionally filtered by
+// ?tag= and ?category= slugs. Authenticated users can ask for other statuses
+// with ?status=; they see only their own articles unless they are an admin.
+func getArticles(w http.ResponseWriter, r *http.Request) {
+	logger.Info("Fetching all articles")
+
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = ArticlePublished
+	}
+	if status != "all" && !isValidArticleStatus(status) {
+		http.Error(w, `{"error": "Unknown article status"}`, http.StatusBadRequest)
+		return
+	}
+
+	query := db.Preload("User").Preload("Category").Preload("Tags")
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		query = query.Where("id IN (SELECT article_tags.article_id FROM article_tags JOIN tags ON tags.id = article_tags.tag_id WHERE tags.slug = ?)", tag)
+	}
+	if category := r.URL.Query().Get("category"); category != "" {
+		query = query.Where("category_id IN (SELECT id FROM categories WHERE slug = ?)", category)
+	}
+	if status != ArticlePublished {
+		claims := optionalClaims(r)
+		if claims == nil {
+			http.Error(w, `{"error": "Unauthorized: log in to see unpublished articles"}`, http.StatusUnauthorized)
+			return
+		}
+		if claims.Role != "admin" {
+			query = query.Where("user_id = ?", claims.UserID)
+		}
+	}
+	if status != "all" {
+		query = query.Where("status = ?", status)
+	}
+
+	var articles []Article
+	if err := query.Order("published_at DESC NULLS LAST, id DESC").Find(&articles).Error; err != nil { // Order by newest first
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Failed to fetch articles")
+		http.Error(w, "Error fetching articles", http.StatusInternalServerError)
+		return
+	}
+
+	if err := decorateArticles(r, articles); err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Failed to count article likes")
+		http.Error(w, "Error fetching articles", http.StatusInternalServerError)
+		return
+	}
+	if err := localizeArticles(articles, requestedLanguage(r)); err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Failed to load article translations")
+		http.Error(w, "Error fetching articles", http.StatusInternalServerError)
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"article_count": len(articles),
+	}).Info("Fetched articles successfully")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Vary", "Accept-Language")
+	json.NewEncoder(w).Encode(articles)
+}
+
+func createArticleHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(uint)
+
+	var input articleInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if input.Title == nil || strings.TrimSpace(*input.Title) == "" || input.Content == nil {
+		http.Error(w, `{"error": "Title and content are required"}`, http.StatusBadRequest)
+		return
+	}
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		http.Error(w, `{"error": "User not found"}`, http.StatusBadRequest)
+		return
+	}
+
+	moderation, ok := moderateSubmission(w, r, moderationSubject{Kind: ReportArticle, UserID: user.ID, Title: *input.Title, Text: *input.Content})
+	if !ok {
+		return
+	}
+
+	status := ArticleDraft
+	if input.Status != nil {
+		status = *input.Status
+	}
+	if status != ArticleDraft && status != ArticleInReview {
+		http.Error(w, `{"error": "New articles start as draft or in_review"}`, http.StatusBadRequest)
+		return
+	}
+
+	article := Article{
+		Title:   *input.Title,
+		Content: *input.Content,
+		UserID:  user.ID,
+		Name:    user.Name,
+		Status:  status,
+	}
+	if !applyLanguageInput(w, &article, input) {
+		return
+	}
+	if err := renderArticleContent(&article); err != nil {
+		http.Error(w, `{"error": "Failed to render content"}`, http.StatusBadRequest)
+		return
+	}
+	if !applyTaxonomyInput(w, &article, input) {
+		return
+	}
+
+	if err := insertArticle(&article, user.ID, ""); err != nil {
+		logger.WithFields(logrus.Fields{
+			"user_id": user.ID,
+			"error":   err.Error(),
+		}).Error("Failed to create article")
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if moderation.Verdict == moderationReview {
+		flagForReview(ReportArticle, article.ID, moderation)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"article_id": article.ID,
+		"user_id":    user.ID,
+	}).Info("Article created successfully")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", articleETag(article))
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":    "Article created successfully",
+		"article_id": article.ID,
+		"slug":       article.Slug,
+		"status":     article.Status,
+	})
+}
+
+func getArticleHandler(w http.ResponseWriter, r *http.Request) {
+	article, ok := loadArticle(w, r)
+	if !ok {
+		return
+	}
+	if !articleVisible(r, article) {
+		http.Error(w, `{"error": "Article not found"}`, http.StatusNotFound)
+		return
+	}
+	recordArticleView(r, article)
+	writeArticle(w, r, article, requestedLanguage(r))
+}
+
+// writeArticle sends a single article in the best language for lang with its
+// validators, answering 304 when the client's copy is still current.
+// Engagement counts do not change the ETag. Series navigation and the list of
+// translations can change without the article changing, so articles in a
+// series or with translations are always sent in full. So are responses to
+// logged-in readers, which carry their liked and bookmarked flags; the ETag
+// is still sent for If-Match.
+func writeArticle(w http.ResponseWriter, r *http.Request, article *Article, lang string) {
+	localized := []Article{*article}
+	if err := localizeArticles(localized, lang); err != nil {
+		http.Error(w, `{"error": "Error fetching article"}`, http.StatusInternalServerError)
+		return
+	}
+	article = &localized[0]
+
+	etag := localizedETag(*article)
+	w.Header().Set("ETag", etag)
+	w.Header().Add("Vary", "Accept-Language")
+	w.Header().Set("Content-Language", article.Language)
+	if !article.UpdatedAt.IsZero() {
+		w.Header().Set("Last-Modified", article.UpdatedAt.UTC().Format(http.TimeFormat))
+	}
+	personal := optionalClaims(r) != nil
+	if personal {
+		w.Header().Set("Cache-Control", cachePersonal)
+	}
+	if !personal && article.SeriesID == nil && len(article.Translations) == 0 && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if err := loadSeriesNav(article); err != nil {
+		http.Error(w, `{"error": "Error fetching article"}`, http.StatusInternalServerError)
+		return
+	}
+
+	articles := []Article{*article}
+	if err := decorateArticles(r, articles); err != nil {
+		http.Error(w, `{"error": "Error fetching article"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(articles[0])
+}
+
+// updateArticleHandler replaces the title and content of an article (PUT).
+func updateArticleHandler(w http.ResponseWriter, r *http.Request) {
+	editArticle(w, r, true)
+}
+
+// patchArticleHandler changes only the fields present in the body (PATCH).
+func patchArticleHandler(w http.ResponseWriter, r *http.Request) {
+	editArticle(w, r, false)
+}
+
+func editArticle(w http.ResponseWriter, r *http.Request, replace bool) {
+	var input articleInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if replace && (input.Title == nil || input.Content == nil) {
+		http.Error(w, `{"error": "Title and content are required"}`, http.StatusBadRequest)
+		return
+	}
+	if input.Title != nil && strings.TrimSpace(*input.Title) == "" {
+		http.Error(w, `{"error": "Title cannot be empty"}`, http.StatusBadRequest)
+		return
+	}
+
+	article, ok := loadEditableArticle(w, r, input.UpdatedAt)
+	if !ok {
+		return
+	}
+	loadedAt := article.UpdatedAt
+
+	if input.Title != nil {
+		article.Title = *input.Title
+	}
+	if input.Content != nil {
+		article.Content = *input.Content
+	}
+	if !applyTaxonomyInput(w, article, input) {
+		return
+	}
+	if !applyLanguageInput(w, article, input) {
+		return
+	}
+
+	userID, _ := r.Context().Value("user_id").(uint)
+	var moderation moderationResult
+	if input.Title != nil || input.Content != nil {
+		moderation, ok = moderateSubmission(w, r, moderationSubject{Kind: ReportArticle, ID: article.ID, UserID: userID, Title: article.Title, Text: article.Content})
+		if !ok {
+			return
+		}
+	}
+	holdFlaggedEdit(article, moderation)
+
+	if err := saveArticle(article, loadedAt, userID, ""); err != nil {
+		writeArticleSaveError(w, article.ID, err)
+		return
+	}
+	if moderation.Verdict == moderationReview {
+		flagForReview(ReportArticle, article.ID, moderation)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"article_id": article.ID,
+		"method":     r.Method,
+	}).Info("Article updated successfully")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", articleETag(*article))
+	json.NewEncoder(w).Encode(article)
+}
+
+// holdFlaggedEdit takes a live or scheduled article back to review when an
+// edit of it was flagged, the way flagged comment edits go back to pending.
+// Only an admin can publish it again.
+func holdFlaggedEdit(article *Article, moderation moderationResult) {
+	if moderation.Verdict != moderationReview {
+		return
+	}
+	if article.Status == ArticlePublished || article.Status == ArticleScheduled {
+		article.Status = ArticleInReview
+		article.ScheduledAt = nil
+	}
+}
+
+func deleteArticleHandler(w http.ResponseWriter, r *http.Request) {
+	article, ok := loadEditableArticle(w, r, nil)
+	if !ok {
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("id = ? AND updated_at IS NOT DISTINCT FROM ?", article.ID, nullableTime(article.UpdatedAt)).Delete(&Article{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errArticleConflict
+		}
+		if article.SeriesID != nil {
+			if err := touchSeries(tx, databaseNow(), *article.SeriesID); err != nil {
+				return err
+			}
+		}
+		return deleteArticleDependents(tx, article.ID)
+	})
+	if err != nil {
+		writeArticleSaveError(w, article.ID, err)
+		return
+	}
+	// Counts still buffered would otherwise bring the stats back
+	beaconStats.forget(article.ID)
+
+	logger.WithFields(logrus.Fields{
+		"article_id": article.ID,
+	}).Info("Article deleted successfully")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Article deleted successfully"})
+}
+
+// deleteArticleDependents removes the rows that only make sense together with
+// the article being deleted.
+func deleteArticleDependents(tx *gorm.DB, articleID uint) error {
+	if err := tx.Where("article_id = ?", articleID).Delete(&ArticleSlug{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("(target_type = ? AND target_id = ?) OR (target_type = ? AND target_id IN (SELECT id FROM comments WHERE article_id = ?))",
+		ReportArticle, articleID, ReportComment, articleID).Delete(&Report{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("article_id = ?", articleID).Delete(&Comment{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("article_id = ?", articleID).Delete(&ArticleLike{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("article_id = ?", articleID).Delete(&ArticleRevision{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("article_id = ?", articleID).Delete(&ArticleCollaborator{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("article_id = ?", articleID).Delete(&Bookmark{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("article_id = ?", articleID).Delete(&ArticleTranslation{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("article_id = ?", articleID).Delete(&ArticleDailyStat{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("article_id = ?", articleID).Delete(&ArticleReferrerStat{}).Error; err != nil {
+		return err
+	}
+	return tx.Exec("DELETE FROM article_tags WHERE article_id = ?", articleID).Error
+}
+
+// loadArticle fetches the article named by the {id} route variable and writes
+// a 404 when it does not exist.
+func loadArticle(w http.ResponseWriter, r *http.Request) (*Article, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error": "Invalid article ID"}`, http.StatusBadRequest)
+		return nil, false
+	}
+
+	var article Article
+	if err := db.Preload("User").Preload("Category").Preload("Tags").First(&article, uint(id)).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, `{"error": "Article not found"}`, http.StatusNotFound)
+		} else {
+			logger.WithFields(logrus.Fields{
+				"article_id": id,
+				"error":      err.Error(),
+			}).Error("Failed to fetch article")
+			http.Error(w, `{"error": "Error fetching article"}`, http.StatusInternalServerError)
+		}
+		return nil, false
+	}
+	return &article, true
+}
+
+// loadEditableArticle loads the article for a write request and checks that
+// the caller owns it (or is an admin) and that the If-Match / updated_at
+// precondition, when given, still holds.
+func loadEditableArticle(w http.ResponseWriter, r *http.Request, updatedAt *time.Time) (*Article, bool) {
+	article, ok := loadArticle(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	if !canEditArticle(r, article) {
+		http.Error(w, `{"error": "Forbidden: you can only edit your own articles"}`, http.StatusForbidden)
+		return nil, false
+	}
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !etagMatchesStrong(ifMatch, articleETag(*article)) {
+		http.Error(w, `{"error": "Article has been modified since it was loaded"}`, http.StatusPreconditionFailed)
+		return nil, false
+	}
+	if updatedAt != nil && !updatedAt.Truncate(time.Microsecond).Equal(article.UpdatedAt.Truncate(time.Microsecond)) {
+		http.Error(w, `{"error": "Article has been modified since it was loaded"}`, http.StatusPreconditionFailed)
+		return nil, false
+	}
+	return article, true
+}
+
+// canEditArticle reports whether the authenticated caller may modify article.
+func canEditArticle(r *http.Request, article *Article) bool {
+	userID, _ := r.Context().Value("user_id").(uint)
+	role, _ := r.Context().Value("role").(string)
+	return role == "admin" || article.UserID == userID
+}
+
+// insertArticle stores a new article with a free slug and its first
+// revision. Content must already be rendered.
+func insertArticle(article *Article, editorID uint, note string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		return insertArticleTx(tx, article, editorID, note)
+	})
+}
+
+// insertArticleTx is insertArticle inside a transaction the caller owns.
+func insertArticleTx(tx *gorm.DB, article *Article, editorID uint, note string) error {
+	if err := refreshArticleSlug(tx, article); err != nil {
+		return err
+	}
+	if err := tx.Create(article).Error; err != nil {
+		return err
+	}
+	return recordRevision(tx, article, editorID, note)
+}
+
+// saveArticle writes the editable columns of article. The update only applies
+// if the stored updated_at still equals loadedAt, so two concurrent edits
+// cannot silently overwrite each other. A changed title also moves the slug,
+// the Markdown is rendered again, and the result is recorded as a revision by
+// editorID.
+func saveArticle(article *Article, loadedAt time.Time, editorID uint, note string) error {
+	if err := renderArticleContent(article); err != nil {
+		return err
+	}
+	article.UpdatedAt = databaseNow()
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := refreshArticleSlug(tx, article); err != nil {
+			return err
+		}
+
+		res := tx.Model(article).
+			Select(articleEditableColumns).
+			Where("updated_at IS NOT DISTINCT FROM ?", nullableTime(loadedAt)).
+			Updates(article)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errArticleConflict
+		}
+		if err := recordRevision(tx, article, editorID, note); err != nil {
+			return err
+		}
+		// The title and status show in the navigation of the whole series
+		if article.SeriesID != nil {
+			if err := touchSeries(tx, article.UpdatedAt, *article.SeriesID); err != nil {
+				return err
+			}
+		}
+		return tx.Model(article).Association("Tags").Replace(article.Tags)
+	})
+}
+
+func writeArticleSaveError(w http.ResponseWriter, articleID uint, err error) {
+	if errors.Is(err, errArticleConflict) {
+		http.Error(w, `{"error": "Article has been modified since it was loaded"}`, http.StatusPreconditionFailed)
+		return
+	}
+	logger.WithFields(logrus.Fields{
+		"article_id": articleID,
+		"error":      err.Error(),
+	}).Error("Failed to save article")
+	http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+}
+
+// articleETag derives a strong validator from the article's last update.
+func articleETag(article Article) string {
+	return fmt.Sprintf(`"%d-%d"`, article.ID, article.UpdatedAt.UnixMicro())
+}
+
+// etagMatches reports whether an If-None-Match header value lists etag.
+// Weak validators are compared by their opaque part.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// etagMatchesStrong is etagMatches for If-Match, which uses the strong
+// comparison: a weak validator never matches.
+func etagMatchesStrong(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// nullableTime maps the zero time to NULL, which is what rows created before
+// the timestamp columns existed hold.
+func nullableTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
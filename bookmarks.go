@@ -0,0 +1,508 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Bookmark saves an article for later; one row per user and article. A
+// bookmark is either unsorted (ReadingListID nil) or in one reading list,
+// and Position orders the bookmarks within it.
+type Bookmark struct {
+	UserID        uint      `json:"user_id" gorm:"primaryKey;autoIncrement:false"`
+	ArticleID     uint      `json:"article_id" gorm:"primaryKey;autoIncrement:false;index"`
+	ReadingListID *uint     `json:"reading_list_id" gorm:"index"`
+	Position      int       `json:"position"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// ReadingList is a named group of a user's bookmarks.
+type ReadingList struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	UserID        uint      `json:"user_id" gorm:"index"`
+	Name          string    `json:"name"`
+	BookmarkCount int64     `json:"bookmark_count" gorm:"-"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// bookmarkEntry is a bookmark together with the saved article.
+type bookmarkEntry struct {
+	ArticleID     uint       `json:"article_id"`
+	ReadingListID *uint      `json:"reading_list_id"`
+	Position      int        `json:"position"`
+	BookmarkedAt  time.Time  `json:"bookmarked_at"`
+	Title         string     `json:"title"`
+	Slug          string     `json:"slug"`
+	AuthorName    string     `json:"author_name"`
+	Status        string     `json:"status"`
+	PublishedAt   *time.Time `json:"published_at"`
+}
+
+const (
+	maxReadingLists     = 50
+	maxReadingListName  = 100
+	maxBookmarksPerUser = 5000
+)
+
+// unsortedReadingList is the ?list= value for bookmarks outside any list.
+const unsortedReadingList = "none"
+
+const readingListNameError = `{"error": "Reading list name must be between 1 and 100 characters"}`
+
+// inReadingList restricts a bookmark query to one list; nil is unsorted.
+func inReadingList(query *gorm.DB, listID *uint) *gorm.DB {
+	if listID == nil {
+		return query.Where("reading_list_id IS NULL")
+	}
+	return query.Where("reading_list_id = ?", *listID)
+}
+
+// loadOwnReadingList checks that listID, when given, is a list of userID and
+// writes a 400 otherwise.
+func loadOwnReadingList(w http.ResponseWriter, userID uint, listID *uint) bool {
+	if listID == nil {
+		return true
+	}
+	var count int64
+	db.Model(&ReadingList{}).Where("id = ? AND user_id = ?", *listID, userID).Count(&count)
+	if count == 0 {
+		http.Error(w, `{"error": "Reading list not found"}`, http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// nextBookmarkPosition is the position after the last bookmark in a list.
+func nextBookmarkPosition(tx *gorm.DB, userID uint, listID *uint) (int, error) {
+	var last int
+	err := inReadingList(tx.Model(&Bookmark{}).Where("user_id = ?", userID), listID).
+		Select("COALESCE(MAX(position), 0)").Scan(&last).Error
+	return last + 1, err
+}
+
+// getBookmarksHandler lists the caller's bookmarks, newest positions last.
+// ?list= picks a reading list by ID, or "none" for unsorted bookmarks;
+// without it all bookmarks are listed.
+func getBookmarksHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(uint)
+	role, _ := r.Context().Value("role").(string)
+
+	query := db.Where("user_id = ?", userID)
+	switch list := r.URL.Query().Get("list"); list {
+	case "":
+	case unsortedReadingList:
+		query = inReadingList(query, nil)
+	default:
+		id, err := strconv.ParseUint(list, 10, 64)
+		if err != nil {
+			http.Error(w, `{"error": "Invalid reading list"}`, http.StatusBadRequest)
+			return
+		}
+		listID := uint(id)
+		query = inReadingList(query, &listID)
+	}
+
+	var bookmarks []Bookmark
+	if err := query.Order("reading_list_id NULLS FIRST, position, created_at").Find(&bookmarks).Error; err != nil {
+		logger.WithFields(logrus.Fields{
+			"user_id": userID,
+			"error":   err.Error(),
+		}).Error("Failed to fetch bookmarks")
+		http.Error(w, `{"error": "Error fetching bookmarks"}`, http.StatusInternalServerError)
+		return
+	}
+
+	ids := make([]uint, len(bookmarks))
+	for i, b := range bookmarks {
+		ids[i] = b.ArticleID
+	}
+	articles := map[uint]Article{}
+	if len(ids) > 0 {
+		var found []Article
+		if err := db.Preload("User").Where("id IN ?", ids).Find(&found).Error; err != nil {
+			http.Error(w, `{"error": "Error fetching bookmarks"}`, http.StatusInternalServerError)
+			return
+		}
+		for _, article := range found {
+			articles[article.ID] = article
+		}
+	}
+
+	entries := []bookmarkEntry{}
+	for _, b := range bookmarks {
+		article, ok := articles[b.ArticleID]
+		// Articles taken offline since are kept but not shown
+		if !ok || (article.Status != ArticlePublished && !canCollaborate(userID, role, &article)) {
+			continue
+		}
+		entries = append(entries, bookmarkEntry{
+			ArticleID:     b.ArticleID,
+			ReadingListID: b.ReadingListID,
+			Position:      b.Position,
+			BookmarkedAt:  b.CreatedAt,
+			Title:         article.Title,
+			Slug:          article.Slug,
+			AuthorName:    article.User.Name,
+			Status:        article.Status,
+			PublishedAt:   article.PublishedAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// addBookmarkHandler bookmarks an article, at the end of the given reading
+// list. Bookmarking an article again moves it to that list.
+func addBookmarkHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(uint)
+
+	var request struct {
+		ArticleID     uint  `json:"article_id"`
+		ReadingListID *uint `json:"reading_list_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	var article Article
+	if err := db.First(&article, request.ArticleID).Error; err != nil || !articleVisible(r, &article) {
+		http.Error(w, `{"error": "Article not found"}`, http.StatusNotFound)
+		return
+	}
+	if !loadOwnReadingList(w, userID, request.ReadingListID) {
+		return
+	}
+
+	var bookmark Bookmark
+	created := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_id = ? AND article_id = ?", userID, article.ID).First(&bookmark).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		created = err != nil
+		if !created && sameReadingList(bookmark.ReadingListID, request.ReadingListID) {
+			return nil
+		}
+		if created {
+			var count int64
+			if err := tx.Model(&Bookmark{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+				return err
+			}
+			if count >= maxBookmarksPerUser {
+				return errTooManyBookmarks
+			}
+		}
+
+		position, err := nextBookmarkPosition(tx, userID, request.ReadingListID)
+		if err != nil {
+			return err
+		}
+		bookmark = Bookmark{
+			UserID:        userID,
+			ArticleID:     article.ID,
+			ReadingListID: request.ReadingListID,
+			Position:      position,
+			CreatedAt:     bookmark.CreatedAt,
+		}
+		if created {
+			return tx.Create(&bookmark).Error
+		}
+		return tx.Model(&bookmark).Select("reading_list_id", "position").Updates(&bookmark).Error
+	})
+	if errors.Is(err, errTooManyBookmarks) {
+		http.Error(w, `{"error": "Too many bookmarks"}`, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"user_id":    userID,
+			"article_id": article.ID,
+			"error":      err.Error(),
+		}).Error("Failed to save bookmark")
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(bookmark)
+}
+
+var errTooManyBookmarks = errors.New("bookmark limit reached")
+
+func sameReadingList(a, b *uint) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+// removeBookmarkHandler removes the caller's bookmark of an article.
+func removeBookmarkHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(uint)
+	articleID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error": "Invalid article ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	res := db.Where("user_id = ? AND article_id = ?", userID, uint(articleID)).Delete(&Bookmark{})
+	if res.Error != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if res.RowsAffected == 0 {
+		http.Error(w, `{"error": "Bookmark not found"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Bookmark removed"})
+}
+
+// reorderBookmarksHandler sets the order of the bookmarks in one reading
+// list (or the unsorted ones). The listed articles come first, in the given
+// order; bookmarks left out keep their relative order after them.
+func reorderBookmarksHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(uint)
+
+	var request struct {
+		ReadingListID *uint  `json:"reading_list_id"`
+		ArticleIDs    []uint `json:"article_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if !loadOwnReadingList(w, userID, request.ReadingListID) {
+		return
+	}
+
+	var bookmarks []Bookmark
+	if err := inReadingList(db.Where("user_id = ?", userID), request.ReadingListID).
+		Order("position, created_at").Find(&bookmarks).Error; err != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	order, err := reorderIDs(bookmarkArticleIDs(bookmarks), request.ArticleIDs)
+	if err != nil {
+		http.Error(w, `{"error": "`+err.Error()+`"}`, http.StatusBadRequest)
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for i, articleID := range order {
+			if err := tx.Model(&Bookmark{}).Where("user_id = ? AND article_id = ?", userID, articleID).
+				Update("position", i+1).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"reading_list_id": request.ReadingListID,
+		"article_ids":     order,
+	})
+}
+
+func bookmarkArticleIDs(bookmarks []Bookmark) []uint {
+	ids := make([]uint, len(bookmarks))
+	for i, b := range bookmarks {
+		ids[i] = b.ArticleID
+	}
+	return ids
+}
+
+// reorderIDs moves first to the front of current, in the given order, and
+// keeps the rest of current after them. Every ID in first must be in
+// current, and only once.
+func reorderIDs(current, first []uint) ([]uint, error) {
+	present := make(map[uint]bool, len(current))
+	for _, id := range current {
+		present[id] = true
+	}
+	placed := make(map[uint]bool, len(first))
+	order := make([]uint, 0, len(current))
+	for _, id := range first {
+		if !present[id] {
+			return nil, errors.New("article " + strconv.FormatUint(uint64(id), 10) + " is not in this list")
+		}
+		if placed[id] {
+			return nil, errors.New("article " + strconv.FormatUint(uint64(id), 10) + " is listed twice")
+		}
+		placed[id] = true
+		order = append(order, id)
+	}
+	for _, id := range current {
+		if !placed[id] {
+			order = append(order, id)
+		}
+	}
+	return order, nil
+}
+
+// getReadingListsHandler lists the caller's reading lists with the number of
+// bookmarks in each.
+func getReadingListsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(uint)
+
+	var lists []ReadingList
+	if err := db.Where("user_id = ?", userID).Order("name, id").Find(&lists).Error; err != nil {
+		http.Error(w, `{"error": "Error fetching reading lists"}`, http.StatusInternalServerError)
+		return
+	}
+	var counts []struct {
+		ReadingListID uint
+		Count         int64
+	}
+	if err := db.Model(&Bookmark{}).Select("reading_list_id, COUNT(*) AS count").
+		Where("user_id = ? AND reading_list_id IS NOT NULL", userID).
+		Group("reading_list_id").Scan(&counts).Error; err != nil {
+		http.Error(w, `{"error": "Error fetching reading lists"}`, http.StatusInternalServerError)
+		return
+	}
+	byList := make(map[uint]int64, len(counts))
+	for _, c := range counts {
+		byList[c.ReadingListID] = c.Count
+	}
+	for i := range lists {
+		lists[i].BookmarkCount = byList[lists[i].ID]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lists)
+}
+
+// createReadingListHandler adds a named reading list for the caller.
+func createReadingListHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(uint)
+
+	var request struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" || len([]rune(request.Name)) > maxReadingListName {
+		http.Error(w, readingListNameError, http.StatusBadRequest)
+		return
+	}
+
+	var count int64
+	db.Model(&ReadingList{}).Where("user_id = ?", userID).Count(&count)
+	if count >= maxReadingLists {
+		http.Error(w, `{"error": "Too many reading lists"}`, http.StatusConflict)
+		return
+	}
+
+	list := ReadingList{UserID: userID, Name: request.Name}
+	if err := db.Create(&list).Error; err != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(list)
+}
+
+// renameReadingListHandler changes the name of one of the caller's lists.
+func renameReadingListHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := loadReadingList(w, r)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" || len([]rune(request.Name)) > maxReadingListName {
+		http.Error(w, readingListNameError, http.StatusBadRequest)
+		return
+	}
+
+	list.Name = request.Name
+	if err := db.Model(list).Select("name", "updated_at").Updates(list).Error; err != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// deleteReadingListHandler removes one of the caller's lists. Its bookmarks
+// are kept and become unsorted.
+func deleteReadingListHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := loadReadingList(w, r)
+	if !ok {
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		next, err := nextBookmarkPosition(tx, list.UserID, nil)
+		if err != nil {
+			return err
+		}
+		// Appended after the unsorted bookmarks, keeping their order
+		if err := tx.Model(&Bookmark{}).Where("reading_list_id = ?", list.ID).
+			UpdateColumns(map[string]interface{}{
+				"reading_list_id": nil,
+				"position":        gorm.Expr("position + ?", next),
+			}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(list).Error
+	})
+	if err != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Reading list deleted"})
+}
+
+// loadReadingList fetches the caller's reading list named by {id}; lists of
+// other users answer 404.
+func loadReadingList(w http.ResponseWriter, r *http.Request) (*ReadingList, bool) {
+	userID, _ := r.Context().Value("user_id").(uint)
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error": "Invalid reading list ID"}`, http.StatusBadRequest)
+		return nil, false
+	}
+	var list ReadingList
+	if err := db.Where("id = ? AND user_id = ?", uint(id), userID).First(&list).Error; err != nil {
+		http.Error(w, `{"error": "Reading list not found"}`, http.StatusNotFound)
+		return nil, false
+	}
+	return &list, true
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Cache-Control policies of the public read routes. Anything sent with an
+// Authorization header may depend on who asked and is always private.
+const (
+	// JSON that clients may keep but must revalidate; 304s make that cheap
+	cacheRevalidate = "public, no-cache"
+	// HTML pages
+	cachePages = "public, max-age=60"
+	// Feeds are polled by readers that do not need the last minute
+	cacheFeeds = "public, max-age=300"
+	// The sitemap and robots.txt
+	cacheCrawlers = "public, max-age=3600"
+	cachePrivate  = "private, no-cache"
+	// Responses with per-reader flags that the validators do not cover
+	cachePersonal = "private, no-store"
+)
+
+// How long a cached response may be served, CACHE_TTL seconds. Writes
+// invalidate the cache as soon as they are committed; this bounds how far
+// view counts, which do not invalidate it, can lag behind.
+var responseCacheTTL = time.Duration(getenvInt("CACHE_TTL", 300)) * time.Second
+
+// pageCache holds rendered anonymous responses of the article list and the
+// article pages. It is emptied whenever a table they are built from changes.
+var pageCache = newResponseCache(getenvInt("CACHE_MAX_ENTRIES", 1000), responseCacheTTL)
+
+// cachedTables are the tables whose writes invalidate pageCache.
+var cachedTables = map[string]bool{
+	"articles":             true,
+	"article_slugs":        true,
+	"article_tags":         true,
+	"article_translations": true,
+	"article_likes":        true,
+	"tags":                 true,
+	"categories":           true,
+	"series":               true,
+	"users":                true,
+	"comments":             true,
+}
+
+type cachedResponse struct {
+	status       int
+	header       http.Header
+	body         []byte
+	etag         string
+	lastModified time.Time
+	stored       time.Time
+	// articleID is the article whose page this is, so hits still count views
+	articleID uint
+}
+
+type responseCache struct {
+	mu         sync.Mutex
+	entries    map[string]*cachedResponse
+	generation uint64
+	maxEntries int
+	ttl        time.Duration
+}
+
+func newResponseCache(maxEntries int, ttl time.Duration) *responseCache {
+	return &responseCache{
+		entries:    make(map[string]*cachedResponse),
+		maxEntries: maxEntries,
+		ttl:        ttl,
+	}
+}
+
+func (c *responseCache) get(key string, now time.Time) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || now.Sub(entry.stored) > c.ttl {
+		return nil, false
+	}
+	return entry, true
+}
+
+// put stores entry unless the cache was invalidated since generation was
+// read, in which case the entry may already be out of date.
+func (c *responseCache) put(key string, generation uint64, entry *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		// Evict the oldest entry
+		var oldest string
+		for k, e := range c.entries {
+			if oldest == "" || e.stored.Before(c.entries[oldest].stored) {
+				oldest = k
+			}
+		}
+		delete(c.entries, oldest)
+	}
+	c.entries[key] = entry
+}
+
+func (c *responseCache) currentGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// invalidate drops every cached response.
+func (c *responseCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.entries = make(map[string]*cachedResponse)
+}
+
+// wrap serves anonymous GETs of h from the cache. Everything else still
+// gets validators and 304s, computed from the response h writes.
+func (c *responseCache) wrap(h http.HandlerFunc) http.HandlerFunc {
+	return responseValidators(c, h)
+}
+
+// withValidators gives the responses of h an ETag derived from the body and
+// answers conditional requests with 304, without caching anything.
+func withValidators(h http.HandlerFunc) http.HandlerFunc {
+	return responseValidators(nil, h)
+}
+
+// cacheHints is how a handler tells the cache what a hit has to do besides
+// replaying the response.
+type cacheHints struct {
+	articleID uint
+}
+
+// noteArticleView marks the response as the page of an article, so cache
+// hits record a view the way recordArticleView does.
+func noteArticleView(r *http.Request, article *Article) {
+	if article.Status != ArticlePublished {
+		return
+	}
+	if hints, ok := r.Context().Value("cache_hints").(*cacheHints); ok {
+		hints.articleID = article.ID
+	}
+}
+
+func responseValidators(c *responseCache, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		cacheable := c != nil && r.Method == http.MethodGet && r.Header.Get("Authorization") == ""
+		// The language is part of the key since the list follows Accept-Language
+		key := r.URL.RequestURI() + "|" + requestedLanguage(r)
+
+		if cacheable {
+			if entry, ok := c.get(key, now); ok {
+				if entry.articleID != 0 {
+					articleViews.record(entry.articleID, visitorKey(r), now)
+				}
+				w.Header().Set("X-Cache", "HIT")
+				writeCachedResponse(w, r, entry)
+				return
+			}
+		}
+
+		var generation uint64
+		if cacheable {
+			generation = c.currentGeneration()
+		}
+		hints := &cacheHints{}
+		rec := &responseRecorder{header: make(http.Header), status: http.StatusOK}
+		h(rec, r.WithContext(context.WithValue(r.Context(), "cache_hints", hints)))
+
+		entry := &cachedResponse{
+			status:    rec.status,
+			header:    rec.header,
+			body:      rec.body.Bytes(),
+			etag:      rec.header.Get("ETag"),
+			stored:    now,
+			articleID: hints.articleID,
+		}
+		if entry.status == http.StatusOK {
+			if entry.etag == "" {
+				sum := sha256.Sum256(entry.body)
+				entry.etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+			}
+			entry.lastModified, _ = http.ParseTime(rec.header.Get("Last-Modified"))
+			if entry.lastModified.IsZero() {
+				// The content is known to be current as of now
+				entry.lastModified = now
+			}
+			if cacheable {
+				c.put(key, generation, entry)
+				w.Header().Set("X-Cache", "MISS")
+			}
+		}
+		writeCachedResponse(w, r, entry)
+	}
+}
+
+// writeCachedResponse replays a recorded response, or a 304 when the client
+// already has it.
+func writeCachedResponse(w http.ResponseWriter, r *http.Request, entry *cachedResponse) {
+	for name, values := range entry.header {
+		if name == "Vary" {
+			for _, value := range values {
+				w.Header().Add(name, value)
+			}
+			continue
+		}
+		w.Header()[name] = values
+	}
+	if entry.status == http.StatusOK && notModified(w, r, entry.etag, entry.lastModified) {
+		return
+	}
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+}
+
+// responseRecorder buffers a response so it can be cached and validated
+// before it is sent.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	wrote  bool
+}
+
+func (rec *responseRecorder) Header() http.Header { return rec.header }
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wrote {
+		rec.status = status
+		rec.wrote = true
+	}
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.wrote = true
+	return rec.body.Write(b)
+}
+
+// cacheControl sets the Cache-Control policy of a route. Requests carrying
+// credentials always get cachePrivate.
+func cacheControl(policy string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Authorization")
+		if r.Header.Get("Authorization") != "" {
+			w.Header().Set("Cache-Control", cachePrivate)
+		} else {
+			w.Header().Set("Cache-Control", policy)
+		}
+		h(w, r)
+	}
+}
+
+// registerCacheInvalidation empties pageCache after every write to one of
+// cachedTables, whichever code path made it. Writes made in a transaction
+// empty it when the transaction commits: done any earlier, a concurrent
+// reader could cache what the table held before the commit.
+func registerCacheInvalidation(db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	db.ConnPool = invalidatingPool{sqlDB}
+	db.Statement.ConnPool = db.ConnPool
+
+	invalidate := func(tx *gorm.DB) {
+		if tx.Error != nil || !touchesCachedTables(tx) {
+			return
+		}
+		if pending, ok := tx.Statement.ConnPool.(*invalidatingTx); ok {
+			pending.dirty = true
+			return
+		}
+		pageCache.invalidate()
+	}
+
+	callbacks := db.Callback()
+	if err := callbacks.Create().After("gorm:create").Register("cache:invalidate_create", invalidate); err != nil {
+		return err
+	}
+	if err := callbacks.Update().After("gorm:update").Register("cache:invalidate_update", invalidate); err != nil {
+		return err
+	}
+	if err := callbacks.Delete().After("gorm:delete").Register("cache:invalidate_delete", invalidate); err != nil {
+		return err
+	}
+	return callbacks.Raw().After("gorm:raw").Register("cache:invalidate_raw", invalidate)
+}
+
+// touchesCachedTables reports whether the statement tx ran changes a table
+// cached responses are built from.
+func touchesCachedTables(tx *gorm.DB) bool {
+	if cachedTables[tx.Statement.Table] {
+		// Flushed view counts are allowed to lag for CACHE_TTL; they are
+		// written every few seconds and would keep the cache empty
+		columns, ok := tx.Statement.Dest.(map[string]interface{})
+		_, views := columns["view_count"]
+		return !(ok && views && len(columns) == 1)
+	}
+	if tx.Statement.Table == "" {
+		// Raw statements: look for a table name in the SQL
+		sql := strings.ToLower(tx.Statement.SQL.String())
+		if strings.HasPrefix(strings.TrimSpace(sql), "select") {
+			return false
+		}
+		for table := range cachedTables {
+			if strings.Contains(sql, table) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// invalidatingPool is the connection pool gorm runs statements on. The
+// transactions it begins empty pageCache when they commit, if they wrote to
+// one of cachedTables.
+type invalidatingPool struct {
+	*sql.DB
+}
+
+func (p invalidatingPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	tx, err := p.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &invalidatingTx{Tx: tx}, nil
+}
+
+// GetDBConn lets gorm's DB() find the pool underneath.
+func (p invalidatingPool) GetDBConn() (*sql.DB, error) {
+	return p.DB, nil
+}
+
+type invalidatingTx struct {
+	*sql.Tx
+	dirty bool
+}
+
+func (tx *invalidatingTx) Commit() error {
+	if err := tx.Tx.Commit(); err != nil {
+		return err
+	}
+	if tx.dirty {
+		pageCache.invalidate()
+	}
+	return nil
+}
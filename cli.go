@@ -0,0 +1,223 @@
+package main
+
+import (
+	"archive/zip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const commandUsage = `Usage:
+  BlogAP                                   start the server
+  BlogAP import-markdown -user ID|EMAIL [-overwrite] ARCHIVE.zip
+  BlogAP export-markdown [-user ID|EMAIL] [-o FILE.zip]
+  BlogAP import-wxr -user ID|EMAIL [-invite] EXPORT.xml
+  BlogAP export-static [-o DIR] [-full]
+`
+
+// runCommand runs a command-line subcommand and returns the exit code.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "import-markdown":
+		return importMarkdownCommand(args[1:])
+	case "export-markdown":
+		return exportMarkdownCommand(args[1:])
+	case "import-wxr":
+		return importWXRCommand(args[1:])
+	case "export-static":
+		return exportStaticCommand(args[1:])
+	case "help", "-h", "--help":
+		fmt.Print(commandUsage)
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", args[0], commandUsage)
+	return 2
+}
+
+// findUser looks a user up by numeric ID or by email.
+func findUser(ref string) (User, error) {
+	var user User
+	if id, err := strconv.ParseUint(ref, 10, 64); err == nil {
+		return user, db.First(&user, uint(id)).Error
+	}
+	return user, db.Where("email = ?", strings.TrimSpace(ref)).First(&user).Error
+}
+
+func importMarkdownCommand(args []string) int {
+	flags := flag.NewFlagSet("import-markdown", flag.ContinueOnError)
+	userRef := flags.String("user", "", "ID or email of the user the articles belong to")
+	overwrite := flags.Bool("overwrite", false, "update articles whose slug already exists instead of skipping them")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *userRef == "" || flags.NArg() != 1 {
+		fmt.Fprint(os.Stderr, commandUsage)
+		return 2
+	}
+
+	user, err := findUser(*userRef)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "user %s not found\n", *userRef)
+		return 1
+	}
+	archive, err := zip.OpenReader(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot open %s: %v\n", flags.Arg(0), err)
+		return 1
+	}
+	defer archive.Close()
+
+	report := importMarkdownArchive(&archive.Reader, user, user.Role == "admin", *overwrite)
+	printImportReport(os.Stdout, report)
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// printImportReport writes one line per file and a summary.
+func printImportReport(w io.Writer, report importReport) {
+	for _, result := range report.Results {
+		line := fmt.Sprintf("%-8s %s", result.Status, result.File)
+		if result.Slug != "" {
+			line += " -> " + result.Slug
+		}
+		if result.Error != "" {
+			line += ": " + result.Error
+		}
+		fmt.Fprintln(w, line)
+		for _, warning := range result.Warnings {
+			fmt.Fprintln(w, "         warning: "+warning)
+		}
+	}
+	fmt.Fprintf(w, "\n%d created, %d updated, %d skipped, %d failed\n",
+		report.Created, report.Updated, report.Skipped, report.Failed)
+}
+
+func exportMarkdownCommand(args []string) int {
+	flags := flag.NewFlagSet("export-markdown", flag.ContinueOnError)
+	userRef := flags.String("user", "", "ID or email of the user to export; all articles when empty")
+	output := flags.String("o", "articles.zip", "file to write, - for standard output")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var userID uint
+	if *userRef != "" {
+		user, err := findUser(*userRef)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "user %s not found\n", *userRef)
+			return 1
+		}
+		userID = user.ID
+	}
+
+	articles, err := exportableArticles(userID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot load articles: %v\n", err)
+		return 1
+	}
+
+	out := io.Writer(os.Stdout)
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot create %s: %v\n", *output, err)
+			return 1
+		}
+		defer file.Close()
+		out = file
+	}
+	if err := writeMarkdownArchive(out, articles); err != nil {
+		fmt.Fprintf(os.Stderr, "export failed: %v\n", err)
+		return 1
+	}
+	if *output != "-" {
+		fmt.Fprintf(os.Stderr, "exported %d articles to %s\n", len(articles), *output)
+	}
+	return 0
+}
+
+func importWXRCommand(args []string) int {
+	flags := flag.NewFlagSet("import-wxr", flag.ContinueOnError)
+	userRef := flags.String("user", "", "ID or email of the user running the import; owns posts without a known author")
+	invite := flags.Bool("invite", false, "email an invitation to every author account that is created")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *userRef == "" || flags.NArg() != 1 {
+		fmt.Fprint(os.Stderr, commandUsage)
+		return 2
+	}
+
+	importer, err := findUser(*userRef)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "user %s not found\n", *userRef)
+		return 1
+	}
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot open %s: %v\n", flags.Arg(0), err)
+		return 1
+	}
+	defer file.Close()
+
+	export, err := parseWXR(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	report := importWordPress(export, importer, *invite)
+	printWXRReport(os.Stdout, report)
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// printWXRReport writes one line per reported item and a summary.
+func printWXRReport(w io.Writer, report wxrReport) {
+	for _, result := range report.Results {
+		line := fmt.Sprintf("%-8s %-8s %s", result.Status, result.Kind, result.ExternalID)
+		if result.Title != "" {
+			line += " " + strconv.Quote(result.Title)
+		}
+		if result.Error != "" {
+			line += ": " + result.Error
+		}
+		fmt.Fprintln(w, line)
+		for _, warning := range result.Warnings {
+			fmt.Fprintln(w, "         warning: "+warning)
+		}
+	}
+	fmt.Fprintf(w, "\n%s: %d created, %d matched, %d skipped, %d failed\n",
+		report.Source, report.Created, report.Matched, report.Skipped, report.Failed)
+}
+
+func exportStaticCommand(args []string) int {
+	flags := flag.NewFlagSet("export-static", flag.ContinueOnError)
+	output := flags.String("o", "public", "directory to write the site to")
+	full := flags.Bool("full", false, "rebuild every file instead of only what changed since the last export")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 0 {
+		fmt.Fprint(os.Stderr, commandUsage)
+		return 2
+	}
+
+	report, err := exportStaticSite(*output, *full)
+	for _, warning := range report.Warnings {
+		fmt.Fprintln(os.Stderr, "warning: "+warning)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("%s: %d written, %d unchanged, %d removed\n",
+		*output, report.Written, report.Unchanged, report.Removed)
+	return 0
+}
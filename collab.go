@@ -0,0 +1,641 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// ArticleCollaborator lets a user co-write an article they do not own.
+type ArticleCollaborator struct {
+	ArticleID uint      `json:"article_id" gorm:"primaryKey"`
+	UserID    uint      `json:"user_id" gorm:"primaryKey"`
+	User      User      `json:"-" gorm:"foreignKey:UserID"`
+	Name      string    `json:"name" gorm:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const (
+	// collabSnapshotInterval is how often edits are written to the article
+	collabSnapshotInterval = 15 * time.Second
+	// collabHistoryLimit bounds the operations kept for clients that lag
+	// behind; a client further behind has to reload
+	collabHistoryLimit    = 2000
+	maxCollabMessageBytes = 1 << 20
+	maxCollabTextLength   = 500000
+	collabSendBuffer      = 64
+	collabWriteTimeout    = 10 * time.Second
+)
+
+// collabCursor is a co-author's selection in code points; Position equals
+// End when nothing is selected.
+type collabCursor struct {
+	Position int `json:"position"`
+	End      int `json:"end"`
+}
+
+// collabPeer is what co-authors see of each other.
+type collabPeer struct {
+	ClientID uint64        `json:"client_id"`
+	UserID   uint          `json:"user_id"`
+	Name     string        `json:"name"`
+	Cursor   *collabCursor `json:"cursor,omitempty"`
+}
+
+// clone copies the peer so it can be queued while the original cursor keeps
+// moving.
+func (p collabPeer) clone() *collabPeer {
+	if p.Cursor != nil {
+		cursor := *p.Cursor
+		p.Cursor = &cursor
+	}
+	return &p
+}
+
+// collabMessage is the envelope of every message on the channel. Clients
+// send "op" and "cursor"; the server sends "init", "ack", "op", "cursor",
+// "join", "leave", "saved" and "error".
+type collabMessage struct {
+	Type      string        `json:"type"`
+	Revision  int           `json:"revision,omitempty"`
+	Op        textOp        `json:"op,omitempty"`
+	Cursor    *collabCursor `json:"cursor,omitempty"`
+	Content   *string       `json:"content,omitempty"`
+	ClientID  uint64        `json:"client_id,omitempty"`
+	UserID    uint          `json:"user_id,omitempty"`
+	Peer      *collabPeer   `json:"peer,omitempty"`
+	Peers     []collabPeer  `json:"peers,omitempty"`
+	UpdatedAt *time.Time    `json:"updated_at,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// collabClient is one open editor. Messages are queued on send and written
+// by a single goroutine, as gorilla/websocket requires.
+type collabClient struct {
+	peer   collabPeer
+	role   string
+	conn   *websocket.Conn
+	send   chan collabMessage
+	mu     sync.Mutex
+	closed bool
+}
+
+func (c *collabClient) queue(msg collabMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.send <- msg:
+	default:
+		// A client that cannot keep up is dropped and reloads
+		c.closed = true
+		close(c.send)
+	}
+}
+
+// close stops the writer once the queued messages are sent.
+func (c *collabClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+	}
+}
+
+func (c *collabClient) writeLoop() {
+	for msg := range c.send {
+		c.conn.SetWriteDeadline(time.Now().Add(collabWriteTimeout))
+		if err := c.conn.WriteJSON(msg); err != nil {
+			break
+		}
+	}
+	c.conn.Close()
+}
+
+// collabSession is the shared state of one article being edited. Revision n
+// is the text after n operations; history holds the operations from
+// historyStart on, so operations made against older revisions can be
+// transformed.
+type collabSession struct {
+	articleID uint
+	mu        sync.Mutex
+	doc       []rune
+	revision  int
+	history   []textOp
+	// historyStart is the revision history[0] applies to
+	historyStart int
+	clients      map[*collabClient]bool
+	// persisted is the content last read from or written to the article;
+	// persistedRevision is the first revision that includes it
+	persisted         string
+	persistedRevision int
+	lastEditor        uint
+	// editors made the changes the last snapshot does not include, with
+	// their roles
+	editors map[uint]string
+	stop    chan struct{}
+}
+
+var (
+	collabSessions = map[uint]*collabSession{}
+	collabMu       sync.Mutex
+	collabClientID uint64
+)
+
+// joinCollab adds client to the session of article, starting the session if
+// it is the first editor.
+func joinCollab(article *Article, client *collabClient) *collabSession {
+	collabMu.Lock()
+	defer collabMu.Unlock()
+
+	session, ok := collabSessions[article.ID]
+	if !ok {
+		session = &collabSession{
+			articleID: article.ID,
+			doc:       []rune(article.Content),
+			clients:   map[*collabClient]bool{},
+			editors:   map[uint]string{},
+			persisted: article.Content,
+			stop:      make(chan struct{}),
+		}
+		collabSessions[article.ID] = session
+		go session.run(collabSnapshotInterval)
+	}
+	collabClientID++
+	client.peer.ClientID = collabClientID
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	peers := []collabPeer{}
+	for other := range session.clients {
+		peers = append(peers, *other.peer.clone())
+		other.queue(collabMessage{Type: "join", Peer: client.peer.clone()})
+	}
+	session.clients[client] = true
+
+	content := string(session.doc)
+	client.queue(collabMessage{
+		Type:     "init",
+		Revision: session.revision,
+		Content:  &content,
+		ClientID: client.peer.ClientID,
+		Peers:    peers,
+	})
+	return session
+}
+
+// leave removes client. The last editor to leave ends the session after a
+// final snapshot, taken under collabMu so a new session cannot load the
+// article before it is written.
+func (s *collabSession) leave(client *collabClient) {
+	collabMu.Lock()
+	defer collabMu.Unlock()
+
+	s.mu.Lock()
+	delete(s.clients, client)
+	for other := range s.clients {
+		other.queue(collabMessage{Type: "leave", ClientID: client.peer.ClientID})
+	}
+	empty := len(s.clients) == 0
+	s.mu.Unlock()
+	client.close()
+
+	if empty {
+		delete(collabSessions, s.articleID)
+		close(s.stop)
+		s.snapshot()
+	}
+}
+
+// receive applies an operation a client made against revision. It is
+// transformed across everything applied since, acknowledged to the sender
+// and sent on to the other editors.
+func (s *collabSession) receive(client *collabClient, revision int, op textOp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if revision < s.historyStart || revision > s.revision {
+		return errors.New("revision is out of date; reload the document")
+	}
+	for _, concurrent := range s.history[revision-s.historyStart:] {
+		var err error
+		if op, _, err = transformOps(op, concurrent); err != nil {
+			return err
+		}
+	}
+	if err := s.applyLocked(op, client.peer.ClientID, client.peer.UserID); err != nil {
+		return err
+	}
+	s.editors[client.peer.UserID] = client.role
+	client.queue(collabMessage{Type: "ack", Revision: s.revision})
+	return nil
+}
+
+// applyLocked applies op at the current revision and sends it to every
+// editor but the author, who is acknowledged by the caller. A zero clientID
+// marks changes made outside the session, which everyone receives.
+func (s *collabSession) applyLocked(op textOp, clientID uint64, userID uint) error {
+	doc, err := op.apply(s.doc)
+	if err != nil {
+		return err
+	}
+	if len(doc) > maxCollabTextLength {
+		return errors.New("the article is too long")
+	}
+	s.doc = doc
+	s.revision++
+	s.history = append(s.history, op)
+	if userID != 0 {
+		s.lastEditor = userID
+	}
+
+	// Operations the last snapshot does not include must stay for merging
+	if drop := len(s.history) - collabHistoryLimit; drop > 0 {
+		drop = min(drop, s.persistedRevision-s.historyStart)
+		if drop > 0 {
+			s.history = append([]textOp(nil), s.history[drop:]...)
+			s.historyStart += drop
+		}
+	}
+
+	for other := range s.clients {
+		if cursor := other.peer.Cursor; cursor != nil {
+			cursor.Position = transformIndex(op, cursor.Position)
+			cursor.End = transformIndex(op, cursor.End)
+		}
+		if other.peer.ClientID != clientID {
+			other.queue(collabMessage{Type: "op", Revision: s.revision, Op: op, ClientID: clientID, UserID: userID})
+		}
+	}
+	return nil
+}
+
+// moveCursor records a client's selection and shows it to the others.
+func (s *collabSession) moveCursor(client *collabClient, cursor collabCursor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	size := len(s.doc)
+	cursor.Position = max(0, min(cursor.Position, size))
+	cursor.End = max(0, min(cursor.End, size))
+	client.peer.Cursor = &cursor
+	for other := range s.clients {
+		if other != client {
+			moved := cursor
+			other.queue(collabMessage{Type: "cursor", ClientID: client.peer.ClientID, Cursor: &moved})
+		}
+	}
+}
+
+func (s *collabSession) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.snapshot()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// snapshot writes the text to the article when it changed since the last
+// snapshot. The article may have been edited through the API in the
+// meantime; that edit is merged into the session like one more operation.
+// A save that loses the race with such an edit is retried on the next tick.
+// Editors who may no longer edit the article are disconnected first, and
+// changes made by one of them, or refused by moderation, are discarded.
+func (s *collabSession) snapshot() {
+	var article Article
+	if err := db.Preload("Tags").First(&article, s.articleID).Error; err != nil {
+		logger.WithFields(logrus.Fields{
+			"article_id": s.articleID,
+			"error":      err.Error(),
+		}).Error("Failed to load article for a collaborative snapshot")
+		return
+	}
+
+	s.mu.Lock()
+	if article.Content != s.persisted {
+		external := diffOp(s.persisted, article.Content)
+		var err error
+		for _, concurrent := range s.history[s.persistedRevision-s.historyStart:] {
+			if external, _, err = transformOps(external, concurrent); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = s.applyLocked(external, 0, 0)
+		}
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"article_id": s.articleID,
+				"error":      err.Error(),
+			}).Error("Failed to merge an article edit into the collaborative session")
+		}
+		s.persisted = article.Content
+		s.persistedRevision = s.revision
+	}
+	content, revision, editor := string(s.doc), s.revision, s.lastEditor
+	editors := make(map[uint]string, len(s.editors))
+	for userID, role := range s.editors {
+		editors[userID] = role
+	}
+	clients := make([]*collabClient, 0, len(s.clients))
+	for client := range s.clients {
+		clients = append(clients, client)
+	}
+	s.mu.Unlock()
+
+	for _, client := range clients {
+		if !mayCollaborate(client.peer.UserID, client.role, &article) {
+			client.queue(collabMessage{Type: "error", Error: "You can no longer edit this article"})
+			client.close()
+		}
+	}
+	if content == article.Content {
+		return
+	}
+
+	moderated := false
+	for userID, role := range editors {
+		if !mayCollaborate(userID, role, &article) {
+			s.discard(article.Content, "Changes by an editor who can no longer edit this article were discarded")
+			return
+		}
+		moderated = moderated || role != "admin"
+	}
+	var moderation moderationResult
+	if moderated {
+		moderation = moderate(moderationSubject{Kind: ReportArticle, ID: article.ID, UserID: editor, Title: article.Title, Text: content})
+		if moderation.Verdict == moderationReject {
+			s.discard(article.Content, "The changes were rejected by moderation and discarded")
+			return
+		}
+	}
+	holdFlaggedEdit(&article, moderation)
+
+	loadedAt := article.UpdatedAt
+	article.Content = content
+	if err := saveArticle(&article, loadedAt, editor, "Collaborative edit"); err != nil {
+		if !errors.Is(err, errArticleConflict) {
+			logger.WithFields(logrus.Fields{
+				"article_id": s.articleID,
+				"error":      err.Error(),
+			}).Error("Failed to save a collaborative snapshot")
+		}
+		return
+	}
+	if moderation.Verdict == moderationReview {
+		flagForReview(ReportArticle, article.ID, moderation)
+	}
+
+	s.mu.Lock()
+	s.persisted = content
+	s.persistedRevision = revision
+	if s.revision == revision {
+		s.editors = map[uint]string{}
+	}
+	for client := range s.clients {
+		client.queue(collabMessage{Type: "saved", Revision: revision, UpdatedAt: &article.UpdatedAt})
+	}
+	s.mu.Unlock()
+}
+
+// discard takes the text back to content, the article as stored, for every
+// editor and tells them why.
+func (s *collabSession) discard(content, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.applyLocked(diffOp(string(s.doc), content), 0, 0); err != nil {
+		logger.WithFields(logrus.Fields{
+			"article_id": s.articleID,
+			"error":      err.Error(),
+		}).Error("Failed to discard collaborative changes")
+		return
+	}
+	s.persisted = content
+	s.persistedRevision = s.revision
+	s.editors = map[uint]string{}
+	for client := range s.clients {
+		client.queue(collabMessage{Type: "error", Error: reason})
+	}
+}
+
+// mayCollaborate reports whether a user may still edit article in a session:
+// the article is a draft or in review, the user is not banned and is still
+// its author, a co-author or an admin.
+func mayCollaborate(userID uint, role string, article *Article) bool {
+	if article.Status != ArticleDraft && article.Status != ArticleInReview {
+		return false
+	}
+	return !isBanned(userID) && canCollaborate(userID, role, article)
+}
+
+// canCollaborate reports whether a user may edit article together with its
+// author.
+func canCollaborate(userID uint, role string, article *Article) bool {
+	if role == "admin" || article.UserID == userID {
+		return true
+	}
+	var count int64
+	db.Model(&ArticleCollaborator{}).Where("article_id = ? AND user_id = ?", article.ID, userID).Count(&count)
+	return count > 0
+}
+
+// collabHandler opens the collaborative editing channel of a draft. Browsers
+// cannot set headers on a WebSocket, so the token may come as ?token=.
+func collabHandler(w http.ResponseWriter, r *http.Request) {
+	claims := optionalClaims(r)
+	if claims == nil {
+		claims = parseClaims(r.URL.Query().Get("token"))
+	}
+	if claims == nil {
+		http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	if isBanned(claims.UserID) {
+		http.Error(w, `{"error": "Your account has been banned"}`, http.StatusForbidden)
+		return
+	}
+
+	article, ok := loadArticle(w, r)
+	if !ok {
+		return
+	}
+	if !canCollaborate(claims.UserID, claims.Role, article) {
+		http.Error(w, `{"error": "You are not a co-author of this article"}`, http.StatusForbidden)
+		return
+	}
+	if article.Status != ArticleDraft && article.Status != ArticleInReview {
+		http.Error(w, `{"error": "Only drafts can be edited together"}`, http.StatusConflict)
+		return
+	}
+	var user User
+	if err := db.First(&user, claims.UserID).Error; err != nil {
+		http.Error(w, `{"error": "User not found"}`, http.StatusBadRequest)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Collaborative editing upgrade failed")
+		return
+	}
+	conn.SetReadLimit(maxCollabMessageBytes)
+
+	client := &collabClient{
+		peer: collabPeer{UserID: user.ID, Name: user.Name},
+		role: claims.Role,
+		conn: conn,
+		send: make(chan collabMessage, collabSendBuffer),
+	}
+	go client.writeLoop()
+	session := joinCollab(article, client)
+	defer session.leave(client)
+
+	logger.WithFields(logrus.Fields{
+		"article_id": article.ID,
+		"user_id":    user.ID,
+	}).Info("Collaborative editor joined")
+
+	for {
+		var msg collabMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		switch msg.Type {
+		case "op":
+			if err := session.receive(client, msg.Revision, msg.Op); err != nil {
+				// The client cannot recover from a rejected operation
+				client.queue(collabMessage{Type: "error", Error: err.Error()})
+				client.close()
+				return
+			}
+			if msg.Cursor != nil {
+				session.moveCursor(client, *msg.Cursor)
+			}
+		case "cursor":
+			if msg.Cursor != nil {
+				session.moveCursor(client, *msg.Cursor)
+			}
+		}
+	}
+}
+
+// getCollaboratorsHandler lists the co-authors of an article.
+func getCollaboratorsHandler(w http.ResponseWriter, r *http.Request) {
+	article, ok := loadArticle(w, r)
+	if !ok {
+		return
+	}
+	userID, _ := r.Context().Value("user_id").(uint)
+	role, _ := r.Context().Value("role").(string)
+	if !canCollaborate(userID, role, article) {
+		http.Error(w, `{"error": "You are not a co-author of this article"}`, http.StatusForbidden)
+		return
+	}
+
+	var collaborators []ArticleCollaborator
+	if err := db.Preload("User").Where("article_id = ?", article.ID).Order("created_at").Find(&collaborators).Error; err != nil {
+		http.Error(w, `{"error": "Error fetching collaborators"}`, http.StatusInternalServerError)
+		return
+	}
+	for i := range collaborators {
+		collaborators[i].Name = collaborators[i].User.Name
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(collaborators)
+}
+
+// addCollaboratorHandler lets the author invite a co-author by email.
+func addCollaboratorHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || strings.TrimSpace(request.Email) == "" {
+		http.Error(w, `{"error": "email is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	article, ok := loadArticle(w, r)
+	if !ok {
+		return
+	}
+	if !canEditArticle(r, article) {
+		http.Error(w, `{"error": "Only the author can add co-authors"}`, http.StatusForbidden)
+		return
+	}
+
+	var user User
+	if err := db.Where("LOWER(email) = LOWER(?)", strings.TrimSpace(request.Email)).First(&user).Error; err != nil {
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return
+	}
+	if user.ID == article.UserID {
+		http.Error(w, `{"error": "The author is already editing this article"}`, http.StatusBadRequest)
+		return
+	}
+
+	collaborator := ArticleCollaborator{ArticleID: article.ID, UserID: user.ID}
+	err := db.Where(collaborator).FirstOrCreate(&collaborator).Error
+	if err != nil {
+		http.Error(w, `{"error": "Error adding collaborator"}`, http.StatusInternalServerError)
+		return
+	}
+	collaborator.Name = user.Name
+
+	logger.WithFields(logrus.Fields{
+		"article_id": article.ID,
+		"user_id":    user.ID,
+	}).Info("Collaborator added")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(collaborator)
+}
+
+// removeCollaboratorHandler removes a co-author. Co-authors may also remove
+// themselves.
+func removeCollaboratorHandler(w http.ResponseWriter, r *http.Request) {
+	article, ok := loadArticle(w, r)
+	if !ok {
+		return
+	}
+	collaboratorID, err := strconv.ParseUint(mux.Vars(r)["user_id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error": "Invalid user ID"}`, http.StatusBadRequest)
+		return
+	}
+	userID, _ := r.Context().Value("user_id").(uint)
+	if !canEditArticle(r, article) && uint(collaboratorID) != userID {
+		http.Error(w, `{"error": "Only the author can remove co-authors"}`, http.StatusForbidden)
+		return
+	}
+
+	res := db.Where("article_id = ? AND user_id = ?", article.ID, collaboratorID).Delete(&ArticleCollaborator{})
+	if res.Error != nil {
+		http.Error(w, `{"error": "Error removing collaborator"}`, http.StatusInternalServerError)
+		return
+	}
+	if res.RowsAffected == 0 {
+		http.Error(w, `{"error": "Collaborator not found"}`, http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Comment moderation states.
+const (
+	CommentPending  = "pending"
+	CommentApproved = "approved"
+	CommentHidden   = "hidden"
+)
+
+const (
+	maxCommentLength = 5000
+	// Comments from accounts younger than this wait in the moderation queue.
+	newAccountAge = 72 * time.Hour
+)
+
+// Comment is a reader comment on an article. Replies point at a top-level
+// comment through ParentID; deeper nesting is flattened to one level.
+type Comment struct {
+	ID         uint   `json:"id" gorm:"primaryKey"`
+	ArticleID  uint   `json:"article_id" gorm:"index"`
+	UserID     uint   `json:"user_id" gorm:"index"`
+	User       User   `json:"-" gorm:"foreignKey:UserID"`
+	AuthorName string `json:"author_name" gorm:"-"`
+	// Imported comments by readers without an account keep their name here
+	GuestName string    `json:"-"`
+	ParentID  *uint     `json:"parent_id" gorm:"index"`
+	Content   string    `json:"content"`
+	Status    string    `json:"status" gorm:"index"`
+	Replies   []Comment `json:"replies,omitempty" gorm:"-"`
+	// Hash of the normalized content, for the duplicate moderation check
+	Fingerprint string    `json:"-" gorm:"index"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// needsModeration reports whether comments by user should wait for an admin.
+func needsModeration(user User, now time.Time) bool {
+	if !user.EmailVerified {
+		return true
+	}
+	return !user.CreatedAt.IsZero() && now.Sub(user.CreatedAt) < newAccountAge
+}
+
+// authorName is the name shown for the comment: the guest name of an
+// imported comment, otherwise the name of the commenter's account.
+func (c Comment) authorName() string {
+	if c.GuestName != "" {
+		return c.GuestName
+	}
+	return c.User.Name
+}
+
+// threadComments nests replies under their top-level comment, keeping the
+// order of the input.
+func threadComments(comments []Comment) []Comment {
+	index := map[uint]int{}
+	threads := []Comment{}
+	for _, c := range comments {
+		c.AuthorName = c.authorName()
+		if c.ParentID == nil {
+			index[c.ID] = len(threads)
+			threads = append(threads, c)
+		}
+	}
+	for _, c := range comments {
+		if c.ParentID == nil {
+			continue
+		}
+		c.AuthorName = c.authorName()
+		if i, ok := index[*c.ParentID]; ok {
+			threads[i].Replies = append(threads[i].Replies, c)
+		}
+	}
+	return threads
+}
+
+// getArticleCommentsHandler lists the approved comments of an article as
+// threads. Logged-in users also see their own comments awaiting moderation.
+func getArticleCommentsHandler(w http.ResponseWriter, r *http.Request) {
+	article, ok := loadArticle(w, r)
+	if !ok {
+		return
+	}
+	if !articleVisible(r, article) {
+		http.Error(w, `{"error": "Article not found"}`, http.StatusNotFound)
+		return
+	}
+
+	query := db.Preload("User").Where("article_id = ?", article.ID)
+	if claims := optionalClaims(r); claims != nil {
+		query = query.Where("status = ? OR (user_id = ? AND status = ?)", CommentApproved, claims.UserID, CommentPending)
+	} else {
+		query = query.Where("status = ?", CommentApproved)
+	}
+
+	var comments []Comment
+	if err := query.Order("created_at ASC, id ASC").Find(&comments).Error; err != nil {
+		logger.WithFields(logrus.Fields{
+			"article_id": article.ID,
+			"error":      err.Error(),
+		}).Error("Failed to fetch comments")
+		http.Error(w, `{"error": "Error fetching comments"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(threadComments(comments))
+}
+
+// createCommentHandler adds a comment or a reply to a published article.
+func createCommentHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(uint)
+
+	var request struct {
+		Content  string `json:"content"`
+		ParentID *uint  `json:"parent_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	request.Content = strings.TrimSpace(request.Content)
+	if request.Content == "" || len(request.Content) > maxCommentLength {
+		http.Error(w, `{"error": "Comment must be between 1 and 5000 characters"}`, http.StatusBadRequest)
+		return
+	}
+
+	article, ok := loadArticle(w, r)
+	if !ok {
+		return
+	}
+	if article.Status != ArticlePublished {
+		http.Error(w, `{"error": "Comments are only open on published articles"}`, http.StatusConflict)
+		return
+	}
+
+	var user User
+	if err := db.First(&user, userID).Error; err != nil {
+		http.Error(w, `{"error": "User not found"}`, http.StatusBadRequest)
+		return
+	}
+
+	moderation, ok := moderateSubmission(w, r, moderationSubject{Kind: ReportComment, UserID: user.ID, Text: request.Content})
+	if !ok {
+		return
+	}
+
+	comment := Comment{
+		ArticleID:   article.ID,
+		UserID:      user.ID,
+		User:        user,
+		Content:     request.Content,
+		Status:      CommentApproved,
+		Fingerprint: contentFingerprint(request.Content),
+	}
+	if needsModeration(user, time.Now()) || moderation.Verdict == moderationReview {
+		comment.Status = CommentPending
+	}
+
+	if request.ParentID != nil {
+		var parent Comment
+		if err := db.Where("id = ? AND article_id = ?", *request.ParentID, article.ID).First(&parent).Error; err != nil {
+			http.Error(w, `{"error": "Parent comment not found"}`, http.StatusBadRequest)
+			return
+		}
+		// Replies to replies join the same thread
+		if parent.ParentID != nil {
+			comment.ParentID = parent.ParentID
+		} else {
+			comment.ParentID = &parent.ID
+		}
+	}
+
+	if err := db.Omit("User").Create(&comment).Error; err != nil {
+		logger.WithFields(logrus.Fields{
+			"article_id": article.ID,
+			"error":      err.Error(),
+		}).Error("Failed to create comment")
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if moderation.Verdict == moderationReview {
+		flagForReview(ReportComment, comment.ID, moderation)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"comment_id": comment.ID,
+		"article_id": article.ID,
+		"status":     comment.Status,
+	}).Info("Comment created")
+
+	if comment.Status == CommentApproved {
+		notifyArticleAuthor(article, comment, user)
+	}
+
+	comment.AuthorName = user.Name
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(comment)
+}
+
+// updateCommentHandler lets the author of a comment change its text.
+func updateCommentHandler(w http.ResponseWriter, r *http.Request) {
+	comment, ok := loadComment(w, r)
+	if !ok {
+		return
+	}
+	userID, _ := r.Context().Value("user_id").(uint)
+	if comment.UserID != userID {
+		http.Error(w, `{"error": "Forbidden: you can only edit your own comments"}`, http.StatusForbidden)
+		return
+	}
+
+	var request struct {
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	request.Content = strings.TrimSpace(request.Content)
+	if request.Content == "" || len(request.Content) > maxCommentLength {
+		http.Error(w, `{"error": "Comment must be between 1 and 5000 characters"}`, http.StatusBadRequest)
+		return
+	}
+
+	moderation, ok := moderateSubmission(w, r, moderationSubject{Kind: ReportComment, ID: comment.ID, UserID: userID, Text: request.Content})
+	if !ok {
+		return
+	}
+
+	comment.Content = request.Content
+	comment.Fingerprint = contentFingerprint(request.Content)
+	// Flagged edits go back to the moderation queue
+	if moderation.Verdict == moderationReview && comment.Status == CommentApproved {
+		comment.Status = CommentPending
+	}
+	if err := db.Model(comment).Select("content", "fingerprint", "status", "updated_at").Updates(comment).Error; err != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if moderation.Verdict == moderationReview {
+		flagForReview(ReportComment, comment.ID, moderation)
+	}
+
+	comment.AuthorName = comment.authorName()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(comment)
+}
+
+// deleteCommentHandler removes a comment and its replies. Authors can delete
+// their own comments, admins any comment.
+func deleteCommentHandler(w http.ResponseWriter, r *http.Request) {
+	comment, ok := loadComment(w, r)
+	if !ok {
+		return
+	}
+	userID, _ := r.Context().Value("user_id").(uint)
+	role, _ := r.Context().Value("role").(string)
+	if comment.UserID != userID && role != "admin" {
+		http.Error(w, `{"error": "Forbidden: you can only delete your own comments"}`, http.StatusForbidden)
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("target_type = ? AND target_id IN (SELECT id FROM comments WHERE id = ? OR parent_id = ?)", ReportComment, comment.ID, comment.ID).
+			Delete(&Report{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ? OR parent_id = ?", comment.ID, comment.ID).Delete(&Comment{}).Error
+	})
+	if err != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"comment_id": comment.ID,
+		"user_id":    userID,
+	}).Info("Comment deleted")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Comment deleted successfully"})
+}
+
+// getModerationQueueHandler lists comments by status for admins, pending by
+// default.
+func getModerationQueueHandler(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = CommentPending
+	}
+
+	var comments []Comment
+	if err := db.Preload("User").Where("status = ?", status).Order("created_at ASC").Find(&comments).Error; err != nil {
+		http.Error(w, `{"error": "Error fetching comments"}`, http.StatusInternalServerError)
+		return
+	}
+	for i := range comments {
+		comments[i].AuthorName = comments[i].authorName()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(comments)
+}
+
+// approveCommentHandler publishes a pending or hidden comment.
+func approveCommentHandler(w http.ResponseWriter, r *http.Request) {
+	moderateComment(w, r, CommentApproved)
+}
+
+// hideCommentHandler takes a comment out of public view without deleting it.
+func hideCommentHandler(w http.ResponseWriter, r *http.Request) {
+	moderateComment(w, r, CommentHidden)
+}
+
+func moderateComment(w http.ResponseWriter, r *http.Request, status string) {
+	comment, ok := loadComment(w, r)
+	if !ok {
+		return
+	}
+	previous := comment.Status
+
+	if err := db.Model(comment).Update("status", status).Error; err != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"comment_id": comment.ID,
+		"status":     status,
+	}).Info("Comment moderated")
+
+	// Deciding on the comment also settles the reports about it
+	resolution, reportStatus := "approve", ReportDismissed
+	if status == CommentHidden {
+		resolution, reportStatus = "hide", ReportActioned
+	}
+	adminID, _ := r.Context().Value("user_id").(uint)
+	if _, err := closeReports(ReportComment, comment.ID, reportStatus, resolution, adminID); err != nil {
+		logger.WithFields(logrus.Fields{
+			"comment_id": comment.ID,
+			"error":      err.Error(),
+		}).Error("Failed to close reports")
+	}
+
+	if previous == CommentPending && status == CommentApproved {
+		var article Article
+		if err := db.Preload("User").First(&article, comment.ArticleID).Error; err == nil {
+			notifyArticleAuthor(&article, *comment, comment.User)
+		}
+	}
+
+	comment.AuthorName = comment.authorName()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(comment)
+}
+
+func loadComment(w http.ResponseWriter, r *http.Request) (*Comment, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error": "Invalid comment ID"}`, http.StatusBadRequest)
+		return nil, false
+	}
+
+	var comment Comment
+	if err := db.Preload("User").First(&comment, uint(id)).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, `{"error": "Comment not found"}`, http.StatusNotFound)
+		} else {
+			http.Error(w, `{"error": "Error fetching comment"}`, http.StatusInternalServerError)
+		}
+		return nil, false
+	}
+	return &comment, true
+}
+
+// notifyArticleAuthor emails the author of article about a new visible
+// comment, unless they wrote it themselves.
+func notifyArticleAuthor(article *Article, comment Comment, commenter User) {
+	if article.UserID == commenter.ID || article.User.Email == "" {
+		return
+	}
+	go func() {
+		if err := sendCommentNotificationEmail(article.User, *article, commenter.Name, comment.Content); err != nil {
+			logger.WithFields(logrus.Fields{
+				"article_id": article.ID,
+				"comment_id": comment.ID,
+				"error":      err.Error(),
+			}).Error("Failed to send comment notification")
+		}
+	}()
+}
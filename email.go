@@ -9,10 +9,20 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"gopkg.in/gomail.v2"
 )
 
+// deliverMail sends m through the SMTP server. It is a variable so tests can
+// capture mail instead.
+var deliverMail = func(m *gomail.Message) error {
+	d := gomail.NewDialer(SMTPServer, SMTPPort, EmailSender, EmailPassword)
+	d.TLSConfig = &tls.Config{InsecureSkipVerify: true} // Bypass TLS verification if needed
+	return d.DialAndSend(m)
+}
+
 func GenerateVerificationCode() string {
 	b := make([]byte, 6)
 	rand.Read(b)
@@ -179,3 +189,73 @@ func sendReceiptEmail(customerID uint, receiptPath string) error {
 
 	return err
 }
+
+func sendCommentNotificationEmail(author User, article Article, commenterName, content string) error {
+	m := gomail.NewMessage()
+	m.SetHeader("From", EmailSender)
+	m.SetHeader("To", author.Email)
+	m.SetHeader("Subject", fmt.Sprintf("New comment on \"%s\"", article.Title))
+	m.SetBody("text/plain", fmt.Sprintf("Dear %s,\n\n%s commented on your article \"%s\":\n\n%s\n\nBest regards,\nSelf Blog.kz", author.Name, commenterName, article.Title, content))
+
+	d := gomail.NewDialer(SMTPServer, SMTPPort, EmailSender, EmailPassword)
+	d.TLSConfig = &tls.Config{InsecureSkipVerify: true} // Bypass TLS verification if needed
+	return d.DialAndSend(m)
+}
+
+func sendInvitationEmail(user User) error {
+	link := fmt.Sprintf("%s/invitation.html?email=%s&code=%s", siteURL, url.QueryEscape(user.Email), url.QueryEscape(user.VerificationCode))
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", EmailSender)
+	m.SetHeader("To", user.Email)
+	m.SetHeader("Subject", "Your account on Self Blog.kz")
+	m.SetBody("text/plain", fmt.Sprintf("Dear %s,\n\nYour posts have been moved to Self Blog.kz. Choose a password to sign in:\n\n%s\n\nBest regards,\nSelf Blog.kz", user.Name, link))
+
+	d := gomail.NewDialer(SMTPServer, SMTPPort, EmailSender, EmailPassword)
+	d.TLSConfig = &tls.Config{InsecureSkipVerify: true} // Bypass TLS verification if needed
+	return d.DialAndSend(m)
+}
+
+func sendSubscriptionConfirmEmail(sub Subscriber) error {
+	m := gomail.NewMessage()
+	m.SetHeader("From", EmailSender)
+	m.SetHeader("To", sub.Email)
+	m.SetHeader("Subject", "Confirm your subscription to "+siteName)
+	m.SetHeader("List-Unsubscribe", "<"+unsubscribeURL(sub)+">")
+	m.SetHeader("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	m.SetBody("text/plain", fmt.Sprintf("Hello,\n\nPlease confirm that you want a %s digest of new articles on %s:\n\n%s\n\nIf you did not ask for this, ignore this email or unsubscribe:\n%s\n\nBest regards,\n%s",
+		sub.Frequency, siteName, confirmSubscriptionURL(sub), unsubscribeURL(sub), siteName))
+	return deliverMail(m)
+}
+
+// sendDigestEmail mails a subscriber the articles published since their last
+// digest, newest first.
+func sendDigestEmail(sub Subscriber, articles []Article) error {
+	var body strings.Builder
+	fmt.Fprintf(&body, "Hello,\n\nNew on %s:\n", siteName)
+	for i, article := range articles {
+		if i == digestArticleLimit {
+			fmt.Fprintf(&body, "\n...and %d more at %s/\n", len(articles)-i, siteURL)
+			break
+		}
+		fmt.Fprintf(&body, "\n%s\nby %s\n%s\n", article.Title, article.User.Name, articleURL(article))
+		if summary := articleExcerpt(article, 200); summary != "" {
+			fmt.Fprintf(&body, "%s\n", summary)
+		}
+	}
+	fmt.Fprintf(&body, "\nYou receive this %s digest because you subscribed on %s.\nUnsubscribe: %s\n", sub.Frequency, siteURL, unsubscribeURL(sub))
+
+	subject := fmt.Sprintf("%d new articles on %s", len(articles), siteName)
+	if len(articles) == 1 {
+		subject = fmt.Sprintf("New on %s: %s", siteName, articles[0].Title)
+	}
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", EmailSender)
+	m.SetHeader("To", sub.Email)
+	m.SetHeader("Subject", subject)
+	m.SetHeader("List-Unsubscribe", "<"+unsubscribeURL(sub)+">")
+	m.SetHeader("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	m.SetBody("text/plain", body.String())
+	return deliverMail(m)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ArticleLike records that a user liked an article; one row per pair.
+type ArticleLike struct {
+	ArticleID uint      `json:"article_id" gorm:"primaryKey;autoIncrement:false"`
+	UserID    uint      `json:"user_id" gorm:"primaryKey;autoIncrement:false;index"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const (
+	// A visitor reading the same article again within this window is not
+	// counted twice.
+	viewDedupWindow = 30 * time.Minute
+	// Buffered view counts are written to the database this often.
+	viewFlushInterval = 30 * time.Second
+)
+
+// viewCounter deduplicates article views in memory and buffers the counts, so
+// a page view does not have to lock the article row.
+type viewCounter struct {
+	mu      sync.Mutex
+	window  time.Duration
+	seen    map[string]time.Time // "articleID:visitor" -> when the view was counted
+	pending map[uint]int64       // articleID -> views not yet flushed
+}
+
+var articleViews = newViewCounter(viewDedupWindow)
+
+func newViewCounter(window time.Duration) *viewCounter {
+	return &viewCounter{
+		window:  window,
+		seen:    make(map[string]time.Time),
+		pending: make(map[uint]int64),
+	}
+}
+
+// record counts a view of articleID by visitor unless the same visitor was
+// counted within the window. It reports whether the view was counted.
+func (vc *viewCounter) record(articleID uint, visitor string, now time.Time) bool {
+	key := fmt.Sprintf("%d:%s", articleID, visitor)
+
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	if last, ok := vc.seen[key]; ok && now.Sub(last) < vc.window {
+		return false
+	}
+	vc.seen[key] = now
+	vc.pending[articleID]++
+	return true
+}
+
+// unflushed returns the views of articleID that are not in the database yet.
+func (vc *viewCounter) unflushed(articleID uint) int64 {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	return vc.pending[articleID]
+}
+
+// drain hands over the buffered counts and forgets visitors outside the
+// window.
+func (vc *viewCounter) drain(now time.Time) map[uint]int64 {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	for key, last := range vc.seen {
+		if now.Sub(last) >= vc.window {
+			delete(vc.seen, key)
+		}
+	}
+	pending := vc.pending
+	vc.pending = make(map[uint]int64)
+	return pending
+}
+
+// restore puts back views that could not be written, so the next flush
+// retries them.
+func (vc *viewCounter) restore(articleID uint, count int64) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	vc.pending[articleID] += count
+}
+
+// flushViews adds the buffered view counts to articles.view_count. Counts
+// that fail to write stay buffered for the next flush.
+func flushViews(now time.Time) {
+	for articleID, count := range articleViews.drain(now) {
+		err := db.Model(&Article{}).Where("id = ?", articleID).
+			UpdateColumn("view_count", gorm.Expr("view_count + ?", count)).Error
+		if err != nil {
+			articleViews.restore(articleID, count)
+			logger.WithFields(logrus.Fields{
+				"article_id": articleID,
+				"views":      count,
+				"error":      err.Error(),
+			}).Error("Failed to flush article views")
+		}
+	}
+}
+
+// runViewFlusher periodically writes buffered views to the database.
+func runViewFlusher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		flushViews(now)
+	}
+}
+
+// visitorKey identifies the reader for view deduplication: the user ID when
+// logged in, otherwise a hash of the client address and user agent, so no
+// cookie or raw IP has to be kept.
+func visitorKey(r *http.Request) string {
+	if claims := optionalClaims(r); claims != nil {
+		return fmt.Sprintf("u:%d", claims.UserID)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	sum := sha256.Sum256([]byte(host + "|" + r.UserAgent()))
+	return "a:" + hex.EncodeToString(sum[:12])
+}
+
+// recordArticleView counts a view of a published article.
+func recordArticleView(r *http.Request, article *Article) {
+	if article.Status == ArticlePublished {
+		articleViews.record(article.ID, visitorKey(r), time.Now())
+	}
+}
+
+// decorateArticles fills in the per-request fields of article payloads: like
+// counts, views still buffered in memory, and whether the caller liked or
+// bookmarked each article.
+func decorateArticles(r *http.Request, articles []Article) error {
+	if len(articles) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(articles))
+	for i := range articles {
+		ids[i] = articles[i].ID
+	}
+
+	var counts []struct {
+		ArticleID uint
+		Count     int64
+	}
+	if err := db.Model(&ArticleLike{}).Select("article_id, COUNT(*) AS count").
+		Where("article_id IN ?", ids).Group("article_id").Scan(&counts).Error; err != nil {
+		return err
+	}
+	likes := make(map[uint]int64, len(counts))
+	for _, c := range counts {
+		likes[c.ArticleID] = c.Count
+	}
+
+	liked := map[uint]bool{}
+	bookmarked := map[uint]bool{}
+	if claims := optionalClaims(r); claims != nil {
+		var mine []uint
+		if err := db.Model(&ArticleLike{}).Where("user_id = ? AND article_id IN ?", claims.UserID, ids).
+			Pluck("article_id", &mine).Error; err != nil {
+			return err
+		}
+		for _, id := range mine {
+			liked[id] = true
+		}
+
+		var saved []uint
+		if err := db.Model(&Bookmark{}).Where("user_id = ? AND article_id IN ?", claims.UserID, ids).
+			Pluck("article_id", &saved).Error; err != nil {
+			return err
+		}
+		for _, id := range saved {
+			bookmarked[id] = true
+		}
+	}
+
+	for i := range articles {
+		articles[i].LikeCount = likes[articles[i].ID]
+		articles[i].Liked = liked[articles[i].ID]
+		articles[i].Bookmarked = bookmarked[articles[i].ID]
+		articles[i].ViewCount += articleViews.unflushed(articles[i].ID)
+	}
+	return nil
+}
+
+// likeArticleHandler likes a published article; liking twice is a no-op.
+func likeArticleHandler(w http.ResponseWriter, r *http.Request) {
+	article, ok := loadArticle(w, r)
+	if !ok {
+		return
+	}
+	if article.Status != ArticlePublished {
+		http.Error(w, `{"error": "Article not found"}`, http.StatusNotFound)
+		return
+	}
+	userID, _ := r.Context().Value("user_id").(uint)
+
+	like := ArticleLike{ArticleID: article.ID, UserID: userID}
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&like).Error; err != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	writeLikeState(w, article.ID, true)
+}
+
+// unlikeArticleHandler removes the caller's like.
+func unlikeArticleHandler(w http.ResponseWriter, r *http.Request) {
+	article, ok := loadArticle(w, r)
+	if !ok {
+		return
+	}
+	userID, _ := r.Context().Value("user_id").(uint)
+
+	if err := db.Where("article_id = ? AND user_id = ?", article.ID, userID).Delete(&ArticleLike{}).Error; err != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	writeLikeState(w, article.ID, false)
+}
+
+func writeLikeState(w http.ResponseWriter, articleID uint, liked bool) {
+	var count int64
+	db.Model(&ArticleLike{}).Where("article_id = ?", articleID).Count(&count)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"article_id": articleID,
+		"liked":      liked,
+		"like_count": count,
+	})
+}
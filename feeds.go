@@ -0,0 +1,499 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/sirupsen/logrus"
+)
+
+// Public address of the site, used for absolute links in feeds.
+var siteURL = strings.TrimRight(getenvDefault("SITE_URL", "http://localhost:8080"), "/")
+
+var siteName = getenvDefault("SITE_NAME", "BlogAP")
+
+// Number of articles in each feed, FEED_ITEM_LIMIT.
+var feedItemLimit = getenvInt("FEED_ITEM_LIMIT", 20)
+
+const feedExcerptLength = 300
+
+var plainTextPolicy = bluemonday.StrictPolicy()
+
+func getenvDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func getenvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// articleURL is the public page of an article.
+func articleURL(article Article) string {
+	return siteURL + pageLinks{}.Article(article.Slug)
+}
+
+// articleFeedID identifies an article in feeds. It does not change when the
+// slug or the page URL does, so readers do not show renamed articles twice.
+func articleFeedID(article Article) string {
+	return fmt.Sprintf("%s/articles/%d", siteURL, article.ID)
+}
+
+// articleExcerpt turns the rendered article into plain text and cuts it at a
+// word boundary after at most limit characters.
+func articleExcerpt(article Article, limit int) string {
+	text := html.UnescapeString(plainTextPolicy.Sanitize(article.ContentHTML))
+	text = strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(text) <= limit {
+		return text
+	}
+	runes := []rune(text)[:limit]
+	if cut := strings.LastIndex(string(runes), " "); cut > 0 {
+		return string(runes)[:cut] + "…"
+	}
+	return string(runes) + "…"
+}
+
+// notModified sets the validators on w and reports whether the client's copy
+// is current, in which case a 304 has been written.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, lastModified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etagMatches(inm, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+		return false
+	}
+	if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !lastModified.IsZero() &&
+		!lastModified.Truncate(time.Second).After(ims) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// feed is the format-independent content of a site or author feed.
+type feed struct {
+	Title       string
+	Description string
+	HomeURL     string
+	SelfURL     string
+	Author      *User
+	Language    string // "" for each article's original language
+	Articles    []Article
+	Updated     time.Time
+}
+
+// etag changes whenever an article enters, leaves or changes in the feed,
+// including its translations.
+func (f feed) etag(format string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%s|%s|%d", format, f.Title, f.Language, feedItemLimit)
+	for _, article := range f.Articles {
+		fmt.Fprintf(h, "|%d-%d", article.ID, article.UpdatedAt.UnixMicro())
+		for _, t := range article.Translations {
+			fmt.Fprintf(h, ",%s-%d", t.Language, t.updated.UnixMicro())
+		}
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// loadFeed collects the newest published articles for the site, or for one
+// author when the route has an {id}. ?lang= shows them in that language
+// where a translation exists. It writes an error response and returns false
+// on failure.
+func loadFeed(w http.ResponseWriter, r *http.Request) (*feed, bool) {
+	language := ""
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		language = normalizeLanguage(lang)
+		if language == "" {
+			http.Error(w, `{"error": "Unsupported language"}`, http.StatusBadRequest)
+			return nil, false
+		}
+	}
+
+	var author *User
+	if id, ok := mux.Vars(r)["id"]; ok {
+		author = &User{}
+		if err := db.First(author, id).Error; err != nil {
+			http.Error(w, `{"error": "Author not found"}`, http.StatusNotFound)
+			return nil, false
+		}
+	}
+
+	f, err := buildFeed(r.URL.Path, author, language)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"path":  r.URL.Path,
+			"error": err.Error(),
+		}).Error("Failed to fetch feed articles")
+		http.Error(w, "Error fetching articles", http.StatusInternalServerError)
+		return nil, false
+	}
+	return f, true
+}
+
+// buildFeed collects the newest published articles of the site, or of
+// author when not nil, in language ("" for their own). selfPath is where the
+// feed is served.
+func buildFeed(selfPath string, author *User, language string) (*feed, error) {
+	f := &feed{
+		Title:       siteName,
+		Description: "Latest articles on " + siteName,
+		HomeURL:     siteURL + "/",
+		SelfURL:     siteURL + selfPath,
+		Language:    language,
+	}
+	if language != "" {
+		f.SelfURL += "?lang=" + language
+	}
+
+	query := db.Preload("User").Preload("Category").Preload("Tags").Where("status = ?", ArticlePublished)
+	if author != nil {
+		f.Author = author
+		f.Title = siteName + " — " + author.Name
+		f.Description = "Latest articles by " + author.Name + " on " + siteName
+		query = query.Where("user_id = ?", author.ID)
+	}
+
+	if err := query.Order("published_at DESC NULLS LAST, id DESC").Limit(feedItemLimit).Find(&f.Articles).Error; err != nil {
+		return nil, err
+	}
+	if err := localizeArticles(f.Articles, f.Language); err != nil {
+		return nil, err
+	}
+
+	for _, article := range f.Articles {
+		if article.UpdatedAt.After(f.Updated) {
+			f.Updated = article.UpdatedAt
+		}
+		for _, t := range article.Translations {
+			if t.updated.After(f.Updated) {
+				f.Updated = t.updated
+			}
+		}
+	}
+	return f, nil
+}
+
+// articleAlternates links to the other language versions of an article.
+func articleAlternates(article Article) []atomLink {
+	var links []atomLink
+	for _, t := range article.Translations {
+		if t.Language != articleLanguage(article) {
+			links = append(links, atomLink{Href: siteURL + pageLinks{}.Article(t.Slug), Rel: "alternate", Type: "text/html", Hreflang: t.Language})
+		}
+	}
+	return links
+}
+
+func feedPublished(article Article) time.Time {
+	if article.PublishedAt != nil {
+		return *article.PublishedAt
+	}
+	return article.CreatedAt
+}
+
+func articleCategories(article Article) []string {
+	names := []string{}
+	if article.Category != nil {
+		names = append(names, article.Category.Name)
+	}
+	for _, tag := range article.Tags {
+		names = append(names, tag.Name)
+	}
+	return names
+}
+
+type rssFeed struct {
+	XMLName   xml.Name   `xml:"rss"`
+	Version   string     `xml:"version,attr"`
+	ContentNS string     `xml:"xmlns:content,attr"`
+	DCNS      string     `xml:"xmlns:dc,attr"`
+	AtomNS    string     `xml:"xmlns:atom,attr"`
+	Channel   rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string      `xml:"title"`
+	Link          string      `xml:"link"`
+	Description   string      `xml:"description"`
+	Language      string      `xml:"language,omitempty"`
+	AtomLink      rssAtomLink `xml:"atom:link"`
+	LastBuildDate string      `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem   `xml:"item"`
+}
+
+type rssAtomLink struct {
+	Href     string `xml:"href,attr"`
+	Rel      string `xml:"rel,attr"`
+	Type     string `xml:"type,attr"`
+	Hreflang string `xml:"hreflang,attr,omitempty"`
+}
+
+type rssItem struct {
+	Title       string        `xml:"title"`
+	Link        string        `xml:"link"`
+	Alternates  []rssAtomLink `xml:"atom:link"`
+	GUID        rssGUID       `xml:"guid"`
+	PubDate     string        `xml:"pubDate"`
+	Creator     string        `xml:"dc:creator,omitempty"`
+	Categories  []string      `xml:"category"`
+	Description string        `xml:"description"`
+	Content     string        `xml:"content:encoded"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle"`
+	ID       string      `xml:"id"`
+	Updated  string      `xml:"updated"`
+	Links    []atomLink  `xml:"link"`
+	Author   *atomPerson `xml:"author,omitempty"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href     string `xml:"href,attr"`
+	Rel      string `xml:"rel,attr,omitempty"`
+	Type     string `xml:"type,attr,omitempty"`
+	Hreflang string `xml:"hreflang,attr,omitempty"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	Lang       string         `xml:"xml:lang,attr,omitempty"`
+	ID         string         `xml:"id"`
+	Links      []atomLink     `xml:"link"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Author     atomPerson     `xml:"author"`
+	Categories []atomCategory `xml:"category"`
+	Summary    atomText       `xml:"summary"`
+	Content    atomText       `xml:"content"`
+}
+
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url"`
+	FeedURL     string         `json:"feed_url"`
+	Description string         `json:"description"`
+	Authors     []jsonFeedUser `json:"authors,omitempty"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedUser struct {
+	Name string `json:"name"`
+}
+
+type jsonFeedItem struct {
+	ID            string         `json:"id"`
+	URL           string         `json:"url"`
+	Title         string         `json:"title"`
+	Language      string         `json:"language,omitempty"`
+	ContentHTML   string         `json:"content_html"`
+	Summary       string         `json:"summary"`
+	DatePublished string         `json:"date_published"`
+	DateModified  string         `json:"date_modified"`
+	Authors       []jsonFeedUser `json:"authors"`
+	Tags          []string       `json:"tags,omitempty"`
+}
+
+func buildRSS(f *feed) rssFeed {
+	out := rssFeed{
+		Version:   "2.0",
+		ContentNS: "http://purl.org/rss/1.0/modules/content/",
+		DCNS:      "http://purl.org/dc/elements/1.1/",
+		AtomNS:    "http://www.w3.org/2005/Atom",
+		Channel: rssChannel{
+			Title:       f.Title,
+			Link:        f.HomeURL,
+			Description: f.Description,
+			Language:    f.Language,
+			AtomLink:    rssAtomLink{Href: f.SelfURL, Rel: "self", Type: "application/rss+xml"},
+		},
+	}
+	if !f.Updated.IsZero() {
+		out.Channel.LastBuildDate = f.Updated.UTC().Format(time.RFC1123Z)
+	}
+	for _, article := range f.Articles {
+		var alternates []rssAtomLink
+		for _, link := range articleAlternates(article) {
+			alternates = append(alternates, rssAtomLink{Href: link.Href, Rel: link.Rel, Type: link.Type, Hreflang: link.Hreflang})
+		}
+		out.Channel.Items = append(out.Channel.Items, rssItem{
+			Title:       article.Title,
+			Link:        articleURL(article),
+			Alternates:  alternates,
+			GUID:        rssGUID{Value: articleFeedID(article)},
+			PubDate:     feedPublished(article).UTC().Format(time.RFC1123Z),
+			Creator:     article.User.Name,
+			Categories:  articleCategories(article),
+			Description: articleExcerpt(article, feedExcerptLength),
+			Content:     article.ContentHTML,
+		})
+	}
+	return out
+}
+
+func buildAtom(f *feed) atomFeed {
+	updated := f.Updated
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	out := atomFeed{
+		Title:    f.Title,
+		Subtitle: f.Description,
+		ID:       f.SelfURL,
+		Updated:  updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: f.HomeURL, Rel: "alternate", Type: "text/html"},
+			{Href: f.SelfURL, Rel: "self", Type: "application/atom+xml"},
+		},
+	}
+	if f.Author != nil {
+		out.Author = &atomPerson{Name: f.Author.Name}
+	}
+	for _, article := range f.Articles {
+		categories := []atomCategory{}
+		for _, name := range articleCategories(article) {
+			categories = append(categories, atomCategory{Term: name})
+		}
+		links := append([]atomLink{{Href: articleURL(article), Rel: "alternate", Type: "text/html"}}, articleAlternates(article)...)
+		out.Entries = append(out.Entries, atomEntry{
+			Title:      article.Title,
+			Lang:       articleLanguage(article),
+			ID:         articleFeedID(article),
+			Links:      links,
+			Published:  feedPublished(article).UTC().Format(time.RFC3339),
+			Updated:    article.UpdatedAt.UTC().Format(time.RFC3339),
+			Author:     atomPerson{Name: article.User.Name},
+			Categories: categories,
+			Summary:    atomText{Type: "text", Body: articleExcerpt(article, feedExcerptLength)},
+			Content:    atomText{Type: "html", Body: article.ContentHTML},
+		})
+	}
+	return out
+}
+
+func buildJSONFeed(f *feed) jsonFeed {
+	out := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       f.Title,
+		HomePageURL: f.HomeURL,
+		FeedURL:     f.SelfURL,
+		Description: f.Description,
+		Items:       []jsonFeedItem{},
+	}
+	if f.Author != nil {
+		out.Authors = []jsonFeedUser{{Name: f.Author.Name}}
+	}
+	for _, article := range f.Articles {
+		out.Items = append(out.Items, jsonFeedItem{
+			ID:            articleFeedID(article),
+			URL:           articleURL(article),
+			Title:         article.Title,
+			Language:      articleLanguage(article),
+			ContentHTML:   article.ContentHTML,
+			Summary:       articleExcerpt(article, feedExcerptLength),
+			DatePublished: feedPublished(article).UTC().Format(time.RFC3339),
+			DateModified:  article.UpdatedAt.UTC().Format(time.RFC3339),
+			Authors:       []jsonFeedUser{{Name: article.User.Name}},
+			Tags:          articleCategories(article),
+		})
+	}
+	return out
+}
+
+// rssFeedHandler serves /feed.xml and /authors/{id}/feed.xml.
+func rssFeedHandler(w http.ResponseWriter, r *http.Request) {
+	f, ok := loadFeed(w, r)
+	if !ok || notModified(w, r, f.etag("rss"), f.Updated) {
+		return
+	}
+	writeXML(w, "application/rss+xml; charset=utf-8", buildRSS(f))
+}
+
+// atomFeedHandler serves /atom.xml and /authors/{id}/atom.xml.
+func atomFeedHandler(w http.ResponseWriter, r *http.Request) {
+	f, ok := loadFeed(w, r)
+	if !ok || notModified(w, r, f.etag("atom"), f.Updated) {
+		return
+	}
+	writeXML(w, "application/atom+xml; charset=utf-8", buildAtom(f))
+}
+
+// jsonFeedHandler serves /feed.json and /authors/{id}/feed.json.
+func jsonFeedHandler(w http.ResponseWriter, r *http.Request) {
+	f, ok := loadFeed(w, r)
+	if !ok || notModified(w, r, f.etag("json"), f.Updated) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/feed+json; charset=utf-8")
+	json.NewEncoder(w).Encode(buildJSONFeed(f))
+}
+
+func writeXML(w http.ResponseWriter, contentType string, v interface{}) {
+	out, err := marshalXML(v)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Failed to encode feed")
+		http.Error(w, "Error building feed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(out)
+}
+
+// marshalXML encodes v as an indented XML document.
+func marshalXML(v interface{}) ([]byte, error) {
+	out, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), out...), nil
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// HTTP Signatures (draft-cavage-http-signatures-12), the way Mastodon and
+// most other fediverse servers sign requests between servers.
+
+const (
+	// Signed requests older than this, or dated this far in the future, are
+	// refused so a captured request cannot be replayed.
+	signatureMaxAge    = 12 * time.Hour
+	signatureClockSkew = time.Hour
+	// Public keys of remote actors are fetched again after this long, and
+	// at most this many are kept.
+	remoteActorTTL  = time.Hour
+	maxRemoteActors = 1000
+	// Remote documents larger than this are not read.
+	maxRemoteDocumentBytes = 1 << 20
+)
+
+var errInvalidSignature = errors.New("invalid HTTP signature")
+
+// httpSigner is the key a local actor signs requests with.
+type httpSigner struct {
+	keyID string
+	key   *rsa.PrivateKey
+}
+
+// bodyDigest is the Digest header of a request body.
+func bodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// signingString builds the text that is signed from the listed headers.
+func signingString(r *http.Request, headers []string) (string, error) {
+	lines := make([]string, len(headers))
+	for i, name := range headers {
+		switch name {
+		case "(request-target)":
+			lines[i] = "(request-target): " + strings.ToLower(r.Method) + " " + r.URL.RequestURI()
+		case "host":
+			host := r.Host
+			if host == "" {
+				host = r.URL.Host
+			}
+			lines[i] = "host: " + host
+		default:
+			value := r.Header.Get(name)
+			if value == "" {
+				return "", fmt.Errorf("signed header %s is missing", name)
+			}
+			lines[i] = name + ": " + value
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// signRequest sets the Date, Digest and Signature headers of an outgoing
+// request. GET requests have no body and no Digest.
+func signRequest(req *http.Request, body []byte, signer httpSigner, now time.Time) error {
+	headers := []string{"(request-target)", "host", "date"}
+	req.Header.Set("Date", now.UTC().Format(http.TimeFormat))
+	if req.Method != http.MethodGet {
+		req.Header.Set("Digest", bodyDigest(body))
+		headers = append(headers, "digest")
+	}
+
+	text, err := signingString(req, headers)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(text))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, signer.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		signer.keyID, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(signature)))
+	return nil
+}
+
+// parseSignatureHeader splits a Signature header into its parameters.
+func parseSignatureHeader(header string) map[string]string {
+	params := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		params[strings.ToLower(name)] = strings.Trim(value, `"`)
+	}
+	return params
+}
+
+// verifyRequestSignature checks the HTTP signature of an incoming request
+// against the public key of the remote actor that signed it, and returns
+// that actor. The signature has to cover the request target, host and date,
+// plus the digest of the body for POSTs. signer, when given, signs the key
+// lookup for servers that only answer signed requests.
+func verifyRequestSignature(r *http.Request, body []byte, signer *httpSigner, now time.Time) (*remoteActor, error) {
+	params := parseSignatureHeader(r.Header.Get("Signature"))
+	keyID, signature := params["keyid"], params["signature"]
+	if keyID == "" || signature == "" {
+		return nil, errInvalidSignature
+	}
+	if algorithm := params["algorithm"]; algorithm != "" && algorithm != "rsa-sha256" && algorithm != "hs2019" {
+		return nil, errInvalidSignature
+	}
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+	covered := make(map[string]bool, len(headers))
+	for _, name := range headers {
+		covered[name] = true
+	}
+	if !covered["(request-target)"] || !covered["host"] || !covered["date"] {
+		return nil, errInvalidSignature
+	}
+	if r.Method != http.MethodGet {
+		if !covered["digest"] || r.Header.Get("Digest") != bodyDigest(body) {
+			return nil, errInvalidSignature
+		}
+	}
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil || now.Sub(date) > signatureMaxAge || date.Sub(now) > signatureClockSkew {
+		return nil, errInvalidSignature
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, errInvalidSignature
+	}
+	text, err := signingString(r, headers)
+	if err != nil {
+		return nil, errInvalidSignature
+	}
+	sum := sha256.Sum256([]byte(text))
+
+	actor, err := lookupRemoteKey(keyID, signer, false)
+	if err != nil {
+		return nil, err
+	}
+	if rsa.VerifyPKCS1v15(actor.publicKey, crypto.SHA256, sum[:], raw) != nil {
+		// The actor may have rotated its key since it was cached
+		if actor, err = lookupRemoteKey(keyID, signer, true); err != nil {
+			return nil, err
+		}
+		if rsa.VerifyPKCS1v15(actor.publicKey, crypto.SHA256, sum[:], raw) != nil {
+			return nil, errInvalidSignature
+		}
+	}
+	return actor, nil
+}
+
+// remoteActor is what the blog needs to know about an actor on another
+// server: where to deliver to and the key it signs with.
+type remoteActor struct {
+	ID          string
+	Inbox       string
+	SharedInbox string
+	KeyID       string
+	publicKey   *rsa.PublicKey
+	fetched     time.Time
+}
+
+var (
+	remoteActorsMu sync.Mutex
+	remoteActors   = make(map[string]*remoteActor) // by key ID
+)
+
+// federationClient talks to other servers. The addresses it is given come
+// from unauthenticated requests, so it only connects to public addresses:
+// an inbox post must not make the blog reach its own network, localhost or
+// a cloud metadata service. The check runs on the resolved address of every
+// connection, redirects included.
+var federationClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: refusePrivateAddress}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, private in practice.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func refusePrivateAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !publicAddress(ip) {
+		return fmt.Errorf("refusing to connect to non-public address %s", host)
+	}
+	return nil
+}
+
+// publicAddress reports whether ip can be reached on the internet.
+func publicAddress(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !sharedAddressSpace.Contains(ip)
+}
+
+// lookupRemoteKey returns the actor owning keyID, from the cache unless
+// refresh is set or the entry is stale.
+func lookupRemoteKey(keyID string, signer *httpSigner, refresh bool) (*remoteActor, error) {
+	remoteActorsMu.Lock()
+	cached, ok := remoteActors[keyID]
+	remoteActorsMu.Unlock()
+	if ok && !refresh && time.Since(cached.fetched) < remoteActorTTL {
+		return cached, nil
+	}
+
+	// The key ID is usually the actor with a #main-key fragment
+	actorURL, _, _ := strings.Cut(keyID, "#")
+	actor, err := fetchRemoteActor(actorURL, signer)
+	if err != nil {
+		return nil, err
+	}
+	// Only cached once it is known to own the key, so a document cannot
+	// take the place of another actor's
+	if actor.KeyID != keyID {
+		return nil, errInvalidSignature
+	}
+	cacheRemoteActor(actor)
+	return actor, nil
+}
+
+// cacheRemoteActor keeps actor by its key ID. A full cache drops the entry
+// fetched longest ago.
+func cacheRemoteActor(actor *remoteActor) {
+	remoteActorsMu.Lock()
+	defer remoteActorsMu.Unlock()
+	if _, ok := remoteActors[actor.KeyID]; !ok && len(remoteActors) >= maxRemoteActors {
+		var oldest string
+		for keyID, cached := range remoteActors {
+			if oldest == "" || cached.fetched.Before(remoteActors[oldest].fetched) {
+				oldest = keyID
+			}
+		}
+		delete(remoteActors, oldest)
+	}
+	remoteActors[actor.KeyID] = actor
+}
+
+// fetchRemoteActor loads an actor document.
+func fetchRemoteActor(uri string, signer *httpSigner) (*remoteActor, error) {
+	if !validWebhookURL(uri) {
+		return nil, fmt.Errorf("invalid actor URL %q", uri)
+	}
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", activityContentType)
+	req.Header.Set("User-Agent", siteName+"-ActivityPub")
+	if signer != nil {
+		if err := signRequest(req, nil, *signer, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := federationClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching actor %s: status %d", uri, resp.StatusCode)
+	}
+
+	var doc struct {
+		ID        string `json:"id"`
+		Inbox     string `json:"inbox"`
+		Endpoints struct {
+			SharedInbox string `json:"sharedInbox"`
+		} `json:"endpoints"`
+		PublicKey struct {
+			ID           string `json:"id"`
+			Owner        string `json:"owner"`
+			PublicKeyPem string `json:"publicKeyPem"`
+		} `json:"publicKey"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxRemoteDocumentBytes)).Decode(&doc); err != nil {
+		return nil, err
+	}
+	// A document may only speak for the address it was fetched from
+	if doc.ID != uri || doc.PublicKey.Owner != doc.ID || !validWebhookURL(doc.Inbox) {
+		return nil, fmt.Errorf("actor document %s does not describe itself", uri)
+	}
+	key, err := parsePublicKeyPEM(doc.PublicKey.PublicKeyPem)
+	if err != nil {
+		return nil, err
+	}
+
+	actor := &remoteActor{
+		ID:        doc.ID,
+		Inbox:     doc.Inbox,
+		KeyID:     doc.PublicKey.ID,
+		publicKey: key,
+		fetched:   time.Now(),
+	}
+	if validWebhookURL(doc.Endpoints.SharedInbox) {
+		actor.SharedInbox = doc.Endpoints.SharedInbox
+	}
+	return actor, nil
+}
+
+// generateKeyPair creates an RSA key pair in PEM form: PKCS#8 for the
+// private key and PKIX for the public one, as Mastodon publishes it.
+func generateKeyPair() (string, string, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", "", err
+	}
+	private, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+	var privatePEM, publicPEM bytes.Buffer
+	pem.Encode(&privatePEM, &pem.Block{Type: "PRIVATE KEY", Bytes: private})
+	pem.Encode(&publicPEM, &pem.Block{Type: "PUBLIC KEY", Bytes: public})
+	return privatePEM.String(), publicPEM.String(), nil
+}
+
+func parsePrivateKeyPEM(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return key, nil
+}
+
+func parsePublicKeyPEM(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("no PEM data")
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return key, nil
+}
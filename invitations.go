@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Invited users are created by imports on behalf of someone else. They have
+// no password until they accept the invitation, so they cannot log in; the
+// invitation code is kept in VerificationCode.
+
+const minPasswordLength = 8
+
+// newInvitationCode returns a code long enough that it cannot be guessed,
+// since accepting an invitation sets the account's password.
+func newInvitationCode() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newInvitedUser builds an invited account; the caller saves it.
+func newInvitedUser(name, email string) User {
+	return User{
+		Name:             name,
+		Email:            strings.TrimSpace(email),
+		Role:             "user",
+		EmailVerified:    false,
+		VerificationCode: newInvitationCode(),
+	}
+}
+
+// isInvited reports whether user was invited and has not accepted yet.
+func isInvited(user User) bool {
+	return user.PasswordHash == "" && user.VerificationCode != ""
+}
+
+// acceptInvitationHandler sets the password of an invited account. Receiving
+// the invitation proves the address, so the email is verified as well.
+func acceptInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Email    string `json:"email"`
+		Code     string `json:"code"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, `{"error": "Invalid request format"}`, http.StatusBadRequest)
+		return
+	}
+	if request.Email == "" || request.Code == "" {
+		http.Error(w, `{"error": "Email and invitation code are required"}`, http.StatusBadRequest)
+		return
+	}
+	if len(request.Password) < minPasswordLength {
+		http.Error(w, `{"error": "Password must be at least 8 characters"}`, http.StatusBadRequest)
+		return
+	}
+
+	var user User
+	if err := db.Where("email = ? AND verification_code = ? AND (password_hash = '' OR password_hash IS NULL)", request.Email, request.Code).First(&user).Error; err != nil {
+		http.Error(w, `{"error": "Invalid or already used invitation"}`, http.StatusBadRequest)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(request.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, `{"error": "Error hashing password"}`, http.StatusInternalServerError)
+		return
+	}
+	res := db.Model(&User{}).
+		Where("id = ? AND verification_code = ?", user.ID, request.Code).
+		Updates(map[string]interface{}{
+			"password_hash":     string(hashedPassword),
+			"email_verified":    true,
+			"verification_code": "",
+		})
+	if res.Error != nil || res.RowsAffected == 0 {
+		http.Error(w, `{"error": "Error accepting invitation"}`, http.StatusInternalServerError)
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"user_id": user.ID,
+	}).Info("Invitation accepted")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Invitation accepted. You can now log in."})
+}
@@ -8,8 +8,10 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -28,15 +30,17 @@ var jwtSecret = []byte(os.Getenv("JWT_SECRET"))
 
 // Define the User struct
 type User struct {
-	ID               uint   `json:"id" gorm:"primaryKey"`
-	Name             string `json:"name"`
-	Email            string `json:"email"`
-	Password         string `json:"-" gorm:"-"` // Добавляем это поле, но оно не будет сохраняться в БД
-	PasswordHash     string `json:"-"`
-	Role             string `json:"role"`
-	EmailVerified    bool   `json:"email_verified"`
-	VerificationCode string `json:"-"`
-	ProfilePicture   string `json:"profile_picture"` // Add this line for storing the profile picture path or URL
+	ID               uint      `json:"id" gorm:"primaryKey"`
+	Name             string    `json:"name"`
+	Email            string    `json:"email"`
+	Password         string    `json:"-" gorm:"-"` // Добавляем это поле, но оно не будет сохраняться в БД
+	PasswordHash     string    `json:"-"`
+	Role             string    `json:"role"`
+	EmailVerified    bool      `json:"email_verified"`
+	VerificationCode string    `json:"-"`
+	ProfilePicture   string    `json:"profile_picture"` // Add this line for storing the profile picture path or URL
+	Banned           bool      `json:"banned"`
+	CreatedAt        time.Time `json:"created_at"`
 }
 
 var upgrader = websocket.Upgrader{
@@ -79,10 +83,41 @@ type Claims struct {
 type Article struct {
 	ID      uint   `json:"id" gorm:"primaryKey"`
 	Title   string `json:"title"`
-	Content string `json:"content"`
+	Slug    string `json:"slug" gorm:"uniqueIndex"`
+	Content string `json:"content"`                 // Markdown source
 	Name    string `json:"name" gorm:"column:name"` // New column name
 	UserID  uint   `json:"user_id"`
 	User    User   `json:"user" gorm:"foreignKey:UserID"`
+	// Sanitized HTML and table of contents rendered from Content on save,
+	// and the fingerprint the duplicate moderation check compares
+	ContentHTML string     `json:"content_html" gorm:"type:text"`
+	TOC         []TOCEntry `json:"toc" gorm:"serializer:json"`
+	Fingerprint string     `json:"-" gorm:"index"`
+	CategoryID  *uint      `json:"category_id" gorm:"index"`
+	Category    *Category  `json:"category,omitempty"`
+	Tags        []Tag      `json:"tags" gorm:"many2many:article_tags"`
+	// Articles in a series are ordered by SeriesPosition; Series carries the
+	// navigation for single-article responses
+	SeriesID       *uint      `json:"series_id" gorm:"index"`
+	SeriesPosition int        `json:"series_position" gorm:"not null;default:0"`
+	Series         *seriesNav `json:"series,omitempty" gorm:"-"`
+	// Language of Title and Content, empty for the site language. Responses
+	// may carry a translation instead, listed with the others in Translations
+	Language     string              `json:"language" gorm:"size:8"`
+	Translations []translationLink   `json:"translations,omitempty" gorm:"-"`
+	Translation  *ArticleTranslation `json:"-" gorm:"-"`
+	// New articles start out as drafts.
+	Status      string     `json:"status" gorm:"index;default:draft"`
+	PublishedAt *time.Time `json:"published_at"`
+	ScheduledAt *time.Time `json:"scheduled_at"`
+	// Views are buffered in memory and flushed periodically; likes live in
+	// article_likes and are counted per request.
+	ViewCount  int64     `json:"view_count" gorm:"not null;default:0"`
+	LikeCount  int64     `json:"like_count" gorm:"-"`
+	Liked      bool      `json:"liked" gorm:"-"`
+	Bookmarked bool      `json:"bookmarked" gorm:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
 }
 
 // Define visitor struct first
@@ -187,6 +222,7 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Error creating user", http.StatusInternalServerError)
 		return
 	}
+	emitWebhookEvent(EventUserRegistered, userEventData(user))
 
 	// Отправляем письмо с кодом верификации
 	if err := sendVerificationEmail(user.Email, user.VerificationCode); err != nil {
@@ -251,6 +287,11 @@ func authMiddleware(next http.HandlerFunc, requiredRole string) http.HandlerFunc
 			return
 		}
 
+		if isBanned(claims.UserID) {
+			http.Error(w, `{"error": "Your account has been banned"}`, http.StatusForbidden)
+			return
+		}
+
 		// 7️⃣ Добавляем `user_id` и `role` в контекст запроса
 		ctx := context.WithValue(r.Context(), "user_id", claims.UserID)
 		ctx = context.WithValue(ctx, "role", claims.Role)
@@ -260,6 +301,31 @@ func authMiddleware(next http.HandlerFunc, requiredRole string) http.HandlerFunc
 	}
 }
 
+// optionalClaims returns the claims of a valid bearer token, or nil for
+// anonymous requests. Public handlers use it to show more to logged-in users.
+func optionalClaims(r *http.Request) *Claims {
+	return parseClaims(strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")))
+}
+
+// parseClaims returns the claims of a valid token, or nil.
+func parseClaims(tokenString string) *Claims {
+	if tokenString == "" {
+		return nil
+	}
+
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return jwtSecret, nil
+	})
+	if err != nil || !token.Valid || claims.UserID == 0 {
+		return nil
+	}
+	return claims
+}
+
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	var request struct {
 		Email    string `json:"email"`
@@ -286,6 +352,11 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if user.Banned {
+		http.Error(w, `{"error": "Your account has been banned"}`, http.StatusForbidden)
+		return
+	}
+
 	// Логируем jwtSecret перед генерацией токена
 	fmt.Println("🔹 jwtSecret при генерации токена:", string(jwtSecret))
 
@@ -373,170 +444,6 @@ func createUserHandler(db *gorm.DB) http.HandlerFunc {
 	}
 }
 
-// ////////////////////
-func handleArticles(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		getArticles(w)
-		return
-	case http.MethodPost:
-		tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-		tokenString = strings.TrimSpace(tokenString)
-
-		if tokenString == "" {
-			http.Error(w, `{"error": "Missing token"}`, http.StatusUnauthorized)
-			return
-		}
-
-		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return jwtSecret, nil
-		})
-		if err != nil || !token.Valid {
-			http.Error(w, `{"error": "Invalid token"}`, http.StatusUnauthorized)
-			return
-		}
-
-		if claims.ExpiresAt < time.Now().Unix() {
-			http.Error(w, `{"error": "Token expired"}`, http.StatusUnauthorized)
-			return
-		}
-
-		var article Article
-		if err := json.NewDecoder(r.Body).Decode(&article); err != nil {
-			http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
-			return
-		}
-
-		var user User
-		if err := db.First(&user, claims.UserID).Error; err != nil {
-			http.Error(w, `{"error": "User not found"}`, http.StatusBadRequest)
-			return
-		}
-
-		article.UserID = user.ID
-		article.Name = user.Name
-
-		if err := db.Create(&article).Error; err != nil {
-			http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
-			return
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"message":    "Article created successfully",
-			"article_id": article.ID,
-		})
-	}
-}
-
-func getArticles(w http.ResponseWriter) {
-	logger.Info("Fetching all articles")
-
-	var articles []Article
-	if err := db.Preload("User").Order("id DESC").Find(&articles).Error; err != nil { // Order by newest first
-		logger.WithFields(logrus.Fields{
-			"error": err.Error(),
-		}).Error("Failed to fetch articles")
-		http.Error(w, "Error fetching articles", http.StatusInternalServerError)
-		return
-	}
-
-	logger.WithFields(logrus.Fields{
-		"article_count": len(articles),
-	}).Info("Fetched articles successfully")
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(articles)
-}
-
-func createArticle(w http.ResponseWriter, r *http.Request) {
-	// Проверяем, что метод запроса - POST
-	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// Получаем заголовок Authorization
-	tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-	tokenString = strings.TrimSpace(tokenString) // Remove any extra spaces
-
-	if tokenString == "" {
-		http.Error(w, "Missing authorization token", http.StatusUnauthorized)
-		return
-	}
-
-	// Убираем "Bearer "
-	splitToken := strings.Split(tokenString, " ")
-	if len(splitToken) != 2 || splitToken[0] != "Bearer" {
-		http.Error(w, "Invalid authorization format", http.StatusUnauthorized)
-		return
-	}
-	tokenString = splitToken[1]
-	fmt.Println("Token after trimming 'Bearer':", tokenString)
-
-	// Разбираем токен
-	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return jwtSecret, nil
-	})
-	if err != nil {
-		fmt.Println("JWT parsing error:", err)
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
-		return
-	}
-	claims, ok := token.Claims.(*Claims)
-	if !ok || !token.Valid {
-		fmt.Println("Invalid token structure")
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
-		return
-	}
-
-	if err != nil {
-		fmt.Println("❌ Ошибка парсинга токена:", err)
-	} else if !token.Valid {
-		fmt.Println("❌ Токен не валидный!")
-	}
-	http.Error(w, "Invalid token", http.StatusUnauthorized)
-	return
-
-	// Декодируем JSON статьи
-	var article Article
-	if err := json.NewDecoder(r.Body).Decode(&article); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
-	}
-
-	// Retrieve user details from database to get the author's name
-	var user User
-	if err := db.First(&user, claims.UserID).Error; err != nil {
-		http.Error(w, "User not found", http.StatusBadRequest)
-		return
-	}
-
-	// Assign the correct UserID and Author name
-	article.UserID = user.ID
-	article.Name = user.Name
-
-	// Устанавливаем имя автора
-	article.Name = user.Name
-
-	// Сохраняем статью в БД
-	if err := db.Create(&article).Error; err != nil {
-		http.Error(w, "Error creating article", http.StatusInternalServerError)
-		return
-	}
-
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Article created successfully"})
-}
-
 // Create a new rate limiter
 func newRateLimiter(limit int, interval time.Duration) *rateLimiter {
 	return &rateLimiter{
@@ -587,8 +494,9 @@ func enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Разрешаем WebSocket-запросы
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match, If-None-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, Last-Modified")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 
 		if r.Method == "OPTIONS" {
@@ -599,38 +507,96 @@ func enableCORS(next http.Handler) http.Handler {
 	})
 }
 
-func main() {
-
-	r := mux.NewRouter()
-	// Initialize the rate limiter
-	//Initialize the rate limiter
-	rl := newRateLimiter(1000, time.Minute) // Allow 1000 requests per minute per IP
-
-	// Configure Logrus
-	logger.SetFormatter(&logrus.JSONFormatter{}) // Logs in JSON format
-	logger.SetLevel(logrus.InfoLevel)            // Set logging level
-	logger.Info("Server is starting...")
+// databaseNow is the time gorm stamps rows with, cut to the microseconds
+// PostgreSQL keeps. A timestamp echoed to a client then equals the stored one,
+// so it works as a precondition for the next write.
+func databaseNow() time.Time {
+	return time.Now().Truncate(time.Microsecond)
+}
 
-	// Database Connection ///////////////////////////////////////////////////////////////////////
+// connectDatabase opens the database, migrates the schema and runs the
+// backfills. Any failure is fatal.
+func connectDatabase() {
 	dsn := "user=postgres password=admin dbname=bloguser port=5433 sslmode=disable"
 	var err error
-	db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{NowFunc: databaseNow})
 	if err != nil {
 		logger.WithFields(logrus.Fields{
 			"error": err.Error(),
 		}).Fatal("Failed to connect to the database")
 	}
+	if err := registerCacheInvalidation(db); err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Fatal("Failed to register cache invalidation")
+	}
+	if err := migrateArticleStatus(); err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Fatal("Failed to add article status")
+	}
 	// Auto-migrate: Create tables if they don't exist
-	if err := db.AutoMigrate(&User{}, &Article{}, &Chat{}, &Message{}); err != nil {
+	if err := db.AutoMigrate(&User{}, &Category{}, &Tag{}, &Article{}, &ArticleSlug{}, &Comment{}, &ArticleLike{}, &ArticleDailyStat{}, &ArticleReferrerStat{}, &ArticleRevision{}, &Media{}, &ImportedItem{}, &ArticleCollaborator{}, &ArticleTranslation{}, &Report{}, &Series{}, &Bookmark{}, &ReadingList{}, &Subscriber{}, &Webhook{}, &WebhookDelivery{}, &ActorKey{}, &Follower{}, &ActivityDelivery{}, &Chat{}, &Message{}); err != nil {
 		logger.WithFields(logrus.Fields{
 			"error": err.Error(),
 		}).Fatal("Failed to auto-migrate tables")
 	}
 
+	if err := migrateArticleSearch(); err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Fatal("Failed to set up article search")
+	}
+	if err := backfillPublishedAt(); err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Fatal("Failed to backfill article publication dates")
+	}
+	if err := backfillRenderedContent(); err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Fatal("Failed to render existing articles")
+	}
+	if err := backfillArticleFingerprints(); err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Fatal("Failed to fingerprint existing articles")
+	}
+	if err := backfillArticleSlugs(); err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Fatal("Failed to backfill article slugs")
+	}
+	if err := backfillArticleRevisions(); err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Fatal("Failed to backfill article revisions")
+	}
+}
+
+func main() {
+
+	r := mux.NewRouter()
+	// Initialize the rate limiter
+	//Initialize the rate limiter
+	rl := newRateLimiter(1000, time.Minute) // Allow 1000 requests per minute per IP
+
+	// Configure Logrus
+	logger.SetFormatter(&logrus.JSONFormatter{}) // Logs in JSON format
+	logger.SetLevel(logrus.InfoLevel)            // Set logging level
+	logger.Info("Server is starting...")
+
+	connectDatabase()
 	logger.Info("Database connection established and migrations applied")
 
+	// Subcommands such as import-markdown run instead of the server
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	// ROUTES ////////////////////////////////////////////////////////////////////////////////
 	r.HandleFunc("/ws", wsHandler)
+	r.HandleFunc("/ws/articles/{id:[0-9]+}/collab", collabHandler)
 
 	r.HandleFunc("/create-chat", authMiddleware(createChatHandler, "user")).Methods("POST")
 	r.HandleFunc("/active-chats", authMiddleware(getActiveChatsHandler, "admin")).Methods("GET")
@@ -638,6 +604,7 @@ func main() {
 	r.HandleFunc("/register", registerHandler).Methods("POST")
 	r.HandleFunc("/login", loginHandler).Methods("POST")
 	r.HandleFunc("/verify-email", verifyEmailHandler).Methods("POST")
+	r.HandleFunc("/invitations/accept", acceptInvitationHandler).Methods("POST")
 	r.HandleFunc("/create-transaction", authMiddleware(createTransactionHandler, "user")).Methods("POST")
 	r.HandleFunc("/payment-callback", paymentCallbackHandler).Methods("POST")
 	r.HandleFunc("/get-transactions", authMiddleware(getTransactionsHandler, "user")).Methods("GET")
@@ -648,84 +615,106 @@ func main() {
 	r.Handle("/update", rl.limitMiddleware(http.HandlerFunc(updateUser))).Methods("PUT")
 	r.Handle("/delete", rl.limitMiddleware(http.HandlerFunc(deleteUser))).Methods("DELETE")
 	r.Handle("/search", rl.limitMiddleware(http.HandlerFunc(searchUser))).Methods("GET")
-	r.Handle("/articles", rl.limitMiddleware(http.HandlerFunc(handleArticles))).Methods("GET", "POST")
+	r.Handle("/articles", rl.limitMiddleware(http.HandlerFunc(cacheControl(cacheRevalidate, pageCache.wrap(getArticles))))).Methods("GET")
+	r.Handle("/articles", rl.limitMiddleware(authMiddleware(createArticleHandler, ""))).Methods("POST")
+	r.Handle("/import/wordpress", rl.limitMiddleware(authMiddleware(importWordPressHandler, "admin"))).Methods("POST")
+	r.Handle("/articles/import", rl.limitMiddleware(authMiddleware(importArticlesHandler, ""))).Methods("POST")
+	r.Handle("/articles/export", rl.limitMiddleware(authMiddleware(exportArticlesHandler, ""))).Methods("GET")
+	r.Handle("/articles/search", rl.limitMiddleware(http.HandlerFunc(searchArticlesHandler))).Methods("GET")
+	r.Handle("/articles/{id:[0-9]+}", rl.limitMiddleware(http.HandlerFunc(cacheControl(cacheRevalidate, getArticleHandler)))).Methods("GET")
+	r.Handle("/articles/{id:[0-9]+}/status", rl.limitMiddleware(authMiddleware(changeArticleStatusHandler, ""))).Methods("POST")
+	r.Handle("/articles/{id:[0-9]+}/comments", rl.limitMiddleware(http.HandlerFunc(cacheControl(cacheRevalidate, withValidators(getArticleCommentsHandler))))).Methods("GET")
+	r.Handle("/articles/{id:[0-9]+}/comments", rl.limitMiddleware(authMiddleware(createCommentHandler, ""))).Methods("POST")
+	r.Handle("/articles/{id:[0-9]+}/beacon", rl.limitMiddleware(http.HandlerFunc(articleBeaconHandler))).Methods("POST")
+	r.Handle("/articles/{id:[0-9]+}/analytics", rl.limitMiddleware(authMiddleware(getArticleAnalyticsHandler, ""))).Methods("GET")
+	r.Handle("/analytics/articles", rl.limitMiddleware(authMiddleware(getAuthorAnalyticsHandler, ""))).Methods("GET")
+	r.Handle("/articles/{id:[0-9]+}/like", rl.limitMiddleware(authMiddleware(likeArticleHandler, ""))).Methods("POST")
+	r.Handle("/articles/{id:[0-9]+}/like", rl.limitMiddleware(authMiddleware(unlikeArticleHandler, ""))).Methods("DELETE")
+	r.Handle("/articles/{id:[0-9]+}/collaborators", rl.limitMiddleware(authMiddleware(getCollaboratorsHandler, ""))).Methods("GET")
+	r.Handle("/articles/{id:[0-9]+}/collaborators", rl.limitMiddleware(authMiddleware(addCollaboratorHandler, ""))).Methods("POST")
+	r.Handle("/articles/{id:[0-9]+}/collaborators/{user_id:[0-9]+}", rl.limitMiddleware(authMiddleware(removeCollaboratorHandler, ""))).Methods("DELETE")
+	r.Handle("/articles/{id:[0-9]+}/translations", rl.limitMiddleware(http.HandlerFunc(cacheControl(cacheRevalidate, withValidators(getTranslationsHandler))))).Methods("GET")
+	r.Handle("/articles/{id:[0-9]+}/translations/{lang}", rl.limitMiddleware(authMiddleware(putTranslationHandler, ""))).Methods("PUT")
+	r.Handle("/articles/{id:[0-9]+}/translations/{lang}", rl.limitMiddleware(authMiddleware(deleteTranslationHandler, ""))).Methods("DELETE")
+	r.Handle("/articles/{id:[0-9]+}/revisions", rl.limitMiddleware(authMiddleware(getArticleRevisionsHandler, ""))).Methods("GET")
+	r.Handle("/articles/{id:[0-9]+}/revisions/diff", rl.limitMiddleware(authMiddleware(diffArticleRevisionsHandler, ""))).Methods("GET")
+	r.Handle("/articles/{id:[0-9]+}/revisions/{number:[0-9]+}", rl.limitMiddleware(authMiddleware(getArticleRevisionHandler, ""))).Methods("GET")
+	r.Handle("/articles/{id:[0-9]+}/revisions/{number:[0-9]+}/rollback", rl.limitMiddleware(authMiddleware(rollbackArticleHandler, ""))).Methods("POST")
+	r.Handle("/comments/{id:[0-9]+}", rl.limitMiddleware(authMiddleware(updateCommentHandler, ""))).Methods("PUT")
+	r.Handle("/comments/{id:[0-9]+}", rl.limitMiddleware(authMiddleware(deleteCommentHandler, ""))).Methods("DELETE")
+	r.HandleFunc("/admin/comments", authMiddleware(getModerationQueueHandler, "admin")).Methods("GET")
+	r.HandleFunc("/admin/comments/{id:[0-9]+}/approve", authMiddleware(approveCommentHandler, "admin")).Methods("POST")
+	r.HandleFunc("/admin/comments/{id:[0-9]+}/hide", authMiddleware(hideCommentHandler, "admin")).Methods("POST")
+	r.Handle("/reports", rl.limitMiddleware(authMiddleware(createReportHandler, ""))).Methods("POST")
+	r.HandleFunc("/admin/reports", authMiddleware(getReportQueueHandler, "admin")).Methods("GET")
+	r.HandleFunc("/admin/reports/{id:[0-9]+}/resolve", authMiddleware(resolveReportHandler, "admin")).Methods("POST")
+	r.HandleFunc("/admin/users/{id:[0-9]+}/unban", authMiddleware(unbanUserHandler, "admin")).Methods("POST")
+	r.Handle("/articles/by-slug/{slug}", rl.limitMiddleware(http.HandlerFunc(cacheControl(cacheRevalidate, getArticleBySlugHandler)))).Methods("GET")
+	r.Handle("/articles/{id:[0-9]+}", rl.limitMiddleware(authMiddleware(updateArticleHandler, ""))).Methods("PUT")
+	r.Handle("/articles/{id:[0-9]+}", rl.limitMiddleware(authMiddleware(patchArticleHandler, ""))).Methods("PATCH")
+	r.Handle("/articles/{id:[0-9]+}", rl.limitMiddleware(authMiddleware(deleteArticleHandler, ""))).Methods("DELETE")
+	r.Handle("/bookmarks", rl.limitMiddleware(authMiddleware(getBookmarksHandler, ""))).Methods("GET")
+	r.Handle("/bookmarks", rl.limitMiddleware(authMiddleware(addBookmarkHandler, ""))).Methods("POST")
+	r.Handle("/bookmarks/order", rl.limitMiddleware(authMiddleware(reorderBookmarksHandler, ""))).Methods("PUT")
+	r.Handle("/bookmarks/{id:[0-9]+}", rl.limitMiddleware(authMiddleware(removeBookmarkHandler, ""))).Methods("DELETE")
+	r.Handle("/reading-lists", rl.limitMiddleware(authMiddleware(getReadingListsHandler, ""))).Methods("GET")
+	r.Handle("/reading-lists", rl.limitMiddleware(authMiddleware(createReadingListHandler, ""))).Methods("POST")
+	r.Handle("/reading-lists/{id:[0-9]+}", rl.limitMiddleware(authMiddleware(renameReadingListHandler, ""))).Methods("PUT")
+	r.Handle("/reading-lists/{id:[0-9]+}", rl.limitMiddleware(authMiddleware(deleteReadingListHandler, ""))).Methods("DELETE")
+	r.Handle("/newsletter/subscribe", rl.limitMiddleware(http.HandlerFunc(subscribeHandler))).Methods("POST")
+	r.Handle("/newsletter/confirm", rl.limitMiddleware(http.HandlerFunc(confirmSubscriptionHandler))).Methods("GET")
+	r.Handle("/newsletter/unsubscribe", rl.limitMiddleware(http.HandlerFunc(unsubscribeHandler))).Methods("GET", "POST")
+	r.Handle("/series", rl.limitMiddleware(http.HandlerFunc(cacheControl(cacheRevalidate, withValidators(getSeriesListHandler))))).Methods("GET")
+	r.Handle("/series", rl.limitMiddleware(authMiddleware(createSeriesHandler, ""))).Methods("POST")
+	r.Handle("/series/{slug}", rl.limitMiddleware(http.HandlerFunc(cacheControl(cacheRevalidate, withValidators(getSeriesHandler))))).Methods("GET")
+	r.Handle("/series/{id:[0-9]+}", rl.limitMiddleware(authMiddleware(updateSeriesHandler, ""))).Methods("PUT")
+	r.Handle("/series/{id:[0-9]+}", rl.limitMiddleware(authMiddleware(deleteSeriesHandler, ""))).Methods("DELETE")
+	r.Handle("/series/{id:[0-9]+}/articles", rl.limitMiddleware(authMiddleware(setSeriesArticlesHandler, ""))).Methods("PUT")
+	r.Handle("/tags", rl.limitMiddleware(http.HandlerFunc(cacheControl(cacheRevalidate, withValidators(getTagsHandler))))).Methods("GET")
+	r.Handle("/categories", rl.limitMiddleware(http.HandlerFunc(cacheControl(cacheRevalidate, withValidators(getCategoriesHandler))))).Methods("GET")
+	r.HandleFunc("/categories", authMiddleware(createCategoryHandler, "admin")).Methods("POST")
+	r.HandleFunc("/categories/{id:[0-9]+}", authMiddleware(updateCategoryHandler, "admin")).Methods("PUT")
+	r.HandleFunc("/categories/{id:[0-9]+}", authMiddleware(deleteCategoryHandler, "admin")).Methods("DELETE")
+	r.HandleFunc("/admin/webhooks", authMiddleware(getWebhooksHandler, "admin")).Methods("GET")
+	r.HandleFunc("/admin/webhooks", authMiddleware(createWebhookHandler, "admin")).Methods("POST")
+	r.HandleFunc("/admin/webhooks/{id:[0-9]+}", authMiddleware(updateWebhookHandler, "admin")).Methods("PUT")
+	r.HandleFunc("/admin/webhooks/{id:[0-9]+}", authMiddleware(deleteWebhookHandler, "admin")).Methods("DELETE")
+	r.HandleFunc("/admin/webhooks/{id:[0-9]+}/ping", authMiddleware(pingWebhookHandler, "admin")).Methods("POST")
+	r.HandleFunc("/admin/webhooks/{id:[0-9]+}/deliveries", authMiddleware(getWebhookDeliveriesHandler, "admin")).Methods("GET")
+	r.HandleFunc("/admin/webhooks/deliveries/{id:[0-9]+}/redeliver", authMiddleware(redeliverWebhookHandler, "admin")).Methods("POST")
+	r.HandleFunc("/admin/tags/{id:[0-9]+}", authMiddleware(renameTagHandler, "admin")).Methods("PUT")
+	r.HandleFunc("/admin/tags/merge", authMiddleware(mergeTagsHandler, "admin")).Methods("POST")
+	r.Handle("/feed.xml", rl.limitMiddleware(http.HandlerFunc(cacheControl(cacheFeeds, rssFeedHandler)))).Methods("GET")
+	r.Handle("/atom.xml", rl.limitMiddleware(http.HandlerFunc(cacheControl(cacheFeeds, atomFeedHandler)))).Methods("GET")
+	r.Handle("/feed.json", rl.limitMiddleware(http.HandlerFunc(cacheControl(cacheFeeds, jsonFeedHandler)))).Methods("GET")
+	r.Handle("/authors/{id:[0-9]+}/feed.xml", rl.limitMiddleware(http.HandlerFunc(cacheControl(cacheFeeds, rssFeedHandler)))).Methods("GET")
+	r.Handle("/authors/{id:[0-9]+}/atom.xml", rl.limitMiddleware(http.HandlerFunc(cacheControl(cacheFeeds, atomFeedHandler)))).Methods("GET")
+	r.Handle("/authors/{id:[0-9]+}/feed.json", rl.limitMiddleware(http.HandlerFunc(cacheControl(cacheFeeds, jsonFeedHandler)))).Methods("GET")
+	r.Handle("/posts", rl.limitMiddleware(http.HandlerFunc(cacheControl(cachePages, pageCache.wrap(postsPageHandler))))).Methods("GET")
+	r.Handle("/posts/page/{page:[0-9]+}", rl.limitMiddleware(http.HandlerFunc(cacheControl(cachePages, pageCache.wrap(postsPageHandler))))).Methods("GET")
+	r.Handle("/posts/{kind:tag|category|author}/{slug}", rl.limitMiddleware(http.HandlerFunc(cacheControl(cachePages, pageCache.wrap(postsPageHandler))))).Methods("GET")
+	r.Handle("/posts/{kind:tag|category|author}/{slug}/page/{page:[0-9]+}", rl.limitMiddleware(http.HandlerFunc(cacheControl(cachePages, pageCache.wrap(postsPageHandler))))).Methods("GET")
+	r.Handle("/posts/{slug}", rl.limitMiddleware(http.HandlerFunc(cacheControl(cachePages, pageCache.wrap(postPageHandler))))).Methods("GET")
+	r.Handle("/sitemap.xml", rl.limitMiddleware(http.HandlerFunc(cacheControl(cacheCrawlers, sitemapHandler)))).Methods("GET")
+	r.Handle("/robots.txt", cacheControl(cacheCrawlers, robotsHandler)).Methods("GET")
+	r.Handle("/.well-known/webfinger", rl.limitMiddleware(http.HandlerFunc(webfingerHandler))).Methods("GET")
+	r.Handle("/ap/authors/{id:[0-9]+}", rl.limitMiddleware(http.HandlerFunc(actorHandler))).Methods("GET")
+	r.Handle("/ap/authors/{id:[0-9]+}/inbox", rl.limitMiddleware(http.HandlerFunc(inboxHandler))).Methods("POST")
+	r.Handle("/ap/authors/{id:[0-9]+}/outbox", rl.limitMiddleware(http.HandlerFunc(outboxHandler))).Methods("GET")
+	r.Handle("/ap/authors/{id:[0-9]+}/followers", rl.limitMiddleware(http.HandlerFunc(followersHandler))).Methods("GET")
+	r.Handle("/ap/articles/{id:[0-9]+}", rl.limitMiddleware(http.HandlerFunc(articleObjectHandler))).Methods("GET")
+	r.Handle("/media", rl.limitMiddleware(authMiddleware(uploadMediaHandler, ""))).Methods("POST")
+	r.Handle("/media", rl.limitMiddleware(authMiddleware(getMediaHandler, ""))).Methods("GET")
+	r.Handle("/media/{id:[0-9]+}", rl.limitMiddleware(authMiddleware(deleteMediaHandler, ""))).Methods("DELETE")
 	r.Handle("/send-email", rl.limitMiddleware(http.HandlerFunc(sendEmail))).Methods("POST")
 	handler := enableCORS(r)
 
-	http.Handle("/uploads/", http.StripPrefix("/uploads", http.FileServer(http.Dir("./uploads"))))
-
-	r.HandleFunc("/articles", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "GET" {
-			var articles []Article
-			// Preload User data to fetch the author name
-			if err := db.Preload("User").Find(&articles).Error; err != nil {
-				http.Error(w, "Error fetching articles", http.StatusInternalServerError)
-				return
-			}
-
-			// Manually assign the correct author's name to each article
-			for i := range articles {
-				articles[i].Name = articles[i].User.Name // Ensure name is set from User table
-			}
-
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(articles)
-		} else if r.Method == "POST" {
-			var article Article
-			if err := json.NewDecoder(r.Body).Decode(&article); err != nil {
-				http.Error(w, "Invalid request body", http.StatusBadRequest)
-				return
-			}
-
-			// Extract token from request
-			tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-			tokenString = strings.TrimSpace(tokenString)
-
-			if tokenString == "" {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-
-			fmt.Println("JWT Secret during validation:", string(jwtSecret))
-
-			claims := &Claims{}
-			token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-				if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-					return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-				}
-				return jwtSecret, nil
-			})
-			if err != nil {
-				fmt.Println("JWT parsing error:", err)
-				http.Error(w, "Invalid token", http.StatusUnauthorized)
-				return
-			}
-			claims, ok := token.Claims.(*Claims)
-			if !ok || !token.Valid {
-				fmt.Println("Invalid token structure")
-				http.Error(w, "Invalid token", http.StatusUnauthorized)
-				return
-			}
-
-			// Ensure we retrieve the user from the database
-			var user User
-			if err := db.First(&user, claims.UserID).Error; err != nil {
-				http.Error(w, "User not found", http.StatusBadRequest)
-				return
-			}
-
-			// Assign the user's ID and name to the article
-			article.UserID = user.ID
-			article.Name = user.Name // ✅ This ensures 'name' is stored in the database
-
-			w.WriteHeader(http.StatusCreated)
-			json.NewEncoder(w).Encode(map[string]string{"message": "Article created successfully"})
-		}
-	}).Methods("GET", "POST") // Add support for both GET and POST requests
 	r.HandleFunc("/protected", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Protected content"))
 	}, "")).Methods("GET")
 
+	r.PathPrefix("/uploads/").Handler(serveUploads()).Methods("GET", "HEAD")
+
 	// Serve static files from the "static" folder ////////////////////////////////////////////
 	r.PathPrefix("/").Handler(http.StripPrefix("/", http.FileServer(http.Dir("./static"))))
 
@@ -742,10 +731,46 @@ func main() {
 		return nil
 	})
 	go handleMessages()
+	go runArticleScheduler(schedulerInterval)
+	go runViewFlusher(viewFlushInterval)
+	go runAnalyticsFlusher(viewFlushInterval)
+	go runNewsletterDigests(digestInterval)
+	go runWebhookDispatcher(webhookInterval)
+	go runActivityDispatcher(activityInterval)
 	// Start the server
 	port := 8080
 	logger.WithFields(logrus.Fields{
 		"port": port,
 	}).Info("Starting server")
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), handler))
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: handler}
+	if err := serveUntilSignal(server); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// How long in-flight requests get to finish once a shutdown signal arrives.
+const shutdownTimeout = 15 * time.Second
+
+// serveUntilSignal runs the server until SIGINT or SIGTERM, then lets
+// in-flight requests finish and writes the buffered view counts and
+// analytics, so a restart does not lose them.
+func serveUntilSignal(server *http.Server) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, 1)
+	go func() { errc <- server.ListenAndServe() }()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.Info("Shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	flushViews(time.Now())
+	flushAnalytics(time.Now())
+	return err
 }
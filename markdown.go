@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/sirupsen/logrus"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+)
+
+// TOCEntry is one heading in an article's table of contents.
+type TOCEntry struct {
+	Level int    `json:"level"`
+	ID    string `json:"id"`
+	Text  string `json:"text"`
+}
+
+// maxTOCLevel is the deepest heading level listed in the table of contents.
+const maxTOCLevel = 3
+
+// markdown renders GitHub-flavoured Markdown with footnotes. Raw HTML is
+// passed through here and removed by htmlPolicy afterwards, so authors can
+// still use the harmless subset.
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM, extension.Footnote),
+	goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+	goldmark.WithRendererOptions(html.WithUnsafe()),
+)
+
+// htmlPolicy is the allowlist applied to every rendered article.
+var htmlPolicy = newHTMLPolicy()
+
+func newHTMLPolicy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	// Heading anchors and footnote targets
+	p.AllowAttrs("id").Matching(regexp.MustCompile(`^[\w:-]+$`)).OnElements("h1", "h2", "h3", "h4", "h5", "h6", "li", "sup")
+	// Fenced code language and footnote markup
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w+#-]+$`)).OnElements("code")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^(footnote-ref|footnote-backref|footnotes)$`)).OnElements("a", "div")
+	p.AllowAttrs("role").Matching(regexp.MustCompile(`^doc-(noteref|backlink|endnotes)$`)).OnElements("a", "div")
+	// GFM task lists
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").OnElements("input")
+	p.AllowAttrs("align").Matching(regexp.MustCompile(`^(left|right|center)$`)).OnElements("th", "td")
+	return p
+}
+
+// renderMarkdown converts Markdown source into sanitized HTML and collects
+// the table of contents from its headings.
+func renderMarkdown(source string) (string, []TOCEntry, error) {
+	src := []byte(source)
+	doc := markdown.Parser().Parse(text.NewReader(src))
+
+	toc := []TOCEntry{}
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		heading, ok := n.(*ast.Heading)
+		if !entering || !ok || heading.Level > maxTOCLevel {
+			return ast.WalkContinue, nil
+		}
+		entry := TOCEntry{Level: heading.Level, Text: nodeText(heading, src)}
+		if id, ok := heading.AttributeString("id"); ok {
+			if b, ok := id.([]byte); ok {
+				entry.ID = string(b)
+			}
+		}
+		toc = append(toc, entry)
+		return ast.WalkSkipChildren, nil
+	})
+
+	var buf bytes.Buffer
+	if err := markdown.Renderer().Render(&buf, src, doc); err != nil {
+		return "", nil, err
+	}
+	return htmlPolicy.Sanitize(buf.String()), toc, nil
+}
+
+// nodeText returns the plain text inside an inline node tree.
+func nodeText(n ast.Node, source []byte) string {
+	var buf bytes.Buffer
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		switch t := c.(type) {
+		case *ast.Text:
+			buf.Write(t.Segment.Value(source))
+			if t.SoftLineBreak() {
+				buf.WriteByte(' ')
+			}
+		case *ast.String:
+			buf.Write(t.Value)
+		default:
+			buf.WriteString(nodeText(c, source))
+		}
+	}
+	return buf.String()
+}
+
+// renderArticleContent refreshes the stored HTML, table of contents and
+// moderation fingerprint from the article's Markdown source.
+func renderArticleContent(article *Article) error {
+	contentHTML, toc, err := renderMarkdown(article.Content)
+	if err != nil {
+		return err
+	}
+	article.ContentHTML = contentHTML
+	article.TOC = toc
+	article.Fingerprint = contentFingerprint(article.Content)
+	return nil
+}
+
+// backfillRenderedContent renders articles stored before Markdown support.
+func backfillRenderedContent() error {
+	var articles []Article
+	if err := db.Where("content_html IS NULL OR content_html = ''").Find(&articles).Error; err != nil {
+		return err
+	}
+	for i := range articles {
+		if err := renderArticleContent(&articles[i]); err != nil {
+			return err
+		}
+		if err := db.Model(&articles[i]).Select("content_html", "toc", "fingerprint").UpdateColumns(&articles[i]).Error; err != nil {
+			return err
+		}
+	}
+	if len(articles) > 0 {
+		logger.WithFields(logrus.Fields{
+			"article_count": len(articles),
+		}).Info("Rendered Markdown for existing articles")
+	}
+	return nil
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Media is an image in a user's library. The original and its resized
+// variants live under uploads/media/{user_id}/.
+type Media struct {
+	ID          uint           `json:"id" gorm:"primaryKey"`
+	UserID      uint           `json:"user_id" gorm:"index"`
+	FileName    string         `json:"file_name"`
+	Alt         string         `json:"alt"`
+	ContentType string         `json:"content_type"`
+	Size        int64          `json:"size"`
+	Width       int            `json:"width"`
+	Height      int            `json:"height"`
+	URL         string         `json:"url"`
+	Variants    []MediaVariant `json:"variants" gorm:"serializer:json"`
+	Markdown    string         `json:"markdown" gorm:"-"`
+	SrcSet      string         `json:"srcset" gorm:"-"`
+	CreatedAt   time.Time      `json:"created_at"`
+}
+
+// MediaVariant is a resized copy of a Media image.
+type MediaVariant struct {
+	Name   string `json:"name"` // "thumb" or "{width}w"
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+}
+
+const (
+	uploadsDir = "uploads"
+	// Images larger than this many pixels are refused before decoding
+	maxMediaPixels = 40_000_000
+	thumbnailSize  = 320
+)
+
+// Maximum upload size in bytes, MEDIA_MAX_BYTES.
+var maxMediaBytes = int64(getenvInt("MEDIA_MAX_BYTES", 10<<20))
+
+// Widths of the responsive variants; only those narrower than the original
+// are generated.
+var mediaWidths = []int{640, 1280, 1920}
+
+// mediaFormats maps the formats accepted for upload onto their content types.
+var mediaFormats = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+}
+
+var (
+	errUnsupportedMedia = errors.New("unsupported image type")
+	errMediaTooLarge    = errors.New("image dimensions are too large")
+)
+
+// fill the display fields that are derived from the stored ones.
+func (m *Media) fill() {
+	alt := strings.NewReplacer("[", "", "]", "").Replace(m.Alt)
+	m.Markdown = fmt.Sprintf("![%s](%s)", alt, m.URL)
+
+	parts := []string{}
+	for _, v := range m.Variants {
+		if v.Name != "thumb" {
+			parts = append(parts, fmt.Sprintf("%s %dw", v.URL, v.Width))
+		}
+	}
+	parts = append(parts, fmt.Sprintf("%s %dw", m.URL, m.Width))
+	m.SrcSet = strings.Join(parts, ", ")
+}
+
+// decodeMedia checks that data is an image we accept and decodes it. The
+// header is inspected first so oversized images are refused cheaply.
+func decodeMedia(data []byte) (image.Image, string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", errUnsupportedMedia
+	}
+	if _, ok := mediaFormats[format]; !ok {
+		return nil, "", errUnsupportedMedia
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxMediaPixels {
+		return nil, "", errMediaTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", errUnsupportedMedia
+	}
+	return img, format, nil
+}
+
+// resizeToWidth scales img down to width, keeping the aspect ratio.
+func resizeToWidth(img image.Image, width int) image.Image {
+	b := img.Bounds()
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// thumbnailImage crops the centre square of img and scales it to size.
+func thumbnailImage(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+	if side < size {
+		size = side
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, image.Rect(x0, y0, x0+side, y0+side), draw.Src, nil)
+	return dst
+}
+
+// encodeVariant writes a resized image. JPEG sources stay JPEG; everything
+// else becomes PNG so transparency survives. Animated GIFs keep their
+// animation only in the original.
+func encodeVariant(w io.Writer, img image.Image, format string) error {
+	if format == "jpeg" {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	}
+	return png.Encode(w, img)
+}
+
+func variantExtension(format string) string {
+	if format == "jpeg" {
+		return ".jpg"
+	}
+	return ".png"
+}
+
+func originalExtension(format string) string {
+	switch format {
+	case "jpeg":
+		return ".jpg"
+	case "gif":
+		return ".gif"
+	case "webp":
+		return ".webp"
+	}
+	return ".png"
+}
+
+func randomName() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func writeFile(name string, write func(io.Writer) error) error {
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// storeMedia saves the original upload and its variants for userID and
+// returns the record to insert. Files already written are removed on error.
+func storeMedia(userID uint, fileName string, data []byte) (*Media, error) {
+	img, format, err := decodeMedia(data)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := path.Join("media", strconv.FormatUint(uint64(userID), 10))
+	if err := os.MkdirAll(filepath.Join(uploadsDir, filepath.FromSlash(dir)), 0755); err != nil {
+		return nil, err
+	}
+
+	base := randomName()
+	b := img.Bounds()
+	media := &Media{
+		UserID:      userID,
+		FileName:    filepath.Base(fileName),
+		ContentType: mediaFormats[format],
+		Size:        int64(len(data)),
+		Width:       b.Dx(),
+		Height:      b.Dy(),
+		URL:         "/" + path.Join(uploadsDir, dir, base+originalExtension(format)),
+		Variants:    []MediaVariant{},
+	}
+
+	written := []string{}
+	save := func(url string, write func(io.Writer) error) error {
+		name := filepath.FromSlash(strings.TrimPrefix(url, "/"))
+		if err := writeFile(name, write); err != nil {
+			return err
+		}
+		written = append(written, name)
+		return nil
+	}
+	fail := func(err error) (*Media, error) {
+		for _, name := range written {
+			os.Remove(name)
+		}
+		return nil, err
+	}
+
+	if err := save(media.URL, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}); err != nil {
+		return fail(err)
+	}
+
+	thumb := thumbnailImage(img, thumbnailSize)
+	thumbURL := "/" + path.Join(uploadsDir, dir, base+"-thumb"+variantExtension(format))
+	if err := save(thumbURL, func(w io.Writer) error { return encodeVariant(w, thumb, format) }); err != nil {
+		return fail(err)
+	}
+	media.Variants = append(media.Variants, MediaVariant{
+		Name: "thumb", Width: thumb.Bounds().Dx(), Height: thumb.Bounds().Dy(), URL: thumbURL,
+	})
+
+	for _, width := range mediaWidths {
+		if width >= b.Dx() {
+			break
+		}
+		resized := resizeToWidth(img, width)
+		name := strconv.Itoa(width) + "w"
+		url := "/" + path.Join(uploadsDir, dir, base+"-"+name+variantExtension(format))
+		if err := save(url, func(w io.Writer) error { return encodeVariant(w, resized, format) }); err != nil {
+			return fail(err)
+		}
+		media.Variants = append(media.Variants, MediaVariant{
+			Name: name, Width: width, Height: resized.Bounds().Dy(), URL: url,
+		})
+	}
+	return media, nil
+}
+
+// removeMediaFiles deletes the original and variants of media from disk.
+func removeMediaFiles(media *Media) {
+	urls := []string{media.URL}
+	for _, v := range media.Variants {
+		urls = append(urls, v.URL)
+	}
+	for _, url := range urls {
+		name := filepath.FromSlash(strings.TrimPrefix(url, "/"))
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			logger.WithFields(logrus.Fields{
+				"media_id": media.ID,
+				"file":     name,
+				"error":    err.Error(),
+			}).Warn("Failed to remove media file")
+		}
+	}
+}
+
+// uploadMediaHandler accepts a multipart upload with a "file" field and an
+// optional "alt" text.
+func uploadMediaHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(uint)
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxMediaBytes+1<<20)
+	if err := r.ParseMultipartForm(maxMediaBytes); err != nil {
+		http.Error(w, `{"error": "Upload is too large or not multipart"}`, http.StatusRequestEntityTooLarge)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, `{"error": "file is required"}`, http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if header.Size > maxMediaBytes {
+		http.Error(w, `{"error": "File is too large"}`, http.StatusRequestEntityTooLarge)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(file, maxMediaBytes+1))
+	if err != nil || int64(len(data)) > maxMediaBytes {
+		http.Error(w, `{"error": "File is too large"}`, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	media, err := storeMedia(userID, header.Filename, data)
+	if errors.Is(err, errUnsupportedMedia) {
+		http.Error(w, `{"error": "Only JPEG, PNG, GIF and WebP images are accepted"}`, http.StatusUnsupportedMediaType)
+		return
+	}
+	if errors.Is(err, errMediaTooLarge) {
+		http.Error(w, `{"error": "Image dimensions are too large"}`, http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"user_id": userID,
+			"error":   err.Error(),
+		}).Error("Failed to store media")
+		http.Error(w, `{"error": "Error saving upload"}`, http.StatusInternalServerError)
+		return
+	}
+	media.Alt = strings.TrimSpace(r.FormValue("alt"))
+
+	if err := db.Create(media).Error; err != nil {
+		removeMediaFiles(media)
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"media_id": media.ID,
+		"user_id":  userID,
+		"size":     media.Size,
+	}).Info("Media uploaded")
+
+	media.fill()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(media)
+}
+
+// getMediaHandler lists the caller's media, newest first. Admins can pass
+// ?user_id= to see another library.
+func getMediaHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(uint)
+	role, _ := r.Context().Value("role").(string)
+	if other := r.URL.Query().Get("user_id"); other != "" && role == "admin" {
+		id, err := strconv.ParseUint(other, 10, 64)
+		if err != nil {
+			http.Error(w, `{"error": "Invalid user ID"}`, http.StatusBadRequest)
+			return
+		}
+		userID = uint(id)
+	}
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit < 1 || limit > 100 {
+		limit = 30
+	}
+
+	var total int64
+	db.Model(&Media{}).Where("user_id = ?", userID).Count(&total)
+
+	media := []Media{}
+	if err := db.Where("user_id = ?", userID).Order("created_at DESC, id DESC").
+		Offset((page - 1) * limit).Limit(limit).Find(&media).Error; err != nil {
+		http.Error(w, `{"error": "Error fetching media"}`, http.StatusInternalServerError)
+		return
+	}
+	for i := range media {
+		media[i].fill()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"page":  page,
+		"limit": limit,
+		"total": total,
+		"media": media,
+	})
+}
+
+// deleteMediaHandler removes an image and its files. Images still used in an
+// article are kept unless ?force=true.
+func deleteMediaHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(uint)
+	role, _ := r.Context().Value("role").(string)
+
+	var media Media
+	if err := db.First(&media, mux.Vars(r)["id"]).Error; err != nil {
+		http.Error(w, `{"error": "Media not found"}`, http.StatusNotFound)
+		return
+	}
+	if media.UserID != userID && role != "admin" {
+		http.Error(w, `{"error": "Forbidden: you can only delete your own media"}`, http.StatusForbidden)
+		return
+	}
+
+	if r.URL.Query().Get("force") != "true" {
+		urls := []string{media.URL}
+		for _, v := range media.Variants {
+			urls = append(urls, v.URL)
+		}
+		query := db.Model(&Article{})
+		for i, url := range urls {
+			if i == 0 {
+				query = query.Where("content LIKE ?", "%"+url+"%")
+			} else {
+				query = query.Or("content LIKE ?", "%"+url+"%")
+			}
+		}
+		var articleIDs []uint
+		if err := query.Pluck("id", &articleIDs).Error; err != nil {
+			http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+			return
+		}
+		if len(articleIDs) > 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":       "Media is used in articles, pass force=true to delete it anyway",
+				"article_ids": articleIDs,
+			})
+			return
+		}
+	}
+
+	if err := db.Delete(&media).Error; err != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	removeMediaFiles(&media)
+
+	logger.WithFields(logrus.Fields{
+		"media_id": media.ID,
+		"user_id":  userID,
+	}).Info("Media deleted")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Media deleted successfully"})
+}
+
+// serveUploads serves files under uploads/ without directory listings, and
+// tells browsers not to sniff them into something other than an image.
+// Media library files get random names and never change, so browsers may
+// keep them for good; anything else, such as profile pictures, is
+// revalidated.
+func serveUploads() http.Handler {
+	files := http.StripPrefix("/uploads", http.FileServer(http.Dir(uploadsDir)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if strings.HasPrefix(path.Clean(r.URL.Path), "/uploads/media/") {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", cacheRevalidate)
+		}
+		files.ServeHTTP(w, r)
+	})
+}
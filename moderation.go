@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/sirupsen/logrus"
+)
+
+// moderationVerdict is what a check, or the whole pipeline, decides about a
+// submission. Higher verdicts win.
+type moderationVerdict int
+
+const (
+	moderationAllow moderationVerdict = iota
+	// moderationReview holds the submission until an admin looks at it
+	moderationReview
+	// moderationReject refuses the submission outright
+	moderationReject
+)
+
+func (v moderationVerdict) String() string {
+	switch v {
+	case moderationReview:
+		return "review"
+	case moderationReject:
+		return "reject"
+	}
+	return "allow"
+}
+
+// moderationSubject is an article or comment being submitted. ID is zero
+// for new submissions.
+type moderationSubject struct {
+	Kind   string
+	ID     uint
+	UserID uint
+	Title  string
+	Text   string
+}
+
+// moderationFinding is the reason one check gave for its verdict.
+type moderationFinding struct {
+	Check   string            `json:"check"`
+	Verdict moderationVerdict `json:"-"`
+	Reason  string            `json:"reason"`
+}
+
+// moderationResult is the outcome of running every check on a subject.
+type moderationResult struct {
+	Verdict  moderationVerdict
+	Findings []moderationFinding
+}
+
+// reasons joins the findings for reports and error messages.
+func (r moderationResult) reasons() string {
+	parts := make([]string, len(r.Findings))
+	for i, finding := range r.Findings {
+		parts[i] = finding.Check + ": " + finding.Reason
+	}
+	return strings.Join(parts, "; ")
+}
+
+// moderationCheck is one step of the moderation pipeline. A check returns
+// moderationAllow with an empty reason when it has nothing to say.
+type moderationCheck interface {
+	Name() string
+	Check(subject moderationSubject) (moderationVerdict, string)
+}
+
+// moderationChecks run on every article and comment submitted by a
+// non-admin, in order.
+var moderationChecks = []moderationCheck{
+	newWordListCheck(
+		getenvDefault("MODERATION_BLOCKED_WORDS", ""),
+		getenvDefault("MODERATION_REVIEW_WORDS", "viagra,cialis,casino,payday loan,escort"),
+	),
+	linkCountCheck{
+		maxArticleLinks: getenvInt("MODERATION_MAX_ARTICLE_LINKS", 30),
+		maxCommentLinks: getenvInt("MODERATION_MAX_COMMENT_LINKS", 2),
+	},
+	duplicateCheck{window: 24 * time.Hour, minLength: 30, rejectAfter: 3},
+}
+
+// registerModerationCheck adds a check to the pipeline. Call it from an init
+// function so the check is in place before the server starts.
+func registerModerationCheck(check moderationCheck) {
+	moderationChecks = append(moderationChecks, check)
+}
+
+// moderate runs the pipeline on subject.
+func moderate(subject moderationSubject) moderationResult {
+	var result moderationResult
+	for _, check := range moderationChecks {
+		verdict, reason := check.Check(subject)
+		if verdict == moderationAllow {
+			continue
+		}
+		result.Findings = append(result.Findings, moderationFinding{Check: check.Name(), Verdict: verdict, Reason: reason})
+		if verdict > result.Verdict {
+			result.Verdict = verdict
+		}
+	}
+	if result.Verdict != moderationAllow {
+		logger.WithFields(logrus.Fields{
+			"kind":    subject.Kind,
+			"id":      subject.ID,
+			"user_id": subject.UserID,
+			"verdict": result.Verdict.String(),
+			"reasons": result.reasons(),
+		}).Warn("Submission flagged by moderation")
+	}
+	return result
+}
+
+// moderateSubmission runs the pipeline for the caller of r; admins are not
+// moderated. A rejection is written to w and reported as false.
+func moderateSubmission(w http.ResponseWriter, r *http.Request, subject moderationSubject) (moderationResult, bool) {
+	if role, _ := r.Context().Value("role").(string); role == "admin" {
+		return moderationResult{}, true
+	}
+	result := moderate(subject)
+	if result.Verdict == moderationReject {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":    "Your " + subject.Kind + " was rejected by moderation",
+			"findings": result.Findings,
+		})
+		return result, false
+	}
+	return result, true
+}
+
+// normalizeText lowercases text and reduces it to words separated by single
+// spaces, so matching ignores punctuation and formatting.
+func normalizeText(text string) string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(words, " ")
+}
+
+// contentFingerprint identifies texts that are the same apart from case,
+// punctuation and whitespace.
+func contentFingerprint(text string) string {
+	normalized := normalizeText(text)
+	if normalized == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:16])
+}
+
+// wordListCheck rejects submissions containing a blocked word or phrase and
+// holds those containing a suspicious one. Lists are comma separated.
+type wordListCheck struct {
+	blocked []string
+	review  []string
+}
+
+func newWordListCheck(blocked, review string) wordListCheck {
+	split := func(list string) []string {
+		var phrases []string
+		for _, phrase := range strings.Split(list, ",") {
+			if phrase = normalizeText(phrase); phrase != "" {
+				phrases = append(phrases, phrase)
+			}
+		}
+		return phrases
+	}
+	return wordListCheck{blocked: split(blocked), review: split(review)}
+}
+
+func (c wordListCheck) Name() string { return "word_list" }
+
+func (c wordListCheck) Check(subject moderationSubject) (moderationVerdict, string) {
+	text := " " + normalizeText(subject.Title+" "+subject.Text) + " "
+	for _, phrase := range c.blocked {
+		if strings.Contains(text, " "+phrase+" ") {
+			return moderationReject, fmt.Sprintf("contains the blocked word %q", phrase)
+		}
+	}
+	for _, phrase := range c.review {
+		if strings.Contains(text, " "+phrase+" ") {
+			return moderationReview, fmt.Sprintf("contains the word %q", phrase)
+		}
+	}
+	return moderationAllow, ""
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)`)
+
+// linkCountCheck holds submissions with more links than is usual for their
+// kind, the most common sign of spam.
+type linkCountCheck struct {
+	maxArticleLinks int
+	maxCommentLinks int
+}
+
+func (c linkCountCheck) Name() string { return "link_count" }
+
+func (c linkCountCheck) Check(subject moderationSubject) (moderationVerdict, string) {
+	limit := c.maxArticleLinks
+	if subject.Kind == ReportComment {
+		limit = c.maxCommentLinks
+	}
+	if count := len(linkPattern.FindAllStringIndex(subject.Text, -1)); count > limit {
+		return moderationReview, fmt.Sprintf("%d links, more than %d", count, limit)
+	}
+	return moderationAllow, ""
+}
+
+// duplicateCheck looks for the same text submitted before. Comments are
+// compared with those of the last window and rejected once the text was
+// posted rejectAfter times; articles are compared with all articles. Short
+// texts such as "Thanks!" are not checked.
+type duplicateCheck struct {
+	window      time.Duration
+	minLength   int
+	rejectAfter int64
+}
+
+func (c duplicateCheck) Name() string { return "duplicate" }
+
+func (c duplicateCheck) Check(subject moderationSubject) (moderationVerdict, string) {
+	if len(normalizeText(subject.Text)) < c.minLength {
+		return moderationAllow, ""
+	}
+	fingerprint := contentFingerprint(subject.Text)
+
+	var count int64
+	if subject.Kind == ReportComment {
+		db.Model(&Comment{}).
+			Where("fingerprint = ? AND id <> ? AND created_at > ?", fingerprint, subject.ID, time.Now().Add(-c.window)).
+			Count(&count)
+		if count >= c.rejectAfter {
+			return moderationReject, fmt.Sprintf("the same comment was posted %d times recently", count)
+		}
+	} else {
+		db.Model(&Article{}).Where("fingerprint = ? AND id <> ?", fingerprint, subject.ID).Count(&count)
+	}
+	if count > 0 {
+		return moderationReview, fmt.Sprintf("%d earlier copies of the same text", count)
+	}
+	return moderationAllow, ""
+}
+
+// backfillArticleFingerprints fingerprints articles written before the
+// duplicate check existed, so new copies of them are caught too.
+func backfillArticleFingerprints() error {
+	var articles []Article
+	if err := db.Select("id", "content").Where("(fingerprint IS NULL OR fingerprint = '') AND content <> ''").
+		Find(&articles).Error; err != nil {
+		return err
+	}
+	for _, article := range articles {
+		fingerprint := contentFingerprint(article.Content)
+		if fingerprint == "" {
+			continue
+		}
+		if err := db.Model(&Article{}).Where("id = ?", article.ID).UpdateColumn("fingerprint", fingerprint).Error; err != nil {
+			return err
+		}
+	}
+	if len(articles) > 0 {
+		logger.WithFields(logrus.Fields{
+			"article_count": len(articles),
+		}).Info("Fingerprinted existing articles")
+	}
+	return nil
+}
+
+// flagForReview files an automatic report so the flagged item shows up in
+// the admin queue with the reasons. Flagging an item again refreshes the
+// open automatic report instead of adding another.
+func flagForReview(kind string, id uint, result moderationResult) {
+	report := Report{
+		TargetType: kind,
+		TargetID:   id,
+		Reason:     ReasonAutomatic,
+		Status:     ReportOpen,
+	}
+	err := db.Where(&report).Attrs(Report{Details: result.reasons()}).FirstOrCreate(&report).Error
+	if err == nil && report.Details != result.reasons() {
+		err = db.Model(&report).Update("details", result.reasons()).Error
+	}
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"kind":  kind,
+			"id":    id,
+			"error": err.Error(),
+		}).Error("Failed to file moderation report")
+	}
+}
+
+// isBanned reports whether a user was banned by an admin.
+func isBanned(userID uint) bool {
+	var user User
+	if err := db.Select("banned").First(&user, userID).Error; err != nil {
+		return false
+	}
+	return user.Banned
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Subscriber is an email address that receives digests of new articles. It
+// does not need an account; the address is confirmed by a link mailed to
+// it before anything else is sent.
+type Subscriber struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	Email         string     `json:"email" gorm:"uniqueIndex"`
+	Frequency     string     `json:"frequency"`
+	Language      string     `json:"language" gorm:"size:8"`
+	Status        string     `json:"status" gorm:"index"`
+	ConfirmToken  string     `json:"-" gorm:"index"`
+	ConfirmSentAt *time.Time `json:"-"`
+	ConfirmedAt   *time.Time `json:"confirmed_at"`
+	// Articles published after LastSentAt go into the next digest
+	LastSentAt *time.Time `json:"last_sent_at" gorm:"index"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+const (
+	SubscriberPending      = "pending"
+	SubscriberConfirmed    = "confirmed"
+	SubscriberUnsubscribed = "unsubscribed"
+
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+const (
+	// How long a confirmation link stays valid.
+	subscriptionConfirmWindow = 7 * 24 * time.Hour
+	// A new confirmation mail is not sent sooner than this after the last.
+	subscriptionResendDelay = 10 * time.Minute
+	// How often the digest job looks for subscribers that are due.
+	digestInterval = time.Hour
+	// Articles listed in one digest; the rest are left to the site.
+	digestArticleLimit = 20
+)
+
+// digestPeriods is how long a subscriber waits between digests.
+var digestPeriods = map[string]time.Duration{
+	DigestDaily:  24 * time.Hour,
+	DigestWeekly: 7 * 24 * time.Hour,
+}
+
+// newsletterSecret signs unsubscribe links, NEWSLETTER_SECRET or else the
+// JWT secret.
+func newsletterSecret() []byte {
+	if secret := getenvDefault("NEWSLETTER_SECRET", ""); secret != "" {
+		return []byte(secret)
+	}
+	return jwtSecret
+}
+
+// unsubscribeSignature authenticates an unsubscribe link. It covers the
+// address as well as the ID, so a link stays useless for another subscriber
+// that gets the same ID later.
+func unsubscribeSignature(sub Subscriber) string {
+	mac := hmac.New(sha256.New, newsletterSecret())
+	fmt.Fprintf(mac, "%d:%s", sub.ID, strings.ToLower(sub.Email))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// unsubscribeURL is the one-click unsubscribe link put in every mail.
+func unsubscribeURL(sub Subscriber) string {
+	return fmt.Sprintf("%s/newsletter/unsubscribe?id=%d&sig=%s", siteURL, sub.ID, unsubscribeSignature(sub))
+}
+
+// confirmSubscriptionURL is the double opt-in link.
+func confirmSubscriptionURL(sub Subscriber) string {
+	return fmt.Sprintf("%s/newsletter/confirm?token=%s", siteURL, sub.ConfirmToken)
+}
+
+// digestDue reports whether a confirmed subscriber should get a digest now.
+func digestDue(sub Subscriber, now time.Time) bool {
+	period, ok := digestPeriods[sub.Frequency]
+	if !ok || sub.Status != SubscriberConfirmed || sub.LastSentAt == nil {
+		return false
+	}
+	return !sub.LastSentAt.Add(period).After(now)
+}
+
+// subscribeHandler starts a subscription for an email address. A
+// confirmation link is mailed to it, except when a logged-in user
+// subscribes their own verified address. The answer does not say whether
+// the address was subscribed before.
+func subscribeHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Email     string `json:"email"`
+		Frequency string `json:"frequency"`
+		Language  string `json:"language"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	address, err := mail.ParseAddress(strings.TrimSpace(request.Email))
+	if err != nil || address.Address != strings.TrimSpace(request.Email) {
+		http.Error(w, `{"error": "A valid email address is required"}`, http.StatusBadRequest)
+		return
+	}
+	email := strings.ToLower(address.Address)
+	if request.Frequency == "" {
+		request.Frequency = DigestWeekly
+	}
+	if _, ok := digestPeriods[request.Frequency]; !ok {
+		http.Error(w, `{"error": "Frequency must be daily or weekly"}`, http.StatusBadRequest)
+		return
+	}
+	language := requestedLanguage(r)
+	if request.Language != "" {
+		if language = normalizeLanguage(request.Language); language == "" {
+			http.Error(w, `{"error": "Unsupported language"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	var sub Subscriber
+	err = db.Where("email = ?", email).First(&sub).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+
+	if claims := optionalClaims(r); claims != nil {
+		var user User
+		if db.First(&user, claims.UserID).Error == nil && user.EmailVerified && strings.EqualFold(user.Email, email) {
+			sub.Email = email
+			sub.Frequency = request.Frequency
+			sub.Language = language
+			if sub.Status != SubscriberConfirmed {
+				sub.Status = SubscriberConfirmed
+				sub.ConfirmToken = ""
+				sub.ConfirmedAt = &now
+				sub.LastSentAt = &now
+			}
+			if err := db.Save(&sub).Error; err != nil {
+				http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+				return
+			}
+			logger.WithFields(logrus.Fields{
+				"subscriber_id": sub.ID,
+				"user_id":       user.ID,
+			}).Info("Account subscribed to the newsletter")
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"message": "Subscribed", "frequency": sub.Frequency})
+			return
+		}
+	}
+
+	// A confirmed address only changes after a confirmation, and pending
+	// ones are not mailed more often than subscriptionResendDelay.
+	resend := sub.Status != SubscriberConfirmed &&
+		(sub.ConfirmSentAt == nil || now.Sub(*sub.ConfirmSentAt) >= subscriptionResendDelay)
+	if resend {
+		sub.Email = email
+		sub.Frequency = request.Frequency
+		sub.Language = language
+		sub.Status = SubscriberPending
+		sub.ConfirmToken = newInvitationCode()
+		sub.ConfirmSentAt = &now
+		if err := db.Save(&sub).Error; err != nil {
+			http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+			return
+		}
+		if err := sendSubscriptionConfirmEmail(sub); err != nil {
+			logger.WithFields(logrus.Fields{
+				"subscriber_id": sub.ID,
+				"error":         err.Error(),
+			}).Error("Failed to send subscription confirmation")
+			db.Model(&sub).Update("confirm_sent_at", nil)
+			http.Error(w, `{"error": "Failed to send the confirmation email"}`, http.StatusInternalServerError)
+			return
+		}
+		logger.WithFields(logrus.Fields{
+			"subscriber_id": sub.ID,
+		}).Info("Subscription confirmation sent")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Check your inbox to confirm the subscription"})
+}
+
+// confirmSubscriptionHandler serves the link from the confirmation mail.
+// The first digest covers articles published after this moment.
+func confirmSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	var sub Subscriber
+	if token == "" || db.Where("confirm_token = ? AND status = ?", token, SubscriberPending).First(&sub).Error != nil ||
+		sub.ConfirmSentAt == nil || time.Since(*sub.ConfirmSentAt) > subscriptionConfirmWindow {
+		writeNewsletterPage(w, r, http.StatusNotFound, "Link expired", "This confirmation link is invalid or has expired. Please subscribe again.", "")
+		return
+	}
+
+	now := time.Now()
+	res := db.Model(&Subscriber{}).
+		Where("id = ? AND confirm_token = ?", sub.ID, token).
+		Updates(map[string]interface{}{
+			"status":        SubscriberConfirmed,
+			"confirm_token": "",
+			"confirmed_at":  now,
+			"last_sent_at":  now,
+		})
+	if res.Error != nil {
+		writeTemplateError(w, res.Error)
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"subscriber_id": sub.ID,
+	}).Info("Subscription confirmed")
+	writeNewsletterPage(w, r, http.StatusOK, "Subscription confirmed",
+		fmt.Sprintf("%s will receive a %s digest of new articles.", sub.Email, sub.Frequency), "")
+}
+
+// unsubscribeHandler serves the signed link in every mail. GET only shows a
+// button, so link scanners cannot unsubscribe anyone; the POST it sends is
+// also what mail clients use for one-click unsubscribe (RFC 8058).
+func unsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	var sub Subscriber
+	if id == 0 || db.First(&sub, uint(id)).Error != nil ||
+		!hmac.Equal([]byte(unsubscribeSignature(sub)), []byte(r.URL.Query().Get("sig"))) {
+		writeNewsletterPage(w, r, http.StatusNotFound, "Link invalid", "This unsubscribe link is invalid.", "")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeNewsletterPage(w, r, http.StatusOK, "Unsubscribe",
+			fmt.Sprintf("Stop sending new articles to %s?", sub.Email), r.URL.RequestURI())
+		return
+	}
+
+	if sub.Status != SubscriberUnsubscribed {
+		if err := db.Model(&sub).Updates(map[string]interface{}{
+			"status":        SubscriberUnsubscribed,
+			"confirm_token": "",
+		}).Error; err != nil {
+			writeTemplateError(w, err)
+			return
+		}
+		logger.WithFields(logrus.Fields{
+			"subscriber_id": sub.ID,
+		}).Info("Unsubscribed from the newsletter")
+	}
+	writeNewsletterPage(w, r, http.StatusOK, "Unsubscribed",
+		fmt.Sprintf("%s will not receive any more emails from %s.", sub.Email, siteName), "")
+}
+
+// writeNewsletterPage renders the small pages behind newsletter links.
+// action, when set, adds a button that posts to it.
+func writeNewsletterPage(w http.ResponseWriter, r *http.Request, status int, heading, message, action string) {
+	var page bytes.Buffer
+	err := pageTemplates["newsletter"].ExecuteTemplate(&page, "layout", pageData{
+		Lang:     siteLanguage,
+		SiteName: siteName,
+		Meta: pageMeta{
+			Title:     heading + " — " + siteName,
+			Canonical: siteURL + r.URL.Path,
+			Type:      "website",
+		},
+		Heading: heading,
+		Message: message,
+		Action:  action,
+	})
+	if err != nil {
+		writeTemplateError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(page.Bytes())
+}
+
+// sendDueDigests mails every subscriber whose digest is due the articles
+// published since their last one. A subscriber is claimed by moving
+// last_sent_at before the mail goes out, so two instances never send the
+// same digest; a failed delivery moves it back to be retried next time.
+func sendDueDigests(now time.Time) {
+	var subscribers []Subscriber
+	if err := db.Where("status = ? AND last_sent_at IS NOT NULL", SubscriberConfirmed).Find(&subscribers).Error; err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Failed to fetch subscribers")
+		return
+	}
+
+	var due []Subscriber
+	since := now
+	for _, sub := range subscribers {
+		if digestDue(sub, now) {
+			due = append(due, sub)
+			if sub.LastSentAt.Before(since) {
+				since = *sub.LastSentAt
+			}
+		}
+	}
+	if len(due) == 0 {
+		return
+	}
+
+	var articles []Article
+	if err := db.Preload("User").
+		Where("status = ? AND published_at > ? AND published_at <= ?", ArticlePublished, since, now).
+		Order("published_at DESC, id DESC").Find(&articles).Error; err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Failed to fetch digest articles")
+		return
+	}
+
+	sent := 0
+	for _, sub := range due {
+		var fresh []Article
+		for _, article := range articles {
+			if article.PublishedAt.After(*sub.LastSentAt) {
+				fresh = append(fresh, article)
+			}
+		}
+
+		res := db.Model(&Subscriber{}).
+			Where("id = ? AND status = ? AND last_sent_at = ?", sub.ID, SubscriberConfirmed, *sub.LastSentAt).
+			Update("last_sent_at", now)
+		if res.Error != nil || res.RowsAffected == 0 || len(fresh) == 0 {
+			continue
+		}
+
+		err := localizeArticles(fresh, sub.Language)
+		if err == nil {
+			err = sendDigestEmail(sub, fresh)
+		}
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"subscriber_id": sub.ID,
+				"error":         err.Error(),
+			}).Error("Failed to send digest")
+			db.Model(&Subscriber{}).Where("id = ? AND last_sent_at = ?", sub.ID, now).Update("last_sent_at", *sub.LastSentAt)
+			continue
+		}
+		sent++
+	}
+
+	if sent > 0 {
+		logger.WithFields(logrus.Fields{
+			"digest_count": sent,
+		}).Info("Sent newsletter digests")
+	}
+}
+
+// runNewsletterDigests sends due digests in the background.
+func runNewsletterDigests(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		sendDueDigests(now)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// textOp is an operational transformation on plain text, in the format used
+// by ot.js: a positive number retains that many characters, a negative
+// number deletes that many and a string is inserted. Lengths count Unicode
+// code points, so the browser has to measure with Array.from rather than
+// String.length.
+type textOp []opComponent
+
+// opComponent is one step of a textOp; exactly one field is set.
+type opComponent struct {
+	Retain int
+	Delete int
+	Insert string
+}
+
+var errOpLength = errors.New("operation does not match the document length")
+
+func (op textOp) retain(n int) textOp {
+	if n <= 0 {
+		return op
+	}
+	if l := len(op); l > 0 && op[l-1].Retain > 0 {
+		op[l-1].Retain += n
+		return op
+	}
+	return append(op, opComponent{Retain: n})
+}
+
+func (op textOp) insert(s string) textOp {
+	if s == "" {
+		return op
+	}
+	l := len(op)
+	switch {
+	case l > 0 && op[l-1].Insert != "":
+		op[l-1].Insert += s
+	case l > 0 && op[l-1].Delete > 0:
+		// Inserts go before deletes so equivalent operations look the same
+		if l > 1 && op[l-2].Insert != "" {
+			op[l-2].Insert += s
+		} else {
+			op = append(op, op[l-1])
+			op[l-1] = opComponent{Insert: s}
+		}
+	default:
+		op = append(op, opComponent{Insert: s})
+	}
+	return op
+}
+
+func (op textOp) delete(n int) textOp {
+	if n <= 0 {
+		return op
+	}
+	if l := len(op); l > 0 && op[l-1].Delete > 0 {
+		op[l-1].Delete += n
+		return op
+	}
+	return append(op, opComponent{Delete: n})
+}
+
+// baseLen is the length of the text the operation applies to.
+func (op textOp) baseLen() int {
+	n := 0
+	for _, c := range op {
+		n += c.Retain + c.Delete
+	}
+	return n
+}
+
+// targetLen is the length of the text after the operation.
+func (op textOp) targetLen() int {
+	n := 0
+	for _, c := range op {
+		n += c.Retain + utf8.RuneCountInString(c.Insert)
+	}
+	return n
+}
+
+// apply runs the operation on doc.
+func (op textOp) apply(doc []rune) ([]rune, error) {
+	if op.baseLen() != len(doc) {
+		return nil, errOpLength
+	}
+	out := make([]rune, 0, op.targetLen())
+	pos := 0
+	for _, c := range op {
+		switch {
+		case c.Retain > 0:
+			out = append(out, doc[pos:pos+c.Retain]...)
+			pos += c.Retain
+		case c.Delete > 0:
+			pos += c.Delete
+		default:
+			out = append(out, []rune(c.Insert)...)
+		}
+	}
+	return out, nil
+}
+
+// transformOps takes two operations a and b made concurrently on the same
+// text and returns a' and b' such that applying a then b' gives the same
+// text as applying b then a'. When both insert at the same place the text
+// of a goes first.
+func transformOps(a, b textOp) (textOp, textOp, error) {
+	if a.baseLen() != b.baseLen() {
+		return nil, nil, errOpLength
+	}
+
+	var a1, b1 textOp
+	i, j := 0, 0
+	var ca, cb opComponent
+	nextA := func() {
+		ca = opComponent{}
+		if i < len(a) {
+			ca = a[i]
+			i++
+		}
+	}
+	nextB := func() {
+		cb = opComponent{}
+		if j < len(b) {
+			cb = b[j]
+			j++
+		}
+	}
+	isEmpty := func(c opComponent) bool { return c.Retain == 0 && c.Delete == 0 && c.Insert == "" }
+	nextA()
+	nextB()
+
+	for !isEmpty(ca) || !isEmpty(cb) {
+		if ca.Insert != "" {
+			a1 = a1.insert(ca.Insert)
+			b1 = b1.retain(utf8.RuneCountInString(ca.Insert))
+			nextA()
+			continue
+		}
+		if cb.Insert != "" {
+			a1 = a1.retain(utf8.RuneCountInString(cb.Insert))
+			b1 = b1.insert(cb.Insert)
+			nextB()
+			continue
+		}
+		if isEmpty(ca) || isEmpty(cb) {
+			return nil, nil, errOpLength
+		}
+
+		lenA, lenB := ca.Retain+ca.Delete, cb.Retain+cb.Delete
+		n := min(lenA, lenB)
+		switch {
+		case ca.Retain > 0 && cb.Retain > 0:
+			a1 = a1.retain(n)
+			b1 = b1.retain(n)
+		case ca.Delete > 0 && cb.Retain > 0:
+			a1 = a1.delete(n)
+		case ca.Retain > 0 && cb.Delete > 0:
+			b1 = b1.delete(n)
+		}
+		// Both deleting the same text leaves nothing to do for either
+
+		if lenA == n {
+			nextA()
+		} else if ca.Retain > 0 {
+			ca.Retain -= n
+		} else {
+			ca.Delete -= n
+		}
+		if lenB == n {
+			nextB()
+		} else if cb.Retain > 0 {
+			cb.Retain -= n
+		} else {
+			cb.Delete -= n
+		}
+	}
+	return a1, b1, nil
+}
+
+// transformIndex moves a cursor position in a text across op.
+func transformIndex(op textOp, index int) int {
+	newIndex := index
+	for _, c := range op {
+		switch {
+		case c.Retain > 0:
+			index -= c.Retain
+		case c.Delete > 0:
+			newIndex -= min(index, c.Delete)
+			index -= c.Delete
+		default:
+			newIndex += utf8.RuneCountInString(c.Insert)
+		}
+		if index < 0 {
+			break
+		}
+	}
+	return newIndex
+}
+
+// diffOp builds an operation turning from into to by replacing the part
+// between their common prefix and suffix.
+func diffOp(from, to string) textOp {
+	a, b := []rune(from), []rune(to)
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var op textOp
+	op = op.retain(prefix)
+	op = op.insert(string(b[prefix : len(b)-suffix]))
+	op = op.delete(len(a) - prefix - suffix)
+	return op.retain(suffix)
+}
+
+func (op textOp) MarshalJSON() ([]byte, error) {
+	out := make([]interface{}, len(op))
+	for i, c := range op {
+		switch {
+		case c.Retain > 0:
+			out[i] = c.Retain
+		case c.Delete > 0:
+			out[i] = -c.Delete
+		default:
+			out[i] = c.Insert
+		}
+	}
+	return json.Marshal(out)
+}
+
+func (op *textOp) UnmarshalJSON(data []byte) error {
+	var raw []interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	var parsed textOp
+	for _, item := range raw {
+		switch v := item.(type) {
+		case float64:
+			n := int(v)
+			if float64(n) != v || n == 0 {
+				return fmt.Errorf("invalid operation component %v", v)
+			}
+			if n > 0 {
+				parsed = parsed.retain(n)
+			} else {
+				parsed = parsed.delete(-n)
+			}
+		case string:
+			if v == "" {
+				return errors.New("invalid empty insert")
+			}
+			parsed = parsed.insert(v)
+		default:
+			return fmt.Errorf("invalid operation component %v", v)
+		}
+	}
+	*op = parsed
+	return nil
+}
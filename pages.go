@@ -0,0 +1,580 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+var siteLanguage = getenvDefault("SITE_LANGUAGE", "en")
+
+// Articles per listing page.
+const listingPageSize = 10
+
+var pageFuncs = template.FuncMap{
+	"indent":  func(level int) float64 { return float64(level-1) * 1.5 },
+	"excerpt": func(article Article) string { return articleExcerpt(article, 200) },
+}
+
+var pageTemplates = map[string]*template.Template{
+	"article":    parsePage("article"),
+	"list":       parsePage("list"),
+	"newsletter": parsePage("newsletter"),
+}
+
+func parsePage(name string) *template.Template {
+	return template.Must(template.New(name).Funcs(pageFuncs).
+		ParseFS(templateFS, "templates/layout.html", "templates/"+name+".html"))
+}
+
+var firstImagePattern = regexp.MustCompile(`<img[^>]+src="([^"]+)"`)
+
+// pageLinks builds the links between rendered pages. The server uses clean
+// paths from the site root. A static copy of the site sets Suffix to
+// "/index.html", so every page is a file in its own directory, and Root to
+// the way back up to the top of the copy ("../../"), so links are relative
+// and the copy works from any location, file:// included.
+type pageLinks struct {
+	Suffix string
+	Root   string
+}
+
+// path turns a path from the site root into a link.
+func (l pageLinks) path(p string) string {
+	if l.Root == "" {
+		return p
+	}
+	return l.Root + strings.TrimPrefix(p, "/")
+}
+
+// Static reports whether the links are for a static copy, which has no API
+// behind it.
+func (l pageLinks) Static() bool {
+	return l.Root != ""
+}
+
+func (l pageLinks) Article(slug string) string {
+	return l.path("/posts/" + url.PathEscape(slug) + l.Suffix)
+}
+
+// Listing links to all articles (kind "") or those with a tag, in a
+// category or by an author.
+func (l pageLinks) Listing(kind, slug string, page int) string {
+	path := "/posts"
+	if kind != "" {
+		path += "/" + kind + "/" + url.PathEscape(slug)
+	}
+	if page > 1 {
+		path += "/page/" + strconv.Itoa(page)
+	}
+	return l.path(path + l.Suffix)
+}
+
+// Author links to the articles of an author; the slug is the user ID.
+func (l pageLinks) Author(userID uint) string {
+	return l.Listing("author", strconv.FormatUint(uint64(userID), 10), 1)
+}
+
+func (l pageLinks) Asset(path string) string {
+	return l.path(path)
+}
+
+// pageMeta is what search engines and link previews read from <head>.
+type pageMeta struct {
+	Title       string
+	Description string
+	Canonical   string
+	Type        string // og:type
+	Image       string
+	Published   string
+	Modified    string
+	PrevURL     string
+	NextURL     string
+	Alternates  []pageAlternate
+	JSONLD      template.JS
+}
+
+// pageAlternate is the same page in another language, for hreflang links.
+type pageAlternate struct {
+	Language string // a language code or "x-default"
+	URL      string
+}
+
+type pageData struct {
+	Lang     string
+	SiteName string
+	Meta     pageMeta
+	Links    pageLinks
+
+	// Article page
+	Article *Article
+	Content template.HTML
+
+	// Listing page
+	Heading  string
+	Articles []Article
+
+	// Newsletter page; Action is where its button posts
+	Message string
+	Action  string
+}
+
+// listing is one page of published articles, optionally narrowed to a tag or
+// category.
+type listing struct {
+	Kind     string // "", "tag" or "category"
+	Slug     string
+	Name     string
+	Page     int
+	Articles []Article
+	HasNext  bool
+}
+
+// loadListing fetches a listing page. It returns gorm.ErrRecordNotFound for
+// an unknown tag or category.
+func loadListing(kind, slug string, page int) (*listing, error) {
+	l := &listing{Kind: kind, Slug: slug, Page: page}
+
+	query := db.Preload("User").Preload("Category").Preload("Tags").Where("status = ?", ArticlePublished)
+	switch kind {
+	case "tag":
+		var tag Tag
+		if err := db.Where("slug = ?", slug).First(&tag).Error; err != nil {
+			return nil, err
+		}
+		l.Name = tag.Name
+		query = query.Where("id IN (SELECT article_id FROM article_tags WHERE tag_id = ?)", tag.ID)
+	case "category":
+		var category Category
+		if err := db.Where("slug = ?", slug).First(&category).Error; err != nil {
+			return nil, err
+		}
+		l.Name = category.Name
+		query = query.Where("category_id = ?", category.ID)
+	case "author":
+		id, err := strconv.ParseUint(slug, 10, 64)
+		if err != nil {
+			return nil, gorm.ErrRecordNotFound
+		}
+		var author User
+		if err := db.First(&author, uint(id)).Error; err != nil {
+			return nil, err
+		}
+		l.Name = author.Name
+		query = query.Where("user_id = ?", author.ID)
+	}
+
+	if err := query.Order("published_at DESC NULLS LAST, id DESC").
+		Offset((page - 1) * listingPageSize).Limit(listingPageSize + 1).
+		Find(&l.Articles).Error; err != nil {
+		return nil, err
+	}
+	if len(l.Articles) > listingPageSize {
+		l.HasNext = true
+		l.Articles = l.Articles[:listingPageSize]
+	}
+	return l, nil
+}
+
+// articleImage returns the absolute URL of the first image in the article,
+// for link previews.
+func articleImage(article Article) string {
+	match := firstImagePattern.FindStringSubmatch(article.ContentHTML)
+	if match == nil {
+		return ""
+	}
+	src, err := url.Parse(strings.ReplaceAll(match[1], "&amp;", "&"))
+	if err != nil {
+		return ""
+	}
+	base, _ := url.Parse(siteURL + "/")
+	return base.ResolveReference(src).String()
+}
+
+func jsonLD(v interface{}) template.JS {
+	// json.Marshal escapes <, > and &, so the result cannot close the script
+	out, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return template.JS(out)
+}
+
+// renderArticlePage writes the HTML page of a published article.
+func renderArticlePage(w io.Writer, article *Article, links pageLinks) error {
+	canonical := siteURL + pageLinks{}.Article(article.Slug)
+	description := articleExcerpt(*article, 160)
+	published := feedPublished(*article)
+
+	keywords := []string{}
+	for _, tag := range article.Tags {
+		keywords = append(keywords, tag.Name)
+	}
+	ld := map[string]interface{}{
+		"@context":         "https://schema.org",
+		"@type":            "BlogPosting",
+		"headline":         article.Title,
+		"description":      description,
+		"url":              canonical,
+		"mainEntityOfPage": canonical,
+		"datePublished":    published.UTC().Format(time.RFC3339),
+		"dateModified":     article.UpdatedAt.UTC().Format(time.RFC3339),
+		"author":           map[string]string{"@type": "Person", "name": article.User.Name},
+		"publisher":        map[string]string{"@type": "Organization", "name": siteName},
+		"keywords":         strings.Join(keywords, ", "),
+	}
+	image := articleImage(*article)
+	if image != "" {
+		ld["image"] = image
+	}
+	language := articleLanguage(*article)
+	ld["inLanguage"] = language
+
+	var alternates []pageAlternate
+	for _, t := range article.Translations {
+		alternates = append(alternates, pageAlternate{Language: t.Language, URL: siteURL + pageLinks{}.Article(t.Slug)})
+		if t.Original {
+			alternates = append(alternates, pageAlternate{Language: "x-default", URL: siteURL + pageLinks{}.Article(t.Slug)})
+		}
+	}
+
+	return pageTemplates["article"].ExecuteTemplate(w, "layout", pageData{
+		Lang:     language,
+		SiteName: siteName,
+		Links:    links,
+		Meta: pageMeta{
+			Title:       article.Title + " — " + siteName,
+			Description: description,
+			Canonical:   canonical,
+			Type:        "article",
+			Image:       image,
+			Published:   published.UTC().Format(time.RFC3339),
+			Modified:    article.UpdatedAt.UTC().Format(time.RFC3339),
+			Alternates:  alternates,
+			JSONLD:      jsonLD(ld),
+		},
+		Article: article,
+		// content_html was sanitized when the article was saved
+		Content: template.HTML(article.ContentHTML),
+	})
+}
+
+// renderListingPage writes one page of an article listing.
+func renderListingPage(w io.Writer, l *listing, links pageLinks) error {
+	heading := "Articles"
+	description := "Latest articles on " + siteName
+	switch l.Kind {
+	case "tag":
+		heading = "Articles tagged " + l.Name
+		description = "Articles on " + siteName + " tagged " + l.Name
+	case "category":
+		heading = l.Name
+		description = "Articles on " + siteName + " in " + l.Name
+	case "author":
+		heading = "Articles by " + l.Name
+		description = "Articles on " + siteName + " by " + l.Name
+	}
+	title := heading + " — " + siteName
+	if l.Page > 1 {
+		title = fmt.Sprintf("%s, page %d — %s", heading, l.Page, siteName)
+	}
+	canonical := siteURL + pageLinks{}.Listing(l.Kind, l.Slug, l.Page)
+
+	items := []map[string]interface{}{}
+	for i, article := range l.Articles {
+		items = append(items, map[string]interface{}{
+			"@type":    "ListItem",
+			"position": (l.Page-1)*listingPageSize + i + 1,
+			"url":      siteURL + pageLinks{}.Article(article.Slug),
+			"name":     article.Title,
+		})
+	}
+
+	meta := pageMeta{
+		Title:       title,
+		Description: description,
+		Canonical:   canonical,
+		Type:        "website",
+		JSONLD: jsonLD(map[string]interface{}{
+			"@context": "https://schema.org",
+			"@type":    "CollectionPage",
+			"name":     heading,
+			"url":      canonical,
+			"mainEntity": map[string]interface{}{
+				"@type":           "ItemList",
+				"itemListElement": items,
+			},
+		}),
+	}
+	if l.Page > 1 {
+		meta.PrevURL = links.Listing(l.Kind, l.Slug, l.Page-1)
+	}
+	if l.HasNext {
+		meta.NextURL = links.Listing(l.Kind, l.Slug, l.Page+1)
+	}
+
+	return pageTemplates["list"].ExecuteTemplate(w, "layout", pageData{
+		Lang:     siteLanguage,
+		SiteName: siteName,
+		Links:    links,
+		Meta:     meta,
+		Heading:  heading,
+		Articles: l.Articles,
+	})
+}
+
+// postPageHandler serves /posts/{slug}. Every language version has its own
+// slug and page. Old slugs redirect permanently.
+func postPageHandler(w http.ResponseWriter, r *http.Request) {
+	slug := mux.Vars(r)["slug"]
+
+	var article Article
+	language := ""
+	err := db.Preload("User").Preload("Category").Preload("Tags").
+		Where("slug = ? AND status = ?", slug, ArticlePublished).First(&article).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if translation, terr := findTranslationBySlug(slug); terr == nil {
+			language = translation.Language
+			err = db.Preload("User").Preload("Category").Preload("Tags").
+				Where("id = ? AND status = ?", translation.ArticleID, ArticlePublished).First(&article).Error
+		}
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if current, ok := currentSlugFor(slug); ok {
+			http.Redirect(w, r, withQuery(pageLinks{}.Article(current), r), http.StatusMovedPermanently)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"slug":  slug,
+			"error": err.Error(),
+		}).Error("Failed to fetch article page")
+		http.Error(w, "Error fetching article", http.StatusInternalServerError)
+		return
+	}
+
+	if language == "" {
+		language = articleLanguage(article)
+	}
+
+	recordArticleView(r, &article)
+	noteArticleView(r, &article)
+	localized := []Article{article}
+	if err := localizeArticles(localized, language); err != nil {
+		http.Error(w, "Error fetching article", http.StatusInternalServerError)
+		return
+	}
+	article = localized[0]
+	if err := loadSeriesNav(&article); err != nil {
+		http.Error(w, "Error fetching article", http.StatusInternalServerError)
+		return
+	}
+	// A change elsewhere in the series or to another language version changes
+	// the navigation on this page
+	modified := article.UpdatedAt
+	if article.Series != nil && article.Series.updated.After(modified) {
+		modified = article.Series.updated
+	}
+	for _, t := range article.Translations {
+		if t.updated.After(modified) {
+			modified = t.updated
+		}
+	}
+	etag := fmt.Sprintf(`"page-%d-%s-%d-%d"`, article.ID, language, len(article.Translations), modified.UnixMicro())
+	if notModified(w, r, etag, modified) {
+		return
+	}
+
+	var page bytes.Buffer
+	if err := renderArticlePage(&page, &article, pageLinks{}); err != nil {
+		writeTemplateError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page.Bytes())
+}
+
+// postsPageHandler serves /posts, /posts/tag/{slug}, /posts/category/{slug},
+// /posts/author/{id} and their /page/{page} variants.
+func postsPageHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	page := 1
+	if p, ok := vars["page"]; ok {
+		page, _ = strconv.Atoi(p)
+		if page < 1 {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	l, err := loadListing(vars["kind"], vars["slug"], page)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"path":  r.URL.Path,
+			"error": err.Error(),
+		}).Error("Failed to fetch listing page")
+		http.Error(w, "Error fetching articles", http.StatusInternalServerError)
+		return
+	}
+	if page > 1 && len(l.Articles) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	var out bytes.Buffer
+	if err := renderListingPage(&out, l, pageLinks{}); err != nil {
+		writeTemplateError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(out.Bytes())
+}
+
+func writeTemplateError(w http.ResponseWriter, err error) {
+	logger.WithFields(logrus.Fields{
+		"error": err.Error(),
+	}).Error("Failed to render page")
+	http.Error(w, "Error rendering page", http.StatusInternalServerError)
+}
+
+// listingSlugs returns the tags, categories or authors that have published
+// articles, and so a listing page.
+func listingSlugs(kind string) ([]string, error) {
+	var slugs []string
+	var err error
+	switch kind {
+	case "tag":
+		err = db.Table("tags").Distinct("tags.slug").
+			Joins("JOIN article_tags ON article_tags.tag_id = tags.id").
+			Joins("JOIN articles ON articles.id = article_tags.article_id AND articles.status = ?", ArticlePublished).
+			Order("tags.slug").Pluck("tags.slug", &slugs).Error
+	case "category":
+		err = db.Table("categories").Distinct("categories.slug").
+			Joins("JOIN articles ON articles.category_id = categories.id AND articles.status = ?", ArticlePublished).
+			Order("categories.slug").Pluck("categories.slug", &slugs).Error
+	case "author":
+		var ids []uint
+		err = db.Model(&Article{}).Distinct("user_id").Where("status = ?", ArticlePublished).
+			Order("user_id").Pluck("user_id", &ids).Error
+		for _, id := range ids {
+			slugs = append(slugs, strconv.FormatUint(uint64(id), 10))
+		}
+	}
+	return slugs, err
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// buildSitemap lists the listing pages and every published article.
+func buildSitemap() (*sitemapURLSet, error) {
+	var articles []Article
+	if err := db.Select("id", "slug", "updated_at").Where("status = ?", ArticlePublished).
+		Order("published_at DESC NULLS LAST, id DESC").Find(&articles).Error; err != nil {
+		return nil, err
+	}
+
+	set := &sitemapURLSet{}
+	home := sitemapURL{Loc: siteURL + pageLinks{}.Listing("", "", 1)}
+	if len(articles) > 0 {
+		home.LastMod = articles[0].UpdatedAt.UTC().Format(time.RFC3339)
+	}
+	set.URLs = append(set.URLs, home)
+
+	for _, kind := range []string{"tag", "category", "author"} {
+		slugs, err := listingSlugs(kind)
+		if err != nil {
+			return nil, err
+		}
+		for _, slug := range slugs {
+			set.URLs = append(set.URLs, sitemapURL{Loc: siteURL + pageLinks{}.Listing(kind, slug, 1)})
+		}
+	}
+
+	for _, article := range articles {
+		set.URLs = append(set.URLs, sitemapURL{
+			Loc:     siteURL + pageLinks{}.Article(article.Slug),
+			LastMod: article.UpdatedAt.UTC().Format(time.RFC3339),
+		})
+	}
+
+	var translations []ArticleTranslation
+	if err := db.Select("article_translations.slug", "article_translations.updated_at").
+		Joins("JOIN articles ON articles.id = article_translations.article_id AND articles.status = ?", ArticlePublished).
+		Order("article_translations.article_id, article_translations.language").Find(&translations).Error; err != nil {
+		return nil, err
+	}
+	for _, t := range translations {
+		set.URLs = append(set.URLs, sitemapURL{
+			Loc:     siteURL + pageLinks{}.Article(t.Slug),
+			LastMod: t.UpdatedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	return set, nil
+}
+
+// sitemapHandler serves /sitemap.xml.
+func sitemapHandler(w http.ResponseWriter, r *http.Request) {
+	set, err := buildSitemap()
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Failed to build sitemap")
+		http.Error(w, "Error building sitemap", http.StatusInternalServerError)
+		return
+	}
+	writeXML(w, "application/xml; charset=utf-8", set)
+}
+
+// robotsText keeps crawlers out of account and admin pages and points them
+// at the sitemap.
+func robotsText() string {
+	return "User-agent: *\n" +
+		"Disallow: /admin\n" +
+		"Disallow: /profile\n" +
+		"Disallow: /createArticle.html\n" +
+		"Disallow: /payment.html\n" +
+		"Disallow: /supportChat.html\n" +
+		"Disallow: /newsletter/\n" +
+		"Allow: /\n" +
+		"\n" +
+		"Sitemap: " + siteURL + "/sitemap.xml\n"
+}
+
+// robotsHandler serves /robots.txt.
+func robotsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, robotsText())
+}
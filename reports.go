@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Report targets.
+const (
+	ReportArticle = "article"
+	ReportComment = "comment"
+)
+
+// Report states. An admin closes a report by dismissing it or by acting on
+// the target, which closes every open report on that target at once.
+const (
+	ReportOpen      = "open"
+	ReportDismissed = "dismissed"
+	ReportActioned  = "actioned"
+)
+
+// ReasonAutomatic marks reports filed by the moderation pipeline.
+const ReasonAutomatic = "automatic"
+
+// reportReasons are the reasons readers can give.
+var reportReasons = map[string]bool{"spam": true, "abuse": true, "off_topic": true, "other": true}
+
+const maxReportDetails = 1000
+
+// Report flags an article or comment for an admin. ReporterID is nil for
+// reports filed by the moderation pipeline.
+type Report struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	TargetType string     `json:"target_type" gorm:"index:idx_report_target"`
+	TargetID   uint       `json:"target_id" gorm:"index:idx_report_target"`
+	ReporterID *uint      `json:"reporter_id" gorm:"index"`
+	Reason     string     `json:"reason"`
+	Details    string     `json:"details"`
+	Status     string     `json:"status" gorm:"index"`
+	Resolution string     `json:"resolution,omitempty"`
+	ResolvedBy *uint      `json:"resolved_by,omitempty"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// reportTarget is a reported article or comment as shown in the admin queue.
+type reportTarget struct {
+	Type         string   `json:"target_type"`
+	ID           uint     `json:"target_id"`
+	Title        string   `json:"title"`
+	Status       string   `json:"status"`
+	ArticleID    uint     `json:"article_id"`
+	AuthorID     uint     `json:"author_id"`
+	AuthorName   string   `json:"author_name"`
+	AuthorBanned bool     `json:"author_banned"`
+	ReportCount  int      `json:"report_count"`
+	Reports      []Report `json:"reports"`
+}
+
+// loadReportTarget fills in the title, status and author of a target. It
+// returns gorm.ErrRecordNotFound when the target has been deleted.
+func loadReportTarget(targetType string, targetID uint) (reportTarget, error) {
+	target := reportTarget{Type: targetType, ID: targetID}
+	switch targetType {
+	case ReportArticle:
+		var article Article
+		if err := db.Preload("User").First(&article, targetID).Error; err != nil {
+			return target, err
+		}
+		target.Title = article.Title
+		target.Status = article.Status
+		target.ArticleID = article.ID
+		target.AuthorID = article.UserID
+		target.AuthorName = article.User.Name
+		target.AuthorBanned = article.User.Banned
+	case ReportComment:
+		var comment Comment
+		if err := db.Preload("User").First(&comment, targetID).Error; err != nil {
+			return target, err
+		}
+		target.Title = excerpt(comment.Content, 120)
+		target.Status = comment.Status
+		target.ArticleID = comment.ArticleID
+		target.AuthorID = comment.UserID
+		target.AuthorName = comment.authorName()
+		target.AuthorBanned = comment.User.Banned
+	default:
+		return target, gorm.ErrRecordNotFound
+	}
+	return target, nil
+}
+
+// excerpt shortens text to at most n characters on a word boundary.
+func excerpt(text string, n int) string {
+	runes := []rune(strings.Join(strings.Fields(text), " "))
+	if len(runes) <= n {
+		return string(runes)
+	}
+	cut := string(runes[:n])
+	if i := strings.LastIndex(cut, " "); i > n/2 {
+		cut = cut[:i]
+	}
+	return cut + "…"
+}
+
+// createReportHandler lets a reader flag an article or comment they can see.
+func createReportHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(uint)
+
+	var request struct {
+		TargetType string `json:"target_type"`
+		TargetID   uint   `json:"target_id"`
+		Reason     string `json:"reason"`
+		Details    string `json:"details"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if !reportReasons[request.Reason] {
+		http.Error(w, `{"error": "Reason must be spam, abuse, off_topic or other"}`, http.StatusBadRequest)
+		return
+	}
+	request.Details = strings.TrimSpace(request.Details)
+	if len(request.Details) > maxReportDetails {
+		http.Error(w, `{"error": "Details must be at most 1000 characters"}`, http.StatusBadRequest)
+		return
+	}
+
+	var authorID uint
+	switch request.TargetType {
+	case ReportArticle:
+		var article Article
+		if err := db.First(&article, request.TargetID).Error; err != nil || !articleVisible(r, &article) {
+			http.Error(w, `{"error": "Article not found"}`, http.StatusNotFound)
+			return
+		}
+		authorID = article.UserID
+	case ReportComment:
+		var comment Comment
+		if err := db.Where("id = ? AND status = ?", request.TargetID, CommentApproved).First(&comment).Error; err != nil {
+			http.Error(w, `{"error": "Comment not found"}`, http.StatusNotFound)
+			return
+		}
+		var article Article
+		if err := db.First(&article, comment.ArticleID).Error; err != nil || !articleVisible(r, &article) {
+			http.Error(w, `{"error": "Comment not found"}`, http.StatusNotFound)
+			return
+		}
+		authorID = comment.UserID
+	default:
+		http.Error(w, `{"error": "target_type must be article or comment"}`, http.StatusBadRequest)
+		return
+	}
+	if authorID == userID {
+		http.Error(w, `{"error": "You cannot report your own content"}`, http.StatusBadRequest)
+		return
+	}
+
+	var existing int64
+	db.Model(&Report{}).
+		Where("target_type = ? AND target_id = ? AND reporter_id = ? AND status = ?", request.TargetType, request.TargetID, userID, ReportOpen).
+		Count(&existing)
+	if existing > 0 {
+		http.Error(w, `{"error": "You have already reported this"}`, http.StatusConflict)
+		return
+	}
+
+	report := Report{
+		TargetType: request.TargetType,
+		TargetID:   request.TargetID,
+		ReporterID: &userID,
+		Reason:     request.Reason,
+		Details:    request.Details,
+		Status:     ReportOpen,
+	}
+	if err := db.Create(&report).Error; err != nil {
+		logger.WithFields(logrus.Fields{
+			"target_type": request.TargetType,
+			"target_id":   request.TargetID,
+			"error":       err.Error(),
+		}).Error("Failed to create report")
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"report_id":   report.ID,
+		"target_type": report.TargetType,
+		"target_id":   report.TargetID,
+		"reason":      report.Reason,
+	}).Info("Content reported")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(report)
+}
+
+// getReportQueueHandler lists reported items for admins, grouped by target
+// with the most reported first. ?status= picks open (default), dismissed or
+// actioned reports.
+func getReportQueueHandler(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = ReportOpen
+	}
+	if status != ReportOpen && status != ReportDismissed && status != ReportActioned {
+		http.Error(w, `{"error": "Unknown report status"}`, http.StatusBadRequest)
+		return
+	}
+
+	var reports []Report
+	if err := db.Where("status = ?", status).Order("created_at ASC, id ASC").Find(&reports).Error; err != nil {
+		http.Error(w, `{"error": "Error fetching reports"}`, http.StatusInternalServerError)
+		return
+	}
+
+	queue := []reportTarget{}
+	index := map[string]int{}
+	for _, report := range reports {
+		key := report.TargetType + ":" + strconv.FormatUint(uint64(report.TargetID), 10)
+		i, ok := index[key]
+		if !ok {
+			target, err := loadReportTarget(report.TargetType, report.TargetID)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				// Deleted since it was reported
+				continue
+			} else if err != nil {
+				http.Error(w, `{"error": "Error fetching reports"}`, http.StatusInternalServerError)
+				return
+			}
+			i = len(queue)
+			index[key] = i
+			queue = append(queue, target)
+		}
+		queue[i].Reports = append(queue[i].Reports, report)
+		queue[i].ReportCount++
+	}
+	// Stable, so equally reported targets keep the order of their first report
+	sort.SliceStable(queue, func(i, j int) bool { return queue[i].ReportCount > queue[j].ReportCount })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(queue)
+}
+
+// resolveReportHandler closes a report and every other open report on the
+// same target. "dismiss" leaves the target alone, "hide" takes it out of
+// public view and "ban" also bans its author.
+func resolveReportHandler(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := r.Context().Value("user_id").(uint)
+
+	var request struct {
+		Action string `json:"action"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if request.Action != "dismiss" && request.Action != "hide" && request.Action != "ban" {
+		http.Error(w, `{"error": "Action must be dismiss, hide or ban"}`, http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error": "Invalid report ID"}`, http.StatusBadRequest)
+		return
+	}
+	var report Report
+	if err := db.First(&report, uint(id)).Error; err != nil {
+		http.Error(w, `{"error": "Report not found"}`, http.StatusNotFound)
+		return
+	}
+	if report.Status != ReportOpen {
+		http.Error(w, `{"error": "Report is already resolved"}`, http.StatusConflict)
+		return
+	}
+
+	target, err := loadReportTarget(report.TargetType, report.TargetID)
+	if err != nil && request.Action != "dismiss" {
+		http.Error(w, `{"error": "Reported content no longer exists"}`, http.StatusConflict)
+		return
+	}
+
+	status := ReportActioned
+	switch request.Action {
+	case "dismiss":
+		status = ReportDismissed
+	case "ban":
+		var author User
+		if err := db.First(&author, target.AuthorID).Error; err != nil {
+			http.Error(w, `{"error": "Author not found"}`, http.StatusConflict)
+			return
+		}
+		if author.Role == "admin" {
+			http.Error(w, `{"error": "Admins cannot be banned"}`, http.StatusBadRequest)
+			return
+		}
+		if err := db.Model(&author).Update("banned", true).Error; err != nil {
+			http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+			return
+		}
+		logger.WithFields(logrus.Fields{
+			"user_id":  author.ID,
+			"admin_id": adminID,
+		}).Warn("User banned")
+		fallthrough
+	case "hide":
+		if err := hideReportTarget(target, adminID); err != nil {
+			writeArticleSaveError(w, target.ArticleID, err)
+			return
+		}
+	}
+
+	closed, err := closeReports(report.TargetType, report.TargetID, status, request.Action, adminID)
+	if err != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"report_id":   report.ID,
+		"target_type": report.TargetType,
+		"target_id":   report.TargetID,
+		"action":      request.Action,
+		"closed":      closed,
+	}).Info("Report resolved")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":        "Report resolved",
+		"action":         request.Action,
+		"reports_closed": closed,
+	})
+}
+
+// hideReportTarget archives a reported article or hides a reported comment.
+func hideReportTarget(target reportTarget, adminID uint) error {
+	if target.Type == ReportComment {
+		return db.Model(&Comment{}).Where("id = ?", target.ID).Update("status", CommentHidden).Error
+	}
+
+	var article Article
+	if err := db.Preload("Tags").First(&article, target.ID).Error; err != nil {
+		return err
+	}
+	if article.Status == ArticleArchived {
+		return nil
+	}
+	loadedAt := article.UpdatedAt
+	article.Status = ArticleArchived
+	article.ScheduledAt = nil
+	return saveArticle(&article, loadedAt, adminID, "Hidden after reports")
+}
+
+// closeReports resolves every open report on a target and returns how many
+// were closed.
+func closeReports(targetType string, targetID uint, status, resolution string, adminID uint) (int64, error) {
+	now := time.Now()
+	res := db.Model(&Report{}).
+		Where("target_type = ? AND target_id = ? AND status = ?", targetType, targetID, ReportOpen).
+		Updates(map[string]interface{}{
+			"status":      status,
+			"resolution":  resolution,
+			"resolved_by": adminID,
+			"resolved_at": now,
+		})
+	return res.RowsAffected, res.Error
+}
+
+// unbanUserHandler lifts a ban. Hidden content stays hidden.
+func unbanUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error": "Invalid user ID"}`, http.StatusBadRequest)
+		return
+	}
+	res := db.Model(&User{}).Where("id = ?", uint(id)).Update("banned", false)
+	if res.Error != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if res.RowsAffected == 0 {
+		http.Error(w, `{"error": "User not found"}`, http.StatusNotFound)
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"user_id": id,
+	}).Info("User unbanned")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "User unbanned"})
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// ArticleRevision is an immutable snapshot of an article's title and content,
+// written on every save. Numbers count up from 1 per article.
+type ArticleRevision struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	ArticleID  uint      `json:"article_id" gorm:"uniqueIndex:idx_article_revision_number"`
+	Number     int       `json:"number" gorm:"uniqueIndex:idx_article_revision_number"`
+	Title      string    `json:"title"`
+	Content    string    `json:"content,omitempty"`
+	EditorID   uint      `json:"editor_id"`
+	Editor     User      `json:"-" gorm:"foreignKey:EditorID"`
+	EditorName string    `json:"editor_name" gorm:"-"`
+	Note       string    `json:"note,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// diffLine is one line of a line-level diff. OldLine and NewLine are 1-based
+// and zero when the line does not exist on that side.
+type diffLine struct {
+	Op      string `json:"op"` // "equal", "insert" or "delete"
+	Text    string `json:"text"`
+	OldLine int    `json:"old_line,omitempty"`
+	NewLine int    `json:"new_line,omitempty"`
+}
+
+// Above this many cells the LCS table is not built; the changed middle of the
+// two texts is reported as deleted and inserted instead.
+const maxDiffCells = 4000000
+
+// recordRevision snapshots article inside tx. Callers run it after the
+// article row has been updated, so concurrent saves of the same article are
+// serialized by the row lock and get distinct numbers.
+func recordRevision(tx *gorm.DB, article *Article, editorID uint, note string) error {
+	var last int
+	if err := tx.Model(&ArticleRevision{}).Where("article_id = ?", article.ID).
+		Select("COALESCE(MAX(number), 0)").Scan(&last).Error; err != nil {
+		return err
+	}
+	return tx.Create(&ArticleRevision{
+		ArticleID: article.ID,
+		Number:    last + 1,
+		Title:     article.Title,
+		Content:   article.Content,
+		EditorID:  editorID,
+		Note:      note,
+	}).Error
+}
+
+// backfillArticleRevisions gives articles written before revisions existed a
+// first revision, so their original text survives the next edit.
+func backfillArticleRevisions() error {
+	var articles []Article
+	if err := db.Where("NOT EXISTS (SELECT 1 FROM article_revisions WHERE article_revisions.article_id = articles.id)").
+		Find(&articles).Error; err != nil {
+		return err
+	}
+	for i := range articles {
+		if err := recordRevision(db, &articles[i], articles[i].UserID, "Initial revision"); err != nil {
+			return err
+		}
+	}
+	if len(articles) > 0 {
+		logger.WithFields(logrus.Fields{
+			"article_count": len(articles),
+		}).Info("Backfilled article revisions")
+	}
+	return nil
+}
+
+// diffLines computes a line-level diff from a to b using the longest common
+// subsequence of lines.
+func diffLines(a, b string) []diffLine {
+	oldLines := splitLines(a)
+	newLines := splitLines(b)
+
+	// Common prefix and suffix need no table
+	prefix := 0
+	for prefix < len(oldLines) && prefix < len(newLines) && oldLines[prefix] == newLines[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(oldLines)-prefix && suffix < len(newLines)-prefix &&
+		oldLines[len(oldLines)-1-suffix] == newLines[len(newLines)-1-suffix] {
+		suffix++
+	}
+
+	result := []diffLine{}
+	for i := 0; i < prefix; i++ {
+		result = append(result, diffLine{Op: "equal", Text: oldLines[i], OldLine: i + 1, NewLine: i + 1})
+	}
+
+	x := oldLines[prefix : len(oldLines)-suffix]
+	y := newLines[prefix : len(newLines)-suffix]
+	oldNo, newNo := prefix+1, prefix+1
+
+	if len(x)*len(y) > maxDiffCells {
+		for _, line := range x {
+			result = append(result, diffLine{Op: "delete", Text: line, OldLine: oldNo})
+			oldNo++
+		}
+		for _, line := range y {
+			result = append(result, diffLine{Op: "insert", Text: line, NewLine: newNo})
+			newNo++
+		}
+	} else {
+		// lcs[i][j] is the LCS length of x[i:] and y[j:]
+		lcs := make([][]int32, len(x)+1)
+		for i := range lcs {
+			lcs[i] = make([]int32, len(y)+1)
+		}
+		for i := len(x) - 1; i >= 0; i-- {
+			for j := len(y) - 1; j >= 0; j-- {
+				if x[i] == y[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else if lcs[i+1][j] >= lcs[i][j+1] {
+					lcs[i][j] = lcs[i+1][j]
+				} else {
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+
+		i, j := 0, 0
+		for i < len(x) || j < len(y) {
+			switch {
+			case i < len(x) && j < len(y) && x[i] == y[j]:
+				result = append(result, diffLine{Op: "equal", Text: x[i], OldLine: oldNo, NewLine: newNo})
+				i, j, oldNo, newNo = i+1, j+1, oldNo+1, newNo+1
+			case j < len(y) && (i == len(x) || lcs[i][j+1] > lcs[i+1][j]):
+				result = append(result, diffLine{Op: "insert", Text: y[j], NewLine: newNo})
+				j, newNo = j+1, newNo+1
+			default:
+				result = append(result, diffLine{Op: "delete", Text: x[i], OldLine: oldNo})
+				i, oldNo = i+1, oldNo+1
+			}
+		}
+	}
+
+	for k := 0; k < suffix; k++ {
+		result = append(result, diffLine{Op: "equal", Text: oldLines[len(oldLines)-suffix+k], OldLine: oldNo, NewLine: newNo})
+		oldNo, newNo = oldNo+1, newNo+1
+	}
+	return result
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// getArticleRevisionsHandler lists the revisions of an article, newest first,
+// without their content.
+func getArticleRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	article, ok := loadArticle(w, r)
+	if !ok {
+		return
+	}
+	if !canEditArticle(r, article) {
+		http.Error(w, `{"error": "Forbidden: only the author can see revisions"}`, http.StatusForbidden)
+		return
+	}
+
+	var revisions []ArticleRevision
+	if err := db.Preload("Editor").Omit("content").Where("article_id = ?", article.ID).
+		Order("number DESC").Find(&revisions).Error; err != nil {
+		logger.WithFields(logrus.Fields{
+			"article_id": article.ID,
+			"error":      err.Error(),
+		}).Error("Failed to fetch revisions")
+		http.Error(w, `{"error": "Error fetching revisions"}`, http.StatusInternalServerError)
+		return
+	}
+	for i := range revisions {
+		revisions[i].EditorName = revisions[i].Editor.Name
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revisions)
+}
+
+// getArticleRevisionHandler returns one revision with its content.
+func getArticleRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	article, ok := loadArticle(w, r)
+	if !ok {
+		return
+	}
+	if !canEditArticle(r, article) {
+		http.Error(w, `{"error": "Forbidden: only the author can see revisions"}`, http.StatusForbidden)
+		return
+	}
+
+	revision, ok := loadRevision(w, article.ID, mux.Vars(r)["number"])
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revision)
+}
+
+// diffArticleRevisionsHandler compares two revisions:
+// GET /articles/{id}/revisions/diff?from=2&to=5.
+func diffArticleRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	article, ok := loadArticle(w, r)
+	if !ok {
+		return
+	}
+	if !canEditArticle(r, article) {
+		http.Error(w, `{"error": "Forbidden: only the author can see revisions"}`, http.StatusForbidden)
+		return
+	}
+
+	from, ok := loadRevision(w, article.ID, r.URL.Query().Get("from"))
+	if !ok {
+		return
+	}
+	to, ok := loadRevision(w, article.ID, r.URL.Query().Get("to"))
+	if !ok {
+		return
+	}
+
+	lines := diffLines(from.Content, to.Content)
+	added, removed := 0, 0
+	for _, line := range lines {
+		switch line.Op {
+		case "insert":
+			added++
+		case "delete":
+			removed++
+		}
+	}
+
+	response := map[string]interface{}{
+		"from":    from.Number,
+		"to":      to.Number,
+		"added":   added,
+		"removed": removed,
+		"lines":   lines,
+	}
+	if from.Title != to.Title {
+		response["title"] = map[string]string{"from": from.Title, "to": to.Title}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// rollbackArticleHandler restores the title and content of an earlier
+// revision. The restore is a normal save, so it becomes a new revision.
+func rollbackArticleHandler(w http.ResponseWriter, r *http.Request) {
+	article, ok := loadEditableArticle(w, r, nil)
+	if !ok {
+		return
+	}
+	loadedAt := article.UpdatedAt
+
+	revision, ok := loadRevision(w, article.ID, mux.Vars(r)["number"])
+	if !ok {
+		return
+	}
+
+	userID, _ := r.Context().Value("user_id").(uint)
+	article.Title = revision.Title
+	article.Content = revision.Content
+	// An old revision is checked like any other edit; the rules may have
+	// changed since it was written
+	moderation, ok := moderateSubmission(w, r, moderationSubject{Kind: ReportArticle, ID: article.ID, UserID: userID, Title: article.Title, Text: article.Content})
+	if !ok {
+		return
+	}
+	holdFlaggedEdit(article, moderation)
+	if err := saveArticle(article, loadedAt, userID, fmt.Sprintf("Rolled back to revision %d", revision.Number)); err != nil {
+		writeArticleSaveError(w, article.ID, err)
+		return
+	}
+	if moderation.Verdict == moderationReview {
+		flagForReview(ReportArticle, article.ID, moderation)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"article_id": article.ID,
+		"revision":   revision.Number,
+		"user_id":    userID,
+	}).Info("Article rolled back")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", articleETag(*article))
+	json.NewEncoder(w).Encode(article)
+}
+
+func loadRevision(w http.ResponseWriter, articleID uint, number string) (*ArticleRevision, bool) {
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 1 {
+		http.Error(w, `{"error": "Invalid revision number"}`, http.StatusBadRequest)
+		return nil, false
+	}
+
+	var revision ArticleRevision
+	if err := db.Preload("Editor").Where("article_id = ? AND number = ?", articleID, n).First(&revision).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, `{"error": "Revision not found"}`, http.StatusNotFound)
+		} else {
+			http.Error(w, `{"error": "Error fetching revision"}`, http.StatusInternalServerError)
+		}
+		return nil, false
+	}
+	revision.EditorName = revision.Editor.Name
+	return &revision, true
+}
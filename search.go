@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Markers ts_headline puts around matches. They cannot occur in article text,
+// so the snippet can be HTML-escaped first and the markers turned into <mark>
+// afterwards.
+const (
+	highlightStart = "\x02"
+	highlightStop  = "\x03"
+)
+
+// searchConfigs maps the ?lang= values accepted by /articles/search onto
+// PostgreSQL text search configurations.
+var searchConfigs = map[string]string{
+	"en": "english",
+	"ru": "russian",
+}
+
+// articleSearchSchema keeps articles.search_vector up to date. The trigger
+// picks the Russian configuration for Cyrillic text and English otherwise,
+// weights the title above the content, and runs on every insert and on
+// updates that touch the title or content.
+var articleSearchSchema = []string{
+	`ALTER TABLE articles ADD COLUMN IF NOT EXISTS search_config regconfig NOT NULL DEFAULT 'english'`,
+	`ALTER TABLE articles ADD COLUMN IF NOT EXISTS search_vector tsvector`,
+	`CREATE OR REPLACE FUNCTION articles_search_vector_update() RETURNS trigger AS $$
+	BEGIN
+		NEW.search_config := CASE
+			WHEN COALESCE(NEW.title, '') || ' ' || COALESCE(NEW.content, '') ~ '[А-Яа-яЁё]' THEN 'russian'::regconfig
+			ELSE 'english'::regconfig
+		END;
+		NEW.search_vector :=
+			setweight(to_tsvector(NEW.search_config, COALESCE(NEW.title, '')), 'A') ||
+			setweight(to_tsvector(NEW.search_config, COALESCE(NEW.content, '')), 'B');
+		RETURN NEW;
+	END
+	$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS articles_search_vector_trigger ON articles`,
+	`CREATE TRIGGER articles_search_vector_trigger
+		BEFORE INSERT OR UPDATE OF title, content ON articles
+		FOR EACH ROW EXECUTE FUNCTION articles_search_vector_update()`,
+	`CREATE INDEX IF NOT EXISTS idx_articles_search_vector ON articles USING GIN (search_vector)`,
+	// Index rows written before the trigger existed
+	`UPDATE articles SET title = title WHERE search_vector IS NULL`,
+}
+
+// searchResult is one ranked hit from /articles/search.
+type searchResult struct {
+	ID          uint       `json:"id"`
+	Title       string     `json:"title"`
+	Slug        string     `json:"slug"`
+	Name        string     `json:"name"`
+	UserID      uint       `json:"user_id"`
+	PublishedAt *time.Time `json:"published_at"`
+	Rank        float64    `json:"rank"`
+	// HTML-escaped with matches wrapped in <mark>
+	TitleHighlight string `json:"title_highlight"`
+	Snippet        string `json:"snippet"`
+}
+
+func migrateArticleSearch() error {
+	for _, statement := range articleSearchSchema {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// highlightSnippet escapes a ts_headline result and turns the match markers
+// into <mark> elements.
+func highlightSnippet(headline string) string {
+	escaped := html.EscapeString(headline)
+	escaped = strings.ReplaceAll(escaped, highlightStart, "<mark>")
+	return strings.ReplaceAll(escaped, highlightStop, "</mark>")
+}
+
+// searchArticlesHandler runs a ranked full-text search over published
+// articles: GET /articles/search?q=...&lang=ru|en&page=1&limit=10. Without
+// lang the query is matched with both configurations.
+func searchArticlesHandler(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		http.Error(w, `{"error": "Search query is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	tsquery := "websearch_to_tsquery('russian', @q) || websearch_to_tsquery('english', @q)"
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		config, ok := searchConfigs[lang]
+		if !ok {
+			http.Error(w, `{"error": "Unsupported search language"}`, http.StatusBadRequest)
+			return
+		}
+		tsquery = "websearch_to_tsquery('" + config + "', @q)"
+	}
+
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit < 1 || limit > 50 {
+		limit = 10
+	}
+
+	args := map[string]interface{}{
+		"q":         q,
+		"published": ArticlePublished,
+		"snippet":   "StartSel=" + highlightStart + ", StopSel=" + highlightStop + ", MaxFragments=2, MaxWords=30, MinWords=10",
+		"title":     "StartSel=" + highlightStart + ", StopSel=" + highlightStop + ", HighlightAll=true",
+		"limit":     limit,
+		"offset":    (page - 1) * limit,
+	}
+
+	var total int64
+	if err := db.Raw(`SELECT COUNT(*) FROM articles, `+tsquery+` AS query
+		WHERE articles.status = @published AND articles.search_vector @@ query`, args).Scan(&total).Error; err != nil {
+		logger.WithFields(logrus.Fields{
+			"query": q,
+			"error": err.Error(),
+		}).Error("Failed to count search results")
+		http.Error(w, `{"error": "Search failed"}`, http.StatusInternalServerError)
+		return
+	}
+
+	results := []searchResult{}
+	err := db.Raw(`SELECT articles.id, articles.title, articles.slug, articles.name, articles.user_id, articles.published_at,
+			ts_rank_cd(articles.search_vector, query) AS rank,
+			ts_headline(articles.search_config, articles.title, query, @title) AS title_highlight,
+			ts_headline(articles.search_config, articles.content, query, @snippet) AS snippet
+		FROM articles, `+tsquery+` AS query
+		WHERE articles.status = @published AND articles.search_vector @@ query
+		ORDER BY rank DESC, articles.published_at DESC
+		LIMIT @limit OFFSET @offset`, args).Scan(&results).Error
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"query": q,
+			"error": err.Error(),
+		}).Error("Failed to search articles")
+		http.Error(w, `{"error": "Search failed"}`, http.StatusInternalServerError)
+		return
+	}
+
+	for i := range results {
+		results[i].TitleHighlight = highlightSnippet(results[i].TitleHighlight)
+		results[i].Snippet = highlightSnippet(results[i].Snippet)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"query":        q,
+		"result_count": total,
+	}).Info("Article search")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"query":   q,
+		"page":    page,
+		"limit":   limit,
+		"total":   total,
+		"results": results,
+	})
+}
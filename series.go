@@ -0,0 +1,449 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Series groups articles of one author into an ordered collection, such as
+// the parts of a tutorial. Articles point at their series through SeriesID
+// and are ordered by SeriesPosition.
+type Series struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	Title       string    `json:"title"`
+	Slug        string    `json:"slug" gorm:"uniqueIndex"`
+	Description string    `json:"description"`
+	UserID      uint      `json:"user_id" gorm:"index"`
+	User        User      `json:"-" gorm:"foreignKey:UserID"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// seriesNav is the series block of an article payload.
+type seriesNav struct {
+	ID       uint        `json:"id"`
+	Title    string      `json:"title"`
+	Slug     string      `json:"slug"`
+	Position int         `json:"position"`
+	Total    int         `json:"total"`
+	Previous *seriesLink `json:"previous"`
+	Next     *seriesLink `json:"next"`
+	// updated is the last time the navigation may have changed
+	updated time.Time
+}
+
+// seriesLink points at a neighbouring article in a series.
+type seriesLink struct {
+	ID    uint   `json:"id"`
+	Title string `json:"title"`
+	Slug  string `json:"slug"`
+}
+
+// seriesEntry is an article as listed in a series index.
+type seriesEntry struct {
+	ID          uint       `json:"id"`
+	Title       string     `json:"title"`
+	Slug        string     `json:"slug"`
+	Status      string     `json:"status"`
+	Position    int        `json:"position"`
+	PublishedAt *time.Time `json:"published_at"`
+}
+
+const maxSeriesArticles = 200
+
+// loadSeriesNav fills in article.Series. Only published articles are
+// listed, plus the article itself so drafts can be previewed in place.
+func loadSeriesNav(article *Article) error {
+	article.Series = nil
+	if article.SeriesID == nil {
+		return nil
+	}
+
+	var series Series
+	if err := db.First(&series, *article.SeriesID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	var members []Article
+	if err := db.Select("id", "title", "slug", "updated_at").
+		Where("series_id = ? AND (status = ? OR id = ?)", series.ID, ArticlePublished, article.ID).
+		Order("series_position, id").Find(&members).Error; err != nil {
+		return err
+	}
+
+	nav := &seriesNav{ID: series.ID, Title: series.Title, Slug: series.Slug, Total: len(members), updated: series.UpdatedAt}
+	for i, member := range members {
+		if member.UpdatedAt.After(nav.updated) {
+			nav.updated = member.UpdatedAt
+		}
+		if member.ID != article.ID {
+			continue
+		}
+		nav.Position = i + 1
+		if i > 0 {
+			nav.Previous = &seriesLink{ID: members[i-1].ID, Title: members[i-1].Title, Slug: members[i-1].Slug}
+		}
+		if i+1 < len(members) {
+			nav.Next = &seriesLink{ID: members[i+1].ID, Title: members[i+1].Title, Slug: members[i+1].Slug}
+		}
+	}
+	article.Series = nav
+	return nil
+}
+
+// touchSeries bumps updated_at of series whose navigation changed, which
+// the pages of their articles are validated against.
+func touchSeries(tx *gorm.DB, now time.Time, ids ...uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return tx.Model(&Series{}).Where("id IN ?", ids).UpdateColumn("updated_at", now).Error
+}
+
+// uniqueSeriesSlug returns the first free series slug derived from title.
+func uniqueSeriesSlug(title string) (string, error) {
+	base := slugify(title)
+	for n := 1; ; n++ {
+		candidate := base
+		if n > 1 {
+			candidate = fmt.Sprintf("%s-%d", base, n)
+		}
+		var taken int64
+		if err := db.Model(&Series{}).Where("slug = ?", candidate).Count(&taken).Error; err != nil {
+			return "", err
+		}
+		if taken == 0 {
+			return candidate, nil
+		}
+	}
+}
+
+// canEditSeries reports whether the authenticated caller may change series.
+func canEditSeries(r *http.Request, series *Series) bool {
+	userID, _ := r.Context().Value("user_id").(uint)
+	role, _ := r.Context().Value("role").(string)
+	return role == "admin" || series.UserID == userID
+}
+
+// loadSeries fetches the series named by the {id} route variable.
+func loadSeries(w http.ResponseWriter, r *http.Request) (*Series, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, `{"error": "Invalid series ID"}`, http.StatusBadRequest)
+		return nil, false
+	}
+	var series Series
+	if err := db.First(&series, uint(id)).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, `{"error": "Series not found"}`, http.StatusNotFound)
+		} else {
+			http.Error(w, `{"error": "Error fetching series"}`, http.StatusInternalServerError)
+		}
+		return nil, false
+	}
+	return &series, true
+}
+
+// getSeriesListHandler lists all series with their number of published
+// articles, optionally only those of ?author=.
+func getSeriesListHandler(w http.ResponseWriter, r *http.Request) {
+	var series []struct {
+		ID           uint      `json:"id"`
+		Title        string    `json:"title"`
+		Slug         string    `json:"slug"`
+		Description  string    `json:"description"`
+		UserID       uint      `json:"user_id"`
+		ArticleCount int64     `json:"article_count"`
+		UpdatedAt    time.Time `json:"updated_at"`
+	}
+	query := db.Table("series").
+		Select("series.id, series.title, series.slug, series.description, series.user_id, series.updated_at, COUNT(articles.id) AS article_count").
+		Joins("LEFT JOIN articles ON articles.series_id = series.id AND articles.status = ?", ArticlePublished).
+		Group("series.id").
+		Order("series.updated_at DESC")
+	if author := r.URL.Query().Get("author"); author != "" {
+		authorID, err := strconv.ParseUint(author, 10, 64)
+		if err != nil {
+			http.Error(w, `{"error": "Invalid author ID"}`, http.StatusBadRequest)
+			return
+		}
+		query = query.Where("series.user_id = ?", uint(authorID))
+	}
+	if err := query.Scan(&series).Error; err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Failed to fetch series")
+		http.Error(w, `{"error": "Error fetching series"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(series)
+}
+
+// getSeriesHandler is the series index: the series and its articles in
+// order. Its author and admins also see the unpublished parts.
+func getSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	var series Series
+	if err := db.Preload("User").Where("slug = ?", mux.Vars(r)["slug"]).First(&series).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, `{"error": "Series not found"}`, http.StatusNotFound)
+		} else {
+			http.Error(w, `{"error": "Error fetching series"}`, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	query := db.Model(&Article{}).Where("series_id = ?", series.ID)
+	claims := optionalClaims(r)
+	if claims == nil || (claims.Role != "admin" && claims.UserID != series.UserID) {
+		query = query.Where("status = ?", ArticlePublished)
+	}
+	var articles []Article
+	if err := query.Select("id", "title", "slug", "status", "published_at").
+		Order("series_position, id").Find(&articles).Error; err != nil {
+		http.Error(w, `{"error": "Error fetching series"}`, http.StatusInternalServerError)
+		return
+	}
+
+	entries := make([]seriesEntry, len(articles))
+	for i, article := range articles {
+		entries[i] = seriesEntry{
+			ID:          article.ID,
+			Title:       article.Title,
+			Slug:        article.Slug,
+			Status:      article.Status,
+			Position:    i + 1,
+			PublishedAt: article.PublishedAt,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":          series.ID,
+		"title":       series.Title,
+		"slug":        series.Slug,
+		"description": series.Description,
+		"user_id":     series.UserID,
+		"author_name": series.User.Name,
+		"updated_at":  series.UpdatedAt,
+		"articles":    entries,
+	})
+}
+
+// createSeriesHandler starts a new, empty series owned by the caller.
+func createSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(uint)
+
+	var request struct {
+		Title       string `json:"title"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || strings.TrimSpace(request.Title) == "" {
+		http.Error(w, `{"error": "Series title is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	slug, err := uniqueSeriesSlug(request.Title)
+	if err != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	series := Series{
+		Title:       strings.TrimSpace(request.Title),
+		Slug:        slug,
+		Description: strings.TrimSpace(request.Description),
+		UserID:      userID,
+	}
+	if err := db.Create(&series).Error; err != nil {
+		logger.WithFields(logrus.Fields{
+			"user_id": userID,
+			"error":   err.Error(),
+		}).Error("Failed to create series")
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(series)
+}
+
+// updateSeriesHandler changes the title or description of a series. The
+// slug stays the same so links keep working.
+func updateSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	series, ok := loadSeries(w, r)
+	if !ok {
+		return
+	}
+	if !canEditSeries(r, series) {
+		http.Error(w, `{"error": "Forbidden: you can only edit your own series"}`, http.StatusForbidden)
+		return
+	}
+
+	var request struct {
+		Title       *string `json:"title"`
+		Description *string `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if request.Title != nil {
+		if strings.TrimSpace(*request.Title) == "" {
+			http.Error(w, `{"error": "Series title cannot be empty"}`, http.StatusBadRequest)
+			return
+		}
+		series.Title = strings.TrimSpace(*request.Title)
+	}
+	if request.Description != nil {
+		series.Description = strings.TrimSpace(*request.Description)
+	}
+	if err := db.Model(series).Select("title", "description", "updated_at").Updates(series).Error; err != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(series)
+}
+
+// setSeriesArticlesHandler replaces the articles of a series with the
+// ordered list in the body. Articles left out leave the series; articles
+// from another series move over. Authors can only add their own articles.
+func setSeriesArticlesHandler(w http.ResponseWriter, r *http.Request) {
+	series, ok := loadSeries(w, r)
+	if !ok {
+		return
+	}
+	if !canEditSeries(r, series) {
+		http.Error(w, `{"error": "Forbidden: you can only edit your own series"}`, http.StatusForbidden)
+		return
+	}
+
+	var request struct {
+		ArticleIDs []uint `json:"article_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if len(request.ArticleIDs) > maxSeriesArticles {
+		http.Error(w, `{"error": "Too many articles in one series"}`, http.StatusBadRequest)
+		return
+	}
+	seen := map[uint]bool{}
+	for _, id := range request.ArticleIDs {
+		if seen[id] {
+			http.Error(w, `{"error": "An article can only appear once in a series"}`, http.StatusBadRequest)
+			return
+		}
+		seen[id] = true
+	}
+
+	var articles []Article
+	if len(request.ArticleIDs) > 0 {
+		if err := db.Select("id", "user_id", "series_id").Where("id IN ?", request.ArticleIDs).Find(&articles).Error; err != nil {
+			http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(articles) != len(request.ArticleIDs) {
+		http.Error(w, `{"error": "Article not found"}`, http.StatusBadRequest)
+		return
+	}
+	// The series that articles move over from lose them
+	previous := []uint{series.ID}
+	for _, article := range articles {
+		if article.UserID != series.UserID {
+			http.Error(w, `{"error": "A series can only contain articles by its author"}`, http.StatusBadRequest)
+			return
+		}
+		if article.SeriesID != nil && *article.SeriesID != series.ID {
+			previous = append(previous, *article.SeriesID)
+		}
+	}
+
+	// updated_at is bumped on every article and series whose navigation
+	// changes, so their pages and validators pick up the new order
+	now := databaseNow()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		leaving := tx.Model(&Article{}).Where("series_id = ?", series.ID)
+		if len(request.ArticleIDs) > 0 {
+			leaving = leaving.Where("id NOT IN ?", request.ArticleIDs)
+		}
+		if err := leaving.UpdateColumns(map[string]interface{}{"series_id": nil, "series_position": 0, "updated_at": now}).Error; err != nil {
+			return err
+		}
+		for i, id := range request.ArticleIDs {
+			if err := tx.Model(&Article{}).Where("id = ?", id).
+				UpdateColumns(map[string]interface{}{"series_id": series.ID, "series_position": i + 1, "updated_at": now}).Error; err != nil {
+				return err
+			}
+		}
+		return touchSeries(tx, now, previous...)
+	})
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"series_id": series.ID,
+			"error":     err.Error(),
+		}).Error("Failed to update series articles")
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"series_id":     series.ID,
+		"article_count": len(request.ArticleIDs),
+	}).Info("Series articles updated")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":     "Series updated",
+		"article_ids": request.ArticleIDs,
+	})
+}
+
+// deleteSeriesHandler removes a series; its articles stay as standalone
+// articles.
+func deleteSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	series, ok := loadSeries(w, r)
+	if !ok {
+		return
+	}
+	if !canEditSeries(r, series) {
+		http.Error(w, `{"error": "Forbidden: you can only delete your own series"}`, http.StatusForbidden)
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Article{}).Where("series_id = ?", series.ID).
+			UpdateColumns(map[string]interface{}{"series_id": nil, "series_position": 0, "updated_at": databaseNow()}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(series).Error
+	})
+	if err != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"series_id": series.ID,
+	}).Info("Series deleted")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Series deleted successfully"})
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// ArticleSlug keeps the slugs an article used to have, so permalinks that
+// were shared before a title change keep resolving.
+type ArticleSlug struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	ArticleID uint      `json:"article_id" gorm:"index"`
+	Slug      string    `json:"slug" gorm:"uniqueIndex"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const maxSlugLength = 80
+
+// cyrillicToLatin transliterates Russian and Kazakh letters. Letters that are
+// dropped entirely (ъ, ь) map to the empty string.
+var cyrillicToLatin = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e",
+	'ж': "zh", 'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m",
+	'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u",
+	'ф': "f", 'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "shch",
+	'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu", 'я': "ya",
+	// Kazakh
+	'ә': "a", 'ғ': "g", 'қ': "q", 'ң': "n", 'ө': "o", 'ұ': "u", 'ү': "u",
+	'һ': "h", 'і': "i",
+}
+
+// latinToASCII spells accented Latin letters without their accents.
+var latinToASCII = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'æ': "ae", 'ç': "c", 'ć': "c", 'č': "c", 'ď': "d", 'đ': "d", 'ð': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ė': "e", 'ę': "e", 'ě': "e",
+	'ğ': "g", 'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ī': "i", 'į': "i", 'ı': "i",
+	'ł': "l", 'ľ': "l", 'ñ': "n", 'ń': "n", 'ň': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ō': "o", 'ő': "o", 'œ': "oe",
+	'ř': "r", 'ś': "s", 'š': "s", 'ş': "s", 'ș': "s", 'ß': "ss", 'ť': "t", 'ţ': "t", 'ț': "t", 'þ': "th",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ū': "u", 'ů': "u", 'ű': "u", 'ų': "u",
+	'ý': "y", 'ÿ': "y", 'ź': "z", 'ż': "z", 'ž': "z",
+}
+
+// slugSuffix matches the "-2", "-3" suffix uniqueSlug adds.
+var slugSuffix = regexp.MustCompile(`^(.*)-([2-9]|[1-9][0-9]+)$`)
+
+// slugify turns a title into a lowercase ASCII slug such as "hello-world".
+func slugify(title string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(title) {
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			b.WriteRune(r)
+			dash = false
+		case cyrillicToLatin[r] != "":
+			b.WriteString(cyrillicToLatin[r])
+			dash = false
+		case latinToASCII[r] != "":
+			b.WriteString(latinToASCII[r])
+			dash = false
+		case r == 'ъ' || r == 'ь' || unicode.Is(unicode.Mn, r):
+			// silent letters, and accents typed as separate marks
+		default:
+			if !dash && b.Len() > 0 {
+				b.WriteByte('-')
+				dash = true
+			}
+		}
+	}
+
+	slug := strings.Trim(b.String(), "-")
+	if len(slug) > maxSlugLength {
+		slug = strings.Trim(slug[:maxSlugLength], "-")
+	}
+	if slug == "" {
+		slug = "article"
+	}
+	return slug
+}
+
+// slugFitsTitle reports whether slug was generated from title, allowing for
+// the "-2", "-3" suffix added to keep slugs unique. Such a suffix only counts
+// while taken reports the unsuffixed slug as used elsewhere; otherwise the
+// number came from an earlier title ("Windows 10" renamed to "Windows"). A
+// nil taken trusts the suffix, for slugs whose title did not change or that
+// another site made.
+func slugFitsTitle(slug, title string, taken func(slug string) (bool, error)) (bool, error) {
+	base := slugify(title)
+	if slug == base {
+		return true, nil
+	}
+	m := slugSuffix.FindStringSubmatch(slug)
+	if m == nil || m[1] != base {
+		return false, nil
+	}
+	if taken == nil {
+		return true, nil
+	}
+	return taken(base)
+}
+
+// articleSlugTaken reports whether slug is used by another article than
+// articleID, one's old slugs or a translation.
+func articleSlugTaken(tx *gorm.DB, slug string, articleID uint) (bool, error) {
+	var taken int64
+	if err := tx.Model(&Article{}).Where("slug = ? AND id <> ?", slug, articleID).Count(&taken).Error; err != nil || taken > 0 {
+		return taken > 0, err
+	}
+	if err := tx.Model(&ArticleSlug{}).Where("slug = ? AND article_id <> ?", slug, articleID).Count(&taken).Error; err != nil || taken > 0 {
+		return taken > 0, err
+	}
+	err := tx.Model(&ArticleTranslation{}).Where("slug = ?", slug).Count(&taken).Error
+	return taken > 0, err
+}
+
+// uniqueSlug returns the first free slug derived from base, ignoring slugs
+// that already belong to articleID.
+func uniqueSlug(tx *gorm.DB, base string, articleID uint) (string, error) {
+	for n := 1; ; n++ {
+		candidate := base
+		if n > 1 {
+			candidate = fmt.Sprintf("%s-%d", base, n)
+		}
+
+		taken, err := articleSlugTaken(tx, candidate, articleID)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return candidate, nil
+		}
+	}
+}
+
+// refreshArticleSlug gives article a slug matching its current title. The
+// previous slug, if any, is kept in the history table.
+func refreshArticleSlug(tx *gorm.DB, article *Article) error {
+	if article.Slug != "" {
+		// A number at the end is only questioned when the title changes, as
+		// it may have come from the old one. Otherwise the slug would move as
+		// soon as the article it had to avoid went away.
+		var taken func(string) (bool, error)
+		if article.ID != 0 {
+			var stored Article
+			if err := tx.Select("title").First(&stored, article.ID).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			if stored.Title != article.Title {
+				taken = func(slug string) (bool, error) { return articleSlugTaken(tx, slug, article.ID) }
+			}
+		}
+		fits, err := slugFitsTitle(article.Slug, article.Title, taken)
+		if err != nil || fits {
+			return err
+		}
+	}
+
+	slug, err := uniqueSlug(tx, slugify(article.Title), article.ID)
+	if err != nil {
+		return err
+	}
+
+	if article.Slug != "" && article.ID != 0 {
+		if err := tx.Create(&ArticleSlug{ArticleID: article.ID, Slug: article.Slug}).Error; err != nil {
+			return err
+		}
+	}
+	// The new slug may be one this article used before.
+	if err := tx.Where("article_id = ? AND slug = ?", article.ID, slug).Delete(&ArticleSlug{}).Error; err != nil {
+		return err
+	}
+
+	article.Slug = slug
+	return nil
+}
+
+// backfillArticleSlugs assigns slugs to articles created before slugs existed.
+func backfillArticleSlugs() error {
+	var articles []Article
+	if err := db.Where("slug IS NULL OR slug = ''").Find(&articles).Error; err != nil {
+		return err
+	}
+	for i := range articles {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := refreshArticleSlug(tx, &articles[i]); err != nil {
+				return err
+			}
+			return tx.Model(&articles[i]).UpdateColumn("slug", articles[i].Slug).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(articles) > 0 {
+		logger.WithFields(logrus.Fields{
+			"article_count": len(articles),
+		}).Info("Backfilled article slugs")
+	}
+	return nil
+}
+
+// getArticleBySlugHandler resolves /articles/by-slug/{slug}. Slugs an article
+// used before a rename answer with a permanent redirect to the current one.
+// Each language version has its own slug and is served in that language
+// unless ?lang= asks for another.
+func getArticleBySlugHandler(w http.ResponseWriter, r *http.Request) {
+	slug := mux.Vars(r)["slug"]
+
+	var article Article
+	err := db.Preload("User").Preload("Category").Preload("Tags").Where("slug = ?", slug).First(&article).Error
+	if err == nil {
+		if !articleVisible(r, &article) {
+			http.Error(w, `{"error": "Article not found"}`, http.StatusNotFound)
+			return
+		}
+		recordArticleView(r, &article)
+		writeArticle(w, r, &article, slugLanguage(r, articleLanguage(article)))
+		return
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		logger.WithFields(logrus.Fields{
+			"slug":  slug,
+			"error": err.Error(),
+		}).Error("Failed to fetch article by slug")
+		http.Error(w, `{"error": "Error fetching article"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if translation, err := findTranslationBySlug(slug); err == nil {
+		err = db.Preload("User").Preload("Category").Preload("Tags").First(&article, translation.ArticleID).Error
+		if err != nil || !articleVisible(r, &article) {
+			http.Error(w, `{"error": "Article not found"}`, http.StatusNotFound)
+			return
+		}
+		recordArticleView(r, &article)
+		writeArticle(w, r, &article, slugLanguage(r, translation.Language))
+		return
+	}
+
+	current, ok := currentSlugFor(slug)
+	if !ok {
+		http.Error(w, `{"error": "Article not found"}`, http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, r, withQuery("/articles/by-slug/"+current, r), http.StatusMovedPermanently)
+}
+
+// withQuery appends the query string of r to path, so a redirect keeps
+// parameters such as ?lang= and tracking tags.
+func withQuery(path string, r *http.Request) string {
+	if r.URL.RawQuery == "" {
+		return path
+	}
+	return path + "?" + r.URL.RawQuery
+}
+
+// currentSlugFor looks up a slug in the history and returns the slug the
+// article uses now.
+func currentSlugFor(old string) (string, bool) {
+	var history ArticleSlug
+	if err := db.Where("slug = ?", old).First(&history).Error; err != nil {
+		return "", false
+	}
+	var article Article
+	if err := db.Select("id", "slug").First(&article, history.ArticleID).Error; err != nil {
+		return "", false
+	}
+	return article.Slug, true
+}
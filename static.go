@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A static export writes the public pages of the blog, its feeds and the
+// media the articles use into a directory that any file server can host.
+// Pages link to each other relatively. A manifest in the directory records
+// what every file was built from, so the next export only rewrites the
+// files that changed and removes those that are gone.
+
+const (
+	staticManifestName = ".static-manifest.json"
+	// Files of static/ the pages need.
+	staticAssetsDir = "static"
+)
+
+var staticAssets = []string{"style.css"}
+
+// staticManifest lists the files of an export.
+type staticManifest struct {
+	ExportedAt time.Time             `json:"exported_at"`
+	Files      map[string]staticFile `json:"files"`
+}
+
+type staticFile struct {
+	// Hash of the content, to skip writing files that did not change
+	Hash string `json:"hash"`
+	// Source fingerprints what the file was built from, to skip building
+	// it at all. Empty when the file is always rebuilt.
+	Source string `json:"source,omitempty"`
+}
+
+// staticReport counts what an export did.
+type staticReport struct {
+	Written   int
+	Unchanged int
+	Removed   int
+	Warnings  []string
+}
+
+type staticExporter struct {
+	dir      string
+	full     bool
+	previous staticManifest
+	manifest staticManifest
+	report   staticReport
+	// media maps referenced upload paths to true once copied
+	media   map[string]bool
+	uploads *regexp.Regexp
+	version string
+}
+
+// exportStaticSite exports the site into dir. With full every file is
+// rebuilt and rewritten, whatever the manifest says.
+func exportStaticSite(dir string, full bool) (staticReport, error) {
+	x := &staticExporter{
+		dir:      dir,
+		full:     full,
+		manifest: staticManifest{Files: make(map[string]staticFile)},
+		media:    make(map[string]bool),
+		// Links to uploads, relative to the site or absolute on it. The
+		// character before keeps paths of other sites out.
+		uploads: regexp.MustCompile(`(["'\s,(])(?:` + regexp.QuoteMeta(siteURL) + `)?/uploads/([^\s"'<>,)?#]+)`),
+		version: templatesVersion(),
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return x.report, err
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, staticManifestName)); err == nil {
+		if err := json.Unmarshal(data, &x.previous); err != nil {
+			x.warn("ignoring unreadable manifest: %v", err)
+		}
+	}
+
+	steps := []func() error{x.exportArticles, x.exportListings, x.exportFeeds, x.exportAssets}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return x.report, err
+		}
+	}
+	x.removeStale()
+
+	x.manifest.ExportedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(x.manifest, "", "  ")
+	if err != nil {
+		return x.report, err
+	}
+	return x.report, os.WriteFile(filepath.Join(dir, staticManifestName), data, 0o644)
+}
+
+func (x *staticExporter) warn(format string, args ...interface{}) {
+	x.report.Warnings = append(x.report.Warnings, fmt.Sprintf(format, args...))
+}
+
+// file writes the file at name (slash-separated, relative to the export)
+// with what build returns. When source is given and matches the last export,
+// the file is kept without building it.
+func (x *staticExporter) file(name, source string, build func() ([]byte, error)) error {
+	target := filepath.Join(x.dir, filepath.FromSlash(name))
+	previous, known := x.previous.Files[name]
+	_, statErr := os.Stat(target)
+	exists := statErr == nil
+
+	if !x.full && known && exists && source != "" && previous.Source == source {
+		x.manifest.Files[name] = previous
+		x.report.Unchanged++
+		return nil
+	}
+
+	content, err := build()
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	sum := sha256.Sum256(content)
+	entry := staticFile{Hash: hex.EncodeToString(sum[:]), Source: source}
+	x.manifest.Files[name] = entry
+	if !x.full && known && exists && previous.Hash == entry.Hash {
+		x.report.Unchanged++
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(target, content, 0o644); err != nil {
+		return err
+	}
+	x.report.Written++
+	return nil
+}
+
+// removeStale deletes the files of the last export that this one did not
+// produce, and the directories they leave empty.
+func (x *staticExporter) removeStale() {
+	var stale []string
+	for name := range x.previous.Files {
+		if _, ok := x.manifest.Files[name]; !ok {
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(stale)
+	for _, name := range stale {
+		target := filepath.Join(x.dir, filepath.FromSlash(name))
+		if err := os.Remove(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			x.warn("cannot remove %s: %v", name, err)
+			continue
+		}
+		x.report.Removed++
+		// os.Remove refuses directories that are not empty, which ends the walk
+		for dir := filepath.Dir(target); dir != filepath.Clean(x.dir); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+}
+
+// staticPagePath is the file of the page of an article (kind "article") or
+// of a listing. Slugs are used as they are, not escaped like in links, since
+// servers and browsers unescape links before looking for the file.
+func staticPagePath(kind, slug string, page int) string {
+	parts := []string{"posts"}
+	switch kind {
+	case "article":
+		parts = append(parts, slug)
+	case "":
+	default:
+		parts = append(parts, kind, slug)
+	}
+	if page > 1 {
+		parts = append(parts, "page", strconv.Itoa(page))
+	}
+	return path.Join(append(parts, "index.html")...)
+}
+
+// staticLinks are the links of the page stored at name.
+func staticLinks(name string) pageLinks {
+	depth := strings.Count(name, "/")
+	root := strings.Repeat("../", depth)
+	if root == "" {
+		root = "./"
+	}
+	return pageLinks{Suffix: "/index.html", Root: root}
+}
+
+// safeSegment reports whether a slug can be used as a directory name.
+func safeSegment(slug string) bool {
+	return slug != "" && slug != "." && slug != ".." && !strings.ContainsAny(slug, `/\`)
+}
+
+// localizeUploads points the upload links of rendered content at the copied
+// media and copies the files they name.
+func (x *staticExporter) localizeUploads(content string, links pageLinks) (string, error) {
+	var copyErr error
+	content = x.uploads.ReplaceAllStringFunc(content, func(match string) string {
+		parts := x.uploads.FindStringSubmatch(match)
+		rel := parts[2]
+		if strings.Contains(rel, "..") {
+			return match
+		}
+		if err := x.copyUpload(rel); err != nil {
+			if copyErr == nil {
+				copyErr = err
+			}
+			return match
+		}
+		return parts[1] + links.Asset("/uploads/"+rel)
+	})
+	return content, copyErr
+}
+
+// copyUpload copies uploads/rel into the export once. A missing file is
+// only a warning: the page still links to where it would be.
+func (x *staticExporter) copyUpload(rel string) error {
+	if x.media[rel] {
+		return nil
+	}
+	x.media[rel] = true
+
+	source := filepath.Join(uploadsDir, filepath.FromSlash(rel))
+	info, err := os.Stat(source)
+	if err != nil {
+		x.warn("missing upload %s", rel)
+		return nil
+	}
+	fingerprint := fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano())
+	return x.file("uploads/"+rel, fingerprint, func() ([]byte, error) {
+		return os.ReadFile(source)
+	})
+}
+
+// exportArticles writes the page of every language version of every
+// published article.
+func (x *staticExporter) exportArticles() error {
+	var articles []Article
+	if err := db.Preload("User").Preload("Category").Preload("Tags").
+		Where("status = ?", ArticlePublished).Order("id").Find(&articles).Error; err != nil {
+		return err
+	}
+
+	for _, article := range articles {
+		// The original language first; its translations list the others
+		versions := []translationLink{{Language: articleLanguage(article), Slug: article.Slug}}
+		localized := []Article{article}
+		if err := localizeArticles(localized, versions[0].Language); err != nil {
+			return err
+		}
+		for _, t := range localized[0].Translations {
+			if !t.Original {
+				versions = append(versions, t)
+			}
+		}
+
+		for _, version := range versions {
+			if !safeSegment(version.Slug) {
+				x.warn("skipping article %d: slug %q cannot be a directory", article.ID, version.Slug)
+				continue
+			}
+			if err := x.exportArticle(article, version); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (x *staticExporter) exportArticle(article Article, version translationLink) error {
+	localized := []Article{article}
+	if err := localizeArticles(localized, version.Language); err != nil {
+		return err
+	}
+	page := localized[0]
+	if err := loadSeriesNav(&page); err != nil {
+		return err
+	}
+
+	// Whatever the page shows: the article, the other versions, the series
+	// navigation and the names it links to
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%s|%s|%d|%s|%d", x.version, siteURL, siteName, page.ID, version.Language, page.UpdatedAt.UnixMicro())
+	fmt.Fprintf(h, "|%s", page.User.Name)
+	if page.Category != nil {
+		fmt.Fprintf(h, "|%s/%s", page.Category.Slug, page.Category.Name)
+	}
+	for _, tag := range page.Tags {
+		fmt.Fprintf(h, "|%s/%s", tag.Slug, tag.Name)
+	}
+	for _, t := range page.Translations {
+		fmt.Fprintf(h, "|%s/%s/%d", t.Language, t.Slug, t.updated.UnixMicro())
+	}
+	if page.Series != nil {
+		series, _ := json.Marshal(page.Series)
+		fmt.Fprintf(h, "|%s/%d", series, page.Series.updated.UnixMicro())
+	}
+	source := hex.EncodeToString(h.Sum(nil))
+
+	name := staticPagePath("article", version.Slug, 1)
+	links := staticLinks(name)
+	// Media are copied even when the page is kept, so they stay in the
+	// manifest
+	content, err := x.localizeUploads(page.ContentHTML, links)
+	if err != nil {
+		return err
+	}
+	return x.file(name, source, func() ([]byte, error) {
+		page.ContentHTML = content
+		var out bytes.Buffer
+		err := renderArticlePage(&out, &page, links)
+		return out.Bytes(), err
+	})
+}
+
+// exportListings writes every page of the article listings: all articles,
+// and those of each tag, category and author. The first page of all articles
+// is the front page of the export too.
+func (x *staticExporter) exportListings() error {
+	kinds := map[string][]string{"": {""}}
+	for _, kind := range []string{"tag", "category", "author"} {
+		slugs, err := listingSlugs(kind)
+		if err != nil {
+			return err
+		}
+		kinds[kind] = slugs
+	}
+
+	for _, kind := range []string{"", "tag", "category", "author"} {
+		for _, slug := range kinds[kind] {
+			if kind != "" && !safeSegment(slug) {
+				x.warn("skipping %s %q: slug cannot be a directory", kind, slug)
+				continue
+			}
+			for page := 1; ; page++ {
+				l, err := loadListing(kind, slug, page)
+				if err != nil {
+					return err
+				}
+				if err := x.listingFile(staticPagePath(kind, slug, page), l); err != nil {
+					return err
+				}
+				if kind == "" && page == 1 {
+					if err := x.listingFile("index.html", l); err != nil {
+						return err
+					}
+				}
+				if !l.HasNext {
+					break
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (x *staticExporter) listingFile(name string, l *listing) error {
+	// What the page shows of each article: the link, title, byline and
+	// excerpt, which all change with the article's updated_at but the
+	// author's name
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%s|%s|%s|%s|%s|%d|%t", x.version, siteURL, siteName, l.Kind, l.Slug, l.Name, l.Page, l.HasNext)
+	for _, article := range l.Articles {
+		fmt.Fprintf(h, "|%d/%s/%d/%s", article.ID, article.Slug, article.UpdatedAt.UnixMicro(), article.User.Name)
+	}
+	source := hex.EncodeToString(h.Sum(nil))
+
+	return x.file(name, source, func() ([]byte, error) {
+		var out bytes.Buffer
+		err := renderListingPage(&out, l, staticLinks(name))
+		return out.Bytes(), err
+	})
+}
+
+// exportFeeds writes the site and author feeds in every format, and the
+// sitemap.
+func (x *staticExporter) exportFeeds() error {
+	authors, err := listingSlugs("author")
+	if err != nil {
+		return err
+	}
+	prefixes := []string{""}
+	for _, id := range authors {
+		prefixes = append(prefixes, "authors/"+id+"/")
+	}
+
+	for _, prefix := range prefixes {
+		var author *User
+		if prefix != "" {
+			author = &User{}
+			if err := db.First(author, strings.TrimSuffix(strings.TrimPrefix(prefix, "authors/"), "/")).Error; err != nil {
+				return err
+			}
+		}
+		// The feed says where it is served, which is the same for every format
+		// but the file name
+		for _, format := range []string{"feed.xml", "atom.xml", "feed.json"} {
+			name := prefix + format
+			f, err := buildFeed("/"+name, author, "")
+			if err != nil {
+				return err
+			}
+			if err := x.file(name, feedSource(f, format), func() ([]byte, error) { return encodeFeed(f, format) }); err != nil {
+				return err
+			}
+		}
+	}
+
+	set, err := buildSitemap()
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	for _, u := range set.URLs {
+		fmt.Fprintf(h, "%s|%s\n", u.Loc, u.LastMod)
+	}
+	return x.file("sitemap.xml", hex.EncodeToString(h.Sum(nil)), func() ([]byte, error) { return marshalXML(set) })
+}
+
+// feedSource fingerprints a feed file: the articles and translations its
+// ETag covers, and the names the feed shows besides.
+func feedSource(f *feed, format string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%s|%s|%s|%s", f.etag(format), siteURL, f.SelfURL, f.Title, f.Description)
+	for _, article := range f.Articles {
+		fmt.Fprintf(h, "|%s", article.User.Name)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// encodeFeed encodes a feed in the format its file name says.
+func encodeFeed(f *feed, name string) ([]byte, error) {
+	switch name {
+	case "atom.xml":
+		return marshalXML(buildAtom(f))
+	case "feed.json":
+		var out bytes.Buffer
+		err := json.NewEncoder(&out).Encode(buildJSONFeed(f))
+		return out.Bytes(), err
+	}
+	return marshalXML(buildRSS(f))
+}
+
+// exportAssets copies the stylesheet and other files the pages load.
+func (x *staticExporter) exportAssets() error {
+	for _, asset := range staticAssets {
+		source := filepath.Join(staticAssetsDir, asset)
+		info, err := os.Stat(source)
+		if err != nil {
+			x.warn("missing asset %s", asset)
+			continue
+		}
+		fingerprint := fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano())
+		if err := x.file(asset, fingerprint, func() ([]byte, error) { return os.ReadFile(source) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// templatesVersion changes whenever a page template does, so pages built
+// with other templates are rebuilt.
+func templatesVersion() string {
+	h := sha256.New()
+	fs.WalkDir(templateFS, ".", func(name string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			data, _ := templateFS.ReadFile(name)
+			fmt.Fprintf(h, "%s:%d:", name, len(data))
+			h.Write(data)
+		}
+		return nil
+	})
+	return hex.EncodeToString(h.Sum(nil))
+}
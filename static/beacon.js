@@ -0,0 +1,37 @@
+// Reports that an article was viewed and how far it was read. Nothing is sent
+// when the browser asks not to be tracked.
+function trackArticle(articleId, content, api) {
+    if (navigator.doNotTrack === '1' || navigator.globalPrivacyControl) return;
+    const url = (api || '') + '/articles/' + articleId + '/beacon';
+    const send = data => {
+        // text/plain keeps the beacon a simple request
+        const body = new Blob([JSON.stringify(data)], { type: 'text/plain' });
+        if (!navigator.sendBeacon || !navigator.sendBeacon(url, body)) {
+            fetch(url, { method: 'POST', body: body, keepalive: true }).catch(() => {});
+        }
+    };
+
+    send({ event: 'view', referrer: document.referrer });
+
+    let reported = 0;
+    const measure = () => {
+        const rect = content.getBoundingClientRect();
+        const read = rect.height > 0 ? (window.innerHeight - rect.top) / rect.height : 1;
+        const depth = Math.min(100, Math.floor(read * 4) * 25);
+        if (depth > reported) {
+            reported = depth;
+            send({ event: 'depth', depth: depth });
+        }
+        if (reported >= 100) {
+            window.removeEventListener('scroll', onScroll);
+        }
+    };
+    let scheduled = false;
+    const onScroll = () => {
+        if (scheduled) return;
+        scheduled = true;
+        setTimeout(() => { scheduled = false; measure(); }, 250);
+    };
+    window.addEventListener('scroll', onScroll, { passive: true });
+    measure();
+}
@@ -0,0 +1,271 @@
+// Collaborative editing client for /ws/articles/{id}/collab. Operations use
+// the ot.js format: a positive number retains, a negative number deletes and
+// a string inserts. Positions count code points, like the server.
+const OT = (() => {
+    const chars = s => Array.from(s);
+    const cpLength = s => chars(s).length;
+    const isRetain = c => typeof c === 'number' && c > 0;
+    const isDelete = c => typeof c === 'number' && c < 0;
+    const isInsert = c => typeof c === 'string';
+    const cpSlice = (s, from, to) => chars(s).slice(from, to).join('');
+
+    class Builder {
+        constructor() { this.ops = []; }
+        last(offset = 1) { return this.ops[this.ops.length - offset]; }
+        retain(n) {
+            if (n <= 0) return this;
+            if (isRetain(this.last())) this.ops[this.ops.length - 1] += n;
+            else this.ops.push(n);
+            return this;
+        }
+        insert(s) {
+            if (!s) return this;
+            const n = this.ops.length;
+            if (isInsert(this.last())) {
+                this.ops[n - 1] += s;
+            } else if (isDelete(this.last())) {
+                // Inserts go before deletes, as on the server
+                if (isInsert(this.last(2))) this.ops[n - 2] += s;
+                else { this.ops.push(this.ops[n - 1]); this.ops[n - 1] = s; }
+            } else {
+                this.ops.push(s);
+            }
+            return this;
+        }
+        delete(n) {
+            if (n <= 0) return this;
+            if (isDelete(this.last())) this.ops[this.ops.length - 1] -= n;
+            else this.ops.push(-n);
+            return this;
+        }
+    }
+
+    function apply(op, text) {
+        const source = chars(text);
+        const out = [];
+        let pos = 0;
+        for (const c of op) {
+            if (isRetain(c)) { out.push(...source.slice(pos, pos + c)); pos += c; }
+            else if (isDelete(c)) pos -= c;
+            else out.push(c);
+        }
+        if (pos !== source.length) throw new Error('operation does not match the document');
+        return out.join('');
+    }
+
+    // transform returns [a', b'] such that apply(b', apply(a, s)) equals
+    // apply(a', apply(b, s)); inserts of a go first on ties.
+    function transform(a, b) {
+        const a1 = new Builder(), b1 = new Builder();
+        let i = 0, j = 0, ca = a[i++], cb = b[j++];
+        while (ca !== undefined || cb !== undefined) {
+            if (isInsert(ca)) { a1.insert(ca); b1.retain(cpLength(ca)); ca = a[i++]; continue; }
+            if (isInsert(cb)) { a1.retain(cpLength(cb)); b1.insert(cb); cb = b[j++]; continue; }
+            if (ca === undefined || cb === undefined) throw new Error('operations do not match');
+            const la = Math.abs(ca), lb = Math.abs(cb), n = Math.min(la, lb);
+            if (isRetain(ca) && isRetain(cb)) { a1.retain(n); b1.retain(n); }
+            else if (isDelete(ca) && isRetain(cb)) a1.delete(n);
+            else if (isRetain(ca) && isDelete(cb)) b1.delete(n);
+            ca = la === n ? a[i++] : Math.sign(ca) * (la - n);
+            cb = lb === n ? b[j++] : Math.sign(cb) * (lb - n);
+        }
+        return [a1.ops, b1.ops];
+    }
+
+    // compose returns one operation with the effect of a followed by b.
+    function compose(a, b) {
+        const out = new Builder();
+        let i = 0, j = 0, ca = a[i++], cb = b[j++];
+        while (ca !== undefined || cb !== undefined) {
+            if (isDelete(ca)) { out.delete(-ca); ca = a[i++]; continue; }
+            if (isInsert(cb)) { out.insert(cb); cb = b[j++]; continue; }
+            if (ca === undefined || cb === undefined) throw new Error('operations do not match');
+            const la = isInsert(ca) ? cpLength(ca) : ca, lb = Math.abs(cb), n = Math.min(la, lb);
+            if (isRetain(ca) && isRetain(cb)) out.retain(n);
+            else if (isInsert(ca) && isRetain(cb)) out.insert(cpSlice(ca, 0, n));
+            else if (isRetain(ca) && isDelete(cb)) out.delete(n);
+            // An insert deleted again leaves nothing
+            ca = la === n ? a[i++] : (isInsert(ca) ? cpSlice(ca, n) : ca - n);
+            cb = lb === n ? b[j++] : Math.sign(cb) * (lb - n);
+        }
+        return out.ops;
+    }
+
+    function transformIndex(op, index) {
+        let newIndex = index;
+        for (const c of op) {
+            if (isRetain(c)) index -= c;
+            else if (isInsert(c)) newIndex += cpLength(c);
+            else { newIndex -= Math.min(index, -c); index += c; }
+            if (index < 0) break;
+        }
+        return newIndex;
+    }
+
+    // diff turns the textarea before and after an edit into an operation.
+    function diff(before, after) {
+        const a = chars(before), b = chars(after);
+        let prefix = 0;
+        while (prefix < a.length && prefix < b.length && a[prefix] === b[prefix]) prefix++;
+        let suffix = 0;
+        while (suffix < a.length - prefix && suffix < b.length - prefix &&
+            a[a.length - 1 - suffix] === b[b.length - 1 - suffix]) suffix++;
+        return new Builder()
+            .retain(prefix)
+            .insert(b.slice(prefix, b.length - suffix).join(''))
+            .delete(a.length - prefix - suffix)
+            .retain(suffix).ops;
+    }
+
+    const toCodePoints = (text, index) => cpLength(text.slice(0, index));
+    const toUnits = (text, index) => cpSlice(text, 0, index).length;
+
+    return { apply, transform, compose, transformIndex, diff, toCodePoints, toUnits };
+})();
+
+// CollabEditor keeps a textarea in sync with the other co-authors. It
+// follows the ot.js client: at most one operation is in flight, and edits
+// made meanwhile are buffered and sent once the server acknowledges it.
+class CollabEditor {
+    constructor(url, textarea, callbacks = {}) {
+        this.url = url;
+        this.textarea = textarea;
+        this.callbacks = callbacks;
+        this.peers = new Map();
+        this.textarea.addEventListener('input', () => this.onInput());
+        ['select', 'keyup', 'click'].forEach(type =>
+            this.textarea.addEventListener(type, () => this.sendCursor()));
+        this.connect();
+    }
+
+    connect() {
+        this.outstanding = null;
+        this.buffer = null;
+        this.ready = false;
+        this.textarea.readOnly = true;
+        this.socket = new WebSocket(this.url);
+        this.socket.addEventListener('message', event => this.onMessage(JSON.parse(event.data)));
+        this.socket.addEventListener('close', () => {
+            this.ready = false;
+            this.textarea.readOnly = true;
+            this.notify('status', 'Disconnected, reconnecting…');
+            setTimeout(() => this.connect(), 2000);
+        });
+    }
+
+    notify(name, ...args) {
+        if (this.callbacks[name]) this.callbacks[name](...args);
+    }
+
+    onMessage(msg) {
+        switch (msg.type) {
+            case 'init':
+                this.revision = msg.revision || 0;
+                this.clientId = msg.client_id;
+                this.textarea.value = this.text = msg.content || '';
+                this.peers = new Map((msg.peers || []).map(peer => [peer.client_id, peer]));
+                this.ready = true;
+                this.textarea.readOnly = false;
+                this.notify('status', 'Connected');
+                this.notify('peers', this.peers);
+                break;
+            case 'ack':
+                this.revision = msg.revision;
+                this.outstanding = this.buffer;
+                this.buffer = null;
+                if (this.outstanding) this.send(this.outstanding);
+                break;
+            case 'op':
+                this.revision = msg.revision;
+                this.receive(msg.op || []);
+                break;
+            case 'cursor': {
+                const peer = this.peers.get(msg.client_id);
+                if (peer) { peer.cursor = msg.cursor; this.notify('peers', this.peers); }
+                break;
+            }
+            case 'join':
+                this.peers.set(msg.peer.client_id, msg.peer);
+                this.notify('peers', this.peers);
+                break;
+            case 'leave':
+                this.peers.delete(msg.client_id);
+                this.notify('peers', this.peers);
+                break;
+            case 'saved':
+                this.notify('status', 'Saved at ' + new Date(msg.updated_at).toLocaleTimeString());
+                break;
+            case 'error':
+                this.notify('status', 'Error: ' + msg.error);
+                break;
+        }
+    }
+
+    onInput() {
+        if (!this.ready) return;
+        const op = OT.diff(this.text, this.textarea.value);
+        this.text = this.textarea.value;
+        this.moveCursors(op);
+        if (this.buffer) {
+            this.buffer = OT.compose(this.buffer, op);
+        } else if (this.outstanding) {
+            this.buffer = op;
+        } else {
+            this.outstanding = op;
+            this.send(op);
+        }
+    }
+
+    // receive applies an operation from another co-author, transformed past
+    // the local edits the server has not seen yet.
+    receive(op) {
+        if (this.outstanding) {
+            [this.outstanding, op] = OT.transform(this.outstanding, op);
+        }
+        if (this.buffer) {
+            [this.buffer, op] = OT.transform(this.buffer, op);
+        }
+
+        const value = this.textarea.value;
+        const start = OT.transformIndex(op, OT.toCodePoints(value, this.textarea.selectionStart));
+        const end = OT.transformIndex(op, OT.toCodePoints(value, this.textarea.selectionEnd));
+        this.text = OT.apply(op, this.text);
+        this.textarea.value = this.text;
+        this.textarea.setSelectionRange(OT.toUnits(this.text, start), OT.toUnits(this.text, end));
+        this.moveCursors(op);
+    }
+
+    moveCursors(op) {
+        this.peers.forEach(peer => {
+            if (peer.cursor) {
+                peer.cursor.position = OT.transformIndex(op, peer.cursor.position);
+                peer.cursor.end = OT.transformIndex(op, peer.cursor.end);
+            }
+        });
+        this.notify('peers', this.peers);
+    }
+
+    cursor() {
+        const value = this.textarea.value;
+        return {
+            position: OT.toCodePoints(value, this.textarea.selectionStart),
+            end: OT.toCodePoints(value, this.textarea.selectionEnd),
+        };
+    }
+
+    send(op) {
+        this.socket.send(JSON.stringify({ type: 'op', revision: this.revision, op, cursor: this.cursor() }));
+    }
+
+    sendCursor() {
+        if (this.ready && !this.outstanding) {
+            this.socket.send(JSON.stringify({ type: 'cursor', cursor: this.cursor() }));
+        }
+    }
+
+    // lineColumn describes a position as 1-based line and column.
+    lineColumn(position) {
+        const before = Array.from(this.text).slice(0, position).join('').split('\n');
+        return { line: before.length, column: Array.from(before[before.length - 1]).length + 1 };
+    }
+}
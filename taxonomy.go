@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Tag is a free-form label; an article can have many.
+type Tag struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Name      string    `json:"name"`
+	Slug      string    `json:"slug" gorm:"uniqueIndex"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Category is managed by admins; an article belongs to at most one.
+type Category struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	Name        string    `json:"name"`
+	Slug        string    `json:"slug" gorm:"uniqueIndex"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// taxonomyCount is a tag or category together with the number of published
+// articles using it.
+type taxonomyCount struct {
+	ID           uint   `json:"id"`
+	Name         string `json:"name"`
+	Slug         string `json:"slug"`
+	Description  string `json:"description,omitempty"`
+	ArticleCount int64  `json:"article_count"`
+}
+
+const maxTagsPerArticle = 10
+
+// taxonomySymbols spells out the symbols that tell tag names apart, which
+// slugify would otherwise drop: "C", "C++" and "C#" are different tags.
+var taxonomySymbols = strings.NewReplacer("+", " plus ", "#", " sharp ")
+
+// taxonomySlug is the slug of a tag or category name.
+func taxonomySlug(name string) string {
+	return slugify(taxonomySymbols.Replace(name))
+}
+
+// touchTaggedArticles bumps updated_at of the articles with any of tagIDs,
+// whose pages show the tag and are validated against it.
+func touchTaggedArticles(tx *gorm.DB, now time.Time, tagIDs []uint) error {
+	return tx.Model(&Article{}).Where("id IN (SELECT article_id FROM article_tags WHERE tag_id IN ?)", tagIDs).
+		UpdateColumn("updated_at", now).Error
+}
+
+// resolveTags maps tag names onto Tag rows, creating the ones that do not
+// exist yet. Names that slugify to the same value are treated as one tag.
+func resolveTags(names []string) ([]Tag, error) {
+	tags := []Tag{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		slug := taxonomySlug(name)
+		if seen[slug] {
+			continue
+		}
+		seen[slug] = true
+
+		tag := Tag{Name: name, Slug: slug}
+		if err := db.Where(Tag{Slug: slug}).FirstOrCreate(&tag).Error; err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// applyTaxonomyInput copies the tags and category from a create/update
+// request onto article. It writes a 400 and returns false on bad input.
+func applyTaxonomyInput(w http.ResponseWriter, article *Article, input articleInput) bool {
+	if input.Tags != nil {
+		if len(*input.Tags) > maxTagsPerArticle {
+			http.Error(w, `{"error": "Too many tags"}`, http.StatusBadRequest)
+			return false
+		}
+		tags, err := resolveTags(*input.Tags)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Failed to resolve tags")
+			http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+			return false
+		}
+		article.Tags = tags
+	}
+
+	if input.CategoryID != nil {
+		if *input.CategoryID == 0 {
+			article.CategoryID = nil
+			article.Category = nil
+			return true
+		}
+		var category Category
+		if err := db.First(&category, *input.CategoryID).Error; err != nil {
+			http.Error(w, `{"error": "Category not found"}`, http.StatusBadRequest)
+			return false
+		}
+		article.CategoryID = &category.ID
+		article.Category = &category
+	}
+	return true
+}
+
+// getTagsHandler lists all tags with the number of published articles.
+func getTagsHandler(w http.ResponseWriter, r *http.Request) {
+	var tags []taxonomyCount
+	err := db.Table("tags").
+		Select("tags.id, tags.name, tags.slug, COUNT(articles.id) AS article_count").
+		Joins("LEFT JOIN article_tags ON article_tags.tag_id = tags.id").
+		Joins("LEFT JOIN articles ON articles.id = article_tags.article_id AND articles.status = ?", ArticlePublished).
+		Group("tags.id").
+		Order("article_count DESC, tags.name").
+		Scan(&tags).Error
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Failed to fetch tags")
+		http.Error(w, `{"error": "Error fetching tags"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tags)
+}
+
+// getCategoriesHandler lists all categories with the number of published
+// articles.
+func getCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	var categories []taxonomyCount
+	err := db.Table("categories").
+		Select("categories.id, categories.name, categories.slug, categories.description, COUNT(articles.id) AS article_count").
+		Joins("LEFT JOIN articles ON articles.category_id = categories.id AND articles.status = ?", ArticlePublished).
+		Group("categories.id").
+		Order("categories.name").
+		Scan(&categories).Error
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Failed to fetch categories")
+		http.Error(w, `{"error": "Error fetching categories"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(categories)
+}
+
+// createCategoryHandler adds a category (admin only).
+func createCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || strings.TrimSpace(request.Name) == "" {
+		http.Error(w, `{"error": "Category name is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	category := Category{
+		Name:        strings.TrimSpace(request.Name),
+		Slug:        taxonomySlug(request.Name),
+		Description: request.Description,
+	}
+	var existing int64
+	db.Model(&Category{}).Where("slug = ?", category.Slug).Count(&existing)
+	if existing > 0 {
+		http.Error(w, `{"error": "Category already exists"}`, http.StatusConflict)
+		return
+	}
+	if err := db.Create(&category).Error; err != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(category)
+}
+
+// updateCategoryHandler renames a category or changes its description.
+func updateCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var category Category
+	if err := db.First(&category, id).Error; err != nil {
+		http.Error(w, `{"error": "Category not found"}`, http.StatusNotFound)
+		return
+	}
+
+	var request struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if request.Name != nil && strings.TrimSpace(*request.Name) != "" {
+		category.Name = strings.TrimSpace(*request.Name)
+		category.Slug = taxonomySlug(category.Name)
+
+		var clash int64
+		db.Model(&Category{}).Where("slug = ? AND id <> ?", category.Slug, category.ID).Count(&clash)
+		if clash > 0 {
+			http.Error(w, `{"error": "Another category already uses this name"}`, http.StatusConflict)
+			return
+		}
+	}
+	if request.Description != nil {
+		category.Description = *request.Description
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&category).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Article{}).Where("category_id = ?", category.ID).UpdateColumn("updated_at", databaseNow()).Error
+	})
+	if err != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(category)
+}
+
+// deleteCategoryHandler removes a category; its articles become uncategorised.
+func deleteCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&Article{}).Where("category_id = ?", id).
+			UpdateColumns(map[string]interface{}{"category_id": nil, "updated_at": databaseNow()}).Error
+		if err != nil {
+			return err
+		}
+		res := tx.Delete(&Category{}, id)
+		if res.Error == nil && res.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return res.Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, `{"error": "Category not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Category deleted successfully"})
+}
+
+// renameTagHandler changes a tag's name and slug (admin only). Renaming onto
+// an existing tag is refused; use the merge endpoint for that.
+func renameTagHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	var request struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || strings.TrimSpace(request.Name) == "" {
+		http.Error(w, `{"error": "Tag name is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	var tag Tag
+	if err := db.First(&tag, id).Error; err != nil {
+		http.Error(w, `{"error": "Tag not found"}`, http.StatusNotFound)
+		return
+	}
+
+	tag.Name = strings.TrimSpace(request.Name)
+	tag.Slug = taxonomySlug(tag.Name)
+
+	var clash Tag
+	if err := db.Where("slug = ? AND id <> ?", tag.Slug, tag.ID).First(&clash).Error; err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":         "Another tag already uses this name, merge the tags instead",
+			"existing_tag":  clash,
+			"merge_request": map[string]interface{}{"source_ids": []uint{tag.ID}, "target_id": clash.ID},
+		})
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&tag).Error; err != nil {
+			return err
+		}
+		return touchTaggedArticles(tx, databaseNow(), []uint{tag.ID})
+	})
+	if err != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"tag_id": tag.ID,
+		"name":   tag.Name,
+	}).Info("Tag renamed")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tag)
+}
+
+// mergeTagsHandler moves every article from the source tags onto the target
+// tag and deletes the source tags (admin only).
+func mergeTagsHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		SourceIDs []uint `json:"source_ids"`
+		TargetID  uint   `json:"target_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || len(request.SourceIDs) == 0 || request.TargetID == 0 {
+		http.Error(w, `{"error": "source_ids and target_id are required"}`, http.StatusBadRequest)
+		return
+	}
+
+	var sources []uint
+	for _, id := range request.SourceIDs {
+		if id != request.TargetID {
+			sources = append(sources, id)
+		}
+	}
+	if len(sources) == 0 {
+		http.Error(w, `{"error": "Nothing to merge"}`, http.StatusBadRequest)
+		return
+	}
+
+	var target Tag
+	if err := db.First(&target, request.TargetID).Error; err != nil {
+		http.Error(w, `{"error": "Target tag not found"}`, http.StatusNotFound)
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := touchTaggedArticles(tx, databaseNow(), sources); err != nil {
+			return err
+		}
+		if err := tx.Exec(`INSERT INTO article_tags (article_id, tag_id)
+			SELECT DISTINCT article_id, ? FROM article_tags WHERE tag_id IN ?
+			ON CONFLICT DO NOTHING`, target.ID, sources).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("DELETE FROM article_tags WHERE tag_id IN ?", sources).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&Tag{}, sources).Error
+	})
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"target_id": target.ID,
+			"error":     err.Error(),
+		}).Error("Failed to merge tags")
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"target_id":  target.ID,
+		"source_ids": sources,
+	}).Info("Tags merged")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Tags merged successfully",
+		"tag":     target,
+	})
+}
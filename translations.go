@@ -0,0 +1,461 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// supportedLanguages are the languages articles can be written and
+// translated in, SITE_LANGUAGES.
+var supportedLanguages = parseLanguageList(getenvDefault("SITE_LANGUAGES", "ru,kk,en"))
+
+// languageFallbacks is tried in order when an article has no translation in
+// the requested language. The original is used when none of them exists.
+var languageFallbacks = map[string][]string{
+	"kk": {"ru", "en"},
+	"ru": {"en"},
+	"en": {"ru"},
+}
+
+// ArticleTranslation is the text of an article in another language. It is
+// published together with the original and has its own slug and page.
+type ArticleTranslation struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	ArticleID   uint       `json:"article_id" gorm:"uniqueIndex:idx_article_language"`
+	Language    string     `json:"language" gorm:"uniqueIndex:idx_article_language;size:8"`
+	Slug        string     `json:"slug" gorm:"uniqueIndex"`
+	Title       string     `json:"title"`
+	Content     string     `json:"content"`
+	ContentHTML string     `json:"content_html" gorm:"type:text"`
+	TOC         []TOCEntry `json:"toc" gorm:"serializer:json"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// translationLink points at one language version of an article.
+type translationLink struct {
+	Language string `json:"language"`
+	Slug     string `json:"slug"`
+	Title    string `json:"title"`
+	Original bool   `json:"original,omitempty"`
+
+	updated time.Time
+}
+
+func parseLanguageList(list string) []string {
+	languages := []string{}
+	for _, language := range strings.Split(list, ",") {
+		if language = strings.ToLower(strings.TrimSpace(language)); language != "" {
+			languages = append(languages, language)
+		}
+	}
+	return languages
+}
+
+// normalizeLanguage reduces a language tag such as "kk-KZ" to a supported
+// primary language, or "" when it is not supported.
+func normalizeLanguage(tag string) string {
+	primary := strings.ToLower(strings.TrimSpace(tag))
+	if i := strings.IndexAny(primary, "-_"); i >= 0 {
+		primary = primary[:i]
+	}
+	for _, language := range supportedLanguages {
+		if language == primary {
+			return language
+		}
+	}
+	return ""
+}
+
+// parseAcceptLanguage returns the supported languages of an Accept-Language
+// header, most preferred first.
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		language string
+		q        float64
+	}
+	var candidates []weighted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		language := normalizeLanguage(fields[0])
+		if language == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			candidates = append(candidates, weighted{language, q})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+
+	languages := []string{}
+	seen := map[string]bool{}
+	for _, c := range candidates {
+		if !seen[c.language] {
+			seen[c.language] = true
+			languages = append(languages, c.language)
+		}
+	}
+	return languages
+}
+
+// requestedLanguage is the language asked for with ?lang=, or else the
+// preferred supported language of the Accept-Language header. It is "" when
+// the reader has no supported preference.
+func requestedLanguage(r *http.Request) string {
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		return normalizeLanguage(lang)
+	}
+	if preferred := parseAcceptLanguage(r.Header.Get("Accept-Language")); len(preferred) > 0 {
+		return preferred[0]
+	}
+	return ""
+}
+
+// slugLanguage is the language to serve for a slug of the version in own:
+// that version, unless ?lang= asks for another.
+func slugLanguage(r *http.Request, own string) string {
+	if r.URL.Query().Get("lang") != "" {
+		return requestedLanguage(r)
+	}
+	return own
+}
+
+// languageChain lists the languages to try for a reader of lang, best first.
+func languageChain(lang string) []string {
+	if lang == "" {
+		return nil
+	}
+	return append([]string{lang}, languageFallbacks[lang]...)
+}
+
+// articleLanguage is the language of an article's own title and content.
+// Articles written before translations existed are in the site language.
+func articleLanguage(article Article) string {
+	if article.Language != "" {
+		return article.Language
+	}
+	return siteLanguage
+}
+
+// applyLanguageInput sets the language of article from a create/update
+// request. It writes a 400 and returns false when the language is not
+// supported or the article already has a translation into it.
+func applyLanguageInput(w http.ResponseWriter, article *Article, input articleInput) bool {
+	if input.Language == nil {
+		return true
+	}
+	language := normalizeLanguage(*input.Language)
+	if language == "" || language != *input.Language {
+		http.Error(w, `{"error": "Unsupported language"}`, http.StatusBadRequest)
+		return false
+	}
+	if article.ID != 0 {
+		var taken int64
+		if err := db.Model(&ArticleTranslation{}).Where("article_id = ? AND language = ?", article.ID, language).Count(&taken).Error; err != nil {
+			http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+			return false
+		}
+		if taken > 0 {
+			http.Error(w, `{"error": "The article already has a translation into this language"}`, http.StatusBadRequest)
+			return false
+		}
+	}
+	article.Language = language
+	return true
+}
+
+// localizeArticles shows each article in the best language for a reader of
+// lang, following the fallback chain, and lists the language versions in
+// Translations. The original is kept when it comes first in the chain or no
+// translation matches.
+func localizeArticles(articles []Article, lang string) error {
+	if len(articles) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(articles))
+	for i := range articles {
+		ids[i] = articles[i].ID
+	}
+	var translations []ArticleTranslation
+	if err := db.Where("article_id IN ?", ids).Order("language").Find(&translations).Error; err != nil {
+		return err
+	}
+	byArticle := map[uint][]ArticleTranslation{}
+	for _, t := range translations {
+		byArticle[t.ArticleID] = append(byArticle[t.ArticleID], t)
+	}
+
+	for i := range articles {
+		article := &articles[i]
+		available := byArticle[article.ID]
+		original := articleLanguage(*article)
+		article.Language = original
+		article.Translation = nil
+		article.Translations = nil
+		if len(available) == 0 {
+			continue
+		}
+
+		article.Translations = append(article.Translations, translationLink{Language: original, Slug: article.Slug, Title: article.Title, Original: true, updated: article.UpdatedAt})
+		for _, t := range available {
+			article.Translations = append(article.Translations, translationLink{Language: t.Language, Slug: t.Slug, Title: t.Title, updated: t.UpdatedAt})
+		}
+
+	chain:
+		for _, language := range languageChain(lang) {
+			if language == original {
+				break
+			}
+			for j := range available {
+				if available[j].Language == language {
+					applyTranslation(article, &available[j])
+					break chain
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// applyTranslation replaces the text of article with translation t.
+func applyTranslation(article *Article, t *ArticleTranslation) {
+	article.Language = t.Language
+	article.Slug = t.Slug
+	article.Title = t.Title
+	article.Content = t.Content
+	article.ContentHTML = t.ContentHTML
+	article.TOC = t.TOC
+	article.Translation = t
+}
+
+// localizedETag is the ETag of an article as served: a translated version
+// gets its own, so it cannot be used as an If-Match precondition for
+// editing the original.
+func localizedETag(article Article) string {
+	if article.Translation == nil {
+		return articleETag(article)
+	}
+	return fmt.Sprintf(`"%d-%d-%s-%d"`, article.ID, article.UpdatedAt.UnixMicro(), article.Translation.Language, article.Translation.UpdatedAt.UnixMicro())
+}
+
+// translationSlugTaken reports whether slug is used by an article, an old
+// article slug or a translation other than translationID.
+func translationSlugTaken(tx *gorm.DB, slug string, translationID uint) (bool, error) {
+	var taken int64
+	if err := tx.Model(&Article{}).Where("slug = ?", slug).Count(&taken).Error; err != nil || taken > 0 {
+		return taken > 0, err
+	}
+	if err := tx.Model(&ArticleSlug{}).Where("slug = ?", slug).Count(&taken).Error; err != nil || taken > 0 {
+		return taken > 0, err
+	}
+	err := tx.Model(&ArticleTranslation{}).Where("slug = ? AND id <> ?", slug, translationID).Count(&taken).Error
+	return taken > 0, err
+}
+
+// refreshTranslationSlug gives a translation a free slug matching its title.
+func refreshTranslationSlug(tx *gorm.DB, t *ArticleTranslation) error {
+	if t.Slug != "" {
+		// As for articles, a number at the end is only questioned when the
+		// title changes
+		var taken func(string) (bool, error)
+		if t.ID != 0 {
+			var stored ArticleTranslation
+			if err := tx.Select("title").First(&stored, t.ID).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+			if stored.Title != t.Title {
+				taken = func(slug string) (bool, error) { return translationSlugTaken(tx, slug, t.ID) }
+			}
+		}
+		fits, err := slugFitsTitle(t.Slug, t.Title, taken)
+		if err != nil || fits {
+			return err
+		}
+	}
+	base := slugify(t.Title)
+	for n := 1; ; n++ {
+		candidate := base
+		if n > 1 {
+			candidate = fmt.Sprintf("%s-%d", base, n)
+		}
+		taken, err := translationSlugTaken(tx, candidate, t.ID)
+		if err != nil {
+			return err
+		}
+		if !taken {
+			t.Slug = candidate
+			return nil
+		}
+	}
+}
+
+// findTranslationBySlug returns the translation using slug.
+func findTranslationBySlug(slug string) (ArticleTranslation, error) {
+	var translation ArticleTranslation
+	err := db.Where("slug = ?", slug).First(&translation).Error
+	return translation, err
+}
+
+// getTranslationsHandler lists the translations of an article.
+func getTranslationsHandler(w http.ResponseWriter, r *http.Request) {
+	article, ok := loadArticle(w, r)
+	if !ok {
+		return
+	}
+	if !articleVisible(r, article) {
+		http.Error(w, `{"error": "Article not found"}`, http.StatusNotFound)
+		return
+	}
+
+	var translations []ArticleTranslation
+	if err := db.Where("article_id = ?", article.ID).Order("language").Find(&translations).Error; err != nil {
+		http.Error(w, `{"error": "Error fetching translations"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"article_id":   article.ID,
+		"language":     articleLanguage(*article),
+		"translations": translations,
+	})
+}
+
+// putTranslationHandler creates or replaces the translation of an article
+// into {lang}. Whoever may edit the article may translate it.
+func putTranslationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Title   string `json:"title"`
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(input.Title) == "" || strings.TrimSpace(input.Content) == "" {
+		http.Error(w, `{"error": "Title and content are required"}`, http.StatusBadRequest)
+		return
+	}
+
+	language := normalizeLanguage(mux.Vars(r)["lang"])
+	if language == "" || language != mux.Vars(r)["lang"] {
+		http.Error(w, `{"error": "Unsupported language"}`, http.StatusBadRequest)
+		return
+	}
+	article, ok := loadEditableArticle(w, r, nil)
+	if !ok {
+		return
+	}
+	if language == articleLanguage(*article) {
+		http.Error(w, `{"error": "The article is already written in this language"}`, http.StatusBadRequest)
+		return
+	}
+
+	userID, _ := r.Context().Value("user_id").(uint)
+	moderation, ok := moderateSubmission(w, r, moderationSubject{Kind: ReportArticle, ID: article.ID, UserID: userID, Title: input.Title, Text: input.Content})
+	if !ok {
+		return
+	}
+
+	contentHTML, toc, err := renderMarkdown(input.Content)
+	if err != nil {
+		http.Error(w, `{"error": "Failed to render content"}`, http.StatusBadRequest)
+		return
+	}
+
+	// A flagged translation would go live next to the original, so the
+	// article goes back to review as it would for a flagged edit
+	if status := article.Status; moderation.Verdict == moderationReview {
+		holdFlaggedEdit(article, moderation)
+		if article.Status != status {
+			if err := saveArticle(article, article.UpdatedAt, userID, "Held for review: flagged "+language+" translation"); err != nil {
+				writeArticleSaveError(w, article.ID, err)
+				return
+			}
+		}
+	}
+
+	var translation ArticleTranslation
+	created := false
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("article_id = ? AND language = ?", article.ID, language).First(&translation).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		created = err != nil
+		translation.ArticleID = article.ID
+		translation.Language = language
+		translation.Title = strings.TrimSpace(input.Title)
+		translation.Content = input.Content
+		translation.ContentHTML = contentHTML
+		translation.TOC = toc
+		if err := refreshTranslationSlug(tx, &translation); err != nil {
+			return err
+		}
+		return tx.Save(&translation).Error
+	})
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"article_id": article.ID,
+			"language":   language,
+			"error":      err.Error(),
+		}).Error("Failed to save translation")
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if moderation.Verdict == moderationReview {
+		flagForReview(ReportArticle, article.ID, moderation)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"article_id": article.ID,
+		"language":   language,
+		"created":    created,
+	}).Info("Translation saved")
+
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(translation)
+}
+
+// deleteTranslationHandler removes the translation of an article into
+// {lang}.
+func deleteTranslationHandler(w http.ResponseWriter, r *http.Request) {
+	article, ok := loadEditableArticle(w, r, nil)
+	if !ok {
+		return
+	}
+
+	res := db.Where("article_id = ? AND language = ?", article.ID, mux.Vars(r)["lang"]).Delete(&ArticleTranslation{})
+	if res.Error != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	if res.RowsAffected == 0 {
+		http.Error(w, `{"error": "Translation not found"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Translation deleted"})
+}
@@ -1,12 +1,71 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
 )
 
+// useTestDB points db at a fresh in-memory SQLite database with the given
+// tables for the duration of the test.
+func useTestDB(t *testing.T, models ...interface{}) {
+	t.Helper()
+	test, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{NowFunc: databaseNow, Logger: gormlogger.Default.LogMode(gormlogger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One connection, so every query sees the same in-memory database
+	sqlDB, _ := test.DB()
+	sqlDB.SetMaxOpenConns(1)
+	if err := test.AutoMigrate(models...); err != nil {
+		t.Fatal(err)
+	}
+	previous := db
+	db = test
+	t.Cleanup(func() {
+		db = previous
+		sqlDB.Close()
+	})
+}
+
+// serveTest runs handler h for a request by userID (0 for anonymous) with
+// the given route variables and JSON body.
+func serveTest(h http.HandlerFunc, method, target string, body interface{}, vars map[string]string, userID uint, role string) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	r := mux.SetURLVars(httptest.NewRequest(method, target, &buf), vars)
+	if userID != 0 {
+		ctx := context.WithValue(r.Context(), "user_id", userID)
+		r = r.WithContext(context.WithValue(ctx, "role", role))
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
 // TestGenerateVerificationCode ensures the verification code is of the correct length
 func TestGenerateVerificationCode(t *testing.T) {
 	code := GenerateVerificationCode()
@@ -38,3 +97,1594 @@ func TestComparePassword(t *testing.T) {
 }
 
 // Hello bro
+
+// TestEtagMatches ensures If-Match / If-None-Match lists are parsed correctly
+func TestEtagMatches(t *testing.T) {
+	etag := articleETag(Article{ID: 7, UpdatedAt: time.Unix(1700000000, 0)})
+
+	assert.True(t, etagMatches(etag, etag), "Identical ETag should match")
+	assert.True(t, etagMatches(`"other", `+etag, etag), "ETag in a list should match")
+	assert.True(t, etagMatches("W/"+etag, etag), "Weak form should match")
+	assert.True(t, etagMatches("*", etag), "Wildcard should match")
+	assert.False(t, etagMatches(`"7-1"`, etag), "Stale ETag should not match")
+
+	assert.True(t, etagMatchesStrong(`"other", `+etag, etag), "ETag in a list should match strongly")
+	assert.True(t, etagMatchesStrong("*", etag), "Wildcard should match strongly")
+	assert.False(t, etagMatchesStrong("W/"+etag, etag), "Weak form should not match strongly")
+}
+
+// TestSlugify ensures titles, including Cyrillic and accented ones, become readable slugs
+func TestSlugify(t *testing.T) {
+	assert.Equal(t, "hello-world", slugify("Hello, World!"))
+	assert.Equal(t, "privet-mir", slugify("Привет, мир"))
+	assert.Equal(t, "obem-dannykh", slugify("Объём данных"))
+	assert.Equal(t, "qazaqstan-2025", slugify("Қазақстан 2025"))
+	assert.Equal(t, "creme-brulee", slugify("Crème Brûlée"))
+	assert.Equal(t, "strasse-in-lodz", slugify("Straße in Łódź"))
+	assert.Equal(t, "cafe", slugify("Cafe\u0301"), "Separate accent marks should be dropped")
+	assert.Equal(t, "article", slugify("!!!"))
+	assert.LessOrEqual(t, len(slugify(strings.Repeat("long title ", 20))), maxSlugLength)
+}
+
+// TestSlugFitsTitle ensures a number is only taken for a uniqueness suffix
+// while the plain slug is in use elsewhere
+func TestSlugFitsTitle(t *testing.T) {
+	inUse := func(used bool) func(string) (bool, error) {
+		return func(string) (bool, error) { return used, nil }
+	}
+	fits := func(slug, title string, check func(string) (bool, error)) bool {
+		ok, err := slugFitsTitle(slug, title, check)
+		assert.NoError(t, err)
+		return ok
+	}
+
+	assert.True(t, fits("hello-world", "Hello World", inUse(false)))
+	assert.True(t, fits("hello-world-3", "Hello World", inUse(true)))
+	assert.False(t, fits("windows-10", "Windows", inUse(false)), "A number from the old title is not a suffix")
+	assert.True(t, fits("windows-10", "Windows 10", inUse(false)))
+	assert.False(t, fits("hello-world-1", "Hello World", inUse(true)), "uniqueSlug never adds -1")
+	assert.False(t, fits("hello-world", "Goodbye World", inUse(true)))
+	assert.True(t, fits("hello-world-2", "Hello World", nil), "Slugs from elsewhere keep their suffix")
+}
+
+// TestCanTransition ensures the article lifecycle only allows the documented moves
+func TestCanTransition(t *testing.T) {
+	allowed, adminOnly := canTransition(ArticleDraft, ArticleInReview)
+	assert.True(t, allowed, "Author should be able to submit a draft")
+	assert.False(t, adminOnly)
+
+	allowed, adminOnly = canTransition(ArticleInReview, ArticlePublished)
+	assert.True(t, allowed, "Reviewed article can be published")
+	assert.True(t, adminOnly, "Publishing from review needs an admin")
+
+	allowed, _ = canTransition(ArticleDraft, ArticlePublished)
+	assert.False(t, allowed, "Drafts must go through review")
+
+	allowed, _ = canTransition(ArticlePublished, ArticleDraft)
+	assert.False(t, allowed, "Published articles can only be archived")
+}
+
+// TestRenderMarkdown ensures Markdown is rendered to sanitized HTML with a table of contents
+func TestRenderMarkdown(t *testing.T) {
+	source := "# Intro\n\nText with a note.[^1]\n\n## Table\n\n| a | b |\n|---|---|\n| 1 | 2 |\n\n" +
+		"```go\nfmt.Println(1)\n```\n\n<script>alert(1)</script>\n<a href=\"javascript:alert(1)\" onclick=\"x()\">bad</a>\n\n[^1]: Footnote.\n"
+
+	out, toc, err := renderMarkdown(source)
+	assert.Nil(t, err, "Rendering should not fail")
+	assert.Contains(t, out, "<table>", "GFM tables should be rendered")
+	assert.Contains(t, out, `class="language-go"`, "Fenced code language should be kept")
+	assert.Contains(t, out, `class="footnotes"`, "Footnotes should be rendered")
+	assert.NotContains(t, out, "<script", "Scripts must be removed")
+	assert.NotContains(t, out, "javascript:", "Script URLs must be removed")
+	assert.NotContains(t, out, "onclick", "Event handlers must be removed")
+
+	assert.Equal(t, []TOCEntry{{Level: 1, ID: "intro", Text: "Intro"}, {Level: 2, ID: "table", Text: "Table"}}, toc)
+}
+
+// TestHighlightSnippet ensures search snippets are escaped before matches are marked
+func TestHighlightSnippet(t *testing.T) {
+	headline := "a <b> " + highlightStart + "match" + highlightStop + " & more"
+	assert.Equal(t, "a &lt;b&gt; <mark>match</mark> &amp; more", highlightSnippet(headline))
+}
+
+// TestThreadComments ensures replies are nested under their top-level comment
+func TestThreadComments(t *testing.T) {
+	parent := uint(1)
+	threads := threadComments([]Comment{
+		{ID: 1, Content: "first"},
+		{ID: 2, Content: "reply", ParentID: &parent},
+		{ID: 3, Content: "second"},
+	})
+
+	assert.Len(t, threads, 2, "Only top-level comments should be threads")
+	assert.Len(t, threads[0].Replies, 1, "Reply should be nested under its parent")
+	assert.Equal(t, "reply", threads[0].Replies[0].Content)
+}
+
+// TestNeedsModeration ensures unverified and new accounts go to the moderation queue
+func TestNeedsModeration(t *testing.T) {
+	now := time.Now()
+	assert.True(t, needsModeration(User{EmailVerified: false, CreatedAt: now.AddDate(-1, 0, 0)}, now))
+	assert.True(t, needsModeration(User{EmailVerified: true, CreatedAt: now.Add(-time.Hour)}, now))
+	assert.False(t, needsModeration(User{EmailVerified: true, CreatedAt: now.AddDate(0, -1, 0)}, now))
+}
+
+// TestViewCounterDeduplicates ensures repeat views inside the window are counted once
+func TestViewCounterDeduplicates(t *testing.T) {
+	now := time.Now()
+	vc := newViewCounter(30 * time.Minute)
+
+	assert.True(t, vc.record(1, "u:1", now))
+	assert.False(t, vc.record(1, "u:1", now.Add(10*time.Minute)), "Repeat view should not count")
+	assert.True(t, vc.record(1, "u:2", now), "Another visitor should count")
+	assert.True(t, vc.record(2, "u:1", now), "Another article should count")
+	assert.Equal(t, int64(2), vc.unflushed(1))
+
+	assert.Equal(t, map[uint]int64{1: 2, 2: 1}, vc.drain(now.Add(31*time.Minute)))
+	assert.Equal(t, int64(0), vc.unflushed(1), "Drain should reset pending counts")
+	assert.True(t, vc.record(1, "u:1", now.Add(31*time.Minute)), "View after the window should count again")
+}
+
+// TestFlushViewsKeepsFailedCounts ensures views survive a failed write and land on the next flush
+func TestFlushViewsKeepsFailedCounts(t *testing.T) {
+	useTestDB(t)
+	previous := articleViews
+	articleViews = newViewCounter(viewDedupWindow)
+	t.Cleanup(func() { articleViews = previous })
+
+	now := time.Now()
+	articleViews.record(1, "u:1", now)
+	articleViews.record(1, "u:2", now)
+	flushViews(now)
+	assert.Equal(t, int64(2), articleViews.unflushed(1), "Counts should be kept when the table is missing")
+
+	assert.NoError(t, db.AutoMigrate(&User{}, &Category{}, &Tag{}, &Article{}))
+	assert.NoError(t, db.Create(&Article{ID: 1, Title: "Counted", Slug: "counted", UserID: 1}).Error)
+	flushViews(now)
+	var article Article
+	assert.NoError(t, db.First(&article, 1).Error)
+	assert.Equal(t, int64(2), article.ViewCount)
+	assert.Equal(t, int64(0), articleViews.unflushed(1))
+}
+
+// TestDiffLines ensures line diffs keep common lines and mark changes
+func TestDiffLines(t *testing.T) {
+	lines := diffLines("a\nb\nc\nd\n", "a\nc\nx\nd\n")
+
+	var ops []string
+	for _, line := range lines {
+		ops = append(ops, line.Op+" "+line.Text)
+	}
+	assert.Equal(t, []string{"equal a", "delete b", "equal c", "insert x", "equal d"}, ops)
+	assert.Equal(t, 4, lines[4].OldLine, "Old line numbers should skip inserted lines")
+	assert.Equal(t, 4, lines[4].NewLine, "New line numbers should skip deleted lines")
+	assert.Empty(t, diffLines("", ""))
+}
+
+// TestArticleExcerpt ensures feed excerpts are plain text cut at a word boundary
+func TestArticleExcerpt(t *testing.T) {
+	article := Article{ContentHTML: "<h1>Title</h1>\n<p>Fish &amp; <em>chips</em> are tasty</p>"}
+	assert.Equal(t, "Title Fish & chips are tasty", articleExcerpt(article, 100))
+	assert.Equal(t, "Title Fish &…", articleExcerpt(article, 14))
+}
+
+// TestNotModified ensures conditional GET honours both validators
+func TestNotModified(t *testing.T) {
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC)
+
+	r := httptest.NewRequest("GET", "/feed.xml", nil)
+	r.Header.Set("If-None-Match", `"abc"`)
+	w := httptest.NewRecorder()
+	assert.True(t, notModified(w, r, `"abc"`, modified))
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	r = httptest.NewRequest("GET", "/feed.xml", nil)
+	r.Header.Set("If-Modified-Since", modified.Format(http.TimeFormat))
+	assert.True(t, notModified(httptest.NewRecorder(), r, `"abc"`, modified))
+
+	r = httptest.NewRequest("GET", "/feed.xml", nil)
+	r.Header.Set("If-Modified-Since", modified.Add(-time.Hour).Format(http.TimeFormat))
+	assert.False(t, notModified(httptest.NewRecorder(), r, `"abc"`, modified))
+}
+
+// TestPageLinks ensures page links work for the server and for a static copy
+func TestPageLinks(t *testing.T) {
+	assert.Equal(t, "/posts/hello", pageLinks{}.Article("hello"))
+	assert.Equal(t, "/posts", pageLinks{}.Listing("", "", 1))
+	assert.Equal(t, "/posts/tag/go/page/2", pageLinks{}.Listing("tag", "go", 2))
+}
+
+// TestArticleImage ensures link previews get an absolute image URL
+func TestArticleImage(t *testing.T) {
+	article := Article{ContentHTML: `<p><img src="/uploads/a.png?w=1&amp;h=2" alt="x"></p>`}
+	assert.Equal(t, siteURL+"/uploads/a.png?w=1&h=2", articleImage(article))
+	assert.Equal(t, "", articleImage(Article{ContentHTML: "<p>no image</p>"}))
+}
+
+// TestThumbnailImage ensures thumbnails are square crops that never upscale
+func TestThumbnailImage(t *testing.T) {
+	wide := image.NewRGBA(image.Rect(0, 0, 800, 400))
+	assert.Equal(t, image.Rect(0, 0, 320, 320), thumbnailImage(wide, 320).Bounds())
+
+	small := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	assert.Equal(t, image.Rect(0, 0, 50, 50), thumbnailImage(small, 320).Bounds())
+	assert.Equal(t, image.Rect(0, 0, 400, 200), resizeToWidth(wide, 400).Bounds())
+}
+
+// TestParseFrontMatter ensures Markdown files are split into front matter and body
+func TestParseFrontMatter(t *testing.T) {
+	meta, body, err := parseFrontMatter([]byte("\ufeff---\r\ntitle: Hello\r\ntags: [go, web]\r\nstatus: draft\r\n---\r\n\r\n# Body\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", meta.Title)
+	assert.Equal(t, []string{"go", "web"}, meta.Tags)
+	assert.Equal(t, "# Body\n", body)
+
+	_, body, err = parseFrontMatter([]byte("# Just markdown\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "# Just markdown\n", body)
+
+	_, _, err = parseFrontMatter([]byte("---\ntitle: open\n"))
+	assert.Error(t, err)
+}
+
+// TestFormatFrontMatter ensures exported files import back unchanged
+func TestFormatFrontMatter(t *testing.T) {
+	published := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	article := Article{Title: "Hello", Slug: "hello", Status: ArticlePublished, PublishedAt: &published,
+		Content: "Some *text*", Tags: []Tag{{Name: "go"}}, Category: &Category{Name: "Tutorials"}}
+	data, err := formatFrontMatter(article)
+	assert.NoError(t, err)
+
+	meta, body, err := parseFrontMatter(data)
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", meta.Title)
+	assert.Equal(t, "hello", meta.Slug)
+	assert.Equal(t, []string{"go"}, meta.Tags)
+	assert.Equal(t, "Tutorials", meta.Category)
+	assert.True(t, published.Equal(*meta.Date))
+	assert.Equal(t, "Some *text*\n", body)
+}
+
+// TestImportedStatus ensures imports cannot bypass the review workflow
+func TestImportedStatus(t *testing.T) {
+	now := time.Now()
+	future := now.Add(time.Hour)
+
+	status, warning := importedStatus(ArticlePublished, nil, false, now)
+	assert.Equal(t, ArticleInReview, status)
+	assert.NotEmpty(t, warning)
+
+	status, _ = importedStatus(ArticlePublished, &future, true, now)
+	assert.Equal(t, ArticleScheduled, status)
+
+	status, _ = importedStatus("", nil, false, now)
+	assert.Equal(t, ArticleDraft, status)
+
+	status, warning = importedStatus("bogus", nil, true, now)
+	assert.Equal(t, ArticleDraft, status)
+	assert.NotEmpty(t, warning)
+}
+
+// TestCleanWordPressContent ensures block markup and common shortcodes are removed
+func TestCleanWordPressContent(t *testing.T) {
+	content, leftover := cleanWordPressContent("<!-- wp:paragraph -->\r\n<p>Hi</p>\r\n<!-- /wp:paragraph -->\r\n[caption id=\"1\"]<img src=\"a.jpg\"> Cap[/caption]\n<!--more-->\n[gallery ids=\"1\"][/gallery]")
+	assert.Equal(t, "<p>Hi</p>\n<img src=\"a.jpg\"> Cap\n[gallery ids=\"1\"][/gallery]\n", content)
+	assert.Equal(t, []string{"gallery"}, leftover)
+}
+
+// TestWXRStatus ensures WordPress statuses map onto the article workflow
+func TestWXRStatus(t *testing.T) {
+	now := time.Now()
+	future := now.Add(time.Hour)
+
+	status, ok := wxrStatus("publish", nil, now)
+	assert.True(t, ok)
+	assert.Equal(t, ArticlePublished, status)
+	status, _ = wxrStatus("future", &future, now)
+	assert.Equal(t, ArticleScheduled, status)
+	status, _ = wxrStatus("pending", nil, now)
+	assert.Equal(t, ArticleInReview, status)
+	_, ok = wxrStatus("trash", nil, now)
+	assert.False(t, ok)
+}
+
+// TestParseWXR ensures exports are read regardless of the WXR version
+func TestParseWXR(t *testing.T) {
+	export := `<rss xmlns:wp="http://wordpress.org/export/1.1/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:content="http://purl.org/rss/1.0/modules/content/" xmlns:excerpt="http://wordpress.org/export/1.1/excerpt/">
+<channel><wp:base_site_url>https://old.example.com</wp:base_site_url>
+<wp:author><wp:author_login>ann</wp:author_login><wp:author_email>a@x.io</wp:author_email></wp:author>
+<item><title>Hi</title><dc:creator>ann</dc:creator><content:encoded><![CDATA[<p>Body</p>]]></content:encoded><excerpt:encoded><![CDATA[Short]]></excerpt:encoded>
+<wp:post_id>7</wp:post_id><wp:post_date_gmt>0000-00-00 00:00:00</wp:post_date_gmt><wp:status>draft</wp:status><wp:post_type>post</wp:post_type>
+<category domain="post_tag" nicename="go">Go</category></item></channel></rss>`
+	file, err := parseWXR(strings.NewReader(export))
+	assert.NoError(t, err)
+	assert.Equal(t, "ann", file.Channel.Authors[0].Login)
+	item := file.Channel.Items[0]
+	assert.Equal(t, "<p>Body</p>", item.Content)
+	assert.Equal(t, "ann", item.Creator)
+	assert.Equal(t, []wxrTerm{{Domain: "post_tag", Nicename: "go", Name: "Go"}}, item.Terms)
+	assert.Nil(t, parseWXRDate(item.PostDateGMT, "", ""))
+
+	_, err = parseWXR(strings.NewReader("<html></html>"))
+	assert.Error(t, err)
+}
+
+// randomOp builds a random operation on a text of n code points
+func randomOp(rng *rand.Rand, n int) textOp {
+	var op textOp
+	for n > 0 {
+		k := rng.Intn(n) + 1
+		switch rng.Intn(3) {
+		case 0:
+			op = op.retain(k)
+			n -= k
+		case 1:
+			op = op.delete(k)
+			n -= k
+		default:
+			op = op.insert(string([]rune("abcжз🙂")[rng.Intn(6)]))
+		}
+	}
+	if rng.Intn(2) == 0 {
+		op = op.insert("x")
+	}
+	return op
+}
+
+// TestTransformOpsConverge ensures concurrent edits merge to the same text
+// whichever is applied first
+func TestTransformOpsConverge(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		doc := []rune("Привет, 🙂 world")[:rng.Intn(15)]
+		a, b := randomOp(rng, len(doc)), randomOp(rng, len(doc))
+		a1, b1, err := transformOps(a, b)
+		assert.NoError(t, err)
+
+		afterA, _ := a.apply(doc)
+		afterB, _ := b.apply(doc)
+		left, err := b1.apply(afterA)
+		assert.NoError(t, err)
+		right, err := a1.apply(afterB)
+		assert.NoError(t, err)
+		assert.Equal(t, string(left), string(right))
+	}
+
+	_, _, err := transformOps(textOp{}.retain(2), textOp{}.retain(3))
+	assert.Error(t, err)
+}
+
+// TestTransformOpsTieBreak ensures the first operation wins inserts at the
+// same position
+func TestTransformOpsTieBreak(t *testing.T) {
+	a := textOp{}.retain(1).insert("A").retain(1)
+	b := textOp{}.retain(1).insert("B").retain(1)
+	a1, b1, err := transformOps(a, b)
+	assert.NoError(t, err)
+	afterA, _ := a.apply([]rune("xy"))
+	merged, _ := b1.apply(afterA)
+	assert.Equal(t, "xABy", string(merged))
+	afterB, _ := b.apply([]rune("xy"))
+	merged, _ = a1.apply(afterB)
+	assert.Equal(t, "xABy", string(merged))
+}
+
+// TestTransformIndex ensures cursors move with the text around them
+func TestTransformIndex(t *testing.T) {
+	op := textOp{}.retain(2).insert("abc").delete(2).retain(3)
+	assert.Equal(t, 1, transformIndex(op, 1))
+	assert.Equal(t, 5, transformIndex(op, 2))
+	assert.Equal(t, 5, transformIndex(op, 3))
+	assert.Equal(t, 6, transformIndex(op, 5))
+}
+
+// TestDiffOp ensures an outside edit becomes a single replacement
+func TestDiffOp(t *testing.T) {
+	op := diffOp("Hello world", "Hello brave new world")
+	assert.Equal(t, textOp{{Retain: 6}, {Insert: "brave new "}, {Retain: 5}}, op)
+	out, err := diffOp("жук 🙂", "жаба 🙂").apply([]rune("жук 🙂"))
+	assert.NoError(t, err)
+	assert.Equal(t, "жаба 🙂", string(out))
+}
+
+// TestTextOpJSON ensures operations use the ot.js wire format
+func TestTextOpJSON(t *testing.T) {
+	var op textOp
+	assert.NoError(t, json.Unmarshal([]byte(`[3, "hi", -2, 1]`), &op))
+	assert.Equal(t, textOp{{Retain: 3}, {Insert: "hi"}, {Delete: 2}, {Retain: 1}}, op)
+	out, _ := json.Marshal(op)
+	assert.JSONEq(t, `[3, "hi", -2, 1]`, string(out))
+
+	assert.Error(t, json.Unmarshal([]byte(`[0]`), &op))
+	assert.Error(t, json.Unmarshal([]byte(`[1.5]`), &op))
+	assert.Error(t, json.Unmarshal([]byte(`[{}]`), &op))
+}
+
+// TestContentFingerprint ensures copies that differ only in formatting match
+func TestContentFingerprint(t *testing.T) {
+	assert.Equal(t, "buy cheap pills now", normalizeText("  Buy CHEAP pills... NOW!!"))
+	assert.Equal(t, contentFingerprint("Buy cheap pills now"), contentFingerprint("buy  cheap\npills, now!"))
+	assert.NotEqual(t, contentFingerprint("Buy cheap pills now"), contentFingerprint("Buy cheap pills later"))
+	assert.Equal(t, "", contentFingerprint("?!"))
+}
+
+// TestWordListCheck ensures blocked words reject, suspicious ones hold, and
+// only whole words match
+func TestWordListCheck(t *testing.T) {
+	check := newWordListCheck("scam link, badword", "casino")
+
+	verdict, _ := check.Check(moderationSubject{Kind: ReportComment, Text: "Click this SCAM   link!"})
+	assert.Equal(t, moderationReject, verdict)
+	verdict, reason := check.Check(moderationSubject{Kind: ReportArticle, Title: "Casino night", Text: "Fun for all"})
+	assert.Equal(t, moderationReview, verdict)
+	assert.Contains(t, reason, "casino")
+	verdict, _ = check.Check(moderationSubject{Kind: ReportComment, Text: "Casinos and badwords are fine"})
+	assert.Equal(t, moderationAllow, verdict)
+}
+
+// TestLinkCountCheck ensures comments allow fewer links than articles
+func TestLinkCountCheck(t *testing.T) {
+	check := linkCountCheck{maxArticleLinks: 3, maxCommentLinks: 1}
+	text := "see https://a.example and www.b.example and HTTP://c.example"
+
+	verdict, _ := check.Check(moderationSubject{Kind: ReportComment, Text: text})
+	assert.Equal(t, moderationReview, verdict)
+	verdict, _ = check.Check(moderationSubject{Kind: ReportArticle, Text: text})
+	assert.Equal(t, moderationAllow, verdict)
+}
+
+// TestExcerpt ensures long comments are cut on a word boundary
+func TestExcerpt(t *testing.T) {
+	assert.Equal(t, "short text", excerpt("short\n text", 20))
+	assert.Equal(t, "the quick brown…", excerpt("the quick brown fox jumps", 18))
+}
+
+// TestReorderIDs ensures listed bookmarks move to the front and the rest keep
+// their order
+func TestReorderIDs(t *testing.T) {
+	order, err := reorderIDs([]uint{1, 2, 3, 4}, []uint{3, 1})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint{3, 1, 2, 4}, order)
+
+	_, err = reorderIDs([]uint{1, 2}, []uint{5})
+	assert.Error(t, err)
+	_, err = reorderIDs([]uint{1, 2}, []uint{2, 2})
+	assert.Error(t, err)
+}
+
+// TestParseAcceptLanguage ensures supported languages come back by quality,
+// reduced to their primary tag
+func TestParseAcceptLanguage(t *testing.T) {
+	assert.Equal(t, []string{"kk", "en", "ru"}, parseAcceptLanguage("ru;q=0.3, kk-KZ, de;q=0.9, en;q=0.5, ru-RU;q=0.2"))
+	assert.Equal(t, []string{}, parseAcceptLanguage("de, fr;q=0.8, en;q=0"))
+	assert.Equal(t, "", normalizeLanguage("de-DE"))
+	assert.Equal(t, "en", normalizeLanguage("EN_us"))
+}
+
+// TestLanguageChain ensures a missing translation falls back in order
+func TestLanguageChain(t *testing.T) {
+	assert.Equal(t, []string{"kk", "ru", "en"}, languageChain("kk"))
+	assert.Equal(t, []string{"en", "ru"}, languageChain("en"))
+	assert.Nil(t, languageChain(""))
+}
+
+// TestUnsubscribeSignature ensures an unsubscribe link only works for the
+// address it was made for
+func TestUnsubscribeSignature(t *testing.T) {
+	sub := Subscriber{ID: 7, Email: "reader@example.com"}
+	other := Subscriber{ID: 7, Email: "someone@example.com"}
+
+	assert.Equal(t, unsubscribeSignature(sub), unsubscribeSignature(Subscriber{ID: 7, Email: "Reader@Example.com"}))
+	assert.NotEqual(t, unsubscribeSignature(sub), unsubscribeSignature(other))
+	assert.Contains(t, unsubscribeURL(sub), "id=7&sig="+unsubscribeSignature(sub))
+}
+
+// TestDigestDue ensures digests follow the subscriber's frequency
+func TestDigestDue(t *testing.T) {
+	now := time.Now()
+	yesterday := now.Add(-24 * time.Hour)
+
+	assert.True(t, digestDue(Subscriber{Status: SubscriberConfirmed, Frequency: DigestDaily, LastSentAt: &yesterday}, now))
+	assert.False(t, digestDue(Subscriber{Status: SubscriberConfirmed, Frequency: DigestWeekly, LastSentAt: &yesterday}, now))
+	assert.False(t, digestDue(Subscriber{Status: SubscriberPending, Frequency: DigestDaily, LastSentAt: &yesterday}, now))
+	assert.False(t, digestDue(Subscriber{Status: SubscriberConfirmed, Frequency: DigestDaily}, now))
+}
+
+// TestWebhookBackoff ensures retries wait twice as long each time, up to
+// the cap
+func TestWebhookBackoff(t *testing.T) {
+	assert.Equal(t, 30*time.Second, webhookBackoff(1))
+	assert.Equal(t, 2*time.Minute, webhookBackoff(3))
+	assert.Equal(t, webhookMaxBackoff, webhookBackoff(20))
+}
+
+// TestWebhookSignature ensures the signature covers the timestamp and the
+// payload
+func TestWebhookSignature(t *testing.T) {
+	payload := []byte(`{"event":"ping"}`)
+	signature := webhookSignature("secret", 1700000000, payload)
+
+	assert.True(t, strings.HasPrefix(signature, "sha256="))
+	assert.Len(t, signature, len("sha256=")+64)
+	assert.NotEqual(t, signature, webhookSignature("secret", 1700000001, payload))
+	assert.NotEqual(t, signature, webhookSignature("other", 1700000000, payload))
+}
+
+// TestValidWebhookEvents ensures only known events can be subscribed to
+func TestValidWebhookEvents(t *testing.T) {
+	assert.True(t, validWebhookEvents([]string{EventArticlePublished, EventTransactionCompleted}))
+	assert.False(t, validWebhookEvents(nil))
+	assert.False(t, validWebhookEvents([]string{EventPing}))
+	assert.False(t, validWebhookEvents([]string{EventUserRegistered, EventUserRegistered}))
+}
+
+// TestResponseCachePut ensures a response rendered before an invalidation is
+// not stored
+func TestResponseCachePut(t *testing.T) {
+	c := newResponseCache(10, time.Minute)
+	now := time.Now()
+	generation := c.currentGeneration()
+	c.invalidate()
+	c.put("/articles", generation, &cachedResponse{status: 200, stored: now})
+	_, ok := c.get("/articles", now)
+	assert.False(t, ok)
+
+	c.put("/articles", c.currentGeneration(), &cachedResponse{status: 200, stored: now})
+	_, ok = c.get("/articles", now)
+	assert.True(t, ok)
+	_, ok = c.get("/articles", now.Add(2*time.Minute))
+	assert.False(t, ok)
+}
+
+// TestCacheInvalidation ensures writes empty the cache once committed, and
+// flushed view counts do not
+func TestCacheInvalidation(t *testing.T) {
+	useTestDB(t, &User{}, &Article{})
+	assert.NoError(t, registerCacheInvalidation(db))
+	previous := pageCache
+	pageCache = newResponseCache(10, time.Minute)
+	t.Cleanup(func() { pageCache = previous })
+	cached := func() bool {
+		_, ok := pageCache.get("/articles", time.Now())
+		return ok
+	}
+	fill := func() {
+		pageCache.put("/articles", pageCache.currentGeneration(), &cachedResponse{status: 200, stored: time.Now()})
+	}
+
+	db.Create(&Article{ID: 1, Title: "One", UserID: 1, Status: ArticlePublished})
+	fill()
+	articleViews.record(1, "visitor", time.Now())
+	flushViews(time.Now())
+	assert.True(t, cached(), "flushed views should keep the cache")
+	var article Article
+	db.First(&article, 1)
+	assert.EqualValues(t, 1, article.ViewCount)
+
+	tx := db.Begin()
+	tx.Model(&Article{}).Where("id = 1").Update("title", "Changed")
+	assert.True(t, cached(), "an uncommitted write should keep the cache")
+	assert.NoError(t, tx.Commit().Error)
+	assert.False(t, cached(), "a committed write should empty the cache")
+
+	fill()
+	tx = db.Begin()
+	tx.Model(&Article{}).Where("id = 1").Update("title", "Rolled back")
+	tx.Rollback()
+	assert.True(t, cached(), "a rolled back write should keep the cache")
+
+	db.Model(&Article{}).Where("id = 1").Update("title", "Direct")
+	assert.False(t, cached(), "a write outside a transaction should empty the cache")
+}
+
+// TestResponseCacheEviction ensures a full cache drops its oldest entry
+func TestResponseCacheEviction(t *testing.T) {
+	c := newResponseCache(2, time.Minute)
+	now := time.Now()
+	c.put("a", 0, &cachedResponse{stored: now})
+	c.put("b", 0, &cachedResponse{stored: now.Add(time.Second)})
+	c.put("c", 0, &cachedResponse{stored: now.Add(2 * time.Second)})
+
+	_, ok := c.get("a", now)
+	assert.False(t, ok)
+	_, ok = c.get("c", now)
+	assert.True(t, ok)
+}
+
+// TestReferrerDomain ensures referrers are reduced to the domain of another
+// site
+func TestReferrerDomain(t *testing.T) {
+	r := httptest.NewRequest("POST", "http://blog.example.org/articles/1/beacon", nil)
+
+	assert.Equal(t, "news.example.com", referrerDomain("https://www.News.example.com/a?b=c", r))
+	assert.Equal(t, "", referrerDomain("https://blog.example.org/posts", r))
+	assert.Equal(t, "", referrerDomain("android-app://com.example", r))
+	assert.Equal(t, "", referrerDomain("", r))
+}
+
+// TestAnalyticsDepth ensures each reader counts once per depth bucket
+func TestAnalyticsDepth(t *testing.T) {
+	ac := newAnalyticsCollector(time.Hour)
+	now := time.Now()
+	ac.view(1, "a", "", now)
+	ac.depth(1, "a", 60, now)
+	ac.depth(1, "a", 100, now)
+	ac.depth(1, "a", 100, now)
+	ac.depth(1, "b", 30, now)
+
+	days, _ := ac.drain(now)
+	stat := days[dailyStatKey{1, now.UTC().Format(dayLayout)}]
+	assert.Equal(t, int64(2), stat.Views)
+	assert.Equal(t, int64(2), stat.Depth25)
+	assert.Equal(t, int64(1), stat.Depth50)
+	assert.Equal(t, int64(1), stat.Depth100)
+}
+
+// TestFlushAnalyticsKeepsFailedCounts ensures analytics survive a failed write and land on the next flush
+func TestFlushAnalyticsKeepsFailedCounts(t *testing.T) {
+	useTestDB(t)
+	previous := beaconStats
+	beaconStats = newAnalyticsCollector(viewDedupWindow)
+	t.Cleanup(func() { beaconStats = previous })
+
+	now := time.Now()
+	beaconStats.view(1, "a", "news.example.com", now)
+	beaconStats.depth(1, "a", 50, now)
+	beaconStats.view(2, "a", "", now)
+	beaconStats.forget(2)
+	flushAnalytics(now)
+
+	assert.NoError(t, db.AutoMigrate(&ArticleDailyStat{}, &ArticleReferrerStat{}))
+	flushAnalytics(now)
+	var stats []ArticleDailyStat
+	db.Find(&stats)
+	if assert.Len(t, stats, 1, "Forgotten articles should not be written") {
+		assert.Equal(t, int64(1), stats[0].Views)
+		assert.Equal(t, int64(1), stats[0].Depth50)
+	}
+	var referrers []ArticleReferrerStat
+	db.Find(&referrers)
+	if assert.Len(t, referrers, 1) {
+		assert.Equal(t, int64(1), referrers[0].Views)
+	}
+}
+
+// TestDeleteArticleDependents ensures an article's analytics go with it
+func TestDeleteArticleDependents(t *testing.T) {
+	useTestDB(t, &Comment{}, &Report{}, &ArticleSlug{}, &ArticleLike{}, &ArticleRevision{}, &ArticleCollaborator{},
+		&Bookmark{}, &ArticleTranslation{}, &ArticleDailyStat{}, &ArticleReferrerStat{})
+	db.Exec("CREATE TABLE article_tags (article_id integer, tag_id integer)")
+	db.Create(&ArticleDailyStat{ArticleID: 1, Day: "2024-01-01", Views: 3})
+	db.Create(&ArticleDailyStat{ArticleID: 2, Day: "2024-01-01", Views: 5})
+	db.Create(&ArticleReferrerStat{ArticleID: 1, Day: "2024-01-01", Domain: "example.com", Views: 1})
+
+	assert.NoError(t, deleteArticleDependents(db, 1))
+	var days, referrers int64
+	db.Model(&ArticleDailyStat{}).Count(&days)
+	db.Model(&ArticleReferrerStat{}).Count(&referrers)
+	assert.Equal(t, int64(1), days, "Other articles' stats should stay")
+	assert.Equal(t, int64(0), referrers)
+}
+
+// TestReadThroughRate ensures the rate is reads per view and never above 1
+func TestReadThroughRate(t *testing.T) {
+	assert.Equal(t, 0.0, readThroughRate(0, 0))
+	assert.Equal(t, 0.333, readThroughRate(1, 3))
+	assert.Equal(t, 1.0, readThroughRate(5, 4))
+}
+
+// fakeRemoteActor starts an in-process fediverse server publishing an actor
+// with the given public key at /actor; inbox handles posts to /inbox.
+func fakeRemoteActor(t *testing.T, publicKey string, inbox http.HandlerFunc) *httptest.Server {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/inbox" {
+			inbox(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", activityContentType)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":    srv.URL + "/actor",
+			"type":  "Person",
+			"inbox": srv.URL + "/inbox",
+			"publicKey": map[string]string{
+				"id":           srv.URL + "/actor#main-key",
+				"owner":        srv.URL + "/actor",
+				"publicKeyPem": publicKey,
+			},
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// allowLocalFederation lets federation reach the in-process servers of a
+// test, which listen on localhost.
+func allowLocalFederation(t *testing.T) {
+	previous := federationClient
+	federationClient = &http.Client{Timeout: 10 * time.Second}
+	t.Cleanup(func() { federationClient = previous })
+}
+
+// TestFederationClientRefusesPrivateAddresses ensures addresses taken from
+// remote documents cannot point the blog at its own network
+func TestFederationClientRefusesPrivateAddresses(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer local.Close()
+	_, err := federationClient.Get(local.URL)
+	assert.Error(t, err)
+	_, err = fetchRemoteActor(local.URL+"/actor", nil)
+	assert.Error(t, err)
+
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "192.168.0.1", "169.254.169.254", "100.64.0.1", "::1", "fe80::1", "::ffff:127.0.0.1", "0.0.0.0"} {
+		assert.False(t, publicAddress(net.ParseIP(ip)), ip)
+	}
+	assert.True(t, publicAddress(net.ParseIP("93.184.216.34")))
+	assert.True(t, publicAddress(net.ParseIP("2606:4700::1")))
+}
+
+// TestHTTPSignature ensures a signed request verifies against the key the
+// remote actor publishes, and that changing the body or replaying it late
+// does not
+func TestHTTPSignature(t *testing.T) {
+	allowLocalFederation(t)
+	private, public, err := generateKeyPair()
+	assert.NoError(t, err)
+	key, err := parsePrivateKeyPEM(private)
+	assert.NoError(t, err)
+	remote := fakeRemoteActor(t, public, nil)
+	signer := httpSigner{keyID: remote.URL + "/actor#main-key", key: key}
+
+	body := []byte(`{"type":"Follow"}`)
+	now := time.Now()
+	r := httptest.NewRequest("POST", "http://blog.example.org/ap/authors/1/inbox", bytes.NewReader(body))
+	assert.NoError(t, signRequest(r, body, signer, now))
+
+	actor, err := verifyRequestSignature(r, body, nil, now)
+	assert.NoError(t, err)
+	assert.Equal(t, remote.URL+"/actor", actor.ID)
+	assert.Equal(t, remote.URL+"/inbox", actor.Inbox)
+
+	_, err = verifyRequestSignature(r, []byte(`{"type":"Undo"}`), nil, now)
+	assert.Error(t, err)
+	_, err = verifyRequestSignature(r, body, nil, now.Add(13*time.Hour))
+	assert.Error(t, err)
+	r.Host = "other.example.org"
+	_, err = verifyRequestSignature(r, body, nil, now)
+	assert.Error(t, err)
+}
+
+// TestLookupRemoteKeyChecksOwner ensures an actor document naming someone
+// else's key is neither trusted nor cached under that key
+func TestLookupRemoteKeyChecksOwner(t *testing.T) {
+	allowLocalFederation(t)
+	_, public, err := generateKeyPair()
+	assert.NoError(t, err)
+	victim := "https://victim.example.org/actor#main-key"
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":        srv.URL + "/actor",
+			"inbox":     srv.URL + "/inbox",
+			"publicKey": map[string]string{"id": victim, "owner": srv.URL + "/actor", "publicKeyPem": public},
+		})
+	}))
+	defer srv.Close()
+
+	_, err = lookupRemoteKey(srv.URL+"/actor#main-key", nil, false)
+	assert.Error(t, err)
+	remoteActorsMu.Lock()
+	_, cached := remoteActors[victim]
+	remoteActorsMu.Unlock()
+	assert.False(t, cached)
+}
+
+// TestPostActivity ensures activities reach a remote inbox signed, so the
+// receiving server can verify them
+func TestPostActivity(t *testing.T) {
+	allowLocalFederation(t)
+	private, public, err := generateKeyPair()
+	assert.NoError(t, err)
+	key, err := parsePrivateKeyPEM(private)
+	assert.NoError(t, err)
+
+	var verified bool
+	var remote *httptest.Server
+	remote = fakeRemoteActor(t, public, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		actor, err := verifyRequestSignature(r, body, nil, time.Now())
+		verified = err == nil && actor.ID == remote.URL+"/actor" &&
+			r.Header.Get("Content-Type") == activityContentType
+		w.WriteHeader(http.StatusAccepted)
+	})
+	signer := httpSigner{keyID: remote.URL + "/actor#main-key", key: key}
+
+	code, err := postActivity(remote.URL+"/inbox", []byte(`{"type":"Create"}`), signer)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.True(t, verified)
+}
+
+// TestStaticPagePath ensures exported pages land in directories named after their slugs
+func TestStaticPagePath(t *testing.T) {
+	assert.Equal(t, "posts/index.html", staticPagePath("", "", 1))
+	assert.Equal(t, "posts/page/3/index.html", staticPagePath("", "", 3))
+	assert.Equal(t, "posts/hello-world/index.html", staticPagePath("article", "hello-world", 1))
+	assert.Equal(t, "posts/tag/go/page/2/index.html", staticPagePath("tag", "go", 2))
+	assert.Equal(t, "posts/author/7/index.html", staticPagePath("author", "7", 1))
+
+	assert.True(t, safeSegment("hello-world"))
+	assert.False(t, safeSegment(".."))
+	assert.False(t, safeSegment("a/b"))
+	assert.False(t, safeSegment(""))
+}
+
+// TestStaticLinks ensures links of exported pages are relative to the page
+func TestStaticLinks(t *testing.T) {
+	links := staticLinks("posts/tag/go/index.html")
+	assert.Equal(t, "../../../", links.Root)
+	assert.Equal(t, "../../../posts/hello/index.html", links.Article("hello"))
+	assert.Equal(t, "../../../posts/tag/go/page/2/index.html", links.Listing("tag", "go", 2))
+
+	root := staticLinks("index.html")
+	assert.Equal(t, "./", root.Root)
+	assert.True(t, root.Static())
+	assert.False(t, pageLinks{}.Static())
+}
+
+// TestSaveArticleTwice ensures the updated_at returned by an edit is accepted
+// as the precondition of the next one
+func TestSaveArticleTwice(t *testing.T) {
+	useTestDB(t, &User{}, &Category{}, &Tag{}, &Article{}, &ArticleSlug{}, &ArticleRevision{}, &ArticleTranslation{}, &ArticleCollaborator{}, &Series{}, &Report{})
+	db.Create(&User{ID: 1, Name: "Ann"})
+	article := Article{Title: "First", Content: "one", UserID: 1, Status: ArticleDraft}
+	assert.NoError(t, renderArticleContent(&article))
+	assert.NoError(t, insertArticle(&article, 1, ""))
+
+	vars := map[string]string{"id": "1"}
+	var saved Article
+	w := serveTest(patchArticleHandler, "PATCH", "/articles/1", map[string]interface{}{"content": "two", "updated_at": article.UpdatedAt}, vars, 1, "user")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &saved))
+	assert.Zero(t, saved.UpdatedAt.Nanosecond()%1000, "updated_at should have the precision of the database")
+
+	w = serveTest(patchArticleHandler, "PATCH", "/articles/1", map[string]interface{}{"content": "three", "updated_at": saved.UpdatedAt}, vars, 1, "user")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = serveTest(patchArticleHandler, "PATCH", "/articles/1", map[string]interface{}{"content": "four", "updated_at": saved.UpdatedAt}, vars, 1, "user")
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code, "a stale updated_at should be refused")
+}
+
+// TestFlaggedEditLeavesPublication ensures a flagged edit of a published
+// article takes it back to review
+func TestFlaggedEditLeavesPublication(t *testing.T) {
+	useTestDB(t, &User{}, &Category{}, &Tag{}, &Article{}, &ArticleSlug{}, &ArticleRevision{}, &ArticleTranslation{}, &ArticleCollaborator{}, &Series{}, &Report{})
+	db.Create(&User{ID: 1, Name: "Ann"})
+	now := time.Now()
+	article := Article{Title: "Clean", Content: "clean text", UserID: 1, Status: ArticlePublished, PublishedAt: &now}
+	assert.NoError(t, renderArticleContent(&article))
+	assert.NoError(t, insertArticle(&article, 1, ""))
+
+	vars := map[string]string{"id": "1"}
+	w := serveTest(patchArticleHandler, "PATCH", "/articles/1", map[string]string{"content": "still clean"}, vars, 1, "user")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	db.First(&article, article.ID)
+	assert.Equal(t, ArticlePublished, article.Status)
+
+	w = serveTest(patchArticleHandler, "PATCH", "/articles/1", map[string]string{"content": "visit my casino"}, vars, 1, "user")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	db.First(&article, article.ID)
+	assert.Equal(t, ArticleInReview, article.Status)
+	var reports int64
+	db.Model(&Report{}).Where("target_type = ? AND target_id = ?", ReportArticle, article.ID).Count(&reports)
+	assert.EqualValues(t, 1, reports)
+}
+
+// TestCollabSnapshotChecksEditors ensures snapshots only save changes by
+// users who may still edit the article and that pass moderation
+func TestCollabSnapshotChecksEditors(t *testing.T) {
+	useTestDB(t, &User{}, &Category{}, &Tag{}, &Article{}, &ArticleSlug{}, &ArticleRevision{}, &ArticleTranslation{}, &ArticleCollaborator{}, &Series{}, &Report{})
+	previous := moderationChecks
+	moderationChecks = []moderationCheck{newWordListCheck("spam", "")}
+	t.Cleanup(func() { moderationChecks = previous })
+
+	db.Create(&User{ID: 1, Name: "Ann"})
+	db.Create(&User{ID: 2, Name: "Bob"})
+	article := Article{Title: "Draft", Content: "hello", UserID: 1, Status: ArticleDraft}
+	assert.NoError(t, renderArticleContent(&article))
+	assert.NoError(t, insertArticle(&article, 1, ""))
+	db.Create(&ArticleCollaborator{ArticleID: article.ID, UserID: 2})
+
+	session := &collabSession{articleID: article.ID, doc: []rune(article.Content), clients: map[*collabClient]bool{}, editors: map[uint]string{}, persisted: article.Content}
+	bob := &collabClient{peer: collabPeer{ClientID: 1, UserID: 2}, role: "user", send: make(chan collabMessage, collabSendBuffer)}
+	session.clients[bob] = true
+	stored := func() string {
+		var a Article
+		db.First(&a, article.ID)
+		return a.Content
+	}
+
+	assert.NoError(t, session.receive(bob, 0, diffOp("hello", "hello world")))
+	session.snapshot()
+	assert.Equal(t, "hello world", stored())
+
+	assert.NoError(t, session.receive(bob, session.revision, diffOp("hello world", "hello spam")))
+	session.snapshot()
+	assert.Equal(t, "hello world", stored(), "a rejected change should not be saved")
+	assert.Equal(t, "hello world", string(session.doc), "a rejected change should be discarded")
+
+	assert.NoError(t, session.receive(bob, session.revision, diffOp("hello world", "hello there")))
+	db.Where("article_id = ? AND user_id = ?", article.ID, 2).Delete(&ArticleCollaborator{})
+	session.snapshot()
+	assert.Equal(t, "hello world", stored(), "a removed co-author's change should not be saved")
+	assert.Equal(t, "hello world", string(session.doc))
+	assert.True(t, bob.closed, "a removed co-author should be disconnected")
+}
+
+// TestImportWordPress ensures comments are attributed only to imported
+// authors and a repeated import creates nothing
+func TestImportWordPress(t *testing.T) {
+	useTestDB(t, &User{}, &Category{}, &Tag{}, &Article{}, &ArticleSlug{}, &ArticleRevision{}, &ArticleTranslation{}, &Series{}, &Comment{}, &ImportedItem{})
+	db.Create(&User{ID: 1, Name: "Admin", Email: "admin@x.io", Role: "admin", EmailVerified: true})
+	db.Create(&User{ID: 2, Name: "Ann", Email: "ann@x.io", EmailVerified: true})
+	db.Create(&User{ID: 3, Name: "Victim", Email: "victim@x.io", EmailVerified: true})
+	export := `<rss xmlns:wp="http://wordpress.org/export/1.2/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:content="http://purl.org/rss/1.0/modules/content/">
+<channel><wp:base_site_url>https://old.example.com</wp:base_site_url>
+<wp:author><wp:author_id>5</wp:author_id><wp:author_login>ann</wp:author_login><wp:author_email>ann@x.io</wp:author_email></wp:author>
+<item><title>Hi</title><dc:creator>ann</dc:creator><content:encoded><![CDATA[<p>Body</p>]]></content:encoded>
+<wp:post_id>7</wp:post_id><wp:post_date_gmt>2020-01-02 03:04:05</wp:post_date_gmt><wp:status>publish</wp:status><wp:post_type>post</wp:post_type>
+<wp:comment><wp:comment_id>1</wp:comment_id><wp:comment_author>Ann</wp:comment_author><wp:comment_author_email>ann@x.io</wp:comment_author_email><wp:comment_content>Thanks</wp:comment_content><wp:comment_approved>1</wp:comment_approved><wp:comment_user_id>5</wp:comment_user_id></wp:comment>
+<wp:comment><wp:comment_id>2</wp:comment_id><wp:comment_author>Mallory</wp:comment_author><wp:comment_author_email>victim@x.io</wp:comment_author_email><wp:comment_content>Buy now</wp:comment_content><wp:comment_approved>1</wp:comment_approved><wp:comment_user_id>0</wp:comment_user_id></wp:comment>
+</item></channel></rss>`
+	file, err := parseWXR(strings.NewReader(export))
+	assert.NoError(t, err)
+	var admin User
+	db.First(&admin, 1)
+
+	report := importWordPress(file, admin, false)
+	assert.Zero(t, report.Failed, report.Results)
+	var comments []Comment
+	db.Order("id").Find(&comments)
+	assert.Len(t, comments, 2)
+	assert.EqualValues(t, 2, comments[0].UserID, "an imported author's comment should be theirs")
+	assert.NotEqual(t, uint(3), comments[1].UserID, "a comment should not be attributed by its email")
+	assert.Equal(t, "Mallory", comments[1].GuestName)
+
+	report = importWordPress(file, admin, false)
+	assert.Zero(t, report.Created)
+	assert.Zero(t, report.Failed)
+	var articles, total int64
+	db.Model(&Article{}).Count(&articles)
+	db.Model(&Comment{}).Count(&total)
+	assert.EqualValues(t, 1, articles)
+	assert.EqualValues(t, 2, total)
+}
+
+// TestInboxFollow ensures a signed Follow makes a follower who is sent an
+// Accept and then new articles, and that Undo removes the follower
+func TestInboxFollow(t *testing.T) {
+	allowLocalFederation(t)
+	useTestDB(t, &User{}, &Category{}, &Tag{}, &Article{}, &ActorKey{}, &Follower{}, &ActivityDelivery{})
+	now := time.Now()
+	db.Create(&User{ID: 1, Name: "Ann"})
+	article := Article{ID: 1, Title: "Hello", Slug: "hello", UserID: 1, Status: ArticlePublished, PublishedAt: &now}
+	db.Create(&article)
+
+	private, public, err := generateKeyPair()
+	assert.NoError(t, err)
+	key, err := parsePrivateKeyPEM(private)
+	assert.NoError(t, err)
+	var mu sync.Mutex
+	var received []string
+	remote := fakeRemoteActor(t, public, func(w http.ResponseWriter, r *http.Request) {
+		var activity struct {
+			Type string `json:"type"`
+		}
+		json.NewDecoder(r.Body).Decode(&activity)
+		mu.Lock()
+		received = append(received, activity.Type)
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	signer := httpSigner{keyID: remote.URL + "/actor#main-key", key: key}
+
+	post := func(activity map[string]interface{}) int {
+		body, _ := json.Marshal(activity)
+		r := httptest.NewRequest("POST", actorURI(1)+"/inbox", bytes.NewReader(body))
+		assert.NoError(t, signRequest(r, body, signer, time.Now()))
+		w := httptest.NewRecorder()
+		inboxHandler(w, mux.SetURLVars(r, map[string]string{"id": "1"}))
+		return w.Code
+	}
+	follow := map[string]interface{}{"id": remote.URL + "/follows/1", "type": "Follow", "actor": remote.URL + "/actor", "object": actorURI(1)}
+
+	forged := map[string]interface{}{"id": remote.URL + "/follows/2", "type": "Follow", "actor": "https://other.example.org/actor", "object": actorURI(1)}
+	assert.Equal(t, http.StatusUnauthorized, post(forged), "an activity signed by someone else should be refused")
+
+	assert.Equal(t, http.StatusAccepted, post(follow))
+	var followers []Follower
+	db.Find(&followers)
+	assert.Len(t, followers, 1)
+	assert.Equal(t, remote.URL+"/inbox", followers[0].Inbox)
+
+	federateArticle(&article)
+	deliverDueActivities(time.Now())
+	assert.ElementsMatch(t, []string{"Accept", "Create"}, received)
+	var pending int64
+	db.Model(&ActivityDelivery{}).Where("status <> ?", DeliverySucceeded).Count(&pending)
+	assert.Zero(t, pending)
+
+	assert.Equal(t, http.StatusAccepted, post(map[string]interface{}{"id": remote.URL + "/undo/1", "type": "Undo", "actor": remote.URL + "/actor", "object": follow}))
+	var count int64
+	db.Model(&Follower{}).Count(&count)
+	assert.Zero(t, count)
+}
+
+// TestDeliverDueActivities ensures activities are sent concurrently up to
+// the limit
+func TestDeliverDueActivities(t *testing.T) {
+	allowLocalFederation(t)
+	useTestDB(t, &ActorKey{}, &ActivityDelivery{})
+	var mu sync.Mutex
+	running, most := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	_, _, err := actorSigner(1)
+	assert.NoError(t, err)
+	now := time.Now()
+	for i := 0; i < webhookConcurrency*2; i++ {
+		db.Create(&ActivityDelivery{UserID: 1, Inbox: srv.URL + "/inbox", Activity: "{}", Status: DeliveryPending, NextAttemptAt: &now})
+	}
+
+	deliverDueActivities(now)
+	var sent int64
+	db.Model(&ActivityDelivery{}).Where("status = ?", DeliverySucceeded).Count(&sent)
+	assert.Equal(t, int64(webhookConcurrency*2), sent)
+	assert.Greater(t, most, 1, "deliveries should overlap")
+	assert.LessOrEqual(t, most, webhookConcurrency)
+}
+
+// TestPruneActivityDeliveries ensures only old finished deliveries are deleted
+func TestPruneActivityDeliveries(t *testing.T) {
+	useTestDB(t, &ActivityDelivery{})
+	now := time.Now()
+	old := now.Add(-activityRetention - time.Hour)
+	db.Create(&ActivityDelivery{Inbox: "old-ok", Status: DeliverySucceeded, UpdatedAt: old})
+	db.Create(&ActivityDelivery{Inbox: "old-failed", Status: DeliveryFailed, UpdatedAt: old})
+	db.Create(&ActivityDelivery{Inbox: "old-pending", Status: DeliveryPending, UpdatedAt: old})
+	db.Create(&ActivityDelivery{Inbox: "recent", Status: DeliverySucceeded, UpdatedAt: now})
+
+	pruneActivityDeliveries(now)
+	var inboxes []string
+	db.Model(&ActivityDelivery{}).Order("inbox").Pluck("inbox", &inboxes)
+	assert.Equal(t, []string{"old-pending", "recent"}, inboxes)
+}
+
+// TestSetSeriesArticles ensures the order of a series is validated and
+// stored, and that articles and series whose navigation changes are bumped
+func TestSetSeriesArticles(t *testing.T) {
+	useTestDB(t, &User{}, &Category{}, &Tag{}, &Article{}, &ArticleSlug{}, &ArticleRevision{}, &Series{})
+	db.Create(&User{ID: 1, Name: "Ann"})
+	db.Create(&User{ID: 2, Name: "Bob"})
+	old := time.Now().Add(-time.Hour).Truncate(time.Microsecond)
+	db.Create(&Series{ID: 1, Title: "One", Slug: "one", UserID: 1, UpdatedAt: old})
+	db.Create(&Series{ID: 2, Title: "Two", Slug: "two", UserID: 1, UpdatedAt: old})
+	two := uint(2)
+	for id := uint(1); id <= 3; id++ {
+		db.Create(&Article{ID: id, Title: "A", Slug: "a-" + strconv.Itoa(int(id)), UserID: 1, Status: ArticlePublished})
+	}
+	db.Create(&Article{ID: 4, Title: "B", Slug: "b", UserID: 2, Status: ArticlePublished})
+	db.Model(&Article{}).Where("id = 3").UpdateColumns(map[string]interface{}{"series_id": two, "series_position": 1, "updated_at": old})
+	set := func(ids ...uint) int {
+		w := serveTest(setSeriesArticlesHandler, "PUT", "/series/1/articles", map[string][]uint{"article_ids": ids}, map[string]string{"id": "1"}, 1, "user")
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusBadRequest, set(1, 1), "duplicates should be refused")
+	assert.Equal(t, http.StatusBadRequest, set(1, 4), "another author's article should be refused")
+	assert.Equal(t, http.StatusBadRequest, set(1, 99), "unknown articles should be refused")
+
+	assert.Equal(t, http.StatusOK, set(2, 1))
+	var articles []Article
+	db.Order("id").Find(&articles)
+	assert.Equal(t, 2, articles[0].SeriesPosition)
+	assert.Equal(t, 1, articles[1].SeriesPosition)
+
+	assert.Equal(t, http.StatusOK, set(3, 1))
+	db.Order("id").Find(&articles)
+	assert.Nil(t, articles[1].SeriesID, "a left out article should leave the series")
+	assert.True(t, articles[1].UpdatedAt.After(old), "a leaving article's page should change")
+	assert.Equal(t, 1, articles[2].SeriesPosition)
+	assert.EqualValues(t, 1, *articles[2].SeriesID)
+	var previous Series
+	db.First(&previous, 2)
+	assert.True(t, previous.UpdatedAt.After(old), "the series an article left should change")
+
+	db.Model(&Series{}).Where("id = 1").UpdateColumn("updated_at", old)
+	member := articles[2]
+	member.Status = ArticleArchived
+	assert.NoError(t, saveArticle(&member, member.UpdatedAt, 1, ""))
+	var series Series
+	db.First(&series, 1)
+	assert.True(t, series.UpdatedAt.After(old), "archiving a member should change the series")
+
+	w := serveTest(getSeriesListHandler, "GET", "/series?author=ann", nil, nil, 0, "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = serveTest(getSeriesListHandler, "GET", "/series?author=1", nil, nil, 0, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+// TestImportMarkdownAgain ensures a file is recognized as the article it was
+// imported as, even when that article got a suffixed slug, and that
+// overwriting applies the whole front matter
+func TestImportMarkdownAgain(t *testing.T) {
+	useTestDB(t, &User{}, &Category{}, &Tag{}, &Article{}, &ArticleSlug{}, &ArticleRevision{}, &ArticleTranslation{}, &Series{}, &ImportedItem{})
+	db.Create(&User{ID: 1, Name: "Ann"})
+	db.Create(&User{ID: 2, Name: "Bob"})
+	db.Create(&Article{Title: "Hello", Slug: "hello", UserID: 2, Status: ArticleDraft})
+	var ann User
+	db.First(&ann, 1)
+
+	result := importMarkdownFile("posts/hello.md", []byte("# Hello\n\nFirst"), ann, false, false)
+	assert.Equal(t, ImportCreated, result.Status, result.Error)
+	assert.Equal(t, "hello-2", result.Slug)
+	result = importMarkdownFile("posts/hello.md", []byte("# Hello\n\nFirst"), ann, false, false)
+	assert.Equal(t, ImportSkipped, result.Status)
+	var count int64
+	db.Model(&Article{}).Count(&count)
+	assert.EqualValues(t, 2, count)
+
+	date := time.Date(2021, 5, 6, 7, 8, 9, 0, time.UTC)
+	file := "---\ntitle: Hello\nstatus: published\ndate: 2021-05-06T07:08:09Z\n---\n\nSecond"
+	result = importMarkdownFile("posts/hello.md", []byte(file), ann, true, true)
+	assert.Equal(t, ImportUpdated, result.Status, result.Error)
+	var article Article
+	db.First(&article, result.ArticleID)
+	assert.Equal(t, "Second", article.Content)
+	assert.Equal(t, ArticlePublished, article.Status)
+	assert.True(t, date.Equal(*article.PublishedAt))
+
+	result = importMarkdownFile("other.md", []byte("---\ntitle: Intro\nslug: intro-3\n---\n\nText"), ann, false, false)
+	assert.Equal(t, ImportCreated, result.Status, result.Error)
+	assert.Equal(t, "intro-3", result.Slug, "the slug of the front matter should be kept")
+	result = importMarkdownFile("renamed.md", []byte("---\ntitle: Intro\nslug: intro-3\n---\n\nText"), ann, false, false)
+	assert.Equal(t, ImportSkipped, result.Status, "a file with the slug of an article should match it")
+}
+
+// TestImportAnnouncesUndatedArticles ensures only imported articles without
+// a date in their front matter fire the published event
+func TestImportAnnouncesUndatedArticles(t *testing.T) {
+	useTestDB(t, &User{}, &Category{}, &Tag{}, &Article{}, &ArticleSlug{}, &ArticleRevision{}, &ArticleTranslation{}, &Series{}, &ImportedItem{},
+		&Webhook{}, &WebhookDelivery{}, &Follower{})
+	db.Create(&User{ID: 1, Name: "Ann"})
+	db.Create(&Webhook{ID: 1, URL: "https://hooks.example.com", Events: []string{EventArticlePublished}, Active: true, Secret: "s"})
+	var ann User
+	db.First(&ann, 1)
+
+	result := importMarkdownFile("old.md", []byte("---\ntitle: Old\nstatus: published\ndate: 2021-05-06T07:08:09Z\n---\n\nText"), ann, true, false)
+	assert.Equal(t, ImportCreated, result.Status, result.Error)
+	var events []string
+	db.Model(&WebhookDelivery{}).Pluck("event", &events)
+	assert.Empty(t, events, "a dated article is back catalogue")
+
+	result = importMarkdownFile("new.md", []byte("---\ntitle: New\nstatus: published\n---\n\nText"), ann, true, false)
+	assert.Equal(t, ImportCreated, result.Status, result.Error)
+	db.Model(&WebhookDelivery{}).Pluck("event", &events)
+	assert.Equal(t, []string{EventArticlePublished}, events)
+}
+
+// TestTaxonomySlug ensures symbols that tell tags apart survive in the slug
+func TestTaxonomySlug(t *testing.T) {
+	assert.Equal(t, "c", taxonomySlug("C"))
+	assert.Equal(t, "c-plus-plus", taxonomySlug("C++"))
+	assert.Equal(t, "c-sharp", taxonomySlug("C#"))
+	assert.Equal(t, "machine-learning", taxonomySlug(" Machine  Learning "))
+}
+
+// TestResolveTags ensures tags are matched by slug and created once
+func TestResolveTags(t *testing.T) {
+	useTestDB(t, &Tag{})
+	tags, err := resolveTags([]string{"C", "C++", "C#", "c++", " "})
+	assert.NoError(t, err)
+	var slugs []string
+	for _, tag := range tags {
+		slugs = append(slugs, tag.Slug)
+	}
+	assert.Equal(t, []string{"c", "c-plus-plus", "c-sharp"}, slugs)
+
+	again, err := resolveTags([]string{"C++"})
+	assert.NoError(t, err)
+	assert.Equal(t, tags[1].ID, again[0].ID, "an existing tag should be reused")
+	var count int64
+	db.Model(&Tag{}).Count(&count)
+	assert.Equal(t, int64(3), count)
+}
+
+// TestRenameAndMergeTags ensures the articles of renamed and merged tags
+// change, and a merge keeps one link per article
+func TestRenameAndMergeTags(t *testing.T) {
+	useTestDB(t, &User{}, &Category{}, &Tag{}, &Article{})
+	old := time.Now().Add(-time.Hour).Truncate(time.Microsecond)
+	db.Create(&Tag{ID: 1, Name: "Go", Slug: "go"})
+	db.Create(&Tag{ID: 2, Name: "Golang", Slug: "golang"})
+	db.Create(&Tag{ID: 3, Name: "Rust", Slug: "rust"})
+	for id := uint(1); id <= 3; id++ {
+		db.Create(&Article{ID: id, Title: "A", Slug: "a-" + strconv.Itoa(int(id)), UserID: 1, UpdatedAt: old})
+	}
+	db.Exec("INSERT INTO article_tags (article_id, tag_id) VALUES (1, 1), (1, 2), (2, 2), (3, 3)")
+	updatedAt := func(id uint) time.Time {
+		var article Article
+		db.First(&article, id)
+		return article.UpdatedAt
+	}
+
+	w := serveTest(renameTagHandler, "PUT", "/tags/1", map[string]string{"name": "Golang"}, map[string]string{"id": "1"}, 1, "admin")
+	assert.Equal(t, http.StatusConflict, w.Code, "renaming onto another tag should be refused")
+
+	w = serveTest(renameTagHandler, "PUT", "/tags/3", map[string]string{"name": "Rust lang"}, map[string]string{"id": "3"}, 1, "admin")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, updatedAt(3).After(old), "articles of a renamed tag should change")
+	assert.True(t, updatedAt(1).Equal(old), "articles of other tags should not change")
+
+	w = serveTest(mergeTagsHandler, "POST", "/tags/merge", map[string]interface{}{"source_ids": []uint{2}, "target_id": 1}, nil, 1, "admin")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, updatedAt(1).After(old), "articles of a merged tag should change")
+	assert.True(t, updatedAt(2).After(old))
+	var links []struct{ ArticleID, TagID uint }
+	db.Raw("SELECT article_id, tag_id FROM article_tags ORDER BY article_id, tag_id").Scan(&links)
+	assert.Equal(t, []struct{ ArticleID, TagID uint }{{1, 1}, {2, 1}, {3, 3}}, links)
+	var count int64
+	db.Model(&Tag{}).Where("id = 2").Count(&count)
+	assert.Equal(t, int64(0), count, "the source tag should be gone")
+}
+
+// TestExportStaticSiteAgain ensures a second export keeps what did not
+// change without rebuilding it, rewrites what did and removes what is gone
+func TestExportStaticSiteAgain(t *testing.T) {
+	useTestDB(t, &User{}, &Category{}, &Tag{}, &Article{}, &ArticleSlug{}, &ArticleTranslation{}, &Series{})
+	dir := t.TempDir()
+	now := time.Now()
+	db.Create(&User{ID: 1, Name: "Ann"})
+	db.Create(&Article{ID: 1, Title: "Kept", Slug: "kept", Content: "one", ContentHTML: "<p>one</p>", UserID: 1, Status: ArticlePublished, PublishedAt: &now})
+	db.Create(&Article{ID: 2, Title: "Changed", Slug: "changed", Content: "two", ContentHTML: "<p>two</p>", UserID: 1, Status: ArticlePublished, PublishedAt: &now})
+	db.Create(&Article{ID: 3, Title: "Gone", Slug: "gone", Content: "three", ContentHTML: "<p>three</p>", UserID: 1, Status: ArticlePublished, PublishedAt: &now})
+	read := func(name string) string {
+		data, _ := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		return string(data)
+	}
+
+	first, err := exportStaticSite(dir, false)
+	assert.NoError(t, err)
+	assert.Empty(t, first.Warnings)
+	assert.Contains(t, read("posts/gone/index.html"), "three")
+	var manifest staticManifest
+	assert.NoError(t, json.Unmarshal([]byte(read(staticManifestName)), &manifest))
+	for _, name := range []string{"index.html", "posts/index.html", "posts/author/1/index.html", "feed.xml", "atom.xml", "feed.json", "authors/1/feed.xml", "sitemap.xml"} {
+		assert.NotEmpty(t, manifest.Files[name].Source, "%s should be fingerprinted", name)
+	}
+
+	again, err := exportStaticSite(dir, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, again.Written)
+	assert.Equal(t, 0, again.Removed)
+	assert.Equal(t, first.Written, again.Unchanged)
+
+	kept := read("posts/kept/index.html")
+	later := databaseNow().Add(time.Second)
+	db.Model(&Article{}).Where("id = 2").UpdateColumns(map[string]interface{}{"content_html": "<p>two again</p>", "updated_at": later})
+	db.Model(&Article{}).Where("id = 3").UpdateColumns(map[string]interface{}{"status": ArticleArchived, "updated_at": later})
+	third, err := exportStaticSite(dir, false)
+	assert.NoError(t, err)
+	assert.Contains(t, read("posts/changed/index.html"), "two again")
+	assert.NoFileExists(t, filepath.Join(dir, "posts", "gone", "index.html"))
+	assert.NoDirExists(t, filepath.Join(dir, "posts", "gone"))
+	assert.Equal(t, 1, third.Removed)
+	assert.Equal(t, kept, read("posts/kept/index.html"))
+	assert.NotContains(t, read("posts/index.html"), "Gone", "the listing should drop the removed article")
+	assert.NotContains(t, read("sitemap.xml"), "/posts/gone")
+	assert.Greater(t, third.Unchanged, 0)
+}
+
+// TestArticleFlagsAreNotRevalidated ensures a logged-in reader always gets
+// their current liked flag instead of a 304 from the shared ETag
+func TestArticleFlagsAreNotRevalidated(t *testing.T) {
+	useTestDB(t, &User{}, &Category{}, &Tag{}, &Article{}, &ArticleTranslation{}, &Series{}, &ArticleLike{}, &Bookmark{})
+	now := time.Now()
+	db.Create(&User{ID: 1, Name: "Ann"})
+	article := Article{ID: 1, Title: "Hello", Slug: "hello", UserID: 1, Status: ArticlePublished, PublishedAt: &now}
+	db.Create(&article)
+	get := func(token string) *httptest.ResponseRecorder {
+		r := mux.SetURLVars(httptest.NewRequest("GET", "/articles/1", nil), map[string]string{"id": "1"})
+		r.Header.Set("If-None-Match", articleETag(article))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		getArticleHandler(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusNotModified, get("").Code)
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &Claims{UserID: 2, Role: "user"}).SignedString(jwtSecret)
+	assert.NoError(t, err)
+	db.Create(&ArticleLike{ArticleID: 1, UserID: 2})
+	w := get(token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, cachePersonal, w.Header().Get("Cache-Control"))
+	assert.Equal(t, articleETag(article), w.Header().Get("ETag"), "the ETag should still serve as If-Match")
+	var body Article
+	json.NewDecoder(w.Body).Decode(&body)
+	assert.True(t, body.Liked)
+}
+
+// TestDeliverDueWebhooks ensures deliveries are sent concurrently up to the
+// limit and those of disabled webhooks wait
+func TestDeliverDueWebhooks(t *testing.T) {
+	useTestDB(t, &Webhook{}, &WebhookDelivery{})
+	var mu sync.Mutex
+	running, most := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	db.Create(&Webhook{ID: 1, URL: srv.URL, Active: true, Secret: "s"})
+	db.Create(&Webhook{ID: 2, URL: srv.URL, Active: false, Secret: "s"})
+	now := time.Now()
+	for i := 0; i < webhookConcurrency*2; i++ {
+		db.Create(&WebhookDelivery{WebhookID: 1, Event: EventPing, Payload: "{}", Status: DeliveryPending, NextAttemptAt: &now})
+	}
+	db.Create(&WebhookDelivery{ID: 100, WebhookID: 2, Event: EventPing, Payload: "{}", Status: DeliveryPending, NextAttemptAt: &now})
+
+	deliverDueWebhooks(now)
+	var sent int64
+	db.Model(&WebhookDelivery{}).Where("status = ?", DeliverySucceeded).Count(&sent)
+	assert.Equal(t, int64(webhookConcurrency*2), sent)
+	assert.Greater(t, most, 1, "deliveries should overlap")
+	assert.LessOrEqual(t, most, webhookConcurrency)
+
+	var paused WebhookDelivery
+	db.First(&paused, 100)
+	assert.Equal(t, DeliveryPending, paused.Status, "a disabled webhook's delivery should wait")
+	assert.Equal(t, 0, paused.Attempts)
+}
+
+// TestArticleSlugFollowsTitle ensures a number from an old title leaves the
+// slug, a uniqueness suffix stays, and old slugs redirect with the query
+func TestArticleSlugFollowsTitle(t *testing.T) {
+	useTestDB(t, &User{}, &Category{}, &Tag{}, &Article{}, &ArticleSlug{}, &ArticleRevision{}, &ArticleTranslation{}, &Series{})
+	db.Create(&User{ID: 1, Name: "Ann"})
+	now := time.Now()
+	windows := Article{Title: "Windows 10", Content: "x", UserID: 1, Status: ArticlePublished, PublishedAt: &now}
+	first := Article{Title: "Hello", Content: "x", UserID: 1, Status: ArticleDraft}
+	second := Article{Title: "Hello", Content: "x", UserID: 1, Status: ArticleDraft}
+	for _, article := range []*Article{&windows, &first, &second} {
+		assert.NoError(t, insertArticle(article, 1, ""))
+	}
+	assert.Equal(t, "windows-10", windows.Slug)
+	assert.Equal(t, "hello-2", second.Slug)
+
+	windows.Title = "Windows"
+	assert.NoError(t, saveArticle(&windows, windows.UpdatedAt, 1, ""))
+	assert.Equal(t, "windows", windows.Slug, "the number belonged to the old title")
+
+	db.Delete(&Article{}, first.ID)
+	second.Content = "y"
+	assert.NoError(t, saveArticle(&second, second.UpdatedAt, 1, ""))
+	assert.Equal(t, "hello-2", second.Slug, "an unchanged title should keep its slug")
+
+	r := mux.SetURLVars(httptest.NewRequest("GET", "/posts/windows-10?lang=en&utm_source=x", nil), map[string]string{"slug": "windows-10"})
+	w := httptest.NewRecorder()
+	postPageHandler(w, r)
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Equal(t, "/posts/windows?lang=en&utm_source=x", w.Header().Get("Location"))
+}
+
+// TestArticleBySlugIncludesTaxonomy ensures an article fetched by slug has
+// its category and tags, like one fetched by ID
+func TestArticleBySlugIncludesTaxonomy(t *testing.T) {
+	useTestDB(t, &User{}, &Category{}, &Tag{}, &Article{}, &ArticleSlug{}, &ArticleTranslation{}, &Series{}, &ArticleLike{})
+	db.Create(&User{ID: 1, Name: "Ann"})
+	db.Create(&Category{ID: 1, Name: "Go", Slug: "go"})
+	now := time.Now()
+	category := uint(1)
+	db.Create(&Article{ID: 1, Title: "Hello", Slug: "hello", Content: "x", UserID: 1, Status: ArticlePublished, PublishedAt: &now,
+		CategoryID: &category, Tags: []Tag{{Name: "News", Slug: "news"}}})
+
+	w := serveTest(getArticleBySlugHandler, "GET", "/articles/by-slug/hello", nil, map[string]string{"slug": "hello"}, 0, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var got Article
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	if assert.NotNil(t, got.Category) {
+		assert.Equal(t, "go", got.Category.Slug)
+	}
+	if assert.Len(t, got.Tags, 1) {
+		assert.Equal(t, "news", got.Tags[0].Slug)
+	}
+}
+
+// TestMigrateArticleStatus ensures articles from before the workflow stay
+// published while new ones without a status start as drafts
+func TestMigrateArticleStatus(t *testing.T) {
+	useTestDB(t)
+	assert.NoError(t, db.Exec("CREATE TABLE articles (id integer PRIMARY KEY, title text, user_id integer)").Error)
+	assert.NoError(t, db.Exec("INSERT INTO articles (id, title, user_id) VALUES (1, 'Old', 1)").Error)
+
+	assert.NoError(t, migrateArticleStatus())
+	assert.NoError(t, db.AutoMigrate(&User{}, &Category{}, &Tag{}, &Article{}))
+	assert.NoError(t, migrateArticleStatus(), "a second run should do nothing")
+
+	article := Article{ID: 2, Title: "New", Slug: "new", UserID: 1}
+	assert.NoError(t, db.Create(&article).Error)
+	var statuses []string
+	db.Model(&Article{}).Order("id").Pluck("status", &statuses)
+	assert.Equal(t, []string{ArticlePublished, ArticleDraft}, statuses)
+}
+
+// TestServeUploadsCaching ensures only media library files are cached for
+// good, while files that are replaced in place are revalidated
+func TestServeUploadsCaching(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	assert.NoError(t, os.Chdir(dir))
+	t.Cleanup(func() { os.Chdir(wd) })
+	assert.NoError(t, os.MkdirAll(filepath.Join(uploadsDir, "media", "1"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(uploadsDir, "media", "1", "abc.png"), []byte("png"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(uploadsDir, "1_1700000000.jpg"), []byte("jpg"), 0o644))
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		serveUploads().ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w
+	}
+	w := get("/uploads/media/1/abc.png")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Cache-Control"), "immutable")
+
+	w = get("/uploads/1_1700000000.jpg")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, cacheRevalidate, w.Header().Get("Cache-Control"))
+	assert.NotEmpty(t, w.Header().Get("Last-Modified"), "revalidation needs a validator")
+
+	assert.Equal(t, cacheRevalidate, get("/uploads/media/../1_1700000000.jpg").Header().Get("Cache-Control"))
+}
+
+// TestRollbackIsModerated ensures rolling back to a revision goes through
+// moderation like an edit
+func TestRollbackIsModerated(t *testing.T) {
+	useTestDB(t, &User{}, &Category{}, &Tag{}, &Article{}, &ArticleSlug{}, &ArticleRevision{}, &ArticleTranslation{}, &ArticleCollaborator{}, &Series{}, &Report{})
+	previous := moderationChecks
+	moderationChecks = []moderationCheck{newWordListCheck("spam", "casino")}
+	t.Cleanup(func() { moderationChecks = previous })
+
+	db.Create(&User{ID: 1, Name: "Ann"})
+	now := time.Now()
+	article := Article{Title: "Offer", Content: "buy spam", UserID: 1, Status: ArticlePublished, PublishedAt: &now}
+	assert.NoError(t, renderArticleContent(&article))
+	assert.NoError(t, insertArticle(&article, 1, ""))
+	for _, content := range []string{"visit my casino", "clean text"} {
+		article.Content = content
+		assert.NoError(t, saveArticle(&article, article.UpdatedAt, 1, ""))
+	}
+	rollback := func(number string) int {
+		vars := map[string]string{"id": strconv.Itoa(int(article.ID)), "number": number}
+		return serveTest(rollbackArticleHandler, "POST", "/articles/1/revisions/"+number+"/rollback", nil, vars, 1, "user").Code
+	}
+
+	assert.Equal(t, http.StatusUnprocessableEntity, rollback("1"), "a rejected revision should not come back")
+	db.First(&article, article.ID)
+	assert.Equal(t, "clean text", article.Content)
+
+	assert.Equal(t, http.StatusOK, rollback("2"))
+	db.First(&article, article.ID)
+	assert.Equal(t, ArticleInReview, article.Status, "a flagged revision should leave publication")
+	var reports int64
+	db.Model(&Report{}).Where("target_type = ? AND target_id = ?", ReportArticle, article.ID).Count(&reports)
+	assert.EqualValues(t, 1, reports)
+}
+
+// TestImportIsModerated ensures imported text is moderated: rejected files
+// fail and flagged ones leave publication
+func TestImportIsModerated(t *testing.T) {
+	useTestDB(t, &User{}, &Category{}, &Tag{}, &Article{}, &ArticleSlug{}, &ArticleRevision{}, &ArticleTranslation{}, &Series{}, &ImportedItem{}, &Report{})
+	previous := moderationChecks
+	moderationChecks = []moderationCheck{newWordListCheck("spam", "casino")}
+	t.Cleanup(func() { moderationChecks = previous })
+	db.Create(&User{ID: 1, Name: "Ann"})
+	var ann User
+	db.First(&ann, 1)
+
+	result := importMarkdownFile("post.md", []byte("---\ntitle: Post\nstatus: published\n---\n\nClean"), ann, true, false)
+	assert.Equal(t, ImportCreated, result.Status, result.Error)
+
+	result = importMarkdownFile("post.md", []byte("---\ntitle: Post\n---\n\nBuy spam"), ann, false, true)
+	assert.Equal(t, ImportFailed, result.Status)
+	var article Article
+	db.First(&article, "slug = ?", "post")
+	assert.Equal(t, "Clean", article.Content)
+
+	result = importMarkdownFile("post.md", []byte("---\ntitle: Post\n---\n\nVisit my casino"), ann, false, true)
+	assert.Equal(t, ImportUpdated, result.Status, result.Error)
+	assert.NotEmpty(t, result.Warnings)
+	db.First(&article, result.ArticleID)
+	assert.Equal(t, ArticleInReview, article.Status, "a flagged overwrite should not stay live")
+	var reports int64
+	db.Model(&Report{}).Where("target_type = ? AND target_id = ?", ReportArticle, article.ID).Count(&reports)
+	assert.EqualValues(t, 1, reports)
+
+	result = importMarkdownFile("new.md", []byte("---\ntitle: New\n---\n\nMore spam"), ann, false, false)
+	assert.Equal(t, ImportFailed, result.Status)
+}
+
+// TestFlaggedTranslationHoldsArticle ensures a flagged translation does not
+// go live next to the published original
+func TestFlaggedTranslationHoldsArticle(t *testing.T) {
+	useTestDB(t, &User{}, &Category{}, &Tag{}, &Article{}, &ArticleSlug{}, &ArticleRevision{}, &ArticleTranslation{}, &ArticleCollaborator{}, &Series{}, &Report{})
+	previous := moderationChecks
+	moderationChecks = []moderationCheck{newWordListCheck("spam", "casino")}
+	t.Cleanup(func() { moderationChecks = previous })
+	db.Create(&User{ID: 1, Name: "Ann"})
+	now := time.Now()
+	article := Article{Title: "Hello", Content: "text", UserID: 1, Status: ArticlePublished, PublishedAt: &now, Language: "ru"}
+	assert.NoError(t, renderArticleContent(&article))
+	assert.NoError(t, insertArticle(&article, 1, ""))
+	put := func(lang, content string) int {
+		vars := map[string]string{"id": strconv.Itoa(int(article.ID)), "lang": lang}
+		return serveTest(putTranslationHandler, "PUT", "/articles/1/translations/"+lang, map[string]string{"title": "Hello", "content": content}, vars, 1, "user").Code
+	}
+
+	assert.Equal(t, http.StatusCreated, put("kk", "clean text"))
+	db.First(&article, article.ID)
+	assert.Equal(t, ArticlePublished, article.Status)
+
+	assert.Equal(t, http.StatusCreated, put("en", "visit my casino"))
+	db.First(&article, article.ID)
+	assert.Equal(t, ArticleInReview, article.Status, "a flagged translation should take the article back to review")
+	var reports int64
+	db.Model(&Report{}).Where("target_type = ? AND target_id = ?", ReportArticle, article.ID).Count(&reports)
+	assert.EqualValues(t, 1, reports)
+}
+
+// TestBackfillArticleFingerprints ensures articles from before the duplicate
+// check are matched by it once fingerprinted
+func TestBackfillArticleFingerprints(t *testing.T) {
+	useTestDB(t, &User{}, &Category{}, &Tag{}, &Article{})
+	text := "A long enough article body that was written before fingerprints"
+	db.Create(&Article{ID: 1, Title: "Old", Slug: "old", Content: text, UserID: 1})
+	db.Create(&Article{ID: 2, Title: "Empty", Slug: "empty", UserID: 1})
+	check := duplicateCheck{window: time.Hour, minLength: 30, rejectAfter: 3}
+	subject := moderationSubject{Kind: ReportArticle, Text: strings.ToUpper(text)}
+
+	verdict, _ := check.Check(subject)
+	assert.Equal(t, moderationAllow, verdict)
+	assert.NoError(t, backfillArticleFingerprints())
+	verdict, _ = check.Check(subject)
+	assert.Equal(t, moderationReview, verdict)
+
+	var empty Article
+	db.First(&empty, 2)
+	assert.Empty(t, empty.Fingerprint)
+}
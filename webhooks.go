@@ -0,0 +1,629 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Webhook is an endpoint of another tool that is told about events on the
+// blog. Payloads are signed with Secret so the receiver can check where they
+// came from.
+type Webhook struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	URL         string    `json:"url"`
+	Events      []string  `json:"events" gorm:"serializer:json"`
+	Description string    `json:"description"`
+	Active      bool      `json:"active" gorm:"not null"`
+	Secret      string    `json:"-"`
+	CreatedByID uint      `json:"created_by_id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// WebhookDelivery is one event sent, or still to be sent, to one webhook.
+// Failed attempts are retried with exponential backoff until
+// webhookMaxAttempts; the row keeps the outcome of the last attempt.
+type WebhookDelivery struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	WebhookID     uint       `json:"webhook_id" gorm:"index"`
+	EventID       string     `json:"event_id" gorm:"index"`
+	Event         string     `json:"event"`
+	Payload       string     `json:"payload" gorm:"type:text"`
+	Status        string     `json:"status" gorm:"index"`
+	Attempts      int        `json:"attempts" gorm:"not null;default:0"`
+	NextAttemptAt *time.Time `json:"next_attempt_at" gorm:"index"`
+	LastAttemptAt *time.Time `json:"last_attempt_at"`
+	ResponseCode  int        `json:"response_code"`
+	ResponseBody  string     `json:"response_body" gorm:"type:text"`
+	Error         string     `json:"error"`
+	DurationMS    int64      `json:"duration_ms"`
+	RedeliveryOf  *uint      `json:"redelivery_of"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+const (
+	EventArticlePublished     = "article.published"
+	EventUserRegistered       = "user.registered"
+	EventTransactionCompleted = "transaction.completed"
+	EventPing                 = "ping"
+
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// webhookEvents are the events a webhook can subscribe to. Ping is only sent
+// on request and reaches every webhook.
+var webhookEvents = []string{EventArticlePublished, EventUserRegistered, EventTransactionCompleted}
+
+const (
+	webhookMaxAttempts = 8
+	// The first retry waits webhookBaseBackoff, each further one twice as
+	// long, up to webhookMaxBackoff.
+	webhookBaseBackoff = 30 * time.Second
+	webhookMaxBackoff  = 6 * time.Hour
+	// A claimed delivery is not picked up again for this long, so a crashed
+	// attempt is retried eventually.
+	webhookLease = 2 * time.Minute
+	// Response bodies are cut to this many bytes in the log.
+	webhookResponseLimit = 1024
+	webhookInterval      = 15 * time.Second
+	// Deliveries sent at the same time, so one slow endpoint does not hold
+	// up the others
+	webhookConcurrency = 8
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookWake nudges the dispatcher when new deliveries are queued, so they
+// do not wait for the next tick.
+var webhookWake = make(chan struct{}, 1)
+
+// webhookBackoff is the wait before the next attempt after attempts failed
+// ones.
+func webhookBackoff(attempts int) time.Duration {
+	wait := webhookBaseBackoff
+	for i := 1; i < attempts; i++ {
+		wait *= 2
+		if wait >= webhookMaxBackoff {
+			return webhookMaxBackoff
+		}
+	}
+	return wait
+}
+
+// webhookSignature signs a payload for the X-Webhook-Signature header. The
+// timestamp is part of the signed text so a captured request cannot be
+// replayed later with a new timestamp.
+func webhookSignature(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func subscribesTo(hook Webhook, event string) bool {
+	if event == EventPing {
+		return true
+	}
+	for _, e := range hook.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// validWebhookEvents reports whether events is a non-empty list of known
+// events without duplicates.
+func validWebhookEvents(events []string) bool {
+	seen := map[string]bool{}
+	for _, event := range events {
+		known := false
+		for _, e := range webhookEvents {
+			known = known || e == event
+		}
+		if !known || seen[event] {
+			return false
+		}
+		seen[event] = true
+	}
+	return len(events) > 0
+}
+
+func validWebhookURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// emitWebhookEvent queues event for every active webhook subscribed to it.
+// Delivery happens in the background; failures here are only logged so they
+// never break the request that caused the event.
+func emitWebhookEvent(event string, data interface{}) {
+	var hooks []Webhook
+	if err := db.Where("active = ?", true).Find(&hooks).Error; err != nil {
+		logger.WithFields(logrus.Fields{
+			"event": event,
+			"error": err.Error(),
+		}).Error("Failed to fetch webhooks")
+		return
+	}
+	var targets []Webhook
+	for _, hook := range hooks {
+		if subscribesTo(hook, event) {
+			targets = append(targets, hook)
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+	if _, err := queueWebhookEvent(event, data, targets); err != nil {
+		logger.WithFields(logrus.Fields{
+			"event": event,
+			"error": err.Error(),
+		}).Error("Failed to queue webhook deliveries")
+	}
+}
+
+// queueWebhookEvent stores one delivery of event per webhook and wakes the
+// dispatcher.
+func queueWebhookEvent(event string, data interface{}, hooks []Webhook) ([]WebhookDelivery, error) {
+	now := time.Now()
+	eventID := newInvitationCode()
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":         eventID,
+		"event":      event,
+		"created_at": now.UTC().Format(time.RFC3339),
+		"data":       data,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]WebhookDelivery, len(hooks))
+	for i, hook := range hooks {
+		deliveries[i] = WebhookDelivery{
+			WebhookID:     hook.ID,
+			EventID:       eventID,
+			Event:         event,
+			Payload:       string(payload),
+			Status:        DeliveryPending,
+			NextAttemptAt: &now,
+		}
+	}
+	if err := db.Create(&deliveries).Error; err != nil {
+		return nil, err
+	}
+	wakeWebhookDispatcher()
+	return deliveries, nil
+}
+
+func wakeWebhookDispatcher() {
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverDueWebhooks attempts every pending delivery whose time has come,
+// up to webhookConcurrency at once. Deliveries to disabled webhooks wait
+// until they are enabled again.
+func deliverDueWebhooks(now time.Time) {
+	var due []WebhookDelivery
+	if err := db.Where("status = ? AND next_attempt_at <= ?", DeliveryPending, now).
+		Where("webhook_id IN (SELECT id FROM webhooks WHERE active = ?)", true).
+		Order("next_attempt_at, id").Limit(100).Find(&due).Error; err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Failed to fetch due webhook deliveries")
+		return
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, webhookConcurrency)
+	for i := range due {
+		delivery := &due[i]
+		slots <- struct{}{}
+		// Claim the delivery so another instance does not send it too. The
+		// lease starts once a slot is free, so waiting does not use it up.
+		lease := time.Now().Add(webhookLease)
+		res := db.Model(&WebhookDelivery{}).
+			Where("id = ? AND status = ? AND next_attempt_at = ?", delivery.ID, DeliveryPending, *delivery.NextAttemptAt).
+			Update("next_attempt_at", lease)
+		if res.Error != nil || res.RowsAffected == 0 {
+			<-slots
+			continue
+		}
+		delivery.NextAttemptAt = &lease
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			attemptWebhookDelivery(delivery)
+		}()
+	}
+	wg.Wait()
+}
+
+// attemptWebhookDelivery posts a claimed delivery to its webhook and records
+// the outcome.
+func attemptWebhookDelivery(delivery *WebhookDelivery) {
+	var hook Webhook
+	if err := db.First(&hook, delivery.WebhookID).Error; err != nil {
+		db.Model(delivery).Updates(map[string]interface{}{"status": DeliveryFailed, "error": "webhook deleted", "next_attempt_at": nil})
+		return
+	}
+
+	started := time.Now()
+	code, body, err := postWebhook(hook, delivery, started)
+	finished := time.Now()
+
+	updates := map[string]interface{}{
+		"attempts":        delivery.Attempts + 1,
+		"last_attempt_at": finished,
+		"response_code":   code,
+		"response_body":   body,
+		"duration_ms":     finished.Sub(started).Milliseconds(),
+		"error":           "",
+	}
+	switch {
+	case err == nil && code >= 200 && code < 300:
+		updates["status"] = DeliverySucceeded
+		updates["next_attempt_at"] = nil
+	case delivery.Attempts+1 >= webhookMaxAttempts:
+		updates["status"] = DeliveryFailed
+		updates["next_attempt_at"] = nil
+	default:
+		updates["next_attempt_at"] = finished.Add(webhookBackoff(delivery.Attempts + 1))
+	}
+	if err != nil {
+		updates["error"] = err.Error()
+	} else if code < 200 || code >= 300 {
+		updates["error"] = fmt.Sprintf("endpoint answered %d", code)
+	}
+
+	if err := db.Model(delivery).Updates(updates).Error; err != nil {
+		logger.WithFields(logrus.Fields{
+			"delivery_id": delivery.ID,
+			"error":       err.Error(),
+		}).Error("Failed to record webhook delivery")
+		return
+	}
+	if updates["status"] == DeliveryFailed {
+		logger.WithFields(logrus.Fields{
+			"delivery_id": delivery.ID,
+			"webhook_id":  hook.ID,
+			"event":       delivery.Event,
+		}).Warn("Webhook delivery failed for good")
+	}
+}
+
+func postWebhook(hook Webhook, delivery *WebhookDelivery, now time.Time) (int, string, error) {
+	payload := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, "", err
+	}
+	timestamp := now.Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", siteName+"-Webhooks")
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-ID", delivery.EventID)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", webhookSignature(hook.Secret, timestamp, payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, webhookResponseLimit))
+	return resp.StatusCode, string(body), nil
+}
+
+// runWebhookDispatcher delivers queued webhook events in the background.
+func runWebhookDispatcher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-webhookWake:
+		}
+		deliverDueWebhooks(time.Now())
+	}
+}
+
+// Event payloads
+
+func articleEventData(article *Article) map[string]interface{} {
+	return map[string]interface{}{
+		"id":           article.ID,
+		"title":        article.Title,
+		"slug":         article.Slug,
+		"url":          articleURL(*article),
+		"user_id":      article.UserID,
+		"published_at": article.PublishedAt,
+	}
+}
+
+func userEventData(user User) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         user.ID,
+		"name":       user.Name,
+		"email":      user.Email,
+		"created_at": user.CreatedAt,
+	}
+}
+
+func transactionEventData(transaction Transaction) map[string]interface{} {
+	return map[string]interface{}{
+		"id":          transaction.ID,
+		"customer_id": transaction.CustomerID,
+		"amount":      transaction.Amount,
+		"status":      transaction.Status,
+		"updated_at":  transaction.UpdatedAt,
+	}
+}
+
+// Admin endpoints
+
+type webhookInput struct {
+	URL          *string   `json:"url"`
+	Events       *[]string `json:"events"`
+	Description  *string   `json:"description"`
+	Active       *bool     `json:"active"`
+	RotateSecret bool      `json:"rotate_secret"` // update only
+}
+
+// applyWebhookInput copies a create/update request onto hook. It writes a
+// 400 and returns false on bad input.
+func applyWebhookInput(w http.ResponseWriter, hook *Webhook, input webhookInput) bool {
+	if input.URL != nil {
+		if !validWebhookURL(*input.URL) {
+			http.Error(w, `{"error": "URL must be an absolute http or https URL"}`, http.StatusBadRequest)
+			return false
+		}
+		hook.URL = *input.URL
+	}
+	if input.Events != nil {
+		if !validWebhookEvents(*input.Events) {
+			http.Error(w, `{"error": "Events must list known events, each once"}`, http.StatusBadRequest)
+			return false
+		}
+		hook.Events = *input.Events
+	}
+	if input.Description != nil {
+		hook.Description = strings.TrimSpace(*input.Description)
+	}
+	if input.Active != nil {
+		hook.Active = *input.Active
+	}
+	return true
+}
+
+func loadWebhook(w http.ResponseWriter, r *http.Request) (*Webhook, bool) {
+	var hook Webhook
+	if err := db.First(&hook, mux.Vars(r)["id"]).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, `{"error": "Webhook not found"}`, http.StatusNotFound)
+		} else {
+			http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		}
+		return nil, false
+	}
+	return &hook, true
+}
+
+// getWebhooksHandler lists the configured webhooks and the events they can
+// subscribe to.
+func getWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	var hooks []Webhook
+	if err := db.Order("id").Find(&hooks).Error; err != nil {
+		http.Error(w, `{"error": "Error fetching webhooks"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"webhooks": hooks,
+		"events":   webhookEvents,
+	})
+}
+
+// createWebhookHandler adds a webhook. Its signing secret is only shown in
+// this response.
+func createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input webhookInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if input.URL == nil || input.Events == nil {
+		http.Error(w, `{"error": "URL and events are required"}`, http.StatusBadRequest)
+		return
+	}
+
+	adminID, _ := r.Context().Value("user_id").(uint)
+	hook := Webhook{Active: true, Secret: newInvitationCode(), CreatedByID: adminID}
+	if !applyWebhookInput(w, &hook, input) {
+		return
+	}
+	if err := db.Create(&hook).Error; err != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"webhook_id": hook.ID,
+		"events":     hook.Events,
+		"admin_id":   adminID,
+	}).Info("Webhook created")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"webhook": hook,
+		"secret":  hook.Secret,
+	})
+}
+
+// updateWebhookHandler changes the fields present in the body. With
+// rotate_secret the webhook gets a new secret, returned once.
+func updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input webhookInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	hook, ok := loadWebhook(w, r)
+	if !ok || !applyWebhookInput(w, hook, input) {
+		return
+	}
+	if input.RotateSecret {
+		hook.Secret = newInvitationCode()
+	}
+	if err := db.Select("url", "events", "description", "active", "secret", "updated_at").Save(hook).Error; err != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{"webhook": hook}
+	if input.RotateSecret {
+		response["secret"] = hook.Secret
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// deleteWebhookHandler removes a webhook and its delivery log.
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	hook, ok := loadWebhook(w, r)
+	if !ok {
+		return
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("webhook_id = ?", hook.ID).Delete(&WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(hook).Error
+	})
+	if err != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Webhook deleted"})
+}
+
+// pingWebhookHandler queues a ping event for one webhook, to test it.
+func pingWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	hook, ok := loadWebhook(w, r)
+	if !ok {
+		return
+	}
+	deliveries, err := queueWebhookEvent(EventPing, map[string]interface{}{"webhook_id": hook.ID}, []Webhook{*hook})
+	if err != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(deliveries[0])
+}
+
+// getWebhookDeliveriesHandler shows the delivery log of a webhook, newest
+// first. ?status= narrows it to pending, succeeded or failed deliveries.
+func getWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	hook, ok := loadWebhook(w, r)
+	if !ok {
+		return
+	}
+	query := db.Where("webhook_id = ?", hook.ID)
+	if status := r.URL.Query().Get("status"); status != "" {
+		if status != DeliveryPending && status != DeliverySucceeded && status != DeliveryFailed {
+			http.Error(w, `{"error": "Unknown delivery status"}`, http.StatusBadRequest)
+			return
+		}
+		query = query.Where("status = ?", status)
+	}
+
+	var deliveries []WebhookDelivery
+	if err := query.Order("id DESC").Limit(100).Find(&deliveries).Error; err != nil {
+		http.Error(w, `{"error": "Error fetching deliveries"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// redeliverWebhookHandler sends a logged delivery again as a new delivery
+// with the same payload and event ID, so receivers can tell it is a repeat.
+func redeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var original WebhookDelivery
+	if err := db.First(&original, mux.Vars(r)["id"]).Error; err != nil {
+		http.Error(w, `{"error": "Delivery not found"}`, http.StatusNotFound)
+		return
+	}
+	if original.Status == DeliveryPending {
+		http.Error(w, `{"error": "Delivery is still being retried"}`, http.StatusConflict)
+		return
+	}
+	var hook Webhook
+	if err := db.First(&hook, original.WebhookID).Error; err != nil {
+		http.Error(w, `{"error": "Webhook not found"}`, http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	delivery := WebhookDelivery{
+		WebhookID:     hook.ID,
+		EventID:       original.EventID,
+		Event:         original.Event,
+		Payload:       original.Payload,
+		Status:        DeliveryPending,
+		NextAttemptAt: &now,
+		RedeliveryOf:  &original.ID,
+	}
+	if err := db.Create(&delivery).Error; err != nil {
+		http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+		return
+	}
+	wakeWebhookDispatcher()
+
+	adminID, _ := r.Context().Value("user_id").(uint)
+	logger.WithFields(logrus.Fields{
+		"delivery_id":   delivery.ID,
+		"redelivery_of": original.ID,
+		"admin_id":      adminID,
+	}).Info("Webhook redelivery queued")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(delivery)
+}
@@ -0,0 +1,730 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// ImportedItem remembers which local row an item of an external blog became,
+// so running the same import again does not create duplicates.
+type ImportedItem struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	Source     string    `json:"source" gorm:"uniqueIndex:idx_imported_item"`
+	Kind       string    `json:"kind" gorm:"uniqueIndex:idx_imported_item"`
+	ExternalID string    `json:"external_id" gorm:"uniqueIndex:idx_imported_item"`
+	LocalID    uint      `json:"local_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Kinds of imported items.
+const (
+	ImportedAuthor   = "author"
+	ImportedCategory = "category"
+	ImportedPost     = "post"
+	ImportedComment  = "comment"
+)
+
+// ImportMatched reports an item that maps onto a row that already existed.
+const ImportMatched = "matched"
+
+const maxWXRBytes = 64 << 20
+
+const alreadyImported = "already imported"
+
+// guestEmail owns imported comments whose author has no account here; the
+// name they commented under is kept on the comment. The .invalid domain
+// never receives mail.
+const guestEmail = "guest@import.invalid"
+
+// The subset of a WordPress eXtended RSS export that is imported. Elements
+// are matched by local name, so exports of every WXR version parse.
+type wxrFile struct {
+	Channel wxrChannel `xml:"channel"`
+}
+
+type wxrChannel struct {
+	Title       string        `xml:"title"`
+	Link        string        `xml:"link"`
+	BaseSiteURL string        `xml:"base_site_url"`
+	Authors     []wxrAuthor   `xml:"author"`
+	Categories  []wxrCategory `xml:"category"`
+	Items       []wxrItem     `xml:"item"`
+}
+
+type wxrAuthor struct {
+	ID          string `xml:"author_id"`
+	Login       string `xml:"author_login"`
+	Email       string `xml:"author_email"`
+	DisplayName string `xml:"author_display_name"`
+}
+
+type wxrCategory struct {
+	TermID   string `xml:"term_id"`
+	Nicename string `xml:"category_nicename"`
+	Name     string `xml:"cat_name"`
+	Parent   string `xml:"category_parent"`
+}
+
+type wxrItem struct {
+	Title       string       `xml:"title"`
+	Link        string       `xml:"link"`
+	PubDate     string       `xml:"pubDate"`
+	Creator     string       `xml:"creator"`
+	Content     string       `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	PostID      string       `xml:"post_id"`
+	PostDate    string       `xml:"post_date"`
+	PostDateGMT string       `xml:"post_date_gmt"`
+	Status      string       `xml:"status"`
+	PostType    string       `xml:"post_type"`
+	Terms       []wxrTerm    `xml:"category"`
+	Comments    []wxrComment `xml:"comment"`
+}
+
+type wxrTerm struct {
+	Domain   string `xml:"domain,attr"`
+	Nicename string `xml:"nicename,attr"`
+	Name     string `xml:",chardata"`
+}
+
+type wxrComment struct {
+	ID          string `xml:"comment_id"`
+	Author      string `xml:"comment_author"`
+	AuthorEmail string `xml:"comment_author_email"`
+	Date        string `xml:"comment_date"`
+	DateGMT     string `xml:"comment_date_gmt"`
+	Content     string `xml:"comment_content"`
+	Approved    string `xml:"comment_approved"`
+	Type        string `xml:"comment_type"`
+	Parent      string `xml:"comment_parent"`
+	UserID      string `xml:"comment_user_id"`
+}
+
+// wxrResult reports what happened to one item of a WordPress import.
+type wxrResult struct {
+	Kind       string   `json:"kind"`
+	ExternalID string   `json:"external_id"`
+	Title      string   `json:"title,omitempty"`
+	Status     string   `json:"status"`
+	LocalID    uint     `json:"local_id,omitempty"`
+	Error      string   `json:"error,omitempty"`
+	Warnings   []string `json:"warnings,omitempty"`
+}
+
+// wxrReport sums up a WordPress import. Comments that were simply created,
+// or imported by an earlier run, are only counted, to keep the report
+// readable for large blogs.
+type wxrReport struct {
+	Source  string      `json:"source"`
+	Created int         `json:"created"`
+	Matched int         `json:"matched"`
+	Skipped int         `json:"skipped"`
+	Failed  int         `json:"failed"`
+	Results []wxrResult `json:"results"`
+}
+
+func (r *wxrReport) add(result wxrResult) {
+	switch result.Status {
+	case ImportCreated:
+		r.Created++
+	case ImportMatched:
+		r.Matched++
+	case ImportSkipped:
+		r.Skipped++
+	case ImportFailed:
+		r.Failed++
+	}
+	routine := result.Status == ImportCreated || result.Error == alreadyImported
+	if result.Kind == ImportedComment && routine && len(result.Warnings) == 0 {
+		return
+	}
+	r.Results = append(r.Results, result)
+}
+
+// parseWXR reads a WordPress export.
+func parseWXR(r io.Reader) (*wxrFile, error) {
+	var file wxrFile
+	decoder := xml.NewDecoder(r)
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid WXR file: %w", err)
+	}
+	if file.Channel.BaseSiteURL == "" && file.Channel.Link == "" {
+		return nil, errors.New("invalid WXR file: the channel has no site URL")
+	}
+	return &file, nil
+}
+
+// parseWXRDate parses the dates WordPress writes. Unpublished posts carry
+// the zero date 0000-00-00 00:00:00, which yields nil.
+func parseWXRDate(gmt, local, rss string) *time.Time {
+	for _, value := range []string{gmt, local} {
+		if t, err := time.Parse("2006-01-02 15:04:05", strings.TrimSpace(value)); err == nil && t.Year() > 1 {
+			return &t
+		}
+	}
+	if t, err := time.Parse(time.RFC1123Z, strings.TrimSpace(rss)); err == nil {
+		return &t
+	}
+	return nil
+}
+
+var (
+	wpBlockComment = regexp.MustCompile(`<!--\s*/?wp:[^>]*-->\n?`)
+	wpMoreComment  = regexp.MustCompile(`<!--(more|nextpage)[^>]*-->\n?`)
+	wpCaption      = regexp.MustCompile(`(?s)\[caption[^\]]*\](.*?)\[/caption\]`)
+	wpEmbed        = regexp.MustCompile(`(?s)\[embed[^\]]*\](.*?)\[/embed\]`)
+	wpShortcode    = regexp.MustCompile(`\[/([a-z][a-z0-9_-]*)\]`)
+)
+
+// cleanWordPressContent turns the HTML of a WordPress post into article
+// content. Raw HTML is valid in the Markdown source and is sanitized when
+// rendered; block editor comments and the common shortcodes are removed.
+// Shortcodes that remain are returned so they can be reported.
+func cleanWordPressContent(content string) (string, []string) {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	content = wpBlockComment.ReplaceAllString(content, "")
+	content = wpMoreComment.ReplaceAllString(content, "")
+	content = wpCaption.ReplaceAllString(content, "$1")
+	content = wpEmbed.ReplaceAllString(content, "$1")
+
+	var leftover []string
+	seen := map[string]bool{}
+	for _, match := range wpShortcode.FindAllStringSubmatch(content, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			leftover = append(leftover, match[1])
+		}
+	}
+	return strings.TrimSpace(content) + "\n", leftover
+}
+
+// wxrStatus maps a WordPress post status onto the article workflow. The
+// second value is false for posts that are not imported at all.
+func wxrStatus(status string, date *time.Time, now time.Time) (string, bool) {
+	switch status {
+	case "publish":
+		return ArticlePublished, true
+	case "future":
+		if date != nil && date.After(now) {
+			return ArticleScheduled, true
+		}
+		return ArticlePublished, true
+	case "pending":
+		return ArticleInReview, true
+	case "draft", "private":
+		return ArticleDraft, true
+	}
+	// trash, auto-draft and inherit
+	return "", false
+}
+
+// wxrImport carries the state of one WordPress import. The importing admin
+// owns whatever cannot be attributed to an author.
+type wxrImport struct {
+	source     string
+	importer   User
+	invite     bool
+	authors    map[string]User // by login
+	authorIDs  map[string]User // by WordPress user ID
+	categories map[string]uint // by nicename
+	guest      *User
+	report     wxrReport
+}
+
+// importWordPress imports the authors, categories, posts and comments of a
+// WXR export. Items imported by an earlier run of the same site are
+// recognized and not created again, so an import can simply be repeated
+// after a failure or with a newer export.
+func importWordPress(file *wxrFile, importer User, invite bool) wxrReport {
+	source := strings.TrimRight(file.Channel.BaseSiteURL, "/")
+	if source == "" {
+		source = strings.TrimRight(file.Channel.Link, "/")
+	}
+	imp := &wxrImport{
+		source:     source,
+		importer:   importer,
+		invite:     invite,
+		authors:    map[string]User{},
+		authorIDs:  map[string]User{},
+		categories: map[string]uint{},
+		report:     wxrReport{Source: source, Results: []wxrResult{}},
+	}
+
+	for _, author := range file.Channel.Authors {
+		imp.report.add(imp.importAuthor(author))
+	}
+	for _, category := range file.Channel.Categories {
+		imp.report.add(imp.importCategory(category.TermID, category.Nicename, category.Name))
+	}
+	for _, item := range file.Channel.Items {
+		imp.importItem(item)
+	}
+	return imp.report
+}
+
+// lookupImported returns the local ID an external item was imported as.
+func (imp *wxrImport) lookupImported(kind, externalID string) (uint, bool, error) {
+	var item ImportedItem
+	err := db.Where("source = ? AND kind = ? AND external_id = ?", imp.source, kind, externalID).First(&item).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return item.LocalID, true, nil
+}
+
+func (imp *wxrImport) remember(tx *gorm.DB, kind, externalID string, localID uint) error {
+	return tx.Create(&ImportedItem{Source: imp.source, Kind: kind, ExternalID: externalID, LocalID: localID}).Error
+}
+
+// importAuthor maps a WordPress author onto a user with the same email, or
+// creates an invited account for them.
+func (imp *wxrImport) importAuthor(author wxrAuthor) wxrResult {
+	name := strings.TrimSpace(author.DisplayName)
+	if name == "" {
+		name = author.Login
+	}
+	result := wxrResult{Kind: ImportedAuthor, ExternalID: author.Login, Title: name}
+	fail := func(err error) wxrResult {
+		result.Status = ImportFailed
+		result.Error = err.Error()
+		return result
+	}
+
+	var user User
+	if id, ok, err := imp.lookupImported(ImportedAuthor, author.Login); err != nil {
+		return fail(err)
+	} else if ok && db.First(&user, id).Error == nil {
+		result.Status = ImportSkipped
+		result.Error = alreadyImported
+		result.LocalID = user.ID
+		imp.mapAuthor(author, user)
+		return result
+	}
+
+	email := strings.TrimSpace(author.Email)
+	if email == "" {
+		result.Status = ImportSkipped
+		result.Error = "author has no email; their posts are assigned to " + imp.importer.Name
+		return result
+	}
+
+	err := db.Where("LOWER(email) = LOWER(?)", email).First(&user).Error
+	switch {
+	case err == nil && (user.EmailVerified || isInvited(user)):
+		result.Status = ImportMatched
+	case err == nil:
+		// Anyone can register an unverified account for someone else's email
+		result.Status = ImportSkipped
+		result.Error = "an unverified account uses this email; their posts are assigned to " + imp.importer.Name
+		return result
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		user = newInvitedUser(name, email)
+		result.Status = ImportCreated
+	default:
+		return fail(err)
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if user.ID == 0 {
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+		}
+		return imp.remember(tx, ImportedAuthor, author.Login, user.ID)
+	})
+	if err != nil {
+		return fail(err)
+	}
+	result.LocalID = user.ID
+	imp.mapAuthor(author, user)
+
+	if result.Status == ImportCreated && imp.invite {
+		if err := sendInvitationEmail(user); err != nil {
+			logger.WithFields(logrus.Fields{
+				"user_id": user.ID,
+				"error":   err.Error(),
+			}).Warn("Failed to send invitation")
+			result.Warnings = append(result.Warnings, "the invitation email could not be sent")
+		}
+	}
+	return result
+}
+
+func (imp *wxrImport) mapAuthor(author wxrAuthor, user User) {
+	imp.authors[author.Login] = user
+	if author.ID != "" {
+		imp.authorIDs[author.ID] = user
+	}
+}
+
+// importCategory maps a WordPress category onto the category with the same
+// slug, creating it when needed. Category hierarchies are flattened.
+func (imp *wxrImport) importCategory(termID, nicename, name string) wxrResult {
+	name = strings.TrimSpace(name)
+	if termID == "" {
+		termID = nicename
+	}
+	result := wxrResult{Kind: ImportedCategory, ExternalID: termID, Title: name}
+	if name == "" || taxonomySlug(name) == "" {
+		result.Status = ImportSkipped
+		result.Error = "category has no name"
+		return result
+	}
+
+	var category Category
+	err := db.Where("slug = ?", taxonomySlug(name)).First(&category).Error
+	switch {
+	case err == nil:
+		result.Status = ImportMatched
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		category = Category{Name: name, Slug: taxonomySlug(name)}
+		if err := db.Create(&category).Error; err != nil {
+			result.Status = ImportFailed
+			result.Error = err.Error()
+			return result
+		}
+		result.Status = ImportCreated
+	default:
+		result.Status = ImportFailed
+		result.Error = err.Error()
+		return result
+	}
+
+	result.LocalID = category.ID
+	imp.categories[nicename] = category.ID
+	return result
+}
+
+// importItem imports one post and its comments. Posts imported before are
+// left as they are, but comments written since the last export are added.
+func (imp *wxrImport) importItem(item wxrItem) {
+	result := wxrResult{Kind: ImportedPost, ExternalID: item.PostID, Title: strings.TrimSpace(item.Title)}
+	if item.PostType != "post" {
+		result.Status = ImportSkipped
+		switch item.PostType {
+		case "attachment":
+			result.Error = "attachments are not downloaded; posts keep linking to the original files"
+		default:
+			result.Error = "post type " + strconv.Quote(item.PostType) + " is not imported"
+		}
+		imp.report.add(result)
+		return
+	}
+
+	articleID, ok, err := imp.lookupImported(ImportedPost, item.PostID)
+	if err != nil {
+		result.Status = ImportFailed
+		result.Error = err.Error()
+		imp.report.add(result)
+		return
+	}
+	if ok {
+		result.Status = ImportSkipped
+		result.LocalID = articleID
+		var count int64
+		db.Model(&Article{}).Where("id = ?", articleID).Count(&count)
+		if count == 0 {
+			result.Error = "imported before and deleted since"
+			imp.report.add(result)
+			return
+		}
+		result.Error = alreadyImported
+		imp.report.add(result)
+		imp.importComments(articleID, item.Comments)
+		return
+	}
+
+	article, result := imp.importPost(item, result)
+	imp.report.add(result)
+	if article != nil {
+		imp.importComments(article.ID, item.Comments)
+	}
+}
+
+func (imp *wxrImport) importPost(item wxrItem, result wxrResult) (*Article, wxrResult) {
+	fail := func(err error) (*Article, wxrResult) {
+		result.Status = ImportFailed
+		result.Error = err.Error()
+		return nil, result
+	}
+
+	date := parseWXRDate(item.PostDateGMT, item.PostDate, item.PubDate)
+	status, ok := wxrStatus(item.Status, date, time.Now())
+	if !ok {
+		result.Status = ImportSkipped
+		result.Error = "posts with status " + strconv.Quote(item.Status) + " are not imported"
+		return nil, result
+	}
+	if item.Status == "private" {
+		result.Warnings = append(result.Warnings, "private post imported as a draft")
+	}
+
+	author, ok := imp.authors[item.Creator]
+	if !ok {
+		author = imp.importer
+		result.Warnings = append(result.Warnings, "unknown author "+strconv.Quote(item.Creator)+"; assigned to "+imp.importer.Name)
+	}
+
+	title := result.Title
+	if title == "" {
+		title = "Untitled post " + item.PostID
+	}
+	content, shortcodes := cleanWordPressContent(item.Content)
+	if len(shortcodes) > 0 {
+		result.Warnings = append(result.Warnings, "unconverted shortcodes: "+strings.Join(shortcodes, ", "))
+	}
+
+	var tagNames []string
+	var categoryID *uint
+	for _, term := range item.Terms {
+		switch term.Domain {
+		case "post_tag":
+			tagNames = append(tagNames, term.Name)
+		case "category":
+			id, known := imp.categories[term.Nicename]
+			if !known {
+				category := imp.importCategory(term.Nicename, term.Nicename, term.Name)
+				if category.Status == ImportCreated || category.Status == ImportFailed {
+					imp.report.add(category)
+				}
+				id, known = imp.categories[term.Nicename]
+			}
+			if !known {
+				continue
+			}
+			if categoryID == nil {
+				categoryID = &id
+			} else if *categoryID != id {
+				result.Warnings = append(result.Warnings, "only the first category is kept")
+			}
+		}
+	}
+	if len(tagNames) > maxTagsPerArticle {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("only the first %d tags are kept", maxTagsPerArticle))
+		tagNames = tagNames[:maxTagsPerArticle]
+	}
+	tags, err := resolveTags(tagNames)
+	if err != nil {
+		return fail(err)
+	}
+
+	article := Article{
+		Title:      title,
+		Content:    content,
+		UserID:     author.ID,
+		Name:       author.Name,
+		Status:     status,
+		Tags:       tags,
+		CategoryID: categoryID,
+	}
+	if date != nil {
+		article.CreatedAt = *date
+	}
+	switch status {
+	case ArticlePublished:
+		article.PublishedAt = date
+		if date == nil {
+			now := time.Now()
+			article.PublishedAt = &now
+		}
+	case ArticleScheduled:
+		article.ScheduledAt = date
+	}
+	if err := renderArticleContent(&article); err != nil {
+		return fail(err)
+	}
+
+	// Imported posts are not announced as new; they were published long ago
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := insertArticleTx(tx, &article, imp.importer.ID, "Imported from "+imp.source); err != nil {
+			return err
+		}
+		return imp.remember(tx, ImportedPost, item.PostID, article.ID)
+	})
+	if err != nil {
+		return fail(err)
+	}
+
+	result.Status = ImportCreated
+	result.LocalID = article.ID
+	return &article, result
+}
+
+// importComments imports the comments of a post oldest first, so replies
+// find their parent. Pingbacks, trackbacks and spam are skipped.
+func (imp *wxrImport) importComments(articleID uint, comments []wxrComment) {
+	sort.SliceStable(comments, func(i, j int) bool {
+		a, _ := strconv.Atoi(comments[i].ID)
+		b, _ := strconv.Atoi(comments[j].ID)
+		return a < b
+	})
+	for _, comment := range comments {
+		imp.report.add(imp.importComment(articleID, comment))
+	}
+}
+
+func (imp *wxrImport) importComment(articleID uint, wc wxrComment) wxrResult {
+	result := wxrResult{Kind: ImportedComment, ExternalID: wc.ID, Title: wc.Author}
+	fail := func(err error) wxrResult {
+		result.Status = ImportFailed
+		result.Error = err.Error()
+		return result
+	}
+
+	if wc.Type == "pingback" || wc.Type == "trackback" {
+		result.Status = ImportSkipped
+		result.Error = wc.Type + "s are not imported"
+		return result
+	}
+	status := CommentApproved
+	switch wc.Approved {
+	case "1":
+	case "0":
+		status = CommentPending
+	default:
+		result.Status = ImportSkipped
+		result.Error = "spam and trashed comments are not imported"
+		return result
+	}
+
+	if id, ok, err := imp.lookupImported(ImportedComment, wc.ID); err != nil {
+		return fail(err)
+	} else if ok {
+		result.Status = ImportSkipped
+		result.LocalID = id
+		result.Error = alreadyImported
+		return result
+	}
+
+	comment := Comment{ArticleID: articleID, Content: strings.TrimSpace(wc.Content), Status: status}
+	if date := parseWXRDate(wc.DateGMT, wc.Date, ""); date != nil {
+		comment.CreatedAt = *date
+	}
+
+	user, err := imp.commenter(wc)
+	if err != nil {
+		return fail(err)
+	}
+	comment.UserID = user.ID
+	if user.Email == guestEmail {
+		comment.GuestName = strings.TrimSpace(wc.Author)
+		if comment.GuestName == "" {
+			comment.GuestName = "Anonymous"
+		}
+	}
+
+	if wc.Parent != "" && wc.Parent != "0" {
+		parentID, ok, err := imp.lookupImported(ImportedComment, wc.Parent)
+		if err != nil {
+			return fail(err)
+		}
+		var parent Comment
+		if ok && db.Where("id = ? AND article_id = ?", parentID, articleID).First(&parent).Error == nil {
+			// Replies to replies join the same thread
+			if parent.ParentID != nil {
+				comment.ParentID = parent.ParentID
+			} else {
+				comment.ParentID = &parent.ID
+			}
+		} else {
+			result.Warnings = append(result.Warnings, "parent comment "+wc.Parent+" was not imported; kept as a top-level comment")
+		}
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("User").Create(&comment).Error; err != nil {
+			return err
+		}
+		return imp.remember(tx, ImportedComment, wc.ID, comment.ID)
+	})
+	if err != nil {
+		return fail(err)
+	}
+	result.Status = ImportCreated
+	result.LocalID = comment.ID
+	return result
+}
+
+// commenter finds the account a WordPress comment belongs to: an imported
+// author, or the shared guest account. The commenter's email is not used,
+// since WordPress stores whatever was typed into the comment form.
+func (imp *wxrImport) commenter(wc wxrComment) (User, error) {
+	if user, ok := imp.authorIDs[wc.UserID]; ok && wc.UserID != "0" {
+		return user, nil
+	}
+
+	if imp.guest == nil {
+		var guest User
+		err := db.Where("email = ? AND (password_hash = '' OR password_hash IS NULL)", guestEmail).First(&guest).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// No password and no invitation code: the account cannot log in
+			guest = User{Name: "Guest", Email: guestEmail, Role: "user"}
+			err = db.Create(&guest).Error
+		}
+		if err != nil {
+			return User{}, err
+		}
+		imp.guest = &guest
+	}
+	return *imp.guest, nil
+}
+
+// importWordPressHandler imports a WXR export uploaded as "file". Authors
+// that are created get an invitation email with ?invite=true.
+func importWordPressHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := r.Context().Value("user_id").(uint)
+
+	var importer User
+	if err := db.First(&importer, userID).Error; err != nil {
+		http.Error(w, `{"error": "User not found"}`, http.StatusBadRequest)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxWXRBytes+1<<20)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, `{"error": "Upload is too large or not multipart"}`, http.StatusRequestEntityTooLarge)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, `{"error": "file is required"}`, http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	export, err := parseWXR(file)
+	if err != nil {
+		http.Error(w, `{"error": "File is not a valid WordPress export"}`, http.StatusBadRequest)
+		return
+	}
+
+	report := importWordPress(export, importer, r.URL.Query().Get("invite") == "true")
+
+	logger.WithFields(logrus.Fields{
+		"user_id": importer.ID,
+		"source":  report.Source,
+		"created": report.Created,
+		"matched": report.Matched,
+		"skipped": report.Skipped,
+		"failed":  report.Failed,
+	}).Info("WordPress import finished")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
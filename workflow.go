@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Article lifecycle: draft → in_review → scheduled → published → archived.
+const (
+	ArticleDraft     = "draft"
+	ArticleInReview  = "in_review"
+	ArticleScheduled = "scheduled"
+	ArticlePublished = "published"
+	ArticleArchived  = "archived"
+)
+
+// articleTransitions lists the statuses an article may move to from each
+// status.
+var articleTransitions = map[string][]string{
+	ArticleDraft:     {ArticleInReview, ArticleArchived},
+	ArticleInReview:  {ArticleDraft, ArticleScheduled, ArticlePublished},
+	ArticleScheduled: {ArticleDraft, ArticlePublished},
+	ArticlePublished: {ArticleArchived},
+	ArticleArchived:  {ArticleDraft},
+}
+
+// reviewOnlyTransitions can only be made by an admin, since they take an
+// article out of review and put it in front of readers.
+var reviewOnlyTransitions = map[string]bool{
+	ArticleInReview + ">" + ArticleScheduled:  true,
+	ArticleInReview + ">" + ArticlePublished:  true,
+	ArticleScheduled + ">" + ArticlePublished: true,
+}
+
+const schedulerInterval = 30 * time.Second
+
+// canTransition reports whether an article may go from one status to another,
+// and whether that move needs an admin.
+func canTransition(from, to string) (allowed bool, adminOnly bool) {
+	for _, next := range articleTransitions[from] {
+		if next == to {
+			return true, reviewOnlyTransitions[from+">"+to]
+		}
+	}
+	return false, false
+}
+
+// isValidArticleStatus reports whether status is one of the lifecycle states.
+func isValidArticleStatus(status string) bool {
+	_, ok := articleTransitions[status]
+	return ok
+}
+
+// articleVisible reports whether the caller may read article. Anything that
+// is not published is only shown to its author, co-authors and admins.
+func articleVisible(r *http.Request, article *Article) bool {
+	if article.Status == ArticlePublished {
+		return true
+	}
+	claims := optionalClaims(r)
+	return claims != nil && canCollaborate(claims.UserID, claims.Role, article)
+}
+
+// changeArticleStatusHandler moves an article through the lifecycle.
+func changeArticleStatusHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Status      string     `json:"status"`
+		ScheduledAt *time.Time `json:"scheduled_at"`
+		UpdatedAt   *time.Time `json:"updated_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if !isValidArticleStatus(request.Status) {
+		http.Error(w, `{"error": "Unknown article status"}`, http.StatusBadRequest)
+		return
+	}
+
+	article, ok := loadEditableArticle(w, r, request.UpdatedAt)
+	if !ok {
+		return
+	}
+	loadedAt := article.UpdatedAt
+
+	allowed, adminOnly := canTransition(article.Status, request.Status)
+	if !allowed {
+		http.Error(w, `{"error": "Status change from `+article.Status+` to `+request.Status+` is not allowed"}`, http.StatusConflict)
+		return
+	}
+	if role, _ := r.Context().Value("role").(string); adminOnly && role != "admin" {
+		http.Error(w, `{"error": "Forbidden: only an admin can approve articles"}`, http.StatusForbidden)
+		return
+	}
+
+	now := time.Now()
+	article.Status = request.Status
+	article.ScheduledAt = nil
+	switch request.Status {
+	case ArticleScheduled:
+		if request.ScheduledAt == nil || !request.ScheduledAt.After(now) {
+			http.Error(w, `{"error": "scheduled_at must be in the future"}`, http.StatusBadRequest)
+			return
+		}
+		article.ScheduledAt = request.ScheduledAt
+	case ArticlePublished:
+		article.PublishedAt = &now
+	}
+
+	userID, _ := r.Context().Value("user_id").(uint)
+	if err := saveArticle(article, loadedAt, userID, "Status changed to "+article.Status); err != nil {
+		writeArticleSaveError(w, article.ID, err)
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"article_id": article.ID,
+		"status":     article.Status,
+	}).Info("Article status changed")
+
+	if article.Status == ArticlePublished {
+		articlePublished(article)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", articleETag(*article))
+	json.NewEncoder(w).Encode(article)
+}
+
+// articlePublished runs once an article has gone live, either from the status
+// endpoint or from the scheduler.
+func articlePublished(article *Article) {
+	logger.WithFields(logrus.Fields{
+		"article_id": article.ID,
+		"slug":       article.Slug,
+	}).Info("Article published")
+	emitWebhookEvent(EventArticlePublished, articleEventData(article))
+	federateArticle(article)
+}
+
+// publishDueArticles publishes scheduled articles whose time has come. The
+// status is re-checked in the UPDATE so an article unscheduled in the
+// meantime, or picked up by another instance, is left alone.
+func publishDueArticles(now time.Time) {
+	var due []Article
+	if err := db.Where("status = ? AND scheduled_at <= ?", ArticleScheduled, now).Find(&due).Error; err != nil {
+		logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Failed to fetch scheduled articles")
+		return
+	}
+
+	for i := range due {
+		article := &due[i]
+		res := db.Model(&Article{}).
+			Where("id = ? AND status = ?", article.ID, ArticleScheduled).
+			Updates(map[string]interface{}{
+				"status":       ArticlePublished,
+				"published_at": article.ScheduledAt,
+				"updated_at":   now,
+			})
+		if res.Error != nil {
+			logger.WithFields(logrus.Fields{
+				"article_id": article.ID,
+				"error":      res.Error.Error(),
+			}).Error("Failed to publish scheduled article")
+			continue
+		}
+		if res.RowsAffected == 0 {
+			continue
+		}
+		if article.SeriesID != nil {
+			if err := touchSeries(db, now, *article.SeriesID); err != nil {
+				logger.WithFields(logrus.Fields{
+					"article_id": article.ID,
+					"error":      err.Error(),
+				}).Error("Failed to update the series of a published article")
+			}
+		}
+
+		article.Status = ArticlePublished
+		article.PublishedAt = article.ScheduledAt
+		article.UpdatedAt = now
+		articlePublished(article)
+	}
+}
+
+// runArticleScheduler publishes scheduled articles in the background.
+func runArticleScheduler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	publishDueArticles(time.Now())
+	for now := range ticker.C {
+		publishDueArticles(now)
+	}
+}
+
+// migrateArticleStatus adds the status column to an articles table from
+// before the workflow existed. Those articles were all live, so they start
+// out published; the model's default, draft, applies to new rows only.
+func migrateArticleStatus() error {
+	migrator := db.Migrator()
+	if !migrator.HasTable(&Article{}) || migrator.HasColumn(&Article{}, "Status") {
+		return nil
+	}
+	return db.Exec("ALTER TABLE articles ADD COLUMN status text DEFAULT '" + ArticlePublished + "'").Error
+}
+
+// backfillPublishedAt gives articles that were live before the workflow
+// existed a publication date.
+func backfillPublishedAt() error {
+	return db.Model(&Article{}).
+		Where("status = ? AND published_at IS NULL", ArticlePublished).
+		Update("published_at", gorm.Expr("COALESCE(created_at, NOW())")).Error
+}